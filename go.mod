@@ -8,8 +8,22 @@ replace (
 	github.com/grokloc/grokloc-go/pkg/env => ./pkg/env
 	github.com/grokloc/grokloc-go/pkg/jwt => ./pkg/jwt
 	github.com/grokloc/grokloc-go/pkg/models => ./pkg/models
+	github.com/grokloc/grokloc-go/pkg/models/apikey => ./pkg/models/apikey
+	github.com/grokloc/grokloc-go/pkg/models/audit => ./pkg/models/audit
+	github.com/grokloc/grokloc-go/pkg/models/change => ./pkg/models/change
+	github.com/grokloc/grokloc-go/pkg/models/idp => ./pkg/models/idp
+	github.com/grokloc/grokloc-go/pkg/models/invitation => ./pkg/models/invitation
+	github.com/grokloc/grokloc-go/pkg/models/lockout => ./pkg/models/lockout
+	github.com/grokloc/grokloc-go/pkg/models/nonce => ./pkg/models/nonce
 	github.com/grokloc/grokloc-go/pkg/models/org => ./pkg/models/org
+	github.com/grokloc/grokloc-go/pkg/models/refresh => ./pkg/models/refresh
+	github.com/grokloc/grokloc-go/pkg/models/reset => ./pkg/models/reset
+	github.com/grokloc/grokloc-go/pkg/models/revocation => ./pkg/models/revocation
+	github.com/grokloc/grokloc-go/pkg/models/setting => ./pkg/models/setting
+	github.com/grokloc/grokloc-go/pkg/models/totp => ./pkg/models/totp
 	github.com/grokloc/grokloc-go/pkg/models/user => ./pkg/models/user
+	github.com/grokloc/grokloc-go/pkg/notify => ./pkg/notify
+	github.com/grokloc/grokloc-go/pkg/oidc => ./pkg/oidc
 	github.com/grokloc/grokloc-go/pkg/schemas => ./pkg/schemas
 	github.com/grokloc/grokloc-go/pkg/security => ./pkg/security
 	github.com/grokloc/grokloc-go/pkg/state => ./pkg/state
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/apikey"
+)
+
+// CreateAPIKeyMsg is what a client should marshal to send as a json body to CreateAPIKey
+// Scope optionally restricts tokens from the key, space separated;
+// Expires is a unixtime, or zero for a key that does not expire
+type CreateAPIKeyMsg struct {
+	Label   string `json:"label"`
+	Scope   string `json:"scope,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// APIKeyResponse is a new api key; the secret is only ever returned here
+type APIKeyResponse struct {
+	apikey.Instance
+	Secret string `json:"secret"`
+}
+
+// CreateAPIKey creates a named api key for a user
+func (srv Instance) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m CreateAPIKeyMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		http.Error(w, "malformed api key msg", http.StatusBadRequest)
+		return
+	}
+	if m.Expires != 0 && m.Expires <= time.Now().Unix() {
+		http.Error(w, "api key expires in the past", http.StatusBadRequest)
+		return
+	}
+	scopes := jwt.SplitScopes(m.Scope)
+	for _, s := range scopes {
+		if !contains(allScopes, s) {
+			http.Error(w, "unknown scope: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	k, err := apikey.New(u.ID, m.Label, jwt.JoinScopes(scopes), m.Expires)
+	if err != nil {
+		http.Error(w, "malformed api key args", http.StatusBadRequest)
+		return
+	}
+	err = k.Insert(ctx, srv.ST.Master, srv.ST.Key)
+	if err != nil {
+		if err == models.ErrConflict {
+			http.Error(w, "api key label in use", http.StatusConflict)
+			return
+		}
+		sugar.Debugw("insert api key",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(APIKeyResponse{Instance: *k, Secret: k.Secret})
+	if err != nil {
+		sugar.Debugw("marshal api key",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// ListAPIKeys returns the metadata of a user's api keys, without secrets
+func (srv Instance) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := apikey.List(ctx, srv.ST.RandomReplica(), u.ID)
+	if err != nil {
+		sugar.Debugw("list api keys",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(keys)
+	if err != nil {
+		sugar.Debugw("marshal api keys",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// RevokeAPIKey deletes one of a user's api keys
+// tokens already issued from the key last until they expire
+func (srv Instance) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	keyID := chi.URLParam(r, KeyParam)
+	if len(keyID) == 0 {
+		panic("key missing")
+	}
+
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := apikey.Revoke(ctx, srv.ST.Master, u.ID, keyID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("revoke api key",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models/apikey"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *UserSuite) TestAPIKeys() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	keysURL := s.ts.URL + UserRoute + "/" + u.ID + APIKeysPath
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+
+	// create a read-only key and a default one
+	resp, respBody, err := authedDo(s.c, http.MethodPost, keysURL, u.ID, tok,
+		CreateAPIKeyMsg{Label: "ci", Scope: ScopeOrgRead})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var ci APIKeyResponse
+	err = json.Unmarshal(respBody, &ci)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), ci.Secret)
+	resp, respBody, err = authedDo(s.c, http.MethodPost, keysURL, u.ID, tok,
+		CreateAPIKeyMsg{Label: "deploy", Expires: time.Now().Add(time.Hour).Unix()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var deploy APIKeyResponse
+	err = json.Unmarshal(respBody, &deploy)
+	require.Nil(s.T(), err)
+
+	// bad requests
+	resp, _, err = authedDo(s.c, http.MethodPost, keysURL, u.ID, tok, CreateAPIKeyMsg{Label: "ci"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, keysURL, u.ID, tok, CreateAPIKeyMsg{Label: "x", Scope: "no:such"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, keysURL, u.ID, tok, CreateAPIKeyMsg{Label: "x", Expires: 1})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// each key gets tokens; the scope restriction applies and no refresh is issued
+	resp, ciTok, err := requestToken(s.c, s.ts.URL, u.ID, ci.Secret, withAPIKey(ci.ID))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Empty(s.T(), ciTok.Refresh)
+	claims, err := jwt.Decode(ciTok.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{ScopeOrgRead}, claims.Scopes())
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, ciTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, deployTok, err := requestToken(s.c, s.ts.URL, u.ID, deploy.Secret, withAPIKey(deploy.ID))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	claims, err = jwt.Decode(deployTok.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), allScopes, claims.Scopes())
+
+	// a wrong secret for a key, or another user's key, is refused
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, deploy.Secret, withAPIKey(ci.ID))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, s.srv.ST.RootUser, ci.Secret, withAPIKey(ci.ID))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// the list has metadata only, with last use recorded
+	resp, respBody, err = authedDo(s.c, http.MethodGet, keysURL, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.NotContains(s.T(), string(respBody), ci.Secret)
+	var keys []apikey.Instance
+	err = json.Unmarshal(respBody, &keys)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), keys, 2)
+	require.Equal(s.T(), "ci", keys[0].Label)
+	require.NotZero(s.T(), keys[0].LastUsed)
+
+	// revoked keys get no more tokens
+	resp, _, err = authedDo(s.c, http.MethodDelete, keysURL+"/"+ci.ID, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, ci.Secret, withAPIKey(ci.ID))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, keysURL+"/"+uuid.NewString(), u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// expired keys get no more tokens
+	_, err = s.srv.ST.Master.Exec("update api_keys set expires = 1 where id = $1", deploy.ID)
+	require.Nil(s.T(), err)
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, deploy.Secret, withAPIKey(deploy.ID))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// another org's user cannot see the keys
+	_, other, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	otherTok, err := tokenFor(s.c, s.ts.URL, other.ID, other.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, keysURL, other.ID, otherTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
@@ -2,9 +2,15 @@
 package app
 
 import (
+	"context"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/env"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/change"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
 	"github.com/grokloc/grokloc-go/pkg/state"
 )
 
@@ -12,19 +18,21 @@ import (
 const Version = "v0"
 
 // API headers
-// TokenRequest is formatted as security.EncodedSHA256(id+api-secret)
+// a token request is signed with SignRequest, using the Signature,
+// Timestamp (unixtime) and Nonce headers; the legacy TokenRequest is
+// formatted as security.EncodedSHA256(id+api-secret)
+// Scope is an optional space separated list of scopes for the token request
+// APIKey is the id of a named api key, when the token request uses its secret
 const (
+	APIKeyHeader       = "X-GrokLOC-APIKey"
 	IDHeader           = "X-GrokLOC-ID"
+	NonceHeader        = "X-GrokLOC-Nonce"
+	ScopeHeader        = "X-GrokLOC-Scope"
+	SignatureHeader    = "X-GrokLOC-Signature"
+	TimestampHeader    = "X-GrokLOC-Timestamp"
 	TokenRequestHeader = "X-GrokLOC-TokenRequest"
 )
 
-// Auth levels to be found in ctx with key authLevelCtxKey
-const (
-	AuthUser = iota
-	AuthOrg
-	AuthRoot
-)
-
 // contextKey is used to dismbiguate keys for vars put into request contexts
 type contextKey struct {
 	name string
@@ -32,14 +40,20 @@ type contextKey struct {
 
 // Context key instances for inserting and reading context vars
 var (
-	sessionCtxKey   = &contextKey{"session"}   // nolint
-	authLevelCtxKey = &contextKey{"authlevel"} // nolint
+	sessionCtxKey = &contextKey{"session"} // nolint
+	roleCtxKey    = &contextKey{"role"}    // nolint
+	claimsCtxKey  = &contextKey{"claims"}  // nolint
 )
 
 // Instance is a single app server
 type Instance struct {
-	ST      *state.Instance
-	Started time.Time
+	ST           *state.Instance
+	Started      time.Time
+	sessions     *sessionCache // nil when ST.SessionCache is off
+	unlisten     func()        // stops the sessions seeing model changes
+	reencryption *reencryption
+	// verified against when a login names no user, so it takes as long
+	dummyPassword string
 }
 
 // New creates a new app server Instance
@@ -48,5 +62,45 @@ func New(level env.Level) (*Instance, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Instance{ST: st, Started: time.Now()}, nil
+	return newInstance(st)
+}
+
+// newInstance creates an app server Instance on st, first migrating the
+// rows stored under earlier schema versions, which cannot be read until
+// they are
+func newInstance(st *state.Instance) (*Instance, error) {
+	migrated, err := user.Migrate(context.Background(), st.Master, st.Key)
+	if err != nil {
+		return nil, err
+	}
+	if migrated != 0 {
+		st.L.Sugar().Infow("migrated users",
+			"count", migrated,
+			"schema_version", user.SchemaVersion)
+	}
+
+	srv := &Instance{ST: st, Started: time.Now(), reencryption: &reencryption{}}
+	srv.dummyPassword, err = security.DerivePassword(uuid.NewString(), st.Argon2Cfg)
+	if err != nil {
+		return nil, err
+	}
+	if st.SessionCache {
+		srv.sessions = newSessionCache(st.SessionCacheSize, st.SessionCacheTTL)
+		// earlier changes can't affect an empty cache
+		srv.sessions.seq, err = change.Latest(context.Background(), st.Master)
+		if err != nil {
+			return nil, err
+		}
+		srv.unlisten = models.Listen(srv.changed)
+	}
+	return srv, nil
+}
+
+// Close releases what New registered, so a closed Instance can be
+// collected; ST is closed separately
+func (srv *Instance) Close() {
+	if srv.unlisten != nil {
+		srv.unlisten()
+		srv.unlisten = nil
+	}
 }
@@ -4,28 +4,43 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
-	jwt_go "github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/grokloc/grokloc-go/pkg/jwt"
 	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/apikey"
 	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/refresh"
+	"github.com/grokloc/grokloc-go/pkg/models/revocation"
+	"github.com/grokloc/grokloc-go/pkg/models/setting"
 	"github.com/grokloc/grokloc-go/pkg/models/user"
-	"github.com/grokloc/grokloc-go/pkg/security"
 )
 
-// Session is the org and user instances for a user account
+// Session is the org and user instances for a user account,
+// along with the org settings for request-time decisions
+// Actor is set by WithToken to the id of the root user impersonating
+// User, and is empty otherwise
 type Session struct {
-	Org  org.Instance
-	User user.Instance
+	Org      org.Instance
+	User     user.Instance
+	Settings setting.Map
+	Actor    string
 }
 
+// errAuthFailed is the single response for an unknown or unusable user,
+// and for any token or token request that fails, so callers cannot
+// probe for user ids
+const errAuthFailed = "authentication failed"
+
 // WithSession reads the user and org using the X-GrokLOC-ID header,
 // performs basic validation, and then adds a user and org instance to
 // the context.
+// sessions are served from the session cache when it is on
 func (srv *Instance) WithSession(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -38,59 +53,118 @@ func (srv *Instance) WithSession(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := user.Read(ctx, srv.ST.RandomReplica(), srv.ST.Key, id)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "user not found", http.StatusBadRequest)
-				return
+		now := time.Now()
+		var session *Session
+		var gen uint64
+		if srv.sessions != nil {
+			if srv.ST.SessionCacheSync > 0 {
+				err := srv.syncSessions(ctx, now)
+				if err != nil {
+					sugar.Debugw("sync sessions",
+						"reqid", middleware.GetReqID(ctx),
+						"err", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+			}
+			var cached Session
+			var ok bool
+			cached, gen, ok = srv.sessions.get(id, now)
+			if ok {
+				session = &cached
 			}
-			sugar.Debugw("read user",
-				"reqid", middleware.GetReqID(ctx),
-				"err", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
 		}
-		if user.Meta.Status != models.StatusActive {
-			http.Error(w, "user not active", http.StatusBadRequest)
-			return
+		if session == nil {
+			var ok bool
+			session, ok = srv.readSession(w, r, id)
+			if !ok {
+				return
+			}
+			if srv.sessions != nil {
+				srv.sessions.put(*session, gen, now)
+			}
 		}
 
-		org, err := org.Read(ctx, srv.ST.RandomReplica(), user.Org)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "org not found", http.StatusBadRequest)
+		if session.User.Service {
+			// marks the request in the log, keyed by reqid
+			sugar.Infow("service account request",
+				"reqid", middleware.GetReqID(ctx),
+				"service", true,
+				"id", session.User.ID,
+				"org", session.Org.ID)
+			if !session.User.AllowsIP(clientIP(r)) {
+				http.Error(w, errAuthFailed, http.StatusUnauthorized)
 				return
 			}
-			sugar.Debugw("read org",
-				"reqid", middleware.GetReqID(ctx),
-				"err", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
-		}
-		if org.Meta.Status != models.StatusActive {
-			http.Error(w, "org not active", http.StatusBadRequest)
-			return
 		}
 
-		session := &Session{Org: *org, User: *user}
-
-		authLevel := AuthUser
-		if session.Org.ID == srv.ST.RootOrg {
-			// allow for multiple accounts in root org
-			authLevel = AuthRoot
-		} else if session.Org.Owner == session.User.ID {
-			authLevel = AuthOrg
-		}
-		r = r.WithContext(context.WithValue(ctx, authLevelCtxKey, authLevel))
-		// r.Context() to get ctx with authLevel
+		role := srv.roleFor(session.Org, session.User)
+		r = r.WithContext(context.WithValue(ctx, roleCtxKey, role))
+		// r.Context() to get ctx with role
 		r = r.WithContext(context.WithValue(r.Context(), sessionCtxKey, *session))
 		next.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(fn)
 }
 
+// readSession reads the session for the user id from the db, writing an
+// error response and returning false if the user or org is not usable
+func (srv *Instance) readSession(w http.ResponseWriter, r *http.Request, id string) (*Session, bool) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	user, err := user.Read(ctx, srv.ST.RandomReplica(), srv.ST.Key, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, errAuthFailed, http.StatusUnauthorized)
+			return nil, false
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if user.Meta.Status != models.StatusActive {
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	org, err := org.Read(ctx, srv.ST.RandomReplica(), user.Org)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, errAuthFailed, http.StatusUnauthorized)
+			return nil, false
+		}
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if org.Meta.Status != models.StatusActive {
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// all settings are read at once so handlers can consult them freely
+	settings, err := setting.ReadAll(ctx, srv.ST.RandomReplica(), org.ID)
+	if err != nil {
+		sugar.Debugw("read settings",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return &Session{Org: *org, User: *user, Settings: settings}, true
+}
+
 // WithToken extracts the JWT from the X-GrokLOC-Token header
 // and validates the claims
+// an impersonation token also records its actor in the session, and
+// writes made with it are audited, as are writes by service accounts
 func (srv Instance) WithToken(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -101,20 +175,70 @@ func (srv Instance) WithToken(next http.Handler) http.Handler {
 		}
 		token := jwt.FromHeaderVal(r.Header.Get(jwt.Authorization))
 		if len(token) == 0 {
-			http.Error(w, fmt.Sprintf("missing: %s", jwt.Authorization), http.StatusBadRequest)
+			http.Error(w, errAuthFailed, http.StatusUnauthorized)
+			return
+		}
+		claims, err := jwt.Verify(token, srv.ST.SigningKeys, jwt.Expected{
+			Issuer:   jwt.Issuer,
+			Audience: session.User.EmailDigest,
+			Leeway:   srv.ST.TokenLeeway,
+			MaxAge:   srv.ST.TokenMaxAge,
+			Required: jwt.RequiredClaims,
+		}, time.Now())
+		if err != nil {
+			switch {
+			case errors.Is(err, jwt.ErrMalformed):
+				http.Error(w, "token malformed", http.StatusBadRequest)
+			case errors.Is(err, jwt.ErrExpired), errors.Is(err, jwt.ErrTooOld):
+				http.Error(w, "token expired", http.StatusUnauthorized)
+			case errors.Is(err, jwt.ErrNotYetValid):
+				http.Error(w, "token not yet valid", http.StatusUnauthorized)
+			default:
+				// signature, issuer, audience and claim failures are not detailed
+				http.Error(w, errAuthFailed, http.StatusUnauthorized)
+			}
+			return
+		}
+		if claims.Subject != session.User.ID || claims.Org != session.Org.ID {
+			http.Error(w, errAuthFailed, http.StatusUnauthorized)
 			return
 		}
-		claims, err := jwt.Decode(session.User.ID, token, srv.ST.SigningKey)
+		// tokens issued before the latest revocation carry an older watermark
+		if claims.Watermark != session.User.TokenWatermark {
+			http.Error(w, "token revoked", http.StatusUnauthorized)
+			return
+		}
+		revoked, err := revocation.IsRevoked(ctx, srv.ST.RandomReplica(), claims.Id)
 		if err != nil {
-			http.Error(w, "token decode error", http.StatusUnauthorized)
+			srv.ST.L.Sugar().Debugw("read revocation",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		if claims.Id != session.User.ID || claims.Org != session.Org.ID {
-			http.Error(w, "token contents incorrect", http.StatusBadRequest)
+		if revoked {
+			http.Error(w, "token revoked", http.StatusUnauthorized)
 			return
 		}
-		if claims.ExpiresAt < time.Now().Unix() {
-			http.Error(w, "token expired", http.StatusUnauthorized)
+		if claims.Act != nil {
+			valid, err := srv.validActor(ctx, claims.Act)
+			if err != nil {
+				srv.ST.L.Sugar().Debugw("read actor",
+					"reqid", middleware.GetReqID(ctx),
+					"err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if !valid {
+				http.Error(w, "token actor invalid", http.StatusUnauthorized)
+				return
+			}
+			session.Actor = claims.Act.Subject
+			ctx = context.WithValue(ctx, sessionCtxKey, session)
+		}
+		r = r.WithContext(context.WithValue(ctx, claimsCtxKey, *claims))
+		if (len(session.Actor) != 0 || session.User.Service) && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			srv.audited(w, r, next, session)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -122,13 +246,77 @@ func (srv Instance) WithToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-// Token describes the token value and the expiration unixtime
+// errImpersonated is the response to minting credentials while impersonating
+const errImpersonated = "not allowed while impersonating"
+
+// NotImpersonated refuses requests made with an impersonation token, for
+// routes that mint or replace credentials, which would outlive its
+// expiry; it must follow WithToken
+func (srv *Instance) NotImpersonated(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		session, ok := r.Context().Value(sessionCtxKey).(Session)
+		if !ok {
+			panic("session missing")
+		}
+		if len(session.Actor) != 0 {
+			http.Error(w, errImpersonated, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Token describes the token value and the expiration unixtime,
+// along with the refresh token that can be exchanged for a new Token
 type Token struct {
-	Bearer  string `json:"bearer"`
-	Expires int64  `json:"expires"`
+	Bearer         string `json:"bearer"`
+	Expires        int64  `json:"expires"`
+	Refresh        string `json:"refresh,omitempty"`
+	RefreshExpires int64  `json:"refresh_expires,omitempty"`
+}
+
+// RefreshTokenMsg is the body format for exchanging a refresh token
+type RefreshTokenMsg struct {
+	Refresh string `json:"refresh"`
+}
+
+// issueToken creates and signs a new JWT for u granting scopes, with a
+// refresh token starting a new family
+func (srv *Instance) issueToken(ctx context.Context, u user.Instance, scopes []string) (*Token, error) {
+	refreshExpires := time.Now().Add(srv.ST.RefreshTokenExpiration).Unix()
+	refreshToken, err := refresh.Issue(ctx, srv.ST.Master, u.ID, jwt.JoinScopes(scopes), u.TokenWatermark, refreshExpires)
+	if err != nil {
+		return nil, err
+	}
+	return srv.signToken(u, scopes, refreshToken, refreshExpires)
+}
+
+// signToken creates and signs a new JWT for u granting scopes, paired
+// with refreshToken
+func (srv *Instance) signToken(u user.Instance, scopes []string, refreshToken string, refreshExpires int64) (*Token, error) {
+	claims, err := jwt.New(u, srv.ST.AccessTokenExpiration, scopes)
+	if err != nil {
+		return nil, err
+	}
+	signedToken, err := srv.ST.SigningKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Bearer:         signedToken,
+		Expires:        claims.ExpiresAt,
+		Refresh:        refreshToken,
+		RefreshExpires: refreshExpires,
+	}, nil
 }
 
 // NewToken returns a response containing a new JWT
+// the token request is signed with the api secret, or with a named api key
+// given by the APIKeyHeader, which may restrict the scopes further;
+// the ScopeHeader may request a subset of the scopes allowed to the caller
+// service accounts can only use api keys, and are limited to their
+// service scope
 func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	defer srv.ST.L.Sync() // nolint
@@ -138,40 +326,157 @@ func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		panic("session missing")
 	}
-	tokenRequest := r.Header.Get(TokenRequestHeader)
-	if len(tokenRequest) == 0 {
-		http.Error(w, fmt.Sprintf("missing: %s", TokenRequestHeader), http.StatusBadRequest)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	allowed := allowedScopes(role)
+	if session.User.Service && len(session.User.ServiceScope) != 0 {
+		allowed = intersectScopes(allowed, jwt.SplitScopes(session.User.ServiceScope))
+	}
+
+	var k *apikey.Instance
+	var err error
+	secrets := apiSecrets(session.User)
+	if keyID := r.Header.Get(APIKeyHeader); len(keyID) != 0 {
+		k, err = apikey.Read(ctx, srv.ST.RandomReplica(), srv.ST.Key, session.User.ID, keyID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, errAuthFailed, http.StatusUnauthorized)
+				return
+			}
+			sugar.Debugw("read api key",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		secrets = []string{k.Secret}
+	} else if session.User.Service {
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return
+	}
+	if !srv.verifyTokenRequest(w, r, session.User.ID, secrets) {
+		return
+	}
+	if k != nil {
+		if !k.Active(time.Now().Unix()) {
+			http.Error(w, "api key expired", http.StatusUnauthorized)
+			return
+		}
+		if len(k.Scope) != 0 {
+			allowed = intersectScopes(allowed, jwt.SplitScopes(k.Scope))
+		}
+	}
+
+	scopes, err := grantScopes(allowed, jwt.SplitScopes(r.Header.Get(ScopeHeader)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	validate := security.EncodedSHA256(session.User.ID + session.User.APISecret)
-	if tokenRequest != validate {
-		sugar.Debugw("verify token request",
+	var tok *Token
+	if k != nil {
+		// tokens from a key are not refreshable, so revoking or expiring
+		// the key cuts off access once the current token expires
+		tok, err = srv.signToken(session.User, scopes, "", 0)
+	} else {
+		tok, err = srv.issueToken(ctx, session.User, scopes)
+	}
+	if err != nil {
+		sugar.Debugw("issue token",
 			"reqid", middleware.GetReqID(ctx),
-			"tokenrequest", tokenRequest,
-			"validate", validate,
-			"id", session.User.ID)
-		http.Error(w, "token request invalid", http.StatusUnauthorized)
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	claims, err := jwt.New(session.User)
+	if k != nil {
+		err = k.Touch(ctx, srv.ST.Master, time.Now().Unix())
+		if err != nil {
+			// the token is still good, only the metadata is stale
+			sugar.Debugw("touch api key",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+		}
+	}
+
+	bs, err := json.Marshal(tok)
+	if err != nil {
+		sugar.Debugw("marshal token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// RefreshToken exchanges a refresh token for a new JWT and refresh token
+// presenting a refresh token a second time revokes its family
+// the new JWT keeps the original scopes, less any the caller has since lost
+func (srv *Instance) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		sugar.Debugw("create new claims",
+		sugar.Debugw("read body",
 			"reqid", middleware.GetReqID(ctx),
 			"err", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	token := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(session.User.ID + string(srv.ST.SigningKey)))
+
+	var m RefreshTokenMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.Refresh) == 0 {
+		http.Error(w, "malformed refresh", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken, scope, refreshExpires, err := refresh.Rotate(ctx, srv.ST.Master, session.User.ID, m.Refresh, session.User.TokenWatermark, time.Now().Unix())
 	if err != nil {
-		sugar.Debugw("encode token",
+		switch err {
+		case sql.ErrNoRows, refresh.ErrExpired, refresh.ErrRevoked:
+			http.Error(w, "refresh token invalid", http.StatusUnauthorized)
+		case refresh.ErrReused:
+			sugar.Infow("refresh token reused",
+				"reqid", middleware.GetReqID(ctx),
+				"id", session.User.ID)
+			http.Error(w, "refresh token invalid", http.StatusUnauthorized)
+		default:
+			sugar.Debugw("rotate refresh token",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	scopes := intersectScopes(allowedScopes(role), jwt.SplitScopes(scope))
+	tok, err := srv.signToken(session.User, scopes, refreshToken, refreshExpires)
+	if err != nil {
+		sugar.Debugw("sign token",
 			"reqid", middleware.GetReqID(ctx),
 			"err", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	bs, err := json.Marshal(Token{Bearer: signedToken, Expires: claims.ExpiresAt})
+	bs, err := json.Marshal(tok)
 	if err != nil {
 		sugar.Debugw("marshal token",
 			"reqid", middleware.GetReqID(ctx),
@@ -185,3 +490,104 @@ func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 		panic(err.Error())
 	}
 }
+
+// Logout revokes the token used for the request, and the refresh token
+// family if a refresh token is sent in the body
+func (srv *Instance) Logout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	claims, ok := ctx.Value(claimsCtxKey).(jwt.Claims)
+	if !ok {
+		panic("claims missing")
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m RefreshTokenMsg
+	if len(body) != 0 {
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			http.Error(w, "malformed logout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = revocation.Revoke(ctx, srv.ST.Master, claims.Id, session.User.ID, claims.ExpiresAt)
+	if err != nil {
+		sugar.Debugw("revoke token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(m.Refresh) != 0 {
+		err = refresh.RevokeFamily(ctx, srv.ST.Master, session.User.ID, m.Refresh)
+		if err != nil && err != sql.ErrNoRows {
+			sugar.Debugw("revoke refresh family",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// revocations are only needed until the tokens would expire anyway
+	_, err = revocation.Prune(ctx, srv.ST.Master, time.Now().Unix())
+	if err != nil {
+		sugar.Debugw("prune revocations",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAllTokens revokes every access and refresh token issued to the caller
+func (srv *Instance) RevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	u := session.User
+	err := u.RevokeTokens(ctx, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("revoke tokens",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JWKS serves the public keys that verify tokens, so other services
+// can check tokens without calling this server
+func (srv *Instance) JWKS(w http.ResponseWriter, r *http.Request) {
+	bs, err := json.Marshal(srv.ST.SigningKeys.JWKS())
+	if err != nil {
+		panic(err.Error())
+	}
+	w.Header().Set("content-type", "application/json")
+	// rollovers retain old keys, so verifiers can cache briefly
+	w.Header().Set("cache-control", "public, max-age=300")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/change"
+)
+
+// SessionCacheStats are counters for the session cache since the
+// server started
+type SessionCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+// sessionCache holds recently read sessions by user id, so requests
+// don't read and decrypt the user and org each time
+// entries are dropped after ttl, when the user or org changes, or when
+// the cache is full and the entry is the least recently used
+type sessionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // of *cachedSession, most recently used first
+	stats   SessionCacheStats
+	gen     uint64    // incremented by invalidate
+	seq     int64     // last change entry seen
+	polled  time.Time // last read of change entries
+}
+
+// cachedSession is a session and the time it stops being used
+type cachedSession struct {
+	session Session
+	expires time.Time
+}
+
+// newSessionCache returns an empty sessionCache
+func newSessionCache(size int, ttl time.Duration) *sessionCache {
+	return &sessionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached session for user, if it has not expired at now
+// on a miss, the generation is returned for the later put
+func (c *sessionCache) get(user string, now time.Time) (Session, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[user]
+	if !ok {
+		c.stats.Misses++
+		return Session{}, c.gen, false
+	}
+	cached := e.Value.(*cachedSession)
+	if now.After(cached.expires) {
+		c.remove(e)
+		c.stats.Misses++
+		return Session{}, c.gen, false
+	}
+	c.lru.MoveToFront(e)
+	c.stats.Hits++
+	return cached.session, c.gen, true
+}
+
+// put caches session from now, evicting the least recently used
+// session if the cache is full
+// a session read before an invalidation at a later generation than gen
+// may be stale, so it is not cached
+func (c *sessionCache) put(session Session, gen uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	cached := &cachedSession{session: session, expires: now.Add(c.ttl)}
+	if e, ok := c.entries[session.User.ID]; ok {
+		e.Value = cached
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[session.User.ID] = c.lru.PushFront(cached)
+}
+
+// invalidate drops the sessions affected by a change to the instance
+// of kind with id: the user's own session, or those of every user in the org
+func (c *sessionCache) invalidate(kind models.Kind, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	switch kind {
+	case models.KindUser:
+		if e, ok := c.entries[id]; ok {
+			c.remove(e)
+		}
+	case models.KindOrg:
+		for e := c.lru.Front(); e != nil; {
+			next := e.Next()
+			if e.Value.(*cachedSession).session.Org.ID == id {
+				c.remove(e)
+			}
+			e = next
+		}
+	}
+}
+
+// remove drops e; c.mu must be held
+func (c *sessionCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cachedSession).session.User.ID)
+}
+
+// counters returns a copy of the stats
+func (c *sessionCache) counters() SessionCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
+
+// SessionCacheStats returns the session cache counters, or zeros if the
+// cache is off
+func (srv *Instance) SessionCacheStats() SessionCacheStats {
+	if srv.sessions == nil {
+		return SessionCacheStats{}
+	}
+	return srv.sessions.counters()
+}
+
+// changed is the models.Listener for the session cache; with
+// SessionCacheSync set, the change is also recorded for other instances
+func (srv *Instance) changed(kind models.Kind, id string) {
+	if srv.sessions != nil {
+		srv.sessions.invalidate(kind, id)
+	}
+	if srv.ST.SessionCacheSync <= 0 {
+		return
+	}
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+	ctx := context.Background()
+	now := time.Now()
+	err := change.Record(ctx, srv.ST.Master, kind, id, now.Unix())
+	if err != nil {
+		sugar.Debugw("record change",
+			"kind", kind,
+			"id", id,
+			"err", err)
+		return
+	}
+	// cached sessions older than the ttl are gone anyway
+	_, err = change.Prune(ctx, srv.ST.Master, now.Add(-srv.ST.SessionCacheTTL-srv.ST.SessionCacheSync).Unix())
+	if err != nil {
+		sugar.Debugw("prune changes",
+			"err", err)
+	}
+}
+
+// syncSessions drops cached sessions changed by other instances, reading
+// the change entries at most once per SessionCacheSync
+func (srv *Instance) syncSessions(ctx context.Context, now time.Time) error {
+	c := srv.sessions
+	c.mu.Lock()
+	if now.Sub(c.polled) < srv.ST.SessionCacheSync {
+		c.mu.Unlock()
+		return nil
+	}
+	c.polled = now
+	seq := c.seq
+	c.mu.Unlock()
+
+	entries, err := change.Since(ctx, srv.ST.RandomReplica(), seq)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		c.invalidate(e.Kind, e.ID)
+	}
+	if len(entries) != 0 {
+		c.mu.Lock()
+		if last := entries[len(entries)-1].Seq; last > c.seq {
+			c.seq = last
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
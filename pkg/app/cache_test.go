@@ -0,0 +1,105 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// CacheSuite is responsible for testing the session cache itself
+type CacheSuite struct {
+	suite.Suite
+}
+
+// session is a Session for a new user id in the org with id o
+func (s *CacheSuite) session(o string) Session {
+	return Session{
+		Org:  org.Instance{Base: models.Base{ID: o}},
+		User: user.Instance{Base: models.Base{ID: uuid.NewString()}, Org: o},
+	}
+}
+
+func (s *CacheSuite) TestGetPut() {
+	c := newSessionCache(2, time.Minute)
+	now := time.Now()
+	a := s.session(uuid.NewString())
+	_, gen, ok := c.get(a.User.ID, now)
+	require.False(s.T(), ok)
+	c.put(a, gen, now)
+	cached, _, ok := c.get(a.User.ID, now)
+	require.True(s.T(), ok)
+	require.Equal(s.T(), a.User.ID, cached.User.ID)
+
+	// expired after the ttl
+	_, _, ok = c.get(a.User.ID, now.Add(2*time.Minute))
+	require.False(s.T(), ok)
+
+	stats := c.counters()
+	require.Equal(s.T(), uint64(1), stats.Hits)
+	require.Equal(s.T(), uint64(2), stats.Misses)
+	require.Equal(s.T(), 0, stats.Size)
+}
+
+func (s *CacheSuite) TestEviction() {
+	c := newSessionCache(2, time.Minute)
+	now := time.Now()
+	a, b, d := s.session(uuid.NewString()), s.session(uuid.NewString()), s.session(uuid.NewString())
+	c.put(a, 0, now)
+	c.put(b, 0, now)
+	// a is now more recently used than b
+	_, _, ok := c.get(a.User.ID, now)
+	require.True(s.T(), ok)
+	c.put(d, 0, now)
+	_, _, ok = c.get(b.User.ID, now)
+	require.False(s.T(), ok)
+	_, _, ok = c.get(a.User.ID, now)
+	require.True(s.T(), ok)
+	_, _, ok = c.get(d.User.ID, now)
+	require.True(s.T(), ok)
+	stats := c.counters()
+	require.Equal(s.T(), uint64(1), stats.Evictions)
+	require.Equal(s.T(), 2, stats.Size)
+}
+
+func (s *CacheSuite) TestInvalidate() {
+	c := newSessionCache(10, time.Minute)
+	now := time.Now()
+	o := uuid.NewString()
+	a, b, other := s.session(o), s.session(o), s.session(uuid.NewString())
+	for _, session := range []Session{a, b, other} {
+		c.put(session, 0, now)
+	}
+
+	c.invalidate(models.KindUser, a.User.ID)
+	_, _, ok := c.get(a.User.ID, now)
+	require.False(s.T(), ok)
+	_, _, ok = c.get(b.User.ID, now)
+	require.True(s.T(), ok)
+
+	// an org change drops every session in the org
+	c.put(a, 1, now)
+	c.invalidate(models.KindOrg, o)
+	_, _, ok = c.get(a.User.ID, now)
+	require.False(s.T(), ok)
+	_, _, ok = c.get(b.User.ID, now)
+	require.False(s.T(), ok)
+	_, _, ok = c.get(other.User.ID, now)
+	require.True(s.T(), ok)
+
+	// a session read before an invalidation is not cached
+	_, gen, _ := c.get(a.User.ID, now)
+	c.invalidate(models.KindUser, uuid.NewString())
+	c.put(a, gen, now)
+	_, _, ok = c.get(a.User.ID, now)
+	require.False(s.T(), ok)
+}
+
+func TestCacheSuite(t *testing.T) {
+	suite.Run(t, new(CacheSuite))
+}
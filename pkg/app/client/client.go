@@ -8,11 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/grokloc/grokloc-go/pkg/app"
 	"github.com/grokloc/grokloc-go/pkg/jwt"
 	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
 	"github.com/grokloc/grokloc-go/pkg/security"
 )
 
@@ -21,8 +23,14 @@ type Client struct {
 	Host      string // Without trailing /
 	ID        string
 	APISecret string
-	h         *http.Client
-	token     *app.Token
+	APIKeyID  string   // set when APISecret is the secret of a named api key
+	Scopes    []string // requested for new tokens; empty for all allowed
+	// LegacyTokenRequest sends the unsigned token request hash instead of
+	// a signed request, for servers that have not enabled signing
+	LegacyTokenRequest bool
+	h                  *http.Client
+	token              *app.Token
+	challenge          string // pending two-factor login, for VerifyLogin
 }
 
 // NewClient returns a new Client instance
@@ -42,7 +50,20 @@ func (c *Client) getToken() error {
 		return err
 	}
 	req.Header.Add(app.IDHeader, c.ID)
-	req.Header.Add(app.TokenRequestHeader, security.EncodedSHA256(c.ID+c.APISecret))
+	if c.LegacyTokenRequest {
+		req.Header.Add(app.TokenRequestHeader, security.EncodedSHA256(c.ID+c.APISecret))
+	} else {
+		err = app.SignRequest(req, c.APISecret, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.APIKeyID) != 0 {
+		req.Header.Add(app.APIKeyHeader, c.APIKeyID)
+	}
+	if len(c.Scopes) != 0 {
+		req.Header.Add(app.ScopeHeader, jwt.JoinScopes(c.Scopes))
+	}
 	resp, body, err := c.makeRequest(req)
 	if err != nil {
 		return err
@@ -62,11 +83,192 @@ func (c *Client) getToken() error {
 	return nil
 }
 
-// authedRequest will refresh the token for a regular user instance if it is nil
+// Login gets a jwt with an email and password instead of the api secret;
+// on success the client uses the returned user id for later requests,
+// and must log in again when the token expires
+func (c *Client) Login(m app.LoginMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.LoginRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.makeRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		var l app.LoginResponse
+		err = json.Unmarshal(body, &l)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ID = l.ID
+		c.token = &l.Token
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		var l app.LoginChallenge
+		err = json.Unmarshal(body, &l)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ID = l.ID
+		c.challenge = l.Challenge
+	}
+	return resp, body, nil
+}
+
+// VerifyLogin completes a Login that returned a two-factor challenge,
+// with an authenticator or recovery code
+func (c *Client) VerifyLogin(code string) (*http.Response, []byte, error) {
+	if len(c.challenge) == 0 {
+		return nil, nil, errors.New("no login challenge")
+	}
+	bs, err := json.Marshal(app.LoginVerifyMsg{Challenge: c.challenge, Code: code})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.LoginVerifyRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.makeRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		var l app.LoginResponse
+		err = json.Unmarshal(body, &l)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ID = l.ID
+		c.token = &l.Token
+		c.challenge = ""
+	}
+	return resp, body, nil
+}
+
+// OIDCLogin starts a sign in with the org's identity provider; send the
+// user to the url in the returned app.OIDCAuthorization, and pass the
+// state and code the provider returns to OIDCCallback
+func (c *Client) OIDCLogin(m app.OIDCLoginMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.OIDCLoginRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.makeRequest(req)
+}
+
+// OIDCCallback completes an OIDCLogin; on success the client uses the
+// returned user id for later requests, as with Login
+func (c *Client) OIDCCallback(state, code string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.OIDCCallbackMsg{State: state, Code: code})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.OIDCCallbackRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.makeRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		var l app.LoginResponse
+		err = json.Unmarshal(body, &l)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ID = l.ID
+		c.token = &l.Token
+	}
+	return resp, body, nil
+}
+
+// RequestPasswordReset asks for a reset token to be sent to the user
+// with the email; the response is the same whether or not one is sent
+func (c *Client) RequestPasswordReset(m app.PasswordResetMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.PasswordResetRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.makeRequest(req)
+}
+
+// RedeemPasswordReset sets a new password with a reset token
+// tokens issued under the old password are revoked, so log in again
+func (c *Client) RedeemPasswordReset(token, password string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.RedeemPasswordResetMsg{Token: token, Password: password})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.PasswordResetRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.makeRequest(req)
+}
+
+// refreshToken exchanges the refresh token for a new token
+func (c *Client) refreshToken() error {
+	bs, err := json.Marshal(app.RefreshTokenMsg{Refresh: c.token.Refresh})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.RefreshRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Add(app.IDHeader, c.ID)
+	resp, body, err := c.makeRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh response code: %d", resp.StatusCode)
+	}
+	token := app.Token{}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return err
+	}
+	c.token = &token
+	return nil
+}
+
+// renewToken replaces the token, preferring the refresh token over
+// the api secret
+func (c *Client) renewToken() error {
+	now := time.Now().Unix()
+	if c.token != nil && len(c.token.Refresh) != 0 && c.token.RefreshExpires > now {
+		err := c.refreshToken()
+		if err == nil {
+			return nil
+		}
+	}
+	if len(c.APISecret) == 0 {
+		return errors.New("token expired, login required")
+	}
+	return c.getToken()
+}
+
+// authedRequest will renew the token for a regular user instance if it is nil
 // or set to expire in 30 seconds
 func (c *Client) authedRequest(req *http.Request) (*http.Response, []byte, error) {
-	if c.token == nil || (c.token.Expires+30) > time.Now().Unix() {
-		err := c.getToken()
+	if c.token == nil || (c.token.Expires-30) < time.Now().Unix() {
+		err := c.renewToken()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -158,6 +360,261 @@ func (c *Client) UpdateOrgStatus(id string, status models.Status) (*http.Respons
 	return c.authedRequest(req)
 }
 
+// NominateOrgOwner offers ownership of the caller's org to owner
+func (c *Client) NominateOrgOwner(id, owner string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.UpdateOrgOwnerMsg{Owner: owner})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+id+app.TransferPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// CancelOrgOwnerNomination withdraws a pending ownership offer
+func (c *Client) CancelOrgOwnerNomination(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.OrgRoute+"/"+id+app.TransferPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// AcceptOrgOwner accepts an ownership offer made to the caller;
+// the current token is revoked, so the next request gets a new one
+func (c *Client) AcceptOrgOwner(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+id+app.TransferPath+app.AcceptPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.authedRequest(req)
+	if err == nil && resp.StatusCode == http.StatusNoContent {
+		c.token = nil
+	}
+	return resp, body, err
+}
+
+// ReadAudit reads the audit log of an org
+func (c *Client) ReadAudit(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.OrgRoute+"/"+id+app.AuditPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// UpdateOrgRequire2FA sets whether org members must use two-factor auth
+func (c *Client) UpdateOrgRequire2FA(id string, required bool) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.UpdateRequire2FAMsg{Required: required})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+id+app.TwoFactorPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// UpdateOIDCConfig sets the identity provider of an org
+func (c *Client) UpdateOIDCConfig(id string, m app.OIDCConfigMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+id+app.OIDCPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ReadOIDCConfig reads the identity provider of an org
+func (c *Client) ReadOIDCConfig(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.OrgRoute+"/"+id+app.OIDCPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// DeleteOIDCConfig removes the identity provider of an org
+func (c *Client) DeleteOIDCConfig(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.OrgRoute+"/"+id+app.OIDCPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// CreateInvitation invites an email to join an org
+func (c *Client) CreateInvitation(id, email string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.CreateInvitationMsg{Email: email})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.OrgRoute+"/"+id+app.InvitationsPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ListInvitations lists the pending invitations to an org
+func (c *Client) ListInvitations(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.OrgRoute+"/"+id+app.InvitationsPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ResendInvitation sends a new token for one of the invitations to an org
+func (c *Client) ResendInvitation(id, invitationID string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.OrgRoute+"/"+id+app.InvitationsPath+"/"+invitationID+app.ResendPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// RevokeInvitation revokes one of the invitations to an org
+func (c *Client) RevokeInvitation(id, invitationID string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.OrgRoute+"/"+id+app.InvitationsPath+"/"+invitationID, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// CreateServiceAccount adds a service account to an org; the response
+// has the api key to build its client with, see ServiceAccountClient
+func (c *Client) CreateServiceAccount(id string, m app.CreateServiceAccountMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.OrgRoute+"/"+id+app.ServicesPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ListServiceAccounts lists the service accounts of an org
+func (c *Client) ListServiceAccounts(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.OrgRoute+"/"+id+app.ServicesPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// RotateServiceAccount replaces the api keys of one of the service
+// accounts of an org
+func (c *Client) RotateServiceAccount(id, serviceID string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+id+app.ServicesPath+"/"+serviceID+app.RotatePath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// DisableServiceAccount disables one of the service accounts of an org
+func (c *Client) DisableServiceAccount(id, serviceID string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+id+app.ServicesPath+"/"+serviceID+app.DisablePath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ServiceAccountClient returns a new Client for a service account
+func ServiceAccountClient(host string, creds app.ServiceAccountCredentials) (*Client, error) {
+	c, err := NewClient(host, creds.ID, creds.Secret)
+	if err != nil {
+		return nil, err
+	}
+	c.APIKeyID = creds.APIKey
+	return c, nil
+}
+
+// AcceptInvitation creates the invited user; log in with the email and
+// password afterwards
+func (c *Client) AcceptInvitation(m app.AcceptInvitationMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.AcceptInvitationRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.makeRequest(req)
+}
+
+// Logout revokes the current token and its refresh token
+func (c *Client) Logout() (*http.Response, []byte, error) {
+	if c.token == nil {
+		return nil, nil, errors.New("no token to revoke")
+	}
+	bs, err := json.Marshal(app.RefreshTokenMsg{Refresh: c.token.Refresh})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.TokenRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.authedRequest(req)
+	if err == nil && resp.StatusCode == http.StatusNoContent {
+		c.token = nil
+	}
+	return resp, body, err
+}
+
+// RevokeAllTokens revokes every token issued to the caller
+func (c *Client) RevokeAllTokens() (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.TokenRoute+app.AllPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.authedRequest(req)
+	if err == nil && resp.StatusCode == http.StatusNoContent {
+		c.token = nil
+	}
+	return resp, body, err
+}
+
+// Impersonate returns a client acting as the user id, for root users
+// the returned client has no api secret, so it stops working when the
+// impersonation token expires
+func (c *Client) Impersonate(id string) (*Client, *http.Response, []byte, error) {
+	bs, err := json.Marshal(app.ImpersonateMsg{User: id})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.ImpersonateRoute, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	resp, body, err := c.authedRequest(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, body, nil
+	}
+	token := app.Token{}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &Client{Host: c.Host, ID: id, h: c.h, token: &token}, resp, body, nil
+}
+
 // user related
 
 // CreateUser creates a user
@@ -187,6 +644,36 @@ func (c *Client) ReadUser(id string) (*http.Response, []byte, error) {
 	return c.authedRequest(req)
 }
 
+// ReadUserByEmail reads the user in an org with email
+func (c *Client) ReadUserByEmail(org, email string) (*http.Response, []byte, error) {
+	query := url.Values{}
+	query.Set(app.EmailQuery, email)
+	u := c.Host + app.OrgRoute + "/" + org + app.UserPath + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// SearchUsers finds users in an org by email and/or display name prefix;
+// an empty prefix is not searched
+func (c *Client) SearchUsers(org, emailPrefix, displayNamePrefix string) (*http.Response, []byte, error) {
+	query := url.Values{}
+	if len(emailPrefix) != 0 {
+		query.Set(user.SearchEmail, emailPrefix)
+	}
+	if len(displayNamePrefix) != 0 {
+		query.Set(user.SearchDisplayName, displayNamePrefix)
+	}
+	u := c.Host + app.OrgRoute + "/" + org + app.UserPath + app.SearchPath + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
 // UpdateUserDisplayName updates a user display name
 func (c *Client) UpdateUserDisplayName(id, displayName string) (*http.Response, []byte, error) {
 	bs, err := json.Marshal(app.UpdateUserDisplayNameMsg{DisplayName: displayName})
@@ -213,6 +700,164 @@ func (c *Client) UpdateUserPassword(id, password string) (*http.Response, []byte
 	return c.authedRequest(req)
 }
 
+// UpdateOwnDisplayName updates the display name of the calling user
+func (c *Client) UpdateOwnDisplayName(displayName string) (*http.Response, []byte, error) {
+	return c.UpdateUserDisplayName(c.ID, displayName)
+}
+
+// UpdateOwnPassword updates the password of the calling user,
+// which requires the current password
+func (c *Client) UpdateOwnPassword(currentPassword, password string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.UpdateUserPasswordMsg{
+		Password:        password,
+		CurrentPassword: currentPassword,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.UserRoute+"/"+c.ID, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.authedRequest(req)
+	if err == nil && resp.StatusCode == http.StatusNoContent {
+		// the change revoked the current token
+		c.token = nil
+	}
+	return resp, body, err
+}
+
+// RotateAPISecret replaces a user api secret, keeping the old one valid
+// for grace; rotating the client's own secret swaps it in place, so
+// the client keeps working
+func (c *Client) RotateAPISecret(id string, grace time.Duration) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.RotateAPISecretMsg{Grace: int64(grace / time.Second)})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.UserRoute+"/"+id+app.APISecretPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := c.authedRequest(req)
+	if err == nil && resp.StatusCode == http.StatusOK && id == c.ID {
+		var m app.APISecretResponse
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			return resp, body, err
+		}
+		c.APISecret = m.APISecret
+		if grace <= 0 {
+			// the rotation revoked the current token
+			c.token = nil
+		}
+	}
+	return resp, body, err
+}
+
+// CreateAPIKey creates a named api key for a user
+func (c *Client) CreateAPIKey(id string, m app.CreateAPIKeyMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.UserRoute+"/"+id+app.APIKeysPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ListAPIKeys lists the api keys of a user
+func (c *Client) ListAPIKeys(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.UserRoute+"/"+id+app.APIKeysPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// RevokeAPIKey revokes one of the api keys of a user
+func (c *Client) RevokeAPIKey(id, keyID string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.UserRoute+"/"+id+app.APIKeysPath+"/"+keyID, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// EnrollTOTP starts two-factor enrollment for the caller
+func (c *Client) EnrollTOTP() (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.UserRoute+"/"+c.ID+app.TOTPPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ConfirmTOTP completes two-factor enrollment for the caller
+func (c *Client) ConfirmTOTP(code string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.TOTPCodeMsg{Code: code})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.UserRoute+"/"+c.ID+app.TOTPPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// DisableTOTP removes two-factor auth from a user; code is required
+// when id is the caller, and ignored otherwise
+func (c *Client) DisableTOTP(id, code string) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.TOTPCodeMsg{Code: code})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.UserRoute+"/"+id+app.TOTPPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ClearLockout lets a user locked out after failed attempts try again
+func (c *Client) ClearLockout(id string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.UserRoute+"/"+id+app.LockoutPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ClearIPLockout lets a client ip locked out after failed attempts try again
+func (c *Client) ClearIPLockout(ip string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.APIPath+app.LockoutPath+"/"+ip, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// StartReencryption re-encrypts stored users with the server's current key
+func (c *Client) StartReencryption() (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.ReencryptRoute, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ReadReencryption reads the progress of the latest re-encryption
+func (c *Client) ReadReencryption() (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.ReencryptRoute, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
 // UpdateUserStatus updates a user status
 func (c *Client) UpdateUserStatus(id string, status models.Status) (*http.Response, []byte, error) {
 	bs, err := json.Marshal(app.UpdateStatusMsg{Status: status})
@@ -225,3 +870,71 @@ func (c *Client) UpdateUserStatus(id string, status models.Status) (*http.Respon
 	}
 	return c.authedRequest(req)
 }
+
+// UpdateUserRole updates a user role
+func (c *Client) UpdateUserRole(id string, role models.Role) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.UpdateRoleMsg{Role: role})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.UserRoute+"/"+id, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// setting related
+
+// CreateSetting creates a setting for an org
+func (c *Client) CreateSetting(org string, m app.CreateSettingMsg) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Host+app.OrgRoute+"/"+org+app.SettingsPath, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ReadSettings reads all settings for an org
+func (c *Client) ReadSettings(org string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.OrgRoute+"/"+org+app.SettingsPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// ReadSetting reads one setting for an org
+func (c *Client) ReadSetting(org, key string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+app.OrgRoute+"/"+org+app.SettingsPath+"/"+key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// UpdateSetting changes a setting value
+func (c *Client) UpdateSetting(org, key string, value json.RawMessage) (*http.Response, []byte, error) {
+	bs, err := json.Marshal(app.UpdateSettingMsg{Value: value})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Host+app.OrgRoute+"/"+org+app.SettingsPath+"/"+key, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
+
+// DeleteSetting removes a setting
+func (c *Client) DeleteSetting(org, key string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodDelete, c.Host+app.OrgRoute+"/"+org+app.SettingsPath+"/"+key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.authedRequest(req)
+}
@@ -6,15 +6,22 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/app"
 	"github.com/grokloc/grokloc-go/pkg/env"
 	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/audit"
+	"github.com/grokloc/grokloc-go/pkg/models/invitation"
 	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/setting"
 	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/notify"
+	"github.com/grokloc/grokloc-go/pkg/oidc"
 	"github.com/grokloc/grokloc-go/pkg/security"
 	"github.com/grokloc/grokloc-go/pkg/util"
 	"github.com/stretchr/testify/require"
@@ -39,6 +46,12 @@ func (s *ClientSuite) SetupTest() {
 	s.ts = httptest.NewServer(s.srv.Router())
 }
 
+func (s *ClientSuite) TearDownTest() {
+	s.ts.Close()
+	s.srv.Close()
+	require.Nil(s.T(), s.srv.ST.Close())
+}
+
 func (s *ClientSuite) TestOk() {
 	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
 	require.Nil(s.T(), err)
@@ -55,6 +68,189 @@ func (s *ClientSuite) TestStatus() {
 	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
 }
 
+func (s *ClientSuite) TestLegacyTokenRequest() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	c.LegacyTokenRequest = true
+	_, _, err = c.Status()
+	require.Error(s.T(), err)
+	s.srv.ST.LegacyTokenRequests = true
+	defer func() { s.srv.ST.LegacyTokenRequests = false }()
+	resp, _, err := c.Status()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestLogin() {
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), email, o.ID, derived)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, "", "")
+	require.Nil(s.T(), err)
+	resp, _, err := c.Login(app.LoginMsg{OrgName: o.Name, Email: email, Password: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	_, _, err = c.ReadUser(u.ID)
+	require.Error(s.T(), err)
+	resp, _, err = c.Login(app.LoginMsg{OrgName: o.Name, Email: email, Password: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), u.ID, c.ID)
+	resp, _, err = c.ReadUser(u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestTOTP() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), email, o.ID, derived)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	// enroll with an api secret token
+	c, err := NewClient(s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, body, err := c.EnrollTOTP()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var e app.TOTPEnrollment
+	err = json.Unmarshal(body, &e)
+	require.Nil(s.T(), err)
+	code, err := security.TOTPCode(e.Seed, security.TOTPStep(time.Now())-1)
+	require.Nil(s.T(), err)
+	resp, _, err = c.ConfirmTOTP(code)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// password login takes two steps
+	pc, err := NewClient(s.ts.URL, "", "")
+	require.Nil(s.T(), err)
+	_, _, err = pc.VerifyLogin(code)
+	require.Error(s.T(), err)
+	resp, _, err = pc.Login(app.LoginMsg{OrgName: o.Name, Email: email, Password: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+	_, _, err = pc.ReadUser(u.ID)
+	require.Error(s.T(), err)
+	code, err = security.TOTPCode(e.Seed, security.TOTPStep(time.Now()))
+	require.Nil(s.T(), err)
+	resp, _, err = pc.VerifyLogin(code)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = pc.ReadUser(u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// the owner requires 2fa, and resets the user's
+	oc, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = oc.UpdateOrgRequire2FA(o.ID, true)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = oc.DisableTOTP(u.ID, "")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = pc.Login(app.LoginMsg{OrgName: o.Name, Email: email, Password: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestRefreshToken() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	resp, _, err := c.Status()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	first := *c.token
+
+	// not yet expiring, so the token is reused
+	resp, _, err = c.Status()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), first.Bearer, c.token.Bearer)
+
+	// expiring, so the refresh token is exchanged
+	c.token.Expires = 0
+	resp, _, err = c.Status()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.NotEqual(s.T(), first.Refresh, c.token.Refresh)
+
+	// a client with only a login falls back to an error once the refresh fails
+	c.APISecret = ""
+	c.token.Expires = 0
+	c.token.Refresh = first.Refresh // reused, so the family is revoked
+	_, _, err = c.Status()
+	require.Error(s.T(), err)
+}
+
+func (s *ClientSuite) TestLogout() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	_, _, err = c.Logout()
+	require.Error(s.T(), err)
+	resp, _, err := c.Status()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = c.Logout()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = c.RevokeAllTokens()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// a new token is fetched with the api secret
+	resp, _, err = c.Status()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestImpersonate() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	ownerClient, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	_, resp, _, err := ownerClient.Impersonate(s.srv.ST.RootUser)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	ic, resp, _, err := c.Impersonate(owner.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = ic.UpdateOwnDisplayName(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	resp, body, err := ownerClient.ReadAudit(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var entries []audit.Entry
+	err = json.Unmarshal(body, &entries)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), entries, 2)
+	require.Equal(s.T(), s.srv.ST.RootUser, entries[0].Actor)
+	require.Equal(s.T(), http.MethodPut, entries[0].Method)
+}
+
 func (s *ClientSuite) TestCreateOrg() {
 	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
 	require.Nil(s.T(), err)
@@ -85,6 +281,18 @@ func (s *ClientSuite) TestReadOrg() {
 	require.Equal(s.T(), orgID, o.ID)
 }
 
+func (s *ClientSuite) TestScopes() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	c.Scopes = []string{app.ScopeOrgRead}
+	resp, _, err := c.ReadOrg(s.srv.ST.RootOrg)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = c.CreateOrg(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
+
 func (s *ClientSuite) TestUpdateOrgOwner() {
 	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
@@ -111,6 +319,35 @@ func (s *ClientSuite) TestUpdateOrgOwner() {
 	require.Equal(s.T(), rUser.ID, oRead.Owner)
 }
 
+func (s *ClientSuite) TestTransferOrgOwner() {
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	nominee, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	nominee.Meta.Status = models.StatusActive
+	err = nominee.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err := c.NominateOrgOwner(o.ID, nominee.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = c.CancelOrgOwnerNomination(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = c.NominateOrgOwner(o.ID, nominee.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	cNominee, err := NewClient(s.ts.URL, nominee.ID, nominee.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = cNominee.AcceptOrgOwner(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	oRead, err := org.Read(s.ctx, s.srv.ST.RandomReplica(), o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), nominee.ID, oRead.Owner)
+}
+
 func (s *ClientSuite) TestUpdateOrgStatus() {
 	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
@@ -162,6 +399,35 @@ func (s *ClientSuite) TestReadUser() {
 	require.True(s.T(), len(u.Password) == 0)
 }
 
+func (s *ClientSuite) TestReadUserByEmail() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	resp, respBody, err := c.ReadUserByEmail(o.ID, u.Email)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var uRead user.Instance
+	err = json.Unmarshal(respBody, &uRead)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.ID, uRead.ID)
+}
+
+func (s *ClientSuite) TestSearchUsers() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	resp, respBody, err := c.SearchUsers(o.ID, u.Email[:user.MinSearchPrefix], "")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var found []user.Instance
+	err = json.Unmarshal(respBody, &found)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 1)
+	require.Equal(s.T(), u.ID, found[0].ID)
+}
+
 func (s *ClientSuite) TestUpdateUserDisplayName() {
 	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
@@ -197,6 +463,139 @@ func (s *ClientSuite) TestUpdateUserPassword() {
 	require.True(s.T(), verified)
 }
 
+func (s *ClientSuite) TestUpdateOwnProfile() {
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	rUser, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, derived)
+	require.Nil(s.T(), err)
+	rUser.Meta.Status = models.StatusActive
+	err = rUser.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, rUser.ID, rUser.APISecret)
+	require.Nil(s.T(), err)
+	displayName := uuid.NewString()
+	resp, _, err := c.UpdateOwnDisplayName(displayName)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	newPassword := uuid.NewString()
+	resp, _, err = c.UpdateOwnPassword(uuid.NewString(), newPassword)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = c.UpdateOwnPassword(password, newPassword)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	uRead, err := user.Read(s.ctx, s.srv.ST.RandomReplica(), s.srv.ST.Key, rUser.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), displayName, uRead.DisplayName)
+	verified, err := security.VerifyPassword(newPassword, uRead.Password)
+	require.Nil(s.T(), err)
+	require.True(s.T(), verified)
+}
+
+func (s *ClientSuite) TestRotateAPISecret() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+
+	// the new secret is swapped in and the client keeps working
+	resp, _, err := c.RotateAPISecret(u.ID, time.Minute)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.NotEqual(s.T(), u.APISecret, c.APISecret)
+	resp, _, err = c.RotateAPISecret(u.ID, 0)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Nil(s.T(), c.token)
+	resp, _, err = c.ReadUser(u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestAPIKeys() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, respBody, err := c.CreateAPIKey(u.ID, app.CreateAPIKeyMsg{Label: "ci"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var k app.APIKeyResponse
+	err = json.Unmarshal(respBody, &k)
+	require.Nil(s.T(), err)
+
+	// a client using the key
+	kc, err := NewClient(s.ts.URL, u.ID, k.Secret)
+	require.Nil(s.T(), err)
+	kc.APIKeyID = k.ID
+	resp, _, err = kc.ReadUser(u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	resp, _, err = c.ListAPIKeys(u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = c.RevokeAPIKey(u.ID, k.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	kc.token = nil
+	_, _, err = kc.ReadUser(u.ID)
+	require.Error(s.T(), err)
+}
+
+func (s *ClientSuite) TestLockout() {
+	_, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	bad, err := NewClient(s.ts.URL, owner.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	for i := 0; i < s.srv.ST.UserLockout.Threshold; i++ {
+		_, _, err = bad.ReadUser(owner.ID)
+		require.Error(s.T(), err)
+	}
+	ownerClient, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	_, _, err = ownerClient.ReadUser(owner.ID)
+	require.Error(s.T(), err)
+
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	resp, _, err := c.ClearLockout(owner.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = ownerClient.ReadUser(owner.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// the failures also counted against the client ip
+	resp, _, err = ownerClient.ClearIPLockout("127.0.0.1")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = c.ClearIPLockout("127.0.0.1")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestReencryption() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	resp, _, err := c.ReadReencryption()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = c.StartReencryption()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+	require.Eventually(s.T(), func() bool {
+		_, body, err := c.ReadReencryption()
+		require.Nil(s.T(), err)
+		var status app.Reencryption
+		require.Nil(s.T(), json.Unmarshal(body, &status))
+		return !status.Running
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
 func (s *ClientSuite) TestUpdateUserStatus() {
 	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
@@ -210,6 +609,228 @@ func (s *ClientSuite) TestUpdateUserStatus() {
 	require.Equal(s.T(), models.StatusInactive, uRead.Meta.Status)
 }
 
+func (s *ClientSuite) TestUpdateUserRole() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	c, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err := c.UpdateUserRole(u.ID, models.RoleAdmin)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	uRead, err := user.Read(s.ctx, s.srv.ST.RandomReplica(), s.srv.ST.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.RoleAdmin, uRead.Role)
+
+	// the new admin can create users
+	ac, err := NewClient(s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = ac.CreateUser(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestSettings() {
+	c, err := NewClient(s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Nil(s.T(), err)
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	resp, _, err := c.CreateSetting(o.ID, app.CreateSettingMsg{
+		Key:      "feature.beta",
+		Type:     setting.TypeBool,
+		Value:    json.RawMessage(`false`),
+		Editable: true,
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	resp, _, err = c.UpdateSetting(o.ID, "feature.beta", json.RawMessage(`true`))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, respBody, err := c.ReadSetting(o.ID, "feature.beta")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var v setting.Instance
+	err = json.Unmarshal(respBody, &v)
+	require.Nil(s.T(), err)
+	require.JSONEq(s.T(), `true`, string(v.Value))
+	resp, respBody, err = c.ReadSettings(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var m setting.Map
+	err = json.Unmarshal(respBody, &m)
+	require.Nil(s.T(), err)
+	require.True(s.T(), m.Bool("feature.beta", false))
+	resp, _, err = c.DeleteSetting(o.ID, "feature.beta")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+}
+
 func TestClientSuite(t *testing.T) {
 	suite.Run(t, new(ClientSuite))
 }
+
+func (s *ClientSuite) TestPasswordReset() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, "", "")
+	require.Nil(s.T(), err)
+	resp, _, err := c.RequestPasswordReset(app.PasswordResetMsg{OrgName: o.Name, Email: owner.Email})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+
+	outbox, ok := s.srv.ST.Notifier.(*notify.Outbox)
+	require.True(s.T(), ok)
+	ms, err := outbox.Messages()
+	require.Nil(s.T(), err)
+	var token string
+	for _, m := range ms {
+		if m.To == owner.Email {
+			lines := strings.Split(strings.TrimSpace(m.Body), "\n")
+			token = lines[len(lines)-1]
+		}
+	}
+	require.NotEmpty(s.T(), token)
+
+	password := uuid.NewString()
+	resp, _, err = c.RedeemPasswordReset(token, password)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = c.Login(app.LoginMsg{OrgName: o.Name, Email: owner.Email, Password: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestInvitation() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	resp, _, err := c.CreateInvitation(o.ID, email)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	resp, body, err := c.ListInvitations(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var invitations []invitation.Instance
+	require.Nil(s.T(), json.Unmarshal(body, &invitations))
+	require.Len(s.T(), invitations, 1)
+	resp, _, err = c.ResendInvitation(o.ID, invitations[0].ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	outbox, ok := s.srv.ST.Notifier.(*notify.Outbox)
+	require.True(s.T(), ok)
+	ms, err := outbox.Messages()
+	require.Nil(s.T(), err)
+	var token string
+	for _, m := range ms {
+		if m.To == email {
+			lines := strings.Split(strings.TrimSpace(m.Body), "\n")
+			token = lines[len(lines)-1]
+		}
+	}
+	require.NotEmpty(s.T(), token)
+
+	invitee, err := NewClient(s.ts.URL, "", "")
+	require.Nil(s.T(), err)
+	password := uuid.NewString()
+	resp, _, err = invitee.AcceptInvitation(app.AcceptInvitationMsg{Token: token, DisplayName: uuid.NewString(), Password: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	resp, _, err = invitee.Login(app.LoginMsg{Org: o.ID, Email: email, Password: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// revoking an accepted invitation finds nothing
+	resp, _, err = c.RevokeInvitation(o.ID, invitations[0].ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestServiceAccounts() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, body, err := c.CreateServiceAccount(o.ID, app.CreateServiceAccountMsg{DisplayName: uuid.NewString(), Scope: app.ScopeUserRead})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var creds app.ServiceAccountCredentials
+	require.Nil(s.T(), json.Unmarshal(body, &creds))
+
+	sc, err := ServiceAccountClient(s.ts.URL, creds)
+	require.Nil(s.T(), err)
+	resp, _, err = sc.ReadUser(creds.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	resp, body, err = c.ListServiceAccounts(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var accounts []app.ServiceAccount
+	require.Nil(s.T(), json.Unmarshal(body, &accounts))
+	require.Len(s.T(), accounts, 1)
+	resp, _, err = c.RotateServiceAccount(o.ID, creds.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = c.DisableServiceAccount(o.ID, creds.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+}
+
+func (s *ClientSuite) TestOIDC() {
+	mock, err := oidc.NewMockIdP()
+	require.Nil(s.T(), err)
+	defer mock.Close()
+	s.srv.ST.IdPClient = mock.Client()
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := NewClient(s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err := c.UpdateOIDCConfig(o.ID, app.OIDCConfigMsg{Issuer: mock.Issuer(), ClientID: mock.ClientID, ClientSecret: mock.ClientSecret})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = c.ReadOIDCConfig(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	email := uuid.NewString()
+	mock.SignIn(oidc.Identity{Subject: uuid.NewString(), Email: email, EmailVerified: true})
+	federated, err := NewClient(s.ts.URL, "", "")
+	require.Nil(s.T(), err)
+	resp, body, err := federated.OIDCLogin(app.OIDCLoginMsg{Org: o.ID, RedirectURI: "https://app.example.com/callback"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var a app.OIDCAuthorization
+	require.Nil(s.T(), json.Unmarshal(body, &a))
+
+	// the redirect back is read, not followed
+	browser := mock.Client()
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err = browser.Get(a.URL)
+	require.Nil(s.T(), err)
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("location"))
+	require.Nil(s.T(), err)
+	resp, _, err = federated.OIDCCallback(location.Query().Get("state"), location.Query().Get("code"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, body, err = federated.ReadUser(federated.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var u user.Instance
+	require.Nil(s.T(), json.Unmarshal(body, &u))
+	require.Equal(s.T(), email, u.Email)
+
+	resp, _, err = c.DeleteOIDCConfig(o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+}
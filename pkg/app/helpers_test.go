@@ -0,0 +1,107 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+)
+
+// tokenOption sets a header on a token request
+type tokenOption func(*http.Request)
+
+// withAPIKey makes a token request with the api key id, whose secret
+// signs it
+func withAPIKey(id string) tokenOption {
+	return func(req *http.Request) { req.Header.Set(APIKeyHeader, id) }
+}
+
+// withScope requests a token limited to scope
+func withScope(scope string) tokenOption {
+	return func(req *http.Request) { req.Header.Set(ScopeHeader, scope) }
+}
+
+// fromIP makes a token request look like it came from the client ip
+func fromIP(ip string) tokenOption {
+	return func(req *http.Request) { req.Header.Set("X-Real-IP", ip) }
+}
+
+// requestToken sends a token request for id signed with secret to the
+// server at url, as for tokenFor, returning the token if one was issued
+func requestToken(c *http.Client, url, id, secret string, opts ...tokenOption) (*http.Response, *Token, error) {
+	if !strings.HasSuffix(url, "/token") {
+		url += TokenRoute
+	}
+	req, err := http.NewRequest(http.MethodPut, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add(IDHeader, id)
+	for _, opt := range opts {
+		opt(req)
+	}
+	err = SignRequest(req, secret, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, nil
+	}
+	var tok Token
+	err = json.NewDecoder(resp.Body).Decode(&tok)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, &tok, nil
+}
+
+// tokenFor gets a token for id from the server at url
+// url is the server root, unless it ends with the token path
+// (these steps are already run through real tests in token_test)
+func tokenFor(c *http.Client, url, id, apiSecret string) (*Token, error) {
+	resp, tok, err := requestToken(c, url, id, apiSecret)
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, fmt.Errorf("token response code: %d", resp.StatusCode)
+	}
+	return tok, nil
+}
+
+// authedDo sends a request as id with tok; body, if non-nil, is marshaled to json
+func authedDo(c *http.Client, method, url, id string, tok *Token, body interface{}) (*http.Response, []byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		reqBody = bytes.NewBuffer(bs)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add(IDHeader, id)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/audit"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+)
+
+// ImpersonateMsg is what a client should marshal to send as a json body to Impersonate
+// Scope optionally requests a subset of the user's scopes, space separated
+type ImpersonateMsg struct {
+	User  string `json:"user"`
+	Scope string `json:"scope,omitempty"`
+}
+
+// Impersonate issues root a token to act as a user in another org
+// the token names root as the actor, cannot be refreshed, and expires
+// after ImpersonationExpiration; writes made with it are audited
+func (srv Instance) Impersonate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if !can(role, ActionImpersonate) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+	// no impersonating while impersonating
+	if len(session.Actor) != 0 {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m ImpersonateMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.User) == 0 {
+		http.Error(w, "malformed impersonate msg", http.StatusBadRequest)
+		return
+	}
+
+	u, err := user.Read(ctx, srv.ST.Master, srv.ST.Key, m.User)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if u.Org == srv.ST.RootOrg {
+		http.Error(w, "cannot impersonate a root user", http.StatusForbidden)
+		return
+	}
+	if u.Meta.Status != models.StatusActive {
+		http.Error(w, "user not active", http.StatusBadRequest)
+		return
+	}
+	o, err := org.Read(ctx, srv.ST.Master, u.Org)
+	if err != nil {
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if o.Meta.Status != models.StatusActive {
+		http.Error(w, "org not active", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := grantScopes(allowedScopes(srv.roleFor(*o, *u)), jwt.SplitScopes(m.Scope))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	claims, err := jwt.Impersonate(*u, session.User, srv.ST.ImpersonationExpiration, scopes)
+	if err != nil {
+		sugar.Debugw("impersonate claims",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	signedToken, err := srv.ST.SigningKeys.Sign(claims)
+	if err != nil {
+		sugar.Debugw("sign token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// the token is only returned once its issue is on record
+	sugar.Infow("impersonation token issued",
+		"reqid", middleware.GetReqID(ctx),
+		"actor", session.User.ID,
+		"subject", u.ID,
+		"org", u.Org,
+		"jti", claims.Id)
+	e := audit.New(session.User.ID, u.ID, u.Org, r.Method, r.URL.Path, middleware.GetReqID(ctx), http.StatusOK)
+	err = e.Insert(ctx, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("insert audit entry",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(Token{Bearer: signedToken, Expires: claims.ExpiresAt})
+	if err != nil {
+		sugar.Debugw("marshal token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// validActor reports whether the act claim of a token still names an
+// active root user whose tokens have not been revoked since
+func (srv Instance) validActor(ctx context.Context, act *jwt.Actor) (bool, error) {
+	actor, err := user.Read(ctx, srv.ST.RandomReplica(), srv.ST.Key, act.Subject)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return actor.Org == srv.ST.RootOrg &&
+		act.Org == actor.Org &&
+		act.Watermark == actor.TokenWatermark &&
+		actor.Meta.Status == models.StatusActive, nil
+}
+
+// audited serves a write made while impersonating or by a service
+// account, then flags it in the log and records it in the org's audit log
+// a service account is its own actor
+func (srv Instance) audited(w http.ResponseWriter, r *http.Request, next http.Handler, session Session) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	next.ServeHTTP(ww, r)
+	status := ww.Status()
+	if status == 0 {
+		// nothing written is an implicit 200
+		status = http.StatusOK
+	}
+
+	msg, actor := "impersonated write", session.Actor
+	if len(actor) == 0 {
+		msg, actor = "service account write", session.User.ID
+	}
+	sugar.Infow(msg,
+		"reqid", middleware.GetReqID(ctx),
+		"actor", actor,
+		"subject", session.User.ID,
+		"org", session.Org.ID,
+		"service", session.User.Service,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status)
+	e := audit.New(actor, session.User.ID, session.Org.ID, r.Method, r.URL.Path, middleware.GetReqID(ctx), status)
+	e.Service = session.User.Service
+	err := e.Insert(ctx, srv.ST.Master)
+	if err != nil {
+		// the response has been sent, so the log line is the record
+		sugar.Debugw("insert audit entry",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+}
+
+// ReadAudit returns the audit log of an org, newest first
+func (srv Instance) ReadAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if !can(role, ActionReadAudit) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+	if !can(role, ActionManageOrgs) && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return
+	}
+
+	entries, err := audit.List(ctx, srv.ST.RandomReplica(), id)
+	if err != nil {
+		sugar.Debugw("list audit entries",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(entries)
+	if err != nil {
+		sugar.Debugw("marshal audit entries",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/audit"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *UserSuite) TestImpersonate() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	ownerToken, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	member, memberToken := s.newMember(o.ID, models.RoleMember)
+	impersonateURL := s.ts.URL + ImpersonateRoute
+	auditURL := s.ts.URL + OrgRoute + "/" + o.ID + AuditPath
+
+	// only root may impersonate
+	resp, _, err := authedDo(s.c, http.MethodPost, impersonateURL, owner.ID, ownerToken, ImpersonateMsg{User: member.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// and not other root users, or users that don't exist
+	resp, _, err = authedDo(s.c, http.MethodPost, impersonateURL, s.srv.ST.RootUser, s.token, ImpersonateMsg{User: s.srv.ST.RootUser})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, impersonateURL, s.srv.ST.RootUser, s.token, ImpersonateMsg{User: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	before := time.Now().Unix()
+	resp, body, err := authedDo(s.c, http.MethodPost, impersonateURL, s.srv.ST.RootUser, s.token, ImpersonateMsg{User: owner.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var tok Token
+	err = json.Unmarshal(body, &tok)
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), tok.Refresh)
+	require.LessOrEqual(s.T(), tok.Expires, time.Now().Add(s.srv.ST.ImpersonationExpiration).Unix())
+	require.GreaterOrEqual(s.T(), tok.Expires, before)
+	claims, err := jwt.Decode(tok.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), owner.ID, claims.Subject)
+	require.Equal(s.T(), s.srv.ST.RootUser, claims.Act.Subject)
+
+	// the token acts as the owner, so root-only requests are refused
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+OrgRoute+"/"+o.ID, owner.ID, &tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, s.ts.URL+OrgRoute, owner.ID, &tok, CreateOrgMsg{Name: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	// and it is only good for the subject
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+member.ID, member.ID, &tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	displayName := uuid.NewString()
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+member.ID, owner.ID, &tok,
+		UpdateUserDisplayNameMsg{DisplayName: displayName})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	uRead, err := user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, member.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), displayName, uRead.DisplayName)
+
+	// the issue and the attempted writes are audited, reads are not
+	resp, body, err = authedDo(s.c, http.MethodGet, auditURL, owner.ID, ownerToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var entries []audit.Entry
+	err = json.Unmarshal(body, &entries)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), entries, 3)
+	for _, e := range entries {
+		require.Equal(s.T(), s.srv.ST.RootUser, e.Actor)
+		require.Equal(s.T(), owner.ID, e.Subject)
+	}
+	require.Equal(s.T(), http.MethodPut, entries[0].Method)
+	require.Equal(s.T(), UserRoute+"/"+member.ID, entries[0].Path)
+	require.Equal(s.T(), http.StatusNoContent, entries[0].Status)
+	require.Equal(s.T(), OrgRoute, entries[1].Path)
+	require.Equal(s.T(), http.StatusForbidden, entries[1].Status)
+	require.Equal(s.T(), ImpersonateRoute, entries[2].Path)
+
+	// credentials that would outlive the token cannot be made with it
+	ownerURL := s.ts.URL + UserRoute + "/" + owner.ID
+	for _, req := range []struct {
+		method, url string
+		body        interface{}
+	}{
+		{http.MethodPut, ownerURL + APISecretPath, nil},
+		{http.MethodPost, ownerURL + APIKeysPath, CreateAPIKeyMsg{Label: uuid.NewString()}},
+		{http.MethodPost, ownerURL + TOTPPath, nil},
+		{http.MethodDelete, ownerURL + TOTPPath, nil},
+		{http.MethodPost, ownerURL + OIDCPath, OIDCLinkMsg{RedirectURI: "https://app.example.com/callback"}},
+		{http.MethodPut, ownerURL, UpdateUserPasswordMsg{Password: uuid.NewString(), CurrentPassword: uuid.NewString()}},
+		{http.MethodPost, s.ts.URL + OrgRoute + "/" + o.ID + ServicesPath, CreateServiceAccountMsg{DisplayName: uuid.NewString()}},
+	} {
+		resp, _, err = authedDo(s.c, req.method, req.url, owner.ID, &tok, req.body)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusForbidden, resp.StatusCode, req.url)
+	}
+	uRead, err = user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, owner.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), owner.APISecret, uRead.APISecret)
+
+	// members cannot read the audit log
+	resp, _, err = authedDo(s.c, http.MethodGet, auditURL, member.ID, memberToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// revoking root's tokens ends the impersonation too
+	resp, _, err = authedDo(s.c, http.MethodDelete, s.ts.URL+TokenRoute+AllPath, s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+OrgRoute+"/"+o.ID, owner.ID, &tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
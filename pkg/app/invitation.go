@@ -0,0 +1,341 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/invitation"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/notify"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// CreateInvitationMsg is what a client should marshal to send as a json
+// body to CreateInvitation
+type CreateInvitationMsg struct {
+	Email string `json:"email"`
+}
+
+// AcceptInvitationMsg is what a client should marshal to send as a json
+// body to AcceptInvitation
+type AcceptInvitationMsg struct {
+	Token       string `json:"token"`
+	DisplayName string `json:"display_name"`
+	Password    string `json:"password"`
+}
+
+// errInvitationInvalid is the single response for any unusable invitation token
+const errInvitationInvalid = "invitation invalid"
+
+// invitationOrg is the org in the url if the caller can invite users to
+// it, otherwise the error response is written and ok is false
+func (srv Instance) invitationOrg(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ctx := r.Context()
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if !can(role, ActionCreateUser) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return "", false
+	}
+	if !can(role, ActionManageOrgs) && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return "", false
+	}
+	// cannot add to root org through the web api
+	if id == srv.ST.RootOrg {
+		http.Error(w, "cannot invite to root org", http.StatusForbidden)
+		return "", false
+	}
+	return id, true
+}
+
+// readInvitation reads the invitation in the url for the org, writing the
+// error response if it cannot
+func (srv Instance) readInvitation(w http.ResponseWriter, r *http.Request, org string) (*invitation.Instance, bool) {
+	ctx := r.Context()
+	key := chi.URLParam(r, KeyParam)
+	if len(key) == 0 {
+		panic("key missing")
+	}
+	i, err := invitation.Read(ctx, srv.ST.Master, srv.ST.Key, org, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "invitation not found", http.StatusNotFound)
+			return nil, false
+		}
+		srv.ST.L.Sugar().Debugw("read invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return i, true
+}
+
+// sendInvitation delivers the invitation token through the state Notifier
+// the invitation stands regardless, and can be resent, so errors are only logged
+func (srv Instance) sendInvitation(ctx context.Context, i invitation.Instance) {
+	err := srv.ST.Notifier.Notify(ctx, notify.Message{
+		To:      i.Email,
+		Subject: "invitation",
+		Body: fmt.Sprintf("You are invited to join an org. Accept by choosing a password before %s, with the token:\n\n%s\n",
+			time.Unix(i.Expires, 0).UTC().Format(time.RFC1123), i.Token),
+	})
+	if err != nil {
+		srv.ST.L.Sugar().Infow("notify invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+}
+
+// CreateInvitation invites an email to join the org, sending it a token
+// to accept with
+func (srv Instance) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.invitationOrg(w, r)
+	if !ok {
+		return
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m CreateInvitationMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.Email) == 0 {
+		http.Error(w, "malformed invitation", http.StatusBadRequest)
+		return
+	}
+
+	expires := time.Now().Add(srv.ST.InvitationExpiration).Unix()
+	i, err := invitation.New(org, m.Email, session.User.ID, expires)
+	if err != nil {
+		http.Error(w, "malformed invitation args", http.StatusBadRequest)
+		return
+	}
+	err = i.Insert(ctx, srv.ST.Master, srv.ST.Key)
+	if err != nil {
+		if err == models.ErrConflict {
+			http.Error(w, "email already invited or in use", http.StatusConflict)
+			return
+		}
+		if err == models.ErrRelatedOrg {
+			http.Error(w, "org not active", http.StatusForbidden)
+			return
+		}
+		sugar.Debugw("insert invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.sendInvitation(ctx, *i)
+	w.Header().Set("location", fmt.Sprintf("%s/%s%s/%s", OrgRoute, org, InvitationsPath, i.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ListInvitations returns the org's pending invitations, without tokens
+func (srv Instance) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.invitationOrg(w, r)
+	if !ok {
+		return
+	}
+	invitations, err := invitation.List(ctx, srv.ST.RandomReplica(), srv.ST.Key, org)
+	if err != nil {
+		sugar.Debugw("list invitations",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	bs, err := json.Marshal(invitations)
+	if err != nil {
+		sugar.Debugw("marshal invitations",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// ResendInvitation sends a new token for an invitation, renewing its
+// expiration; earlier tokens can no longer be accepted
+func (srv Instance) ResendInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.invitationOrg(w, r)
+	if !ok {
+		return
+	}
+	i, ok := srv.readInvitation(w, r, org)
+	if !ok {
+		return
+	}
+	err := i.Resend(ctx, srv.ST.Master, time.Now().Add(srv.ST.InvitationExpiration).Unix())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "invitation not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("resend invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.sendInvitation(ctx, *i)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeInvitation deletes an invitation, so it can no longer be accepted
+func (srv Instance) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.invitationOrg(w, r)
+	if !ok {
+		return
+	}
+	key := chi.URLParam(r, KeyParam)
+	if len(key) == 0 {
+		panic("key missing")
+	}
+	err := invitation.Revoke(ctx, srv.ST.Master, org, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "invitation not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("revoke invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvitation creates an active user for the invited email, with the
+// display name and password the invitee chooses
+// the token can only be accepted once, and only with a password the
+// org policy accepts
+func (srv Instance) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m AcceptInvitationMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.Token) == 0 || len(m.DisplayName) == 0 || len(m.Password) == 0 {
+		http.Error(w, "malformed invitation acceptance", http.StatusBadRequest)
+		return
+	}
+
+	i, err := invitation.ReadByToken(ctx, srv.ST.Master, srv.ST.Key, m.Token, time.Now().Unix())
+	if err != nil {
+		if err == sql.ErrNoRows || err == invitation.ErrExpired {
+			http.Error(w, errInvitationInvalid, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !srv.checkPassword(w, r, i.Org, m.Password) {
+		return
+	}
+	derived, err := security.DerivePassword(m.Password, srv.ST.Argon2Cfg)
+	if err != nil {
+		sugar.Debugw("derive password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	u, err := user.New(m.DisplayName, i.Email, i.Org, derived)
+	if err != nil {
+		http.Error(w, "malformed user args", http.StatusBadRequest)
+		return
+	}
+	// the invitee proved control of the email
+	u.Meta.Status = models.StatusActive
+
+	// emails are unique, so of concurrent acceptances only one user is inserted
+	err = u.Insert(ctx, srv.ST.Master, srv.ST.Key)
+	if err != nil {
+		if err == models.ErrConflict {
+			http.Error(w, "duplicate user args", http.StatusConflict)
+			return
+		}
+		if err == models.ErrRelatedOrg {
+			http.Error(w, "org not active", http.StatusForbidden)
+			return
+		}
+		sugar.Debugw("insert user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	err = i.Accept(ctx, srv.ST.Master)
+	if err != nil {
+		// the user exists, so the invitation is spent regardless
+		sugar.Infow("remove accepted invitation",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+	w.Header().Set("location", UserRoute+"/"+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/invitation"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// accept sends an invitation acceptance
+func (s *UserSuite) accept(m AcceptInvitationMsg) *http.Response {
+	bs, err := json.Marshal(m)
+	require.Nil(s.T(), err)
+	req, err := http.NewRequest(http.MethodPost, s.ts.URL+AcceptInvitationRoute, bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	req.Header.Add("X-Real-IP", randomIP())
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	resp.Body.Close()
+	return resp
+}
+
+func (s *UserSuite) TestInvitation() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	invitationsURL := s.ts.URL + OrgRoute + "/" + o.ID + InvitationsPath
+
+	email := uuid.NewString()
+	resp, _, err := authedDo(s.c, http.MethodPost, invitationsURL, owner.ID, tok, CreateInvitationMsg{Email: email})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, invitationsURL, owner.ID, tok, CreateInvitationMsg{Email: email})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, invitationsURL, owner.ID, tok, CreateInvitationMsg{Email: owner.Email})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+
+	resp, body, err := authedDo(s.c, http.MethodGet, invitationsURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var invitations []invitation.Instance
+	require.Nil(s.T(), json.Unmarshal(body, &invitations))
+	require.Len(s.T(), invitations, 1)
+	require.Equal(s.T(), email, invitations[0].Email)
+	require.Equal(s.T(), owner.ID, invitations[0].Inviter)
+
+	// resending replaces the token
+	resp, _, err = authedDo(s.c, http.MethodPost, invitationsURL+"/"+invitations[0].ID+ResendPath, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	tokens := s.sentTokens(email)
+	require.Len(s.T(), tokens, 2)
+	password := uuid.NewString()
+	require.Equal(s.T(), http.StatusUnauthorized, s.accept(AcceptInvitationMsg{Token: tokens[0], DisplayName: uuid.NewString(), Password: password}).StatusCode)
+
+	// a refused password does not spend the invitation
+	require.Equal(s.T(), http.StatusBadRequest, s.accept(AcceptInvitationMsg{Token: tokens[1], DisplayName: uuid.NewString(), Password: "a"}).StatusCode)
+	require.Equal(s.T(), http.StatusCreated, s.accept(AcceptInvitationMsg{Token: tokens[1], DisplayName: uuid.NewString(), Password: password}).StatusCode)
+	require.Equal(s.T(), http.StatusUnauthorized, s.accept(AcceptInvitationMsg{Token: tokens[1], DisplayName: uuid.NewString(), Password: password}).StatusCode)
+
+	// the new user is active, and can log in with the password they chose
+	resp, l := s.login(LoginMsg{Org: o.ID, Email: email, Password: password})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, body, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+l.ID, l.ID, &l.Token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var u map[string]interface{}
+	require.Nil(s.T(), json.Unmarshal(body, &u))
+	require.Equal(s.T(), o.ID, u["org"])
+
+	resp, body, err = authedDo(s.c, http.MethodGet, invitationsURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), "[]", string(body))
+}
+
+func (s *UserSuite) TestInvitationRevoke() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	invitationsURL := s.ts.URL + OrgRoute + "/" + o.ID + InvitationsPath
+
+	email := uuid.NewString()
+	resp, _, err := authedDo(s.c, http.MethodPost, invitationsURL, owner.ID, tok, CreateInvitationMsg{Email: email})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	location := resp.Header.Get("location")
+	require.NotEmpty(s.T(), location)
+
+	// members cannot manage invitations, nor can other orgs
+	member, memberTok := s.newMember(o.ID, models.RoleMember)
+	resp, _, err = authedDo(s.c, http.MethodGet, invitationsURL, member.ID, memberTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	_, other, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	otherTok, err := tokenFor(s.c, s.ts.URL, other.ID, other.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodDelete, s.ts.URL+location, other.ID, otherTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	resp, _, err = authedDo(s.c, http.MethodDelete, s.ts.URL+location, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, s.ts.URL+location, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+	tokens := s.sentTokens(email)
+	require.Len(s.T(), tokens, 1)
+	require.Equal(s.T(), http.StatusUnauthorized, s.accept(AcceptInvitationMsg{Token: tokens[0], DisplayName: uuid.NewString(), Password: uuid.NewString()}).StatusCode)
+
+	// nobody is invited to the root org through the api
+	resp, _, err = authedDo(s.c, http.MethodPost, s.ts.URL+OrgRoute+"/"+s.srv.ST.RootOrg+InvitationsPath, s.srv.ST.RootUser, s.token, CreateInvitationMsg{Email: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/lockout"
+)
+
+// errTooManyAttempts is the response while a user or client ip is locked out
+const errTooManyAttempts = "too many attempts"
+
+// clientIP is the address of the caller, as set by RealIP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RealIP sets the bare address
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lockedOut reports whether the key of kind is locked out, writing the
+// error response if it is, or if the lockout cannot be read
+func (srv *Instance) lockedOut(w http.ResponseWriter, r *http.Request, kind lockout.Kind, key string) bool {
+	ctx := r.Context()
+	now := time.Now().Unix()
+	until, err := lockout.LockedUntil(ctx, srv.ST.Master, kind, key, now)
+	if err != nil {
+		srv.ST.L.Sugar().Debugw("read lockout",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return true
+	}
+	if until == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(until-now, 10))
+	http.Error(w, errTooManyAttempts, http.StatusTooManyRequests)
+	return true
+}
+
+// fail records a failed attempt for the key of kind
+// the attempt has already been refused, so errors are only logged
+func (srv *Instance) fail(ctx context.Context, kind lockout.Kind, key string) {
+	sugar := srv.ST.L.Sugar()
+	p := srv.ST.UserLockout
+	if kind == lockout.KindIP {
+		p = srv.ST.IPLockout
+	}
+	now := time.Now().Unix()
+	until, err := lockout.Fail(ctx, srv.ST.Master, kind, key, now, p)
+	if err != nil {
+		sugar.Debugw("record failure",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		return
+	}
+	if until != 0 {
+		sugar.Infow("locked out",
+			"reqid", middleware.GetReqID(ctx),
+			"kind", kind,
+			"until", until)
+	}
+
+	// keys are only needed while their failures still count
+	window := srv.ST.UserLockout.Window
+	if srv.ST.IPLockout.Window > window {
+		window = srv.ST.IPLockout.Window
+	}
+	_, err = lockout.Prune(ctx, srv.ST.Master, now-int64(window/time.Second))
+	if err != nil {
+		sugar.Debugw("prune lockouts",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+}
+
+// succeed forgets the failures for the user id
+func (srv *Instance) succeed(ctx context.Context, id string) {
+	err := lockout.Clear(ctx, srv.ST.Master, lockout.KindUser, id)
+	if err != nil && err != sql.ErrNoRows {
+		srv.ST.L.Sugar().Debugw("clear lockout",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+}
+
+// Throttle refuses requests from locked out client ips, and for locked
+// out users given by the IDHeader, with 429 and a Retry-After header
+// requests let through that are refused with 401 count as failures for
+// both; a success clears the user's failures
+func (srv *Instance) Throttle(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		defer srv.ST.L.Sync() // nolint
+
+		ip := clientIP(r)
+		id := r.Header.Get(IDHeader)
+		if srv.lockedOut(w, r, lockout.KindIP, ip) {
+			return
+		}
+		if len(id) != 0 && srv.lockedOut(w, r, lockout.KindUser, id) {
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		switch ww.Status() {
+		case http.StatusUnauthorized:
+			srv.fail(ctx, lockout.KindIP, ip)
+			if len(id) != 0 {
+				srv.fail(ctx, lockout.KindUser, id)
+			}
+		case http.StatusOK:
+			if len(id) != 0 {
+				srv.succeed(ctx, id)
+			}
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+// ClearUserLockout lets a locked out user try again at once
+// only managers can clear a lockout; see readManagedUser
+func (srv Instance) ClearUserLockout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if session.User.ID == chi.URLParam(r, IDParam) {
+		http.Error(w, "cannot clear own lockout", http.StatusForbidden)
+		return
+	}
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := lockout.Clear(ctx, srv.ST.Master, lockout.KindUser, u.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "no failed attempts", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("clear lockout",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ClearIPLockout lets a locked out client ip try again at once
+func (srv Instance) ClearIPLockout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	ip := chi.URLParam(r, IPParam)
+	if len(ip) == 0 {
+		panic("ip missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	if !can(role, ActionClearIPLockout) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	err := lockout.Clear(ctx, srv.ST.Master, lockout.KindIP, ip)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "no failed attempts", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("clear lockout",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// randomIP is a client ip no other test uses, so lockouts stay apart
+func randomIP() string {
+	return fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256))
+}
+
+func (s *UserSuite) TestTokenLockout() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	threshold := s.srv.ST.UserLockout.Threshold
+
+	// known and unknown users are refused alike, then locked out alike
+	unknown := uuid.NewString()
+	for i := 0; i < threshold; i++ {
+		resp, _, err := requestToken(s.c, s.ts.URL, u.ID, uuid.NewString(), fromIP(randomIP()))
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+		resp, _, err = requestToken(s.c, s.ts.URL, unknown, uuid.NewString(), fromIP(randomIP()))
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+	resp, _, err := requestToken(s.c, s.ts.URL, u.ID, u.APISecret, fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+	require.NotEmpty(s.T(), resp.Header.Get("Retry-After"))
+	resp, _, err = requestToken(s.c, s.ts.URL, unknown, uuid.NewString(), fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+
+	// root clears the lockout
+	lockoutURL := s.ts.URL + UserRoute + "/" + u.ID + LockoutPath
+	resp, _, err = authedDo(s.c, http.MethodDelete, lockoutURL, s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, u.APISecret, fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// a success forgets earlier failures
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, uuid.NewString(), fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, u.APISecret, fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, lockoutURL, s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// users cannot clear their own lockout
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodDelete, lockoutURL, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
+
+func (s *UserSuite) TestIPLockout() {
+	s.srv.ST.IPLockout.Threshold = 3
+	ip := randomIP()
+	for i := 0; i < 3; i++ {
+		resp, _, err := requestToken(s.c, s.ts.URL, uuid.NewString(), uuid.NewString(), fromIP(ip))
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// every user is refused from the ip, but not from others
+	resp, _, err := requestToken(s.c, s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret, fromIP(ip))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret, fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// only root clears an ip
+	lockoutURL := s.ts.URL + APIPath + LockoutPath + "/" + ip
+	_, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodDelete, lockoutURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, lockoutURL, s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret, fromIP(ip))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *UserSuite) TestLoginLockout() {
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, derived)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	threshold := s.srv.ST.UserLockout.Threshold
+
+	// known and unknown emails are refused alike, then locked out alike
+	unknown := uuid.NewString()
+	for i := 0; i < threshold; i++ {
+		resp, _ := s.login(LoginMsg{Org: o.ID, Email: u.Email, Password: uuid.NewString()})
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+		resp, _ = s.login(LoginMsg{Org: o.ID, Email: unknown, Password: uuid.NewString()})
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+	resp, _ := s.login(LoginMsg{Org: o.ID, Email: u.Email, Password: password})
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+	resp, _ = s.login(LoginMsg{Org: o.ID, Email: unknown, Password: uuid.NewString()})
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+
+	// the lockout is shared with token requests
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, u.APISecret, fromIP(randomIP()))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, s.ts.URL+UserRoute+"/"+u.ID+LockoutPath, s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _ = s.login(LoginMsg{Org: o.ID, Email: u.Email, Password: password})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
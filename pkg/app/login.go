@@ -0,0 +1,191 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/lockout"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/totp"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// LoginMsg is what a client should marshal to send as a json body to Login
+// the org is identified by either Org (id) or OrgName
+// Scope optionally requests a subset of the allowed scopes, space separated
+type LoginMsg struct {
+	Org      string `json:"org,omitempty"`
+	OrgName  string `json:"org_name,omitempty"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// LoginResponse is the token issued by Login, along with the ids
+// the client needs for the IDHeader in later requests
+type LoginResponse struct {
+	ID  string `json:"id"`
+	Org string `json:"org"`
+	Token
+}
+
+// errLoginFailed is the single response for any credential mismatch,
+// so callers cannot probe for orgs or emails
+const errLoginFailed = "login failed"
+
+// Login verifies an email and password and returns a new JWT
+// users enrolled in two-factor auth instead get a LoginChallenge, and
+// members of orgs that require it must enroll first, using a token
+// from their api secret
+func (srv *Instance) Login(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m LoginMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || (len(m.Org) == 0) == (len(m.OrgName) == 0) ||
+		len(m.Email) == 0 || len(m.Password) == 0 {
+		http.Error(w, "malformed login", http.StatusBadRequest)
+		return
+	}
+
+	var o *org.Instance
+	if len(m.Org) != 0 {
+		o, err = org.Read(ctx, srv.ST.RandomReplica(), m.Org)
+	} else {
+		o, err = org.ReadByName(ctx, srv.ST.RandomReplica(), m.OrgName)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			srv.loginFailed(w, r, m)
+			return
+		}
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := user.ReadByEmail(ctx, srv.ST.RandomReplica(), srv.ST.Key, o.ID, m.Email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			srv.loginFailed(w, r, m)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if srv.lockedOut(w, r, lockout.KindUser, u.ID) {
+		return
+	}
+	verified, err := security.VerifyPassword(m.Password, u.Password)
+	if err != nil {
+		sugar.Debugw("verify password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		srv.fail(ctx, lockout.KindUser, u.ID)
+		http.Error(w, errLoginFailed, http.StatusUnauthorized)
+		return
+	}
+
+	// statuses are only reported to callers who know the password
+	if u.Meta.Status != models.StatusActive {
+		http.Error(w, "user not active", http.StatusForbidden)
+		return
+	}
+	if o.Meta.Status != models.StatusActive {
+		http.Error(w, "org not active", http.StatusForbidden)
+		return
+	}
+
+	scopes, err := grantScopes(allowedScopes(srv.roleFor(*o, *u)), jwt.SplitScopes(m.Scope))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	enabled, err := totp.Enabled(ctx, srv.ST.Master, u.ID)
+	if err != nil {
+		sugar.Debugw("read totp",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		srv.challenge(w, r, *o, *u, scopes)
+		return
+	}
+	if o.Require2FA {
+		http.Error(w, "two-factor enrollment required", http.StatusForbidden)
+		return
+	}
+
+	tok, err := srv.issueToken(ctx, *u, scopes)
+	if err != nil {
+		sugar.Debugw("issue token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.succeed(ctx, u.ID)
+
+	bs, err := json.Marshal(LoginResponse{ID: u.ID, Org: o.ID, Token: *tok})
+	if err != nil {
+		sugar.Debugw("marshal login response",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// loginFailed refuses a login for an unknown org or email
+// failures are counted against the login given, so these lock out just
+// as known users do; the password is still verified, against a dummy,
+// so the response takes as long as for a known user
+func (srv *Instance) loginFailed(w http.ResponseWriter, r *http.Request, m LoginMsg) {
+	key := m.Org + m.OrgName + "/" + m.Email
+	if srv.lockedOut(w, r, lockout.KindUser, key) {
+		return
+	}
+	_, err := security.VerifyPassword(m.Password, srv.dummyPassword)
+	if err != nil {
+		srv.ST.L.Sugar().Debugw("verify password",
+			"reqid", middleware.GetReqID(r.Context()),
+			"err", err)
+	}
+	srv.fail(r.Context(), lockout.KindUser, key)
+	http.Error(w, errLoginFailed, http.StatusUnauthorized)
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// login posts m to the login endpoint
+func (s *UserSuite) login(m LoginMsg) (*http.Response, *LoginResponse) {
+	bs, err := json.Marshal(m)
+	require.Nil(s.T(), err)
+	resp, err := s.c.Post(s.ts.URL+LoginRoute, "application/json", bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	var l LoginResponse
+	err = json.NewDecoder(resp.Body).Decode(&l)
+	require.Nil(s.T(), err)
+	return resp, &l
+}
+
+func (s *UserSuite) TestLogin() {
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), email, o.ID, derived)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	// by org id and by org name
+	resp, l := s.login(LoginMsg{Org: o.ID, Email: email, Password: password})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), u.ID, l.ID)
+	require.Equal(s.T(), o.ID, l.Org)
+	require.NotEmpty(s.T(), l.Bearer)
+	resp, l = s.login(LoginMsg{OrgName: o.Name, Email: email, Password: password})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// the token works like one from NewToken
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, &l.Token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// malformed
+	resp, _ = s.login(LoginMsg{Email: email, Password: password})
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _ = s.login(LoginMsg{Org: o.ID, OrgName: o.Name, Email: email, Password: password})
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _ = s.login(LoginMsg{Org: o.ID, Email: email})
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// wrong org, email or password all look the same
+	for _, m := range []LoginMsg{
+		{Org: uuid.NewString(), Email: email, Password: password},
+		{OrgName: uuid.NewString(), Email: email, Password: password},
+		{Org: s.srv.ST.RootOrg, Email: email, Password: password},
+		{Org: o.ID, Email: uuid.NewString(), Password: password},
+		{Org: o.ID, Email: email, Password: uuid.NewString()},
+	} {
+		resp, _ = s.login(m)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+	// and take as long: unknown users are verified against a dummy
+	// derived with the same algorithm, version and cost
+	params := func(derived string) []string { return strings.Split(derived, "$")[:4] }
+	require.Equal(s.T(), params(derived), params(s.srv.dummyPassword))
+	verified, err := security.VerifyPassword(password, s.srv.dummyPassword)
+	require.Nil(s.T(), err)
+	require.False(s.T(), verified)
+
+	// inactive user, then inactive org
+	err = u.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusInactive)
+	require.Nil(s.T(), err)
+	resp, _ = s.login(LoginMsg{Org: o.ID, Email: email, Password: password})
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	err = u.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusActive)
+	require.Nil(s.T(), err)
+	oRead, err := org.Read(s.ctx, s.srv.ST.Master, o.ID)
+	require.Nil(s.T(), err)
+	err = oRead.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusInactive)
+	require.Nil(s.T(), err)
+	resp, _ = s.login(LoginMsg{Org: o.ID, Email: email, Password: password})
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
@@ -31,3 +31,28 @@ func (m *UpdateStatusMsg) UnmarshalJSON(bs []byte) error {
 	m.Status = s
 	return nil
 }
+
+// UpdateRoleMsg is what a client should marshal to send as a json body to
+// role update endpoints
+type UpdateRoleMsg struct {
+	Role models.Role `json:"role"`
+}
+
+// UnmarshalJSON is a custom unmarshal for UpdateRoleMsg
+func (m *UpdateRoleMsg) UnmarshalJSON(bs []byte) error {
+	var t map[string]int
+	err := json.Unmarshal(bs, &t)
+	if err != nil {
+		return err
+	}
+	v, ok := t["role"]
+	if !ok {
+		return errors.New("no role field found")
+	}
+	r, err := models.NewRole(v)
+	if err != nil {
+		return err
+	}
+	m.Role = r
+	return nil
+}
@@ -51,6 +51,17 @@ func (s *MsgSuite) TestUnmarshalUpdateMsg() {
 	}
 }
 
+func (s *MsgSuite) TestUnmarshalRoleMsg() {
+	var m UpdateRoleMsg
+	err := m.UnmarshalJSON([]byte(`{"role":-1}`))
+	require.Error(s.T(), err)
+	err = m.UnmarshalJSON([]byte(`{"status":1}`))
+	require.Error(s.T(), err)
+	err = m.UnmarshalJSON([]byte(`{"role":2}`))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.RoleAdmin, m.Role)
+}
+
 func TestMsgSuite(t *testing.T) {
 	suite.Run(t, new(MsgSuite))
 }
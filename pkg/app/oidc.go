@@ -0,0 +1,652 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/idp"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/oidc"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// OIDCConfigMsg is the body format for UpdateOIDCConfig
+type OIDCConfigMsg struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// OIDCLoginMsg is what a client should marshal to send as a json body to OIDCLogin
+// the org is identified by either Org (id) or OrgName; RedirectURI is
+// where the identity provider returns the user, and must be registered
+// with it; Scope optionally requests a subset of the allowed scopes
+type OIDCLoginMsg struct {
+	Org         string `json:"org,omitempty"`
+	OrgName     string `json:"org_name,omitempty"`
+	RedirectURI string `json:"redirect_uri"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// OIDCAuthorization is returned by OIDCLogin; the client sends the user
+// to URL, and passes the state and code returned to its redirect uri
+// to OIDCCallback before Expires
+type OIDCAuthorization struct {
+	URL     string `json:"url"`
+	State   string `json:"state"`
+	Expires int64  `json:"expires"`
+}
+
+// OIDCLinkMsg is what a client should marshal to send as a json body to
+// LinkOIDC; RedirectURI is as for OIDCLoginMsg
+type OIDCLinkMsg struct {
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// OIDCCallbackMsg is what a client should marshal to send as a json body to OIDCCallback
+type OIDCCallbackMsg struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+// errOIDCFailed is the single response for any failed federated login
+const errOIDCFailed = "oidc login failed"
+
+// errOIDCUnlinked is the response to a sign in with an identity whose
+// email is an existing account's, which must link the identity first
+const errOIDCUnlinked = "account exists; link it to the identity provider first"
+
+// oidcOrg is the org in the url if the caller can configure its identity
+// provider, otherwise the error response is written and ok is false
+func (srv Instance) oidcOrg(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ctx := r.Context()
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if !can(role, ActionConfigureOIDC) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return "", false
+	}
+	if role != models.RoleRoot && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return "", false
+	}
+	// root users sign in with api secrets only
+	if id == srv.ST.RootOrg {
+		http.Error(w, "cannot federate root org", http.StatusForbidden)
+		return "", false
+	}
+	return id, true
+}
+
+// UpdateOIDCConfig sets the org's identity provider, replacing any set before
+// the issuer must serve a discovery document naming itself
+func (srv Instance) UpdateOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id, ok := srv.oidcOrg(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m OIDCConfigMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.Issuer) == 0 || len(m.ClientID) == 0 || len(m.ClientSecret) == 0 {
+		http.Error(w, "malformed oidc config", http.StatusBadRequest)
+		return
+	}
+	c, err := idp.NewConfig(id, m.Issuer, m.ClientID, m.ClientSecret)
+	if err == oidc.ErrIssuer {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "malformed oidc config args", http.StatusBadRequest)
+		return
+	}
+
+	_, err = oidc.Discover(ctx, srv.ST.IdPClient, c.Issuer)
+	if err != nil {
+		sugar.Infow("discover identity provider",
+			"reqid", middleware.GetReqID(ctx),
+			"issuer", c.Issuer,
+			"err", err)
+		http.Error(w, "identity provider discovery failed", http.StatusBadRequest)
+		return
+	}
+
+	err = c.Save(ctx, srv.ST.Master, srv.ST.Key)
+	if err != nil {
+		if err == models.ErrRelatedOrg {
+			http.Error(w, "org not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("save oidc config",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReadOIDCConfig returns the org's identity provider, without the client secret
+func (srv Instance) ReadOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id, ok := srv.oidcOrg(w, r)
+	if !ok {
+		return
+	}
+	c, err := idp.ReadConfig(ctx, srv.ST.RandomReplica(), srv.ST.Key, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "oidc not configured", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read oidc config",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	bs, err := json.Marshal(c)
+	if err != nil {
+		sugar.Debugw("marshal oidc config",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// DeleteOIDCConfig removes the org's identity provider; users it
+// provisioned keep their accounts, but cannot sign in until given a
+// password or api secret
+func (srv Instance) DeleteOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id, ok := srv.oidcOrg(w, r)
+	if !ok {
+		return
+	}
+	err := idp.DeleteConfig(ctx, srv.ST.Master, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "oidc not configured", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("delete oidc config",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OIDCLogin starts a sign in with the org's identity provider, using
+// the authorization code flow with PKCE
+func (srv Instance) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m OIDCLoginMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || (len(m.Org) == 0) == (len(m.OrgName) == 0) || len(m.RedirectURI) == 0 {
+		http.Error(w, "malformed oidc login", http.StatusBadRequest)
+		return
+	}
+
+	var o *org.Instance
+	if len(m.Org) != 0 {
+		o, err = org.Read(ctx, srv.ST.RandomReplica(), m.Org)
+	} else {
+		o, err = org.ReadByName(ctx, srv.ST.RandomReplica(), m.OrgName)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "oidc not configured", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.startOIDCFlow(w, r, *o, "", m.RedirectURI, m.Scope)
+}
+
+// LinkOIDC starts linking the caller to an identity at their org's
+// identity provider; once OIDCCallback completes it, signing in with
+// that identity signs in as the caller
+// an existing account is only ever reached through its own link, as an
+// identity provider may release any email
+func (srv Instance) LinkOIDC(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if session.User.ID != id {
+		http.Error(w, "users only link themselves", http.StatusForbidden)
+		return
+	}
+	if session.User.Service {
+		http.Error(w, errServiceCredentials, http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m OIDCLinkMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.RedirectURI) == 0 {
+		http.Error(w, "malformed oidc link", http.StatusBadRequest)
+		return
+	}
+	srv.startOIDCFlow(w, r, session.Org, session.User.ID, m.RedirectURI, "")
+}
+
+// startOIDCFlow starts a flow with the identity provider of o, for
+// link or for a sign in if link is empty, writing the OIDCAuthorization
+func (srv Instance) startOIDCFlow(w http.ResponseWriter, r *http.Request, o org.Instance, link, redirectURI, scope string) {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	redirect, err := url.Parse(redirectURI)
+	if err != nil || !redirect.IsAbs() || len(redirect.Fragment) != 0 {
+		http.Error(w, "malformed redirect uri", http.StatusBadRequest)
+		return
+	}
+	c, err := idp.ReadConfig(ctx, srv.ST.RandomReplica(), srv.ST.Key, o.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "oidc not configured", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read oidc config",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if o.Meta.Status != models.StatusActive {
+		http.Error(w, "org not active", http.StatusForbidden)
+		return
+	}
+
+	p, err := oidc.Discover(ctx, srv.ST.IdPClient, c.Issuer)
+	if err != nil {
+		sugar.Infow("discover identity provider",
+			"reqid", middleware.GetReqID(ctx),
+			"issuer", c.Issuer,
+			"err", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(srv.ST.OIDCFlowExpiration).Unix()
+	f, err := idp.StartFlow(ctx, srv.ST.Master, srv.ST.Key, o.ID, link, redirectURI, scope, expires)
+	if err != nil {
+		sugar.Debugw("start oidc flow",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// abandoned flows are only clutter, so failing to prune is not fatal
+	_, err = idp.PruneFlows(ctx, srv.ST.Master, now.Unix())
+	if err != nil {
+		sugar.Debugw("prune oidc flows",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+
+	bs, err := json.Marshal(OIDCAuthorization{
+		URL:     p.AuthURL(c.ClientID, f.RedirectURI, f.State, f.Nonce, f.Verifier),
+		State:   f.State,
+		Expires: f.Expires,
+	})
+	if err != nil {
+		sugar.Debugw("marshal oidc authorization",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// OIDCCallback completes a sign in started by OIDCLogin, returning a
+// new JWT as Login does
+// the code is redeemed with the PKCE verifier, and the id token must be
+// for the flow's nonce and carry a verified email; see federatedUser for
+// the user it signs in as
+// the identity provider is trusted to apply its own second factor, so
+// TOTP enrollment is not checked
+func (srv Instance) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m OIDCCallbackMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.State) == 0 || len(m.Code) == 0 {
+		http.Error(w, "malformed oidc callback", http.StatusBadRequest)
+		return
+	}
+
+	// the flow is spent whatever the outcome, so a code is tried once
+	now := time.Now()
+	f, err := idp.TakeFlow(ctx, srv.ST.Master, srv.ST.Key, m.State, now.Unix())
+	if err != nil {
+		if err == sql.ErrNoRows || err == idp.ErrExpired {
+			http.Error(w, errOIDCFailed, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("take oidc flow",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	c, err := idp.ReadConfig(ctx, srv.ST.Master, srv.ST.Key, f.Org)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// removed since the flow started
+			http.Error(w, errOIDCFailed, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read oidc config",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	p, err := oidc.Discover(ctx, srv.ST.IdPClient, c.Issuer)
+	if err != nil {
+		sugar.Infow("discover identity provider",
+			"reqid", middleware.GetReqID(ctx),
+			"issuer", c.Issuer,
+			"err", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	idToken, err := p.Exchange(ctx, srv.ST.IdPClient, c.ClientID, c.ClientSecret, f.RedirectURI, m.Code, f.Verifier)
+	if err != nil {
+		sugar.Infow("exchange oidc code",
+			"reqid", middleware.GetReqID(ctx),
+			"issuer", c.Issuer,
+			"err", err)
+		http.Error(w, errOIDCFailed, http.StatusUnauthorized)
+		return
+	}
+	keys, err := p.Keys(ctx, srv.ST.IdPClient)
+	if err != nil {
+		sugar.Infow("read identity provider keys",
+			"reqid", middleware.GetReqID(ctx),
+			"issuer", c.Issuer,
+			"err", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	claims, err := oidc.Verify(idToken, keys, c.Issuer, c.ClientID, f.Nonce, now)
+	if err != nil {
+		sugar.Infow("verify id token",
+			"reqid", middleware.GetReqID(ctx),
+			"issuer", c.Issuer,
+			"err", err)
+		http.Error(w, errOIDCFailed, http.StatusUnauthorized)
+		return
+	}
+	// emails identify users within an org, so only a verified one is used
+	if len(claims.Email) == 0 || !claims.EmailVerified {
+		http.Error(w, "verified email required", http.StatusForbidden)
+		return
+	}
+
+	o, err := org.Read(ctx, srv.ST.Master, f.Org)
+	if err != nil {
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if o.Meta.Status != models.StatusActive {
+		http.Error(w, "org not active", http.StatusForbidden)
+		return
+	}
+
+	u, ok := srv.federatedUser(w, r, o.ID, f.Link, claims)
+	if !ok {
+		return
+	}
+	if u.Meta.Status != models.StatusActive {
+		http.Error(w, "user not active", http.StatusForbidden)
+		return
+	}
+
+	scopes, err := grantScopes(allowedScopes(srv.roleFor(*o, *u)), jwt.SplitScopes(f.Scope))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	tok, err := srv.issueToken(ctx, *u, scopes)
+	if err != nil {
+		sugar.Debugw("issue token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(LoginResponse{ID: u.ID, Org: o.ID, Token: *tok})
+	if err != nil {
+		sugar.Debugw("marshal login response",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// federatedUser returns the user in org the identity in claims is linked
+// to, linking it to link if set, writing the error response if it cannot
+// an identity linked to no one, with an email no user in org has, is
+// linked to a new active user; one whose email is taken is refused, as
+// only the account's own user may link it, with LinkOIDC
+// a created user has a random password, so it signs in through the
+// identity provider until it sets one
+func (srv Instance) federatedUser(w http.ResponseWriter, r *http.Request, org, link string, claims *oidc.IDClaims) (*user.Instance, bool) {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	id, err := idp.LinkedUser(ctx, srv.ST.Master, org, claims.Issuer, claims.Subject)
+	switch {
+	case err == nil:
+		if len(link) != 0 && link != id {
+			http.Error(w, "identity linked to another user", http.StatusConflict)
+			return nil, false
+		}
+		return srv.readFederatedUser(w, r, id)
+	case err != sql.ErrNoRows:
+		sugar.Debugw("read linked user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	case len(link) != 0:
+		return srv.linkFederatedUser(w, r, org, link, claims)
+	}
+
+	_, err = user.ReadByEmail(ctx, srv.ST.Master, srv.ST.Key, org, claims.Email)
+	if err == nil {
+		http.Error(w, errOIDCUnlinked, http.StatusConflict)
+		return nil, false
+	}
+	if err != sql.ErrNoRows {
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	password, err := security.RandomToken(idp.TokenLen)
+	if err != nil {
+		sugar.Debugw("random password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	derived, err := security.DerivePassword(password, srv.ST.Argon2Cfg)
+	if err != nil {
+		sugar.Debugw("derive password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	displayName := claims.Name
+	if len(displayName) == 0 {
+		displayName = claims.Email
+	}
+	u, err := user.New(displayName, claims.Email, org, derived)
+	if err != nil {
+		http.Error(w, "malformed user args", http.StatusBadRequest)
+		return nil, false
+	}
+	// the identity provider verified the email
+	u.Meta.Status = models.StatusActive
+
+	err = u.Insert(ctx, srv.ST.Master, srv.ST.Key)
+	if err == models.ErrConflict {
+		// the email was taken meanwhile
+		http.Error(w, errOIDCUnlinked, http.StatusConflict)
+		return nil, false
+	}
+	if err != nil {
+		sugar.Debugw("provision user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return srv.linkFederatedUser(w, r, org, u.ID, claims)
+}
+
+// linkFederatedUser links the identity in claims to the user id in org,
+// returning the user
+func (srv Instance) linkFederatedUser(w http.ResponseWriter, r *http.Request, org, id string, claims *oidc.IDClaims) (*user.Instance, bool) {
+	ctx := r.Context()
+	err := idp.Link(ctx, srv.ST.Master, org, claims.Issuer, claims.Subject, id)
+	if err == models.ErrConflict {
+		// linked by a concurrent sign in
+		http.Error(w, "identity linked to another user", http.StatusConflict)
+		return nil, false
+	}
+	if err != nil {
+		srv.ST.L.Sugar().Debugw("link identity",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return srv.readFederatedUser(w, r, id)
+}
+
+// readFederatedUser reads the user id an identity is linked to
+func (srv Instance) readFederatedUser(w http.ResponseWriter, r *http.Request, id string) (*user.Instance, bool) {
+	ctx := r.Context()
+	u, err := user.Read(ctx, srv.ST.Master, srv.ST.Key, id)
+	if err != nil {
+		srv.ST.L.Sugar().Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return u, true
+}
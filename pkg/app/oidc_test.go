@@ -0,0 +1,260 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/idp"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/oidc"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// oidcPost posts m as json to route from a random client ip
+func (s *UserSuite) oidcPost(route string, m interface{}) (*http.Response, []byte) {
+	bs, err := json.Marshal(m)
+	require.Nil(s.T(), err)
+	req, err := http.NewRequest(http.MethodPost, s.ts.URL+route, bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	req.Header.Add("X-Real-IP", randomIP())
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	defer resp.Body.Close()
+	var body bytes.Buffer
+	_, err = body.ReadFrom(resp.Body)
+	require.Nil(s.T(), err)
+	return resp, body.Bytes()
+}
+
+// authorize starts an oidc login for org and follows it through the
+// mock provider, returning the state and code sent to the redirect uri
+func (s *UserSuite) authorize(org string) (string, string) {
+	resp, body := s.oidcPost(OIDCLoginRoute, OIDCLoginMsg{Org: org, RedirectURI: "https://app.example.com/callback"})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	return s.followAuthorization(body)
+}
+
+// authorizeLink starts linking id to an identity and follows it through
+// the mock provider, as authorize
+func (s *UserSuite) authorizeLink(id string, tok *Token) (string, string) {
+	resp, body, err := authedDo(s.c, http.MethodPost, s.ts.URL+UserRoute+"/"+id+OIDCPath, id, tok,
+		OIDCLinkMsg{RedirectURI: "https://app.example.com/callback"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	return s.followAuthorization(body)
+}
+
+// followAuthorization follows the OIDCAuthorization in body through the
+// mock provider, returning the state and code sent to the redirect uri
+func (s *UserSuite) followAuthorization(body []byte) (string, string) {
+	var a OIDCAuthorization
+	require.Nil(s.T(), json.Unmarshal(body, &a))
+
+	// the redirect back is read, not followed, and the provider is
+	// reached the way the app reaches it
+	c := *s.srv.ST.IdPClient
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := c.Get(a.URL)
+	require.Nil(s.T(), err)
+	resp.Body.Close()
+	require.Equal(s.T(), http.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("location"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), a.State, location.Query().Get("state"))
+	return a.State, location.Query().Get("code")
+}
+
+func (s *UserSuite) TestOIDC() {
+	mock, err := oidc.NewMockIdP()
+	require.Nil(s.T(), err)
+	defer mock.Close()
+	s.srv.ST.IdPClient = mock.Client()
+
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	oidcURL := s.ts.URL + OrgRoute + "/" + o.ID + OIDCPath
+
+	// nothing to sign in with until configured
+	resp, _ := s.oidcPost(OIDCLoginRoute, OIDCLoginMsg{Org: o.ID, RedirectURI: "https://app.example.com/callback"})
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// members cannot configure the provider, and the issuer must be discoverable
+	member, memberTok := s.newMember(o.ID, models.RoleAdmin)
+	config := OIDCConfigMsg{Issuer: mock.Issuer(), ClientID: mock.ClientID, ClientSecret: mock.ClientSecret}
+	resp, _, err = authedDo(s.c, http.MethodPut, oidcURL, member.ID, memberTok, config)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, oidcURL, owner.ID, tok,
+		OIDCConfigMsg{Issuer: mock.Issuer() + "/other", ClientID: mock.ClientID, ClientSecret: mock.ClientSecret})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, oidcURL, owner.ID, tok,
+		OIDCConfigMsg{Issuer: "https://169.254.169.254", ClientID: mock.ClientID, ClientSecret: mock.ClientSecret})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, oidcURL, owner.ID, tok, config)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// the client secret is not returned
+	resp, body, err := authedDo(s.c, http.MethodGet, oidcURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var c map[string]interface{}
+	require.Nil(s.T(), json.Unmarshal(body, &c))
+	require.Equal(s.T(), mock.Issuer(), c["issuer"])
+	require.Equal(s.T(), mock.ClientID, c["client_id"])
+	require.NotContains(s.T(), string(body), mock.ClientSecret)
+
+	// the first sign in provisions an active user
+	email := uuid.NewString()
+	mock.SignIn(oidc.Identity{Subject: uuid.NewString(), Email: email, EmailVerified: true, Name: uuid.NewString()})
+	state, code := s.authorize(o.ID)
+	resp, body = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var l LoginResponse
+	require.Nil(s.T(), json.Unmarshal(body, &l))
+	require.Equal(s.T(), o.ID, l.Org)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+l.ID, l.ID, &l.Token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	u, err := user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, l.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), email, u.Email)
+	require.Equal(s.T(), models.StatusActive, u.Meta.Status)
+
+	// the flow is spent
+	resp, _ = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// later sign ins find the same user
+	state, code = s.authorize(o.ID)
+	resp, body = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var again LoginResponse
+	require.Nil(s.T(), json.Unmarshal(body, &again))
+	require.Equal(s.T(), l.ID, again.ID)
+
+	// a code not issued for the flow is refused
+	state, _ = s.authorize(o.ID)
+	resp, _ = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: uuid.NewString()})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// unverified emails are not provisioned
+	mock.SignIn(oidc.Identity{Subject: uuid.NewString(), Email: uuid.NewString()})
+	state, code = s.authorize(o.ID)
+	resp, _ = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// removing the config ends federated sign in, including flows under way
+	mock.SignIn(oidc.Identity{Subject: uuid.NewString(), Email: email, EmailVerified: true})
+	state, code = s.authorize(o.ID)
+	resp, _, err = authedDo(s.c, http.MethodDelete, oidcURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _ = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, oidcURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *UserSuite) TestOIDCExpiredFlow() {
+	mock, err := oidc.NewMockIdP()
+	require.Nil(s.T(), err)
+	defer mock.Close()
+	s.srv.ST.IdPClient = mock.Client()
+
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	c, err := idp.NewConfig(o.ID, mock.Issuer(), mock.ClientID, mock.ClientSecret)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), c.Save(s.ctx, s.srv.ST.Master, s.srv.ST.Key))
+
+	mock.SignIn(oidc.Identity{Subject: uuid.NewString(), Email: uuid.NewString(), EmailVerified: true})
+	s.srv.ST.OIDCFlowExpiration = -time.Minute
+	state, code := s.authorize(o.ID)
+	resp, _ := s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
+
+// oidcLogin completes an oidc login to org as the mock's identity
+func (s *UserSuite) oidcLogin(org string) (*http.Response, *LoginResponse) {
+	state, code := s.authorize(org)
+	resp, body := s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	var l LoginResponse
+	require.Nil(s.T(), json.Unmarshal(body, &l))
+	return resp, &l
+}
+
+func (s *UserSuite) TestOIDCLink() {
+	mock, err := oidc.NewMockIdP()
+	require.Nil(s.T(), err)
+	defer mock.Close()
+	s.srv.ST.IdPClient = mock.Client()
+
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	ownerTok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	c, err := idp.NewConfig(o.ID, mock.Issuer(), mock.ClientID, mock.ClientSecret)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), c.Save(s.ctx, s.srv.ST.Master, s.srv.ST.Key))
+
+	// an identity with an existing account's email does not sign in as it
+	subject := uuid.NewString()
+	mock.SignIn(oidc.Identity{Subject: subject, Email: owner.Email, EmailVerified: true})
+	resp, _ := s.oidcLogin(o.ID)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+
+	// until the account links it
+	member, memberTok := s.newMember(o.ID, models.RoleMember)
+	resp, _, err = authedDo(s.c, http.MethodPost, s.ts.URL+UserRoute+"/"+owner.ID+OIDCPath, member.ID, memberTok,
+		OIDCLinkMsg{RedirectURI: "https://app.example.com/callback"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	state, code := s.authorizeLink(owner.ID, ownerTok)
+	resp, body := s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var l LoginResponse
+	require.Nil(s.T(), json.Unmarshal(body, &l))
+	require.Equal(s.T(), owner.ID, l.ID)
+
+	// then it signs in as the account, by subject, whatever the email
+	mock.SignIn(oidc.Identity{Subject: subject, Email: uuid.NewString(), EmailVerified: true})
+	resp, ol := s.oidcLogin(o.ID)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), owner.ID, ol.ID)
+
+	// and cannot be linked to another account
+	state, code = s.authorizeLink(member.ID, memberTok)
+	resp, _ = s.oidcPost(OIDCCallbackRoute, OIDCCallbackMsg{State: state, Code: code})
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+
+	// a provisioned user is reached by subject too, and its email is
+	// not open to another identity
+	provisioned, email := uuid.NewString(), uuid.NewString()
+	mock.SignIn(oidc.Identity{Subject: provisioned, Email: email, EmailVerified: true})
+	resp, pl := s.oidcLogin(o.ID)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	mock.SignIn(oidc.Identity{Subject: provisioned, Email: uuid.NewString(), EmailVerified: true})
+	resp, again := s.oidcLogin(o.ID)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), pl.ID, again.ID)
+	mock.SignIn(oidc.Identity{Subject: uuid.NewString(), Email: email, EmailVerified: true})
+	resp, _ = s.oidcLogin(o.ID)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+}
@@ -6,11 +6,13 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/grokloc/grokloc-go/pkg/models"
 	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
 )
 
 // CreateOrgMsg is what a client should marshal to send as a json body to CreateOrg
@@ -44,12 +46,11 @@ func (srv Instance) CreateOrg(w http.ResponseWriter, r *http.Request) {
 	defer srv.ST.L.Sync() // nolint
 	sugar := srv.ST.L.Sugar()
 
-	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
 	if !ok {
-		panic("auth missing")
+		panic("role missing")
 	}
-	// only root can create an org
-	if authLevel != AuthRoot {
+	if !can(role, ActionManageOrgs) {
 		http.Error(w, "auth inadequate", http.StatusForbidden)
 		return
 	}
@@ -104,9 +105,9 @@ func (srv Instance) ReadOrg(w http.ResponseWriter, r *http.Request) {
 		panic("id missing")
 	}
 
-	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
 	if !ok {
-		panic("auth missing")
+		panic("role missing")
 	}
 
 	var o *org.Instance
@@ -114,7 +115,7 @@ func (srv Instance) ReadOrg(w http.ResponseWriter, r *http.Request) {
 
 	// if root is the caller, the context org is the root org,
 	// so read the requested org
-	if authLevel == AuthRoot {
+	if can(role, ActionManageOrgs) {
 		o, err = org.Read(ctx, srv.ST.RandomReplica(), id)
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -128,7 +129,7 @@ func (srv Instance) ReadOrg(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		// otherwise, a regular user or org owner
+		// otherwise, a member of some role in their own org
 		// if caller is not root, it can only read its own org
 		// (which is in context)
 		session, ok := ctx.Value(sessionCtxKey).(Session)
@@ -168,12 +169,11 @@ func (srv Instance) UpdateOrg(w http.ResponseWriter, r *http.Request) {
 		panic("id missing")
 	}
 
-	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
 	if !ok {
-		panic("auth missing")
+		panic("role missing")
 	}
-	// only root can change the org owner
-	if authLevel != AuthRoot {
+	if !can(role, ActionManageOrgs) {
 		http.Error(w, "auth inadequate", http.StatusForbidden)
 		return
 	}
@@ -247,3 +247,169 @@ func (srv Instance) UpdateOrg(w http.ResponseWriter, r *http.Request) {
 	// no update formats matched
 	http.Error(w, "malformed update msg", http.StatusBadRequest)
 }
+
+// ownTransfer checks that the caller owns the org in the url, for the
+// nomination handlers below; it writes the error response and returns
+// false on failure
+func ownTransfer(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	ctx := r.Context()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	// root changes owners directly with UpdateOrg
+	if !can(role, ActionTransferOrg) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return session, false
+	}
+	if session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return session, false
+	}
+	return session, true
+}
+
+// NominateOrgOwner lets the org owner offer ownership to another
+// active member, who must accept with AcceptOrgOwner
+func (srv Instance) NominateOrgOwner(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ownTransfer(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m UpdateOrgOwnerMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		http.Error(w, "malformed nomination", http.StatusBadRequest)
+		return
+	}
+
+	o := session.Org
+	expires := time.Now().Add(srv.ST.OwnerTransferExpiration).Unix()
+	err = o.NominateOwner(ctx, srv.ST.Master, m.Owner, expires)
+	if err != nil {
+		if err == models.ErrDisallowedValue {
+			http.Error(w, "already the owner", http.StatusBadRequest)
+			return
+		}
+		if err == models.ErrRelatedUser {
+			http.Error(w, "prospective owner not in org", http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("nominate owner",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CancelOrgOwnerNomination lets the org owner withdraw a pending nomination
+func (srv Instance) CancelOrgOwnerNomination(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ownTransfer(w, r)
+	if !ok {
+		return
+	}
+
+	o := session.Org
+	err := o.CancelNomination(ctx, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("cancel nomination",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptOrgOwner lets a nominee accept ownership of their org
+// tokens held by the previous and the new owner are revoked
+func (srv Instance) AcceptOrgOwner(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return
+	}
+
+	o := session.Org
+	previous := o.Owner
+	err := o.AcceptOwner(ctx, srv.ST.Master, session.User.ID)
+	if err != nil {
+		if err == org.ErrNoNomination || err == models.ErrRelatedUser {
+			http.Error(w, "no pending nomination", http.StatusForbidden)
+			return
+		}
+		sugar.Debugw("accept owner",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// both parties must get tokens that reflect their new roles
+	nominee := session.User
+	err = nominee.RevokeTokens(ctx, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("revoke nominee tokens",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if previous != org.OwnerNone {
+		prev, err := user.Read(ctx, srv.ST.Master, srv.ST.Key, previous)
+		if err == nil {
+			err = prev.RevokeTokens(ctx, srv.ST.Master)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			sugar.Debugw("revoke previous owner tokens",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -51,7 +51,10 @@ func (s *OrgSuite) SetupTest() {
 		log.Fatal(err.Error())
 	}
 	req.Header.Add(IDHeader, s.srv.ST.RootUser)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(s.srv.ST.RootUser+s.srv.ST.RootUserAPISecret))
+	err = SignRequest(req, s.srv.ST.RootUserAPISecret, nil)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 	resp, err := s.c.Do(req)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -68,6 +71,12 @@ func (s *OrgSuite) SetupTest() {
 	s.token = &tok
 }
 
+func (s *OrgSuite) TearDownTest() {
+	s.ts.Close()
+	s.srv.Close()
+	require.Nil(s.T(), s.srv.ST.Close())
+}
+
 func (s *OrgSuite) TestCreateOrg() {
 	bs, err := json.Marshal(CreateOrgMsg{Name: uuid.NewString()})
 	require.Nil(s.T(), err)
@@ -103,7 +112,8 @@ func (s *OrgSuite) TestCreateOrgNotRoot() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -130,7 +140,8 @@ func (s *OrgSuite) TestReadOrg() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -176,7 +187,8 @@ func (s *OrgSuite) TestReadOtherOrg() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -249,7 +261,8 @@ func (s *OrgSuite) TestUpdateOrgForbidden() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -294,6 +307,87 @@ func (s *OrgSuite) TestUpdateOrgNotFound() {
 	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
 }
 
+func (s *OrgSuite) TestTransferOrgOwner() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	nominee, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	nominee.Meta.Status = models.StatusActive
+	err = nominee.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	transferURL := s.ts.URL + OrgRoute + "/" + o.ID + TransferPath
+	acceptURL := transferURL + AcceptPath
+
+	ownerTok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	nomineeTok, err := tokenFor(s.c, s.ts.URL, nominee.ID, nominee.APISecret)
+	require.Nil(s.T(), err)
+
+	// the nominee cannot nominate themselves, or accept before nomination
+	resp, _, err := authedDo(s.c, http.MethodPut, transferURL, nominee.ID, nomineeTok, UpdateOrgOwnerMsg{Owner: nominee.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, acceptURL, nominee.ID, nomineeTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// bad nominations
+	resp, _, err = authedDo(s.c, http.MethodPut, transferURL, owner.ID, ownerTok, UpdateOrgOwnerMsg{Owner: owner.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, transferURL, owner.ID, ownerTok, UpdateOrgOwnerMsg{Owner: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// nominate, cancel, nominate again
+	resp, _, err = authedDo(s.c, http.MethodPut, transferURL, owner.ID, ownerTok, UpdateOrgOwnerMsg{Owner: nominee.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, transferURL, owner.ID, ownerTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, acceptURL, nominee.ID, nomineeTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, transferURL, owner.ID, ownerTok, UpdateOrgOwnerMsg{Owner: nominee.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	oRead, err := org.Read(s.ctx, s.srv.ST.RandomReplica(), o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), owner.ID, oRead.Owner)
+	require.Equal(s.T(), nominee.ID, oRead.PendingOwner)
+
+	// accept
+	resp, _, err = authedDo(s.c, http.MethodPut, acceptURL, nominee.ID, nomineeTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	oRead, err = org.Read(s.ctx, s.srv.ST.RandomReplica(), o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), nominee.ID, oRead.Owner)
+	require.Equal(s.T(), "", oRead.PendingOwner)
+
+	// tokens held by both parties are revoked
+	readURL := s.ts.URL + OrgRoute + "/" + o.ID
+	resp, _, err = authedDo(s.c, http.MethodGet, readURL, owner.ID, ownerTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, readURL, nominee.ID, nomineeTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// new tokens reflect the new roles
+	ownerTok, err = tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	nomineeTok, err = tokenFor(s.c, s.ts.URL, nominee.ID, nominee.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodPut, transferURL, owner.ID, ownerTok, UpdateOrgOwnerMsg{Owner: owner.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, transferURL, nominee.ID, nomineeTok, UpdateOrgOwnerMsg{Owner: owner.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+}
+
 func TestOrgSuite(t *testing.T) {
 	suite.Run(t, new(OrgSuite))
 }
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models/setting"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// Org settings (int) that tighten the password policy for an org
+// they cannot loosen the policy set for the environment
+const (
+	SettingPasswordMinLength  = "password.min_length"
+	SettingPasswordMaxLength  = "password.max_length"
+	SettingPasswordMinClasses = "password.min_classes"
+)
+
+// PasswordErrorResponse is the body of a 400 response refusing a new
+// password, listing every rule it violates
+type PasswordErrorResponse struct {
+	Error      string                       `json:"error"`
+	Violations []security.PasswordViolation `json:"violations"`
+}
+
+// passwordPolicy is the environment password policy, tightened by settings
+func (srv Instance) passwordPolicy(settings setting.Map) security.PasswordPolicy {
+	return srv.ST.PasswordPolicy.Tighten(
+		int(settings.Int(SettingPasswordMinLength, 0)),
+		int(settings.Int(SettingPasswordMaxLength, 0)),
+		int(settings.Int(SettingPasswordMinClasses, 0)))
+}
+
+// checkPassword checks a new password for a user in org against the
+// policy, writing the error response and returning false if it is refused
+func (srv Instance) checkPassword(w http.ResponseWriter, r *http.Request, org, password string) bool {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	// the context settings, if any, are for the caller's org
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	settings := session.Settings
+	if !ok || session.Org.ID != org {
+		var err error
+		settings, err = setting.ReadAll(ctx, srv.ST.RandomReplica(), org)
+		if err != nil {
+			sugar.Debugw("read settings",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	violated := srv.passwordPolicy(settings).Check(password)
+	if violated == nil {
+		return true
+	}
+	bs, err := json.Marshal(PasswordErrorResponse{Error: "password violates policy", Violations: violated.Violations})
+	if err != nil {
+		sugar.Debugw("marshal password error",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/setting"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// createUser posts a new user in org with password as root
+func (s *UserSuite) createUser(org, password string) (*http.Response, []byte) {
+	resp, body, err := authedDo(s.c, http.MethodPost, s.ts.URL+UserRoute, s.srv.ST.RootUser, s.token, CreateUserMsg{
+		DisplayName: uuid.NewString(),
+		Email:       uuid.NewString(),
+		Org:         org,
+		Password:    password,
+	})
+	require.Nil(s.T(), err)
+	return resp, body
+}
+
+// violations reads the violations from a PasswordErrorResponse body
+func (s *UserSuite) violations(body []byte) []security.PasswordViolation {
+	var pe PasswordErrorResponse
+	err := json.Unmarshal(body, &pe)
+	require.Nil(s.T(), err)
+	return pe.Violations
+}
+
+func (s *UserSuite) TestPasswordPolicy() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	// every violation is listed
+	resp, body := s.createUser(o.ID, "a")
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), "application/json", resp.Header.Get("content-type"))
+	require.Equal(s.T(), []security.PasswordViolation{
+		{Rule: security.RuleMinLength, Limit: s.srv.ST.PasswordPolicy.MinLength},
+		{Rule: security.RuleMinClasses, Limit: s.srv.ST.PasswordPolicy.MinClasses},
+	}, s.violations(body))
+
+	// long enough, but breached
+	resp, body = s.createUser(o.ID, "Password123!")
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), []security.PasswordViolation{{Rule: security.RuleBreached}}, s.violations(body))
+	resp, _ = s.createUser(o.ID, uuid.NewString())
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+
+	// an org can tighten the policy, but not loosen it
+	tighter, err := setting.New(o.ID, SettingPasswordMinLength, setting.TypeInt, json.RawMessage(`40`), nil, false)
+	require.Nil(s.T(), err)
+	err = tighter.Insert(s.ctx, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	looser, err := setting.New(o.ID, SettingPasswordMinClasses, setting.TypeInt, json.RawMessage(`1`), nil, false)
+	require.Nil(s.T(), err)
+	err = looser.Insert(s.ctx, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	resp, body = s.createUser(o.ID, uuid.NewString())
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), []security.PasswordViolation{{Rule: security.RuleMinLength, Limit: 40}}, s.violations(body))
+	resp, _ = s.createUser(o.ID, "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz")
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _ = s.createUser(o.ID, uuid.NewString()+uuid.NewString())
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+
+	// password updates are checked too, with the org's settings
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	member, _ := s.newMember(o.ID, models.RoleMember)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+member.ID, owner.ID, tok,
+		UpdateUserPasswordMsg{Password: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+member.ID, owner.ID, tok,
+		UpdateUserPasswordMsg{Password: uuid.NewString() + uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+)
+
+// Action is something a role may be permitted to do
+type Action int
+
+// Actions checked against the policy
+const (
+	ActionManageOrgs     Action = iota // create orgs, read any org, change owners and statuses
+	ActionManageSettings               // create and delete settings, edit any setting
+	ActionEditSettings                 // edit settings marked editable
+	ActionTransferOrg                  // nominate the next org owner
+	ActionUpdateOrg2FA                 // require two-factor auth for the org
+	ActionCreateUser                   // add users to the org
+	ActionReadUsers                    // read, look up and search other users in the org
+	ActionManageUsers                  // update other users and their credentials
+	ActionUpdateRoles                  // change the roles of other users
+	ActionUpdateSelf                   // update one's own profile and credentials
+	ActionImpersonate                  // act as a user in another org
+	ActionReadAudit                    // read the org's audit log
+	ActionClearIPLockout               // let a locked out client ip try again
+	ActionConfigureOIDC                // set the org's identity provider
+	ActionManageServices               // create, rotate, disable and list service accounts
+	ActionRotateKeys                   // re-encrypt stored values with the current key
+)
+
+// policy lists the roles permitted each action
+// users are further limited to their own org, and to managing users
+// with a lower role; see manages
+var policy = map[Action][]models.Role{
+	ActionManageOrgs:     {models.RoleRoot},
+	ActionManageSettings: {models.RoleRoot},
+	ActionEditSettings:   {models.RoleRoot, models.RoleOwner, models.RoleAdmin},
+	ActionTransferOrg:    {models.RoleOwner},
+	ActionUpdateOrg2FA:   {models.RoleRoot, models.RoleOwner, models.RoleAdmin},
+	ActionCreateUser:     {models.RoleRoot, models.RoleOwner, models.RoleAdmin},
+	ActionReadUsers:      {models.RoleRoot, models.RoleOwner, models.RoleAdmin},
+	ActionManageUsers:    {models.RoleRoot, models.RoleOwner, models.RoleAdmin},
+	ActionUpdateRoles:    {models.RoleRoot, models.RoleOwner},
+	ActionUpdateSelf:     {models.RoleRoot, models.RoleOwner, models.RoleAdmin, models.RoleMember},
+	ActionImpersonate:    {models.RoleRoot},
+	ActionReadAudit:      {models.RoleRoot, models.RoleOwner, models.RoleAdmin},
+	ActionClearIPLockout: {models.RoleRoot},
+	ActionConfigureOIDC:  {models.RoleRoot, models.RoleOwner},
+	ActionManageServices: {models.RoleRoot, models.RoleOwner},
+	ActionRotateKeys:     {models.RoleRoot},
+}
+
+// roleScopes lists the token scopes that may be granted to each role
+var roleScopes = map[models.Role][]string{
+	models.RoleRoot:     allScopes,
+	models.RoleOwner:    allScopes,
+	models.RoleAdmin:    allScopes,
+	models.RoleMember:   {ScopeOrgRead, ScopeUserRead, ScopeUserWrite, ScopeRepositoryRead},
+	models.RoleReadOnly: {ScopeOrgRead, ScopeUserRead, ScopeRepositoryRead},
+}
+
+// can reports whether role is permitted action
+func can(role models.Role, action Action) bool {
+	for _, r := range policy[action] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// roleFor returns the effective role of u, a user in o
+func (srv *Instance) roleFor(o org.Instance, u user.Instance) models.Role {
+	if o.ID == srv.ST.RootOrg {
+		// allow for multiple accounts in root org
+		return models.RoleRoot
+	}
+	if o.Owner == u.ID {
+		return models.RoleOwner
+	}
+	return u.Role
+}
+
+// manages reports whether a caller with role and session may act on
+// target as their manager: root manages everyone, others only users in
+// their own org with a lower role
+func (srv *Instance) manages(role models.Role, session Session, target user.Instance) bool {
+	if role == models.RoleRoot {
+		return true
+	}
+	if session.Org.ID != target.Org {
+		return false
+	}
+	return role > srv.roleFor(session.Org, target)
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// newMember inserts an active user in org with role, returning it
+// with a token
+func (s *UserSuite) newMember(org string, role models.Role) (*user.Instance, *Token) {
+	u, err := user.New(uuid.NewString(), uuid.NewString(), org, uuid.NewString())
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	u.Role = role
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	return u, tok
+}
+
+func (s *UserSuite) TestRoles() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	ownerToken, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	admin, adminToken := s.newMember(o.ID, models.RoleAdmin)
+	otherAdmin, _ := s.newMember(o.ID, models.RoleAdmin)
+	member, memberToken := s.newMember(o.ID, models.RoleMember)
+	readOnly, readOnlyToken := s.newMember(o.ID, models.RoleReadOnly)
+	userURL := func(id string) string { return s.ts.URL + UserRoute + "/" + id }
+
+	// admins administer the org alongside the owner
+	resp, _, err := authedDo(s.c, http.MethodPost, s.ts.URL+UserRoute, admin.ID, adminToken,
+		CreateUserMsg{DisplayName: uuid.NewString(), Email: uuid.NewString(), Org: o.ID, Password: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, userURL(member.ID), admin.ID, adminToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(member.ID), admin.ID, adminToken,
+		UpdateUserDisplayNameMsg{DisplayName: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// but cannot manage the owner or each other, or change roles
+	for _, id := range []string{owner.ID, otherAdmin.ID} {
+		resp, _, err = authedDo(s.c, http.MethodPut, userURL(id), admin.ID, adminToken,
+			UpdateStatusMsg{Status: models.StatusInactive})
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	}
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(member.ID), admin.ID, adminToken,
+		UpdateRoleMsg{Role: models.RoleReadOnly})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// admins read the owner, but never the owner's api secret
+	resp, body, err := authedDo(s.c, http.MethodGet, userURL(owner.ID), admin.ID, adminToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.NotContains(s.T(), string(body), owner.APISecret)
+	require.NotContains(s.T(), string(body), `"api_secret"`)
+
+	// members only see and update themselves
+	resp, _, err = authedDo(s.c, http.MethodGet, userURL(admin.ID), member.ID, memberToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(member.ID), member.ID, memberToken,
+		UpdateUserDisplayNameMsg{DisplayName: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// read-only users cannot change even themselves
+	resp, _, err = authedDo(s.c, http.MethodGet, userURL(readOnly.ID), readOnly.ID, readOnlyToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(readOnly.ID), readOnly.ID, readOnlyToken,
+		UpdateUserDisplayNameMsg{DisplayName: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// nor get a token that writes
+	claims, err := jwt.Decode(readOnlyToken.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.False(s.T(), claims.HasScope(ScopeUserWrite))
+	resp, _, err = requestToken(s.c, s.ts.URL, readOnly.ID, readOnly.APISecret, withScope(ScopeUserWrite))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// the owner grants roles below their own; the old tokens are revoked
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(member.ID), owner.ID, ownerToken,
+		UpdateRoleMsg{Role: models.RoleOwner})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(member.ID), owner.ID, ownerToken,
+		UpdateRoleMsg{Role: models.RoleAdmin})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, userURL(admin.ID), member.ID, memberToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	memberToken, err = tokenFor(s.c, s.ts.URL, member.ID, member.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, userURL(readOnly.ID), member.ID, memberToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// root can grant admin in any org
+	resp, _, err = authedDo(s.c, http.MethodPut, userURL(readOnly.ID), s.srv.ST.RootUser, s.token,
+		UpdateRoleMsg{Role: models.RoleAdmin})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	uRead, err := user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, readOnly.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.RoleAdmin, uRead.Role)
+}
+
+func (s *UserSuite) TestPolicy() {
+	// every action is allowed to some role, and root is only denied
+	// what is particular to owning an org
+	for action := ActionManageOrgs; action <= ActionRotateKeys; action++ {
+		require.NotEmpty(s.T(), policy[action])
+		require.Equal(s.T(), action != ActionTransferOrg, can(models.RoleRoot, action))
+	}
+	require.False(s.T(), can(models.RoleNone, ActionUpdateSelf))
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxy reports whether ip is one of the configured proxies
+func (srv *Instance) trustedProxy(ip net.IP) bool {
+	for _, n := range srv.ST.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client ip a trusted proxy forwarded r for:
+// X-Real-IP if set, else the last X-Forwarded-For address that is not
+// itself a trusted proxy; nil if neither has one
+func (srv *Instance) forwardedFor(r *http.Request) net.IP {
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+		if !srv.trustedProxy(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// RealIP sets r.RemoteAddr to the client ip forwarded by a trusted proxy
+// forwarding headers from any other peer are ignored, as the client
+// sets them; the ip allowlists and lockouts depend on this
+func (srv *Instance) RealIP(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		peer := net.ParseIP(clientIP(r))
+		if peer != nil && srv.trustedProxy(peer) {
+			if ip := srv.forwardedFor(r); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// realIPFor returns the client ip RealIP finds for a request from peer
+// with headers
+func (s *UserSuite) realIPFor(peer string, headers map[string]string) string {
+	var ip string
+	h := s.srv.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = clientIP(r)
+	}))
+	req := httptest.NewRequest(http.MethodGet, OkRoute, nil)
+	req.RemoteAddr = peer
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	return ip
+}
+
+func (s *UserSuite) TestRealIP() {
+	// forwarding headers from other than a trusted proxy are the client's own
+	for _, header := range []string{"X-Real-IP", "X-Forwarded-For", "True-Client-IP"} {
+		require.Equal(s.T(), "203.0.113.5",
+			s.realIPFor("203.0.113.5:4321", map[string]string{header: "10.1.2.3"}))
+	}
+
+	// a trusted proxy gives the client ip; addresses the client put
+	// ahead of it in X-Forwarded-For are not believed
+	require.Equal(s.T(), "10.1.2.3",
+		s.realIPFor("127.0.0.1:4321", map[string]string{"X-Real-IP": "10.1.2.3"}))
+	require.Equal(s.T(), "10.1.2.3",
+		s.realIPFor("127.0.0.1:4321", map[string]string{"X-Forwarded-For": "192.168.1.1, 10.1.2.3, 127.0.0.2"}))
+	require.Equal(s.T(), "127.0.0.1",
+		s.realIPFor("127.0.0.1:4321", map[string]string{"True-Client-IP": "10.1.2.3"}))
+	require.Equal(s.T(), "127.0.0.1",
+		s.realIPFor("127.0.0.1:4321", map[string]string{"X-Forwarded-For": "not an ip"}))
+}
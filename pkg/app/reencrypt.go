@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/apikey"
+	"github.com/grokloc/grokloc-go/pkg/models/idp"
+	"github.com/grokloc/grokloc-go/pkg/models/invitation"
+	"github.com/grokloc/grokloc-go/pkg/models/totp"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+)
+
+// encrypted lists every table with columns encrypted with the key ring
+// a model that encrypts must be here, or its rows keep the earlier keys
+var encrypted = []models.Encrypted{
+	user.Encrypted,
+	apikey.Encrypted,
+	totp.Encrypted,
+	invitation.Encrypted,
+	idp.ConfigEncrypted,
+	idp.FlowEncrypted,
+}
+
+// Reencryption reports the re-encryption of stored values with the current key
+// Started and Finished are unixtimes, zero if not yet; Error is set if
+// the job stopped early
+type Reencryption struct {
+	models.ReencryptProgress
+	Running  bool   `json:"running"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+	Error    string `json:"error,omitempty"`
+}
+
+// reencryption is the state of the one re-encryption job an app server runs
+type reencryption struct {
+	mu     sync.Mutex
+	status Reencryption
+}
+
+// get returns a copy of the job status
+func (j *reencryption) get() Reencryption {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// start marks the job running, or returns false if it already is
+func (j *reencryption) start(key string, now time.Time) (Reencryption, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Running {
+		return j.status, false
+	}
+	j.status = Reencryption{Running: true, Started: now.Unix()}
+	j.status.Key = key
+	return j.status, true
+}
+
+// progress records p while the job runs
+func (j *reencryption) progress(p models.ReencryptProgress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.ReencryptProgress = p
+}
+
+// finish records the final progress and the error, if any
+func (j *reencryption) finish(p models.ReencryptProgress, err error, now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.ReencryptProgress = p
+	j.status.Running = false
+	j.status.Finished = now.Unix()
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+}
+
+// reencrypt runs the job to the end, logging progress after each batch
+func (srv Instance) reencrypt(ctx context.Context) {
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	p, err := models.Reencrypt(ctx, srv.ST.Master, srv.ST.Key, encrypted, srv.ST.ReencryptBatch, func(p models.ReencryptProgress) {
+		srv.reencryption.progress(p)
+		sugar.Infow("reencrypt progress",
+			"reqid", middleware.GetReqID(ctx),
+			"key", p.Key,
+			"total", p.Total,
+			"checked", p.Checked,
+			"reencrypted", p.Reencrypted,
+			"skipped", p.Skipped,
+			"failed", p.Failed)
+	})
+	srv.reencryption.finish(p, err, time.Now())
+	if err != nil {
+		sugar.Debugw("reencrypt",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		return
+	}
+	sugar.Infow("reencrypt finished",
+		"reqid", middleware.GetReqID(ctx),
+		"key", p.Key,
+		"reencrypted", p.Reencrypted,
+		"skipped", p.Skipped,
+		"failed", p.Failed)
+}
+
+// StartReencryption starts re-encrypting every encrypted column with the
+// current key in the background, after the key ring is rotated; progress
+// is read with ReadReencryption
+// once a run finishes with nothing skipped or failed, earlier keys can be
+// dropped from the config; a run with any left needs another
+func (srv Instance) StartReencryption(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	if !can(role, ActionRotateKeys) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	status, ok := srv.reencryption.start(srv.ST.Key.Current(), time.Now())
+	if !ok {
+		http.Error(w, "reencryption already running", http.StatusConflict)
+		return
+	}
+	// the job outlives the request, but keeps its id for the log
+	go srv.reencrypt(context.WithValue(context.Background(), middleware.RequestIDKey, middleware.GetReqID(ctx)))
+
+	srv.writeReencryption(w, status, http.StatusAccepted)
+}
+
+// ReadReencryption returns the progress of the latest re-encryption
+func (srv Instance) ReadReencryption(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	if !can(role, ActionRotateKeys) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+	srv.writeReencryption(w, srv.reencryption.get(), http.StatusOK)
+}
+
+// writeReencryption writes status as the response
+func (srv Instance) writeReencryption(w http.ResponseWriter, status Reencryption, code int) {
+	bs, err := json.Marshal(status)
+	if err != nil {
+		panic(err.Error())
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models/apikey"
+	"github.com/grokloc/grokloc-go/pkg/models/idp"
+	"github.com/grokloc/grokloc-go/pkg/models/invitation"
+	"github.com/grokloc/grokloc-go/pkg/models/totp"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *UserSuite) TestReencryption() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	ownerTok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	reencryptURL := s.ts.URL + ReencryptRoute
+
+	// only root re-encrypts
+	resp, _, err := authedDo(s.c, http.MethodPut, reencryptURL, owner.ID, ownerTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// values of other models are encrypted with the ring as well
+	k, err := apikey.New(owner.ID, uuid.NewString(), "", 0)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), k.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key))
+	_, err = totp.Enroll(s.ctx, s.srv.ST.Master, s.srv.ST.Key, owner.ID)
+	require.Nil(s.T(), err)
+	inv, err := invitation.New(o.ID, uuid.NewString(), owner.ID, time.Now().Add(time.Hour).Unix())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), inv.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key))
+	c, err := idp.NewConfig(o.ID, "https://"+uuid.NewString(), uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), c.Save(s.ctx, s.srv.ST.Master, s.srv.ST.Key))
+
+	next, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), s.srv.ST.Key.Rotate("next", next))
+	resp, body, err := authedDo(s.c, http.MethodPut, reencryptURL, s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+	var status Reencryption
+	require.Nil(s.T(), json.Unmarshal(body, &status))
+	require.Equal(s.T(), "next", status.Key)
+	require.NotZero(s.T(), status.Started)
+
+	// other tests share the db under their own keys, so some rows fail
+	require.Eventually(s.T(), func() bool {
+		resp, body, err := authedDo(s.c, http.MethodGet, reencryptURL, s.srv.ST.RootUser, s.token, nil)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+		require.Nil(s.T(), json.Unmarshal(body, &status))
+		return !status.Running
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(s.T(), status.Error)
+	require.NotZero(s.T(), status.Finished)
+	require.GreaterOrEqual(s.T(), status.Reencrypted, 2)
+	require.Equal(s.T(), status.Total, status.Checked)
+
+	var email string
+	err = s.srv.ST.Master.QueryRow("select email from users where id = $1", owner.ID).Scan(&email)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "next", security.KeyID(email))
+	for _, col := range []struct{ q, id string }{
+		{"select secret from api_keys where id = $1", k.ID},
+		{"select seed from user_totp where user_id = $1", owner.ID},
+		{"select email from invitations where id = $1", inv.ID},
+		{"select client_secret from oidc_configs where org = $1", o.ID},
+	} {
+		var e string
+		require.Nil(s.T(), s.srv.ST.Master.QueryRow(col.q, col.id).Scan(&e), col.q)
+		require.Equal(s.T(), "next", security.KeyID(e), col.q)
+	}
+	kRead, err := apikey.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, owner.ID, k.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), k.Secret, kRead.Secret)
+	cRead, err := idp.ReadConfig(s.ctx, s.srv.ST.Master, s.srv.ST.Key, o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), c.ClientSecret, cRead.ClientSecret)
+
+	u, err := user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, owner.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), owner.Email, u.Email)
+	_, err = tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/reset"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/notify"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// PasswordResetMsg is what a client should marshal to send as a json body
+// to RequestPasswordReset
+// the org is identified by either Org (id) or OrgName, as in LoginMsg
+type PasswordResetMsg struct {
+	Org     string `json:"org,omitempty"`
+	OrgName string `json:"org_name,omitempty"`
+	Email   string `json:"email"`
+}
+
+// RedeemPasswordResetMsg is what a client should marshal to send as a
+// json body to RedeemPasswordReset
+type RedeemPasswordResetMsg struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// errResetInvalid is the single response for any unusable reset token
+const errResetInvalid = "reset token invalid"
+
+// RequestPasswordReset sends a single-use reset token to the user with
+// the email, through the state Notifier
+// the response is 202 whether or not a token was sent, so callers cannot
+// probe for orgs or emails
+func (srv *Instance) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m PasswordResetMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || (len(m.Org) == 0) == (len(m.OrgName) == 0) || len(m.Email) == 0 {
+		http.Error(w, "malformed password reset", http.StatusBadRequest)
+		return
+	}
+
+	err = srv.sendPasswordReset(ctx, m)
+	if err != nil {
+		sugar.Debugw("send password reset",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset issues and sends a token if m names an active user
+// in an active org; otherwise nothing is sent
+func (srv *Instance) sendPasswordReset(ctx context.Context, m PasswordResetMsg) error {
+	var o *org.Instance
+	var err error
+	if len(m.Org) != 0 {
+		o, err = org.Read(ctx, srv.ST.RandomReplica(), m.Org)
+	} else {
+		o, err = org.ReadByName(ctx, srv.ST.RandomReplica(), m.OrgName)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	u, err := user.ReadByEmail(ctx, srv.ST.RandomReplica(), srv.ST.Key, o.ID, m.Email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if o.Meta.Status != models.StatusActive || u.Meta.Status != models.StatusActive {
+		return nil
+	}
+
+	expires := time.Now().Add(srv.ST.PasswordResetExpiration)
+	token, err := reset.Issue(ctx, srv.ST.Master, u.ID, expires.Unix())
+	if err != nil {
+		return err
+	}
+	err = srv.ST.Notifier.Notify(ctx, notify.Message{
+		To:      u.Email,
+		Subject: "password reset",
+		Body: fmt.Sprintf("Your password reset token, valid until %s:\n\n%s\n",
+			expires.UTC().Format(time.RFC1123), token),
+	})
+	if err != nil {
+		// the token is unusable without the message, but it will expire;
+		// the caller still gets the same response
+		srv.ST.L.Sugar().Infow("notify password reset",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+	return nil
+}
+
+// RedeemPasswordReset sets a new password for the user a reset token was
+// sent to, revoking the tokens issued under the old one
+// the token can only be redeemed once, and only with a password the
+// user's org policy accepts
+func (srv *Instance) RedeemPasswordReset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m RedeemPasswordResetMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.Token) == 0 || len(m.Password) == 0 {
+		http.Error(w, "malformed password reset", http.StatusBadRequest)
+		return
+	}
+
+	// validate before redeeming, so a refused password does not spend the token
+	now := time.Now().Unix()
+	id, err := reset.Lookup(ctx, srv.ST.Master, m.Token, now)
+	if err != nil {
+		if err == sql.ErrNoRows || err == reset.ErrExpired {
+			http.Error(w, errResetInvalid, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read password reset",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	u, err := user.Read(ctx, srv.ST.Master, srv.ST.Key, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, errResetInvalid, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if u.Meta.Status != models.StatusActive {
+		http.Error(w, "user not active", http.StatusForbidden)
+		return
+	}
+	if !srv.checkPassword(w, r, u.Org, m.Password) {
+		return
+	}
+	derived, err := security.DerivePassword(m.Password, srv.ST.Argon2Cfg)
+	if err != nil {
+		sugar.Debugw("derive password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = reset.Redeem(ctx, srv.ST.Master, m.Token, now)
+	if err != nil {
+		if err == sql.ErrNoRows || err == reset.ErrExpired {
+			// redeemed concurrently
+			http.Error(w, errResetInvalid, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("redeem password reset",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	err = u.UpdatePassword(ctx, srv.ST.Master, derived)
+	if err != nil {
+		sugar.Debugw("update password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// the user proved control of their email, so earlier failures are moot
+	srv.succeed(ctx, u.ID)
+	_, err = reset.Prune(ctx, srv.ST.Master, now)
+	if err != nil {
+		sugar.Debugw("prune password resets",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/notify"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// resetDo sends a password reset request or redemption
+func (s *UserSuite) resetDo(method string, m interface{}) *http.Response {
+	bs, err := json.Marshal(m)
+	require.Nil(s.T(), err)
+	req, err := http.NewRequest(method, s.ts.URL+PasswordResetRoute, bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	req.Header.Add("X-Real-IP", randomIP())
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	resp.Body.Close()
+	return resp
+}
+
+// sentTokens are the tokens notified to email, oldest first
+func (s *UserSuite) sentTokens(email string) []string {
+	outbox, ok := s.srv.ST.Notifier.(*notify.Outbox)
+	require.True(s.T(), ok)
+	ms, err := outbox.Messages()
+	require.Nil(s.T(), err)
+	var tokens []string
+	for _, m := range ms {
+		if m.To == email {
+			lines := strings.Split(strings.TrimSpace(m.Body), "\n")
+			tokens = append(tokens, lines[len(lines)-1])
+		}
+	}
+	return tokens
+}
+
+func (s *UserSuite) TestPasswordReset() {
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, derived)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	_, before := s.login(LoginMsg{Org: o.ID, Email: u.Email, Password: password})
+	require.NotNil(s.T(), before)
+
+	// unknown emails are accepted alike, but nothing is sent
+	unknown := uuid.NewString()
+	require.Equal(s.T(), http.StatusAccepted, s.resetDo(http.MethodPost, PasswordResetMsg{Org: o.ID, Email: unknown}).StatusCode)
+	require.Empty(s.T(), s.sentTokens(unknown))
+	require.Equal(s.T(), http.StatusBadRequest, s.resetDo(http.MethodPost, PasswordResetMsg{Email: u.Email}).StatusCode)
+
+	// a later request replaces the earlier token
+	require.Equal(s.T(), http.StatusAccepted, s.resetDo(http.MethodPost, PasswordResetMsg{Org: o.ID, Email: u.Email}).StatusCode)
+	require.Equal(s.T(), http.StatusAccepted, s.resetDo(http.MethodPost, PasswordResetMsg{OrgName: o.Name, Email: u.Email}).StatusCode)
+	tokens := s.sentTokens(u.Email)
+	require.Len(s.T(), tokens, 2)
+	newPassword := uuid.NewString()
+	require.Equal(s.T(), http.StatusUnauthorized, s.resetDo(http.MethodPut, RedeemPasswordResetMsg{Token: tokens[0], Password: newPassword}).StatusCode)
+
+	// a refused password does not spend the token
+	require.Equal(s.T(), http.StatusBadRequest, s.resetDo(http.MethodPut, RedeemPasswordResetMsg{Token: tokens[1], Password: "a"}).StatusCode)
+	require.Equal(s.T(), http.StatusNoContent, s.resetDo(http.MethodPut, RedeemPasswordResetMsg{Token: tokens[1], Password: newPassword}).StatusCode)
+	require.Equal(s.T(), http.StatusUnauthorized, s.resetDo(http.MethodPut, RedeemPasswordResetMsg{Token: tokens[1], Password: uuid.NewString()}).StatusCode)
+
+	// the new password works, the old one and its tokens do not
+	resp, _ := s.login(LoginMsg{Org: o.ID, Email: u.Email, Password: password})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = s.login(LoginMsg{Org: o.ID, Email: u.Email, Password: newPassword})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, &before.Token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// inactive users are sent nothing
+	err = u.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusInactive)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusAccepted, s.resetDo(http.MethodPost, PasswordResetMsg{Org: o.ID, Email: u.Email}).StatusCode)
+	require.Len(s.T(), s.sentTokens(u.Email), 2)
+}
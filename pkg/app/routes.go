@@ -11,60 +11,154 @@ import (
 
 // path/route constants
 const (
+	JWKSRoute  = "/.well-known/jwks.json"
 	APIPath    = "/api/" + Version
+	LoginRoute = APIPath + "/login"
 	TokenRoute = APIPath + "/token"
 
-	OkPath      = "/ok"
-	OkRoute     = APIPath + OkPath
-	OrgPath     = "/org"
-	OrgRoute    = APIPath + OrgPath
-	StatusPath  = "/status"
-	StatusRoute = APIPath + StatusPath // auth + Ok
-	UserPath    = "/user"
-	UserRoute   = APIPath + UserPath
+	LoginVerifyRoute      = LoginRoute + VerifyPath
+	OIDCLoginRoute        = LoginRoute + OIDCPath
+	OIDCCallbackRoute     = OIDCLoginRoute + CallbackPath
+	PasswordResetRoute    = APIPath + ResetPath
+	AcceptInvitationRoute = APIPath + InvitationsPath + AcceptPath
+	ImpersonateRoute      = TokenRoute + ImpersonatePath
+
+	AcceptPath      = "/accept"
+	AllPath         = "/all"
+	APIKeysPath     = "/apikeys"
+	APISecretPath   = "/apisecret"
+	AuditPath       = "/audit"
+	CallbackPath    = "/callback"
+	DisablePath     = "/disable"
+	ImpersonatePath = "/impersonate"
+	InvitationsPath = "/invitations"
+	LockoutPath     = "/lockout"
+	OIDCPath        = "/oidc"
+	OkPath          = "/ok"
+	OkRoute         = APIPath + OkPath
+	ReencryptPath   = "/reencrypt"
+	ReencryptRoute  = APIPath + ReencryptPath
+	OrgPath         = "/org"
+	OrgRoute        = APIPath + OrgPath
+	RefreshPath     = "/refresh"
+	RefreshRoute    = TokenRoute + RefreshPath
+	ResendPath      = "/resend"
+	ResetPath       = "/reset"
+	RotatePath      = "/rotate"
+	SearchPath      = "/search"
+	ServicesPath    = "/services"
+	SettingsPath    = "/settings"
+	StatusPath      = "/status"
+	StatusRoute     = APIPath + StatusPath // auth + Ok
+	TOTPPath        = "/totp"
+	TransferPath    = "/transfer"
+	TwoFactorPath   = "/2fa"
+	UserPath        = "/user"
+	UserRoute       = APIPath + UserPath
+	VerifyPath      = "/verify"
 )
 
 // URL parameter names
 const (
-	IDParam = "id"
+	IDParam  = "id"
+	IPParam  = "ip"
+	KeyParam = "key"
+)
+
+// URL query parameter names
+const (
+	EmailQuery = "email"
 )
 
 // Router provides API route handlers
 func (srv *Instance) Router() *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(srv.RealIP)
 	r.Use(srv.RequestLogger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(5 * time.Second))
 
 	r.Get(OkRoute, Ok)
+	r.Get(JWKSRoute, srv.JWKS)
+
+	// login establishes identity itself, so it has no session
+	r.With(srv.Throttle).Post(LoginRoute, srv.Login)
+	r.With(srv.Throttle).Post(LoginVerifyRoute, srv.LoginVerify)
+	r.With(srv.Throttle).Post(OIDCLoginRoute, srv.OIDCLogin)
+	r.With(srv.Throttle).Post(OIDCCallbackRoute, srv.OIDCCallback)
+	r.With(srv.Throttle).Post(PasswordResetRoute, srv.RequestPasswordReset)
+	r.With(srv.Throttle).Put(PasswordResetRoute, srv.RedeemPasswordReset)
+	r.With(srv.Throttle).Post(AcceptInvitationRoute, srv.AcceptInvitation)
 
 	r.Route(TokenRoute, func(r chi.Router) {
-		r.Use(srv.WithSession)
-		r.Put("/", srv.NewToken)
+		// throttled ahead of the session, so unknown users count as failures
+		r.With(srv.Throttle, srv.WithSession).Put("/", srv.NewToken)
+		r.Group(func(r chi.Router) {
+			r.Use(srv.WithSession)
+			r.Put(RefreshPath, srv.RefreshToken)
+			r.With(srv.WithToken).Delete("/", srv.Logout)
+			r.With(srv.WithToken).Delete(AllPath, srv.RevokeAllTokens)
+			r.With(srv.WithToken).Post(ImpersonatePath, srv.Impersonate)
+		})
 	})
 
 	r.Route(APIPath, func(r chi.Router) {
 		r.Use(srv.WithSession)
 		r.Use(srv.WithToken)
 		r.Get(StatusPath, Ok)
+		r.With(srv.RequireScope(ScopeUserWrite)).Delete(fmt.Sprintf("%s/{%s}", LockoutPath, IPParam), srv.ClearIPLockout)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Put(ReencryptPath, srv.StartReencryption)
+		r.With(srv.RequireScope(ScopeOrgRead)).Get(ReencryptPath, srv.ReadReencryption)
 	})
 
 	r.Route(OrgRoute, func(r chi.Router) {
 		r.Use(srv.WithSession)
 		r.Use(srv.WithToken)
-		r.Post("/", srv.CreateOrg)
-		r.Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadOrg)
-		r.Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateOrg)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Post("/", srv.CreateOrg)
+		r.With(srv.RequireScope(ScopeOrgRead)).Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadOrg)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateOrg)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Put(fmt.Sprintf("/{%s}%s", IDParam, TransferPath), srv.NominateOrgOwner)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Delete(fmt.Sprintf("/{%s}%s", IDParam, TransferPath), srv.CancelOrgOwnerNomination)
+		// the nominee is not yet an owner, so accepting is a change to their own account
+		r.With(srv.RequireScope(ScopeUserWrite)).Put(fmt.Sprintf("/{%s}%s%s", IDParam, TransferPath, AcceptPath), srv.AcceptOrgOwner)
+		r.With(srv.RequireScope(ScopeUserRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, UserPath), srv.ReadUserByEmail)
+		r.With(srv.RequireScope(ScopeUserRead)).Get(fmt.Sprintf("/{%s}%s%s", IDParam, UserPath, SearchPath), srv.SearchUsers)
+		r.With(srv.RequireScope(ScopeOrgRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, SettingsPath), srv.ReadSettings)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Post(fmt.Sprintf("/{%s}%s", IDParam, SettingsPath), srv.CreateSetting)
+		r.With(srv.RequireScope(ScopeOrgRead)).Get(fmt.Sprintf("/{%s}%s/{%s}", IDParam, SettingsPath, KeyParam), srv.ReadSetting)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Put(fmt.Sprintf("/{%s}%s/{%s}", IDParam, SettingsPath, KeyParam), srv.UpdateSetting)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Delete(fmt.Sprintf("/{%s}%s/{%s}", IDParam, SettingsPath, KeyParam), srv.DeleteSetting)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Put(fmt.Sprintf("/{%s}%s", IDParam, TwoFactorPath), srv.UpdateOrgRequire2FA)
+		r.With(srv.RequireScope(ScopeOrgRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, AuditPath), srv.ReadAudit)
+		r.With(srv.RequireScope(ScopeOrgRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, OIDCPath), srv.ReadOIDCConfig)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Put(fmt.Sprintf("/{%s}%s", IDParam, OIDCPath), srv.UpdateOIDCConfig)
+		r.With(srv.RequireScope(ScopeOrgWrite)).Delete(fmt.Sprintf("/{%s}%s", IDParam, OIDCPath), srv.DeleteOIDCConfig)
+		r.With(srv.RequireScope(ScopeUserWrite)).Post(fmt.Sprintf("/{%s}%s", IDParam, InvitationsPath), srv.CreateInvitation)
+		r.With(srv.RequireScope(ScopeUserRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, InvitationsPath), srv.ListInvitations)
+		r.With(srv.RequireScope(ScopeUserWrite)).Post(fmt.Sprintf("/{%s}%s/{%s}%s", IDParam, InvitationsPath, KeyParam, ResendPath), srv.ResendInvitation)
+		r.With(srv.RequireScope(ScopeUserWrite)).Delete(fmt.Sprintf("/{%s}%s/{%s}", IDParam, InvitationsPath, KeyParam), srv.RevokeInvitation)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Post(fmt.Sprintf("/{%s}%s", IDParam, ServicesPath), srv.CreateServiceAccount)
+		r.With(srv.RequireScope(ScopeUserRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, ServicesPath), srv.ListServiceAccounts)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Put(fmt.Sprintf("/{%s}%s/{%s}%s", IDParam, ServicesPath, KeyParam, RotatePath), srv.RotateServiceAccount)
+		r.With(srv.RequireScope(ScopeUserWrite)).Put(fmt.Sprintf("/{%s}%s/{%s}%s", IDParam, ServicesPath, KeyParam, DisablePath), srv.DisableServiceAccount)
 	})
 
 	r.Route(UserRoute, func(r chi.Router) {
 		r.Use(srv.WithSession)
 		r.Use(srv.WithToken)
-		r.Post("/", srv.CreateUser)
-		r.Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadUser)
-		r.Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateUser)
+		r.With(srv.RequireScope(ScopeUserWrite)).Post("/", srv.CreateUser)
+		r.With(srv.RequireScope(ScopeUserRead)).Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadUser)
+		r.With(srv.RequireScope(ScopeUserWrite)).Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateUser)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Put(fmt.Sprintf("/{%s}%s", IDParam, APISecretPath), srv.RotateAPISecret)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Post(fmt.Sprintf("/{%s}%s", IDParam, APIKeysPath), srv.CreateAPIKey)
+		r.With(srv.RequireScope(ScopeUserRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, APIKeysPath), srv.ListAPIKeys)
+		r.With(srv.RequireScope(ScopeUserWrite)).Delete(fmt.Sprintf("/{%s}%s/{%s}", IDParam, APIKeysPath, KeyParam), srv.RevokeAPIKey)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Post(fmt.Sprintf("/{%s}%s", IDParam, TOTPPath), srv.EnrollTOTP)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Put(fmt.Sprintf("/{%s}%s", IDParam, TOTPPath), srv.ConfirmTOTP)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Delete(fmt.Sprintf("/{%s}%s", IDParam, TOTPPath), srv.DisableTOTP)
+		r.With(srv.RequireScope(ScopeUserWrite), srv.NotImpersonated).Post(fmt.Sprintf("/{%s}%s", IDParam, OIDCPath), srv.LinkOIDC)
+		r.With(srv.RequireScope(ScopeUserWrite)).Delete(fmt.Sprintf("/{%s}%s", IDParam, LockoutPath), srv.ClearUserLockout)
 	})
 
 	return r
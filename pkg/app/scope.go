@@ -0,0 +1,96 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+)
+
+// Token scopes
+// a token carries some or all of the scopes allowed by its user's role,
+// and each route requires one of them
+const (
+	ScopeOrgRead         = "org:read"
+	ScopeOrgWrite        = "org:write"
+	ScopeUserRead        = "user:read"
+	ScopeUserWrite       = "user:write"
+	ScopeRepositoryRead  = "repository:read"
+	ScopeRepositoryAdmin = "repository:admin"
+)
+
+// ErrScopeNotAllowed is returned when a scope is requested that the
+// role does not allow
+var ErrScopeNotAllowed = errors.New("scope not allowed")
+
+// allScopes lists every scope, in the order they appear in claims
+var allScopes = []string{
+	ScopeOrgRead,
+	ScopeOrgWrite,
+	ScopeUserRead,
+	ScopeUserWrite,
+	ScopeRepositoryRead,
+	ScopeRepositoryAdmin,
+}
+
+// allowedScopes returns the scopes that may be granted to role
+// policy checks in handlers still apply; scopes only narrow what a token can do
+func allowedScopes(role models.Role) []string {
+	return roleScopes[role]
+}
+
+// grantScopes returns the requested scopes if all are allowed,
+// or every allowed scope if none are requested
+func grantScopes(allowed, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	for _, s := range requested {
+		if !contains(allowed, s) {
+			return nil, ErrScopeNotAllowed
+		}
+	}
+	return intersectScopes(allowed, requested), nil
+}
+
+// intersectScopes returns the scopes in both allowed and granted,
+// in the order of allowed
+func intersectScopes(allowed, granted []string) []string {
+	scopes := []string{}
+	for _, s := range allowed {
+		if contains(granted, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// contains reports whether scopes includes scope
+func contains(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope returns middleware that rejects requests whose token
+// was not granted scope; it must follow WithToken
+func (srv *Instance) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(claimsCtxKey).(jwt.Claims)
+			if !ok {
+				panic("claims missing")
+			}
+			if !claims.HasScope(scope) {
+				http.Error(w, "insufficient scope: "+scope, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *UserSuite) TestScopes() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	orgURL := s.ts.URL + OrgRoute + "/" + o.ID
+	userURL := s.ts.URL + UserRoute + "/" + owner.ID
+
+	// no request is every allowed scope
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	claims, err := jwt.Decode(tok.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), allScopes, claims.Scopes())
+
+	// a read-only token can read but not write
+	resp, readOnly, err := requestToken(s.c, s.ts.URL, owner.ID, owner.APISecret, withScope(ScopeOrgRead+" "+ScopeUserRead))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, orgURL, owner.ID, readOnly, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, userURL, owner.ID, readOnly, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, orgURL, owner.ID, readOnly,
+		map[string]string{"owner": owner.ID})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// the refreshed token keeps the requested scopes
+	resp, respBody, err := authedDo(s.c, http.MethodPut, s.ts.URL+RefreshRoute, owner.ID, readOnly,
+		RefreshTokenMsg{Refresh: readOnly.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var rotated Token
+	err = json.Unmarshal(respBody, &rotated)
+	require.Nil(s.T(), err)
+	claims, err = jwt.Decode(rotated.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{ScopeOrgRead, ScopeUserRead}, claims.Scopes())
+
+	// a regular user cannot request more than their role allows
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, u.APISecret, withScope(ScopeOrgWrite))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, u.ID, u.APISecret, withScope("no:such"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, userTok, err := requestToken(s.c, s.ts.URL, u.ID, u.APISecret, withScope(""))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	claims, err = jwt.Decode(userTok.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.False(s.T(), claims.HasScope(ScopeOrgWrite))
+	require.True(s.T(), claims.HasScope(ScopeUserWrite))
+}
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/apikey"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+)
+
+// CreateServiceAccountMsg is what a client should marshal to send as a
+// json body to CreateServiceAccount
+// Scope optionally limits tokens to those of a member, space separated;
+// AllowedIPs are ips or cidrs that requests may come from, or any if empty
+type CreateServiceAccountMsg struct {
+	DisplayName string   `json:"display_name"`
+	Scope       string   `json:"scope,omitempty"`
+	AllowedIPs  []string `json:"allowed_ips,omitempty"`
+}
+
+// ServiceAccount describes a service account, without credentials
+type ServiceAccount struct {
+	ID          string        `json:"id"`
+	DisplayName string        `json:"display_name"`
+	Org         string        `json:"org"`
+	Scope       string        `json:"scope,omitempty"`
+	AllowedIPs  []string      `json:"allowed_ips,omitempty"`
+	Status      models.Status `json:"status"`
+	Ctime       int64         `json:"ctime"`
+}
+
+// ServiceAccountCredentials is the api key a service account gets tokens
+// with; the secret is only ever returned here
+type ServiceAccountCredentials struct {
+	ID     string `json:"id"`
+	Org    string `json:"org"`
+	APIKey string `json:"api_key"`
+	Secret string `json:"secret"`
+}
+
+// errServiceCredentials is the response to changing a password or api
+// secret a service account does not use
+const errServiceCredentials = "service accounts only use api keys"
+
+// serviceKeyLabel labels the api key made on creation and rotation
+const serviceKeyLabel = "default"
+
+// serviceAccount returns the description of u, a service account
+func serviceAccount(u user.Instance) ServiceAccount {
+	return ServiceAccount{
+		ID:          u.ID,
+		DisplayName: u.DisplayName,
+		Org:         u.Org,
+		Scope:       u.ServiceScope,
+		AllowedIPs:  strings.Fields(u.AllowedIPs),
+		Status:      u.Meta.Status,
+		Ctime:       u.Meta.Ctime,
+	}
+}
+
+// serviceOrg is the org in the url if the caller can manage its service
+// accounts, otherwise the error response is written and ok is false
+func (srv Instance) serviceOrg(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ctx := r.Context()
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if !can(role, ActionManageServices) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return "", false
+	}
+	if !can(role, ActionManageOrgs) && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return "", false
+	}
+	// cannot add to root org through the web api
+	if id == srv.ST.RootOrg {
+		http.Error(w, "cannot manage service accounts in root org", http.StatusForbidden)
+		return "", false
+	}
+	return id, true
+}
+
+// readService reads the service account in the url for the org, writing
+// the error response if it cannot
+func (srv Instance) readService(w http.ResponseWriter, r *http.Request, org string) (*user.Instance, bool) {
+	ctx := r.Context()
+	key := chi.URLParam(r, KeyParam)
+	if len(key) == 0 {
+		panic("key missing")
+	}
+	u, err := user.Read(ctx, srv.ST.Master, srv.ST.Key, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "service account not found", http.StatusNotFound)
+			return nil, false
+		}
+		srv.ST.L.Sugar().Debugw("read service account",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !u.Service || u.Org != org {
+		http.Error(w, "service account not found", http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+// writeServiceKey creates a new api key for u and writes it as the response
+func (srv Instance) writeServiceKey(w http.ResponseWriter, r *http.Request, u user.Instance, status int) {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	// the key is unscoped, as the account scope already limits it
+	k, err := apikey.New(u.ID, serviceKeyLabel, "", 0)
+	if err != nil {
+		panic(err.Error())
+	}
+	err = k.Insert(ctx, srv.ST.Master, srv.ST.Key)
+	if err != nil {
+		sugar.Debugw("insert api key",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(ServiceAccountCredentials{ID: u.ID, Org: u.Org, APIKey: k.ID, Secret: k.Secret})
+	if err != nil {
+		sugar.Debugw("marshal service account credentials",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// CreateServiceAccount adds a service account to the org, returning the
+// api key it gets tokens with
+func (srv Instance) CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.serviceOrg(w, r)
+	if !ok {
+		return
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m CreateServiceAccountMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.DisplayName) == 0 {
+		http.Error(w, "malformed service account", http.StatusBadRequest)
+		return
+	}
+	// service accounts are members, so may only narrow a member's scopes
+	requested := jwt.SplitScopes(m.Scope)
+	_, err = grantScopes(allowedScopes(models.RoleMember), requested)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := user.NewService(m.DisplayName, org, jwt.JoinScopes(requested), m.AllowedIPs)
+	if err != nil {
+		http.Error(w, "malformed service account args", http.StatusBadRequest)
+		return
+	}
+	err = u.Insert(ctx, srv.ST.Master, srv.ST.Key)
+	if err != nil {
+		if err == models.ErrRelatedOrg {
+			http.Error(w, "org not active", http.StatusForbidden)
+			return
+		}
+		sugar.Debugw("insert service account",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	sugar.Infow("service account created",
+		"reqid", middleware.GetReqID(ctx),
+		"service", true,
+		"id", u.ID,
+		"org", org,
+		"by", session.User.ID)
+
+	w.Header().Set("location", fmt.Sprintf("%s/%s%s/%s", OrgRoute, org, ServicesPath, u.ID))
+	srv.writeServiceKey(w, r, *u, http.StatusCreated)
+}
+
+// ListServiceAccounts returns the org's service accounts, without credentials
+func (srv Instance) ListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.serviceOrg(w, r)
+	if !ok {
+		return
+	}
+	users, err := user.ListServices(ctx, srv.ST.RandomReplica(), srv.ST.Key, org)
+	if err != nil {
+		sugar.Debugw("list service accounts",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	accounts := make([]ServiceAccount, 0, len(users))
+	for _, u := range users {
+		accounts = append(accounts, serviceAccount(*u))
+	}
+	bs, err := json.Marshal(accounts)
+	if err != nil {
+		sugar.Debugw("marshal service accounts",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// RotateServiceAccount replaces every api key of a service account with a
+// new one, and revokes the tokens issued so far
+func (srv Instance) RotateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.serviceOrg(w, r)
+	if !ok {
+		return
+	}
+	u, ok := srv.readService(w, r, org)
+	if !ok {
+		return
+	}
+
+	keys, err := apikey.List(ctx, srv.ST.Master, u.ID)
+	if err != nil {
+		sugar.Debugw("list api keys",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	for _, k := range keys {
+		err = apikey.Revoke(ctx, srv.ST.Master, u.ID, k.ID)
+		if err != nil && err != sql.ErrNoRows {
+			sugar.Debugw("revoke api key",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = u.RevokeTokens(ctx, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("revoke tokens",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.writeServiceKey(w, r, *u, http.StatusOK)
+}
+
+// DisableServiceAccount makes a service account inactive, which refuses
+// its keys and revokes its tokens
+func (srv Instance) DisableServiceAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	org, ok := srv.serviceOrg(w, r)
+	if !ok {
+		return
+	}
+	u, ok := srv.readService(w, r, org)
+	if !ok {
+		return
+	}
+	err := u.UpdateStatus(ctx, srv.ST.Master, models.StatusInactive)
+	if err != nil {
+		sugar.Debugw("update service account status",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
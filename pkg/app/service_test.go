@@ -0,0 +1,138 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/audit"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *UserSuite) TestServiceAccounts() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	servicesURL := s.ts.URL + OrgRoute + "/" + o.ID + ServicesPath
+
+	// admins cannot manage service accounts, and scopes are limited to a member's
+	admin, adminTok := s.newMember(o.ID, models.RoleAdmin)
+	resp, _, err := authedDo(s.c, http.MethodPost, servicesURL, admin.ID, adminTok,
+		CreateServiceAccountMsg{DisplayName: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, servicesURL, owner.ID, tok,
+		CreateServiceAccountMsg{DisplayName: uuid.NewString(), Scope: ScopeOrgWrite})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, servicesURL, owner.ID, tok,
+		CreateServiceAccountMsg{DisplayName: uuid.NewString(), AllowedIPs: []string{"not an ip"}})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	resp, body, err := authedDo(s.c, http.MethodPost, servicesURL, owner.ID, tok,
+		CreateServiceAccountMsg{
+			DisplayName: uuid.NewString(),
+			Scope:       jwt.JoinScopes([]string{ScopeUserRead, ScopeUserWrite}),
+			AllowedIPs:  []string{"10.0.0.0/8", "127.0.0.1"},
+		})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var creds ServiceAccountCredentials
+	require.Nil(s.T(), json.Unmarshal(body, &creds))
+	require.Equal(s.T(), o.ID, creds.Org)
+	require.NotEmpty(s.T(), creds.Secret)
+
+	// tokens come from the key, from an allowed ip, with the account scope
+	resp, _, err = requestToken(s.c, s.ts.URL, creds.ID, creds.Secret, withAPIKey(creds.APIKey), fromIP("192.168.1.1"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, serviceTok, err := requestToken(s.c, s.ts.URL, creds.ID, creds.Secret, withAPIKey(creds.APIKey), fromIP("10.1.2.3"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	claims, err := jwt.Decode(serviceTok.Bearer, s.srv.ST.SigningKeys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{ScopeUserRead, ScopeUserWrite}, jwt.SplitScopes(claims.Scope))
+
+	// the api secret is never accepted, and cannot be rotated
+	u, err := user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, creds.ID)
+	require.Nil(s.T(), err)
+	require.True(s.T(), u.Service)
+	_, err = tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Error(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+u.ID+APISecretPath, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// writes by the service account are audited as its own, reads are not
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, serviceTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+u.ID, u.ID, serviceTok,
+		UpdateUserDisplayNameMsg{DisplayName: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	entries, err := audit.List(s.ctx, s.srv.ST.Master, o.ID)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), entries, 1)
+	require.True(s.T(), entries[0].Service)
+	require.Equal(s.T(), u.ID, entries[0].Actor)
+	require.Equal(s.T(), u.ID, entries[0].Subject)
+
+	// listing shows the account without credentials
+	resp, body, err = authedDo(s.c, http.MethodGet, servicesURL, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var accounts []ServiceAccount
+	require.Nil(s.T(), json.Unmarshal(body, &accounts))
+	require.Len(s.T(), accounts, 1)
+	require.Equal(s.T(), u.ID, accounts[0].ID)
+	require.Equal(s.T(), []string{"10.0.0.0/8", "127.0.0.1"}, accounts[0].AllowedIPs)
+	require.NotContains(s.T(), string(body), creds.Secret)
+
+	// service accounts cannot own the org
+	err = o.UpdateOwner(s.ctx, s.srv.ST.Master, u.ID)
+	require.Equal(s.T(), models.ErrRelatedUser, err)
+
+	// rotating replaces the key and revokes tokens
+	serviceURL := servicesURL + "/" + u.ID
+	resp, body, err = authedDo(s.c, http.MethodPut, serviceURL+RotatePath, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var rotated ServiceAccountCredentials
+	require.Nil(s.T(), json.Unmarshal(body, &rotated))
+	require.NotEqual(s.T(), creds.APIKey, rotated.APIKey)
+	resp, _, err = requestToken(s.c, s.ts.URL, creds.ID, creds.Secret, withAPIKey(creds.APIKey), fromIP("10.1.2.3"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, rotated.ID, rotated.Secret, withAPIKey(rotated.APIKey), fromIP("10.1.2.3"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// users are not service accounts
+	resp, _, err = authedDo(s.c, http.MethodPut, servicesURL+"/"+admin.ID+RotatePath, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// disabling refuses the key
+	resp, _, err = authedDo(s.c, http.MethodPut, serviceURL+DisablePath, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = requestToken(s.c, s.ts.URL, rotated.ID, rotated.Secret, withAPIKey(rotated.APIKey), fromIP("10.1.2.3"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// only the org's owner manages its service accounts
+	_, otherOwner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	otherTok, err := tokenFor(s.c, s.ts.URL, otherOwner.ID, otherOwner.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, servicesURL, otherOwner.ID, otherTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
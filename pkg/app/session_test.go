@@ -7,12 +7,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/env"
 	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/change"
 	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
 	"github.com/grokloc/grokloc-go/pkg/security"
 	"github.com/grokloc/grokloc-go/pkg/util"
 	"github.com/matthewhartstonge/argon2"
@@ -20,7 +23,7 @@ import (
 	"github.com/stretchr/testify/suite"
 )
 
-const authLevel = "authlevel"
+const roleHeader = "role"
 
 // SessionSuite is responsible fo testing interior methods used in auth
 type SessionSuite struct {
@@ -38,17 +41,17 @@ func (s *SessionSuite) SetupTest() {
 		log.Fatal(err.Error())
 	}
 
-	// returns the auth leve in a header, and "OK" as a body
+	// returns the role in a header, and "OK" as a body
 	okHandler := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		lvl, ok := ctx.Value(authLevelCtxKey).(int)
+		role, ok := ctx.Value(roleCtxKey).(models.Role)
 		if !ok {
-			http.Error(w, "authLevel", http.StatusInternalServerError)
+			http.Error(w, "role", http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("content-type", "text/plain; charset=utf-8")
-		// tests can read out the auth level
-		w.Header().Set(authLevel, fmt.Sprintf("%d", lvl))
+		// tests can read out the role
+		w.Header().Set(roleHeader, fmt.Sprintf("%d", role))
 		_, err := w.Write([]byte("OK"))
 		if err != nil {
 			panic(err.Error())
@@ -64,6 +67,7 @@ func (s *SessionSuite) SetupTest() {
 
 		// "/token" runs the token generation handler
 		rtr.Put("/token", s.srv.NewToken)
+		rtr.Put("/token"+RefreshPath, s.srv.RefreshToken)
 
 		rtr.Route("/verify", func(rtr chi.Router) {
 			rtr.Use(s.srv.WithToken)
@@ -77,6 +81,12 @@ func (s *SessionSuite) SetupTest() {
 	s.c = &http.Client{}
 }
 
+func (s *SessionSuite) TearDownTest() {
+	s.ts.Close()
+	s.srv.Close()
+	require.Nil(s.T(), s.srv.ST.Close())
+}
+
 func (s *SessionSuite) TestFoundAndActiveRoot() {
 	// root
 	req, err := http.NewRequest(http.MethodGet, s.ts.URL+"/", nil)
@@ -85,9 +95,9 @@ func (s *SessionSuite) TestFoundAndActiveRoot() {
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
-	authLevelVal := resp.Header.Get(authLevel)
-	require.NotEqual(s.T(), "", authLevelVal)
-	require.Equal(s.T(), fmt.Sprintf("%d", AuthRoot), authLevelVal)
+	roleVal := resp.Header.Get(roleHeader)
+	require.NotEqual(s.T(), "", roleVal)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleRoot), roleVal)
 }
 
 func (s *SessionSuite) TestFoundAndActiveOwner() {
@@ -100,9 +110,9 @@ func (s *SessionSuite) TestFoundAndActiveOwner() {
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
-	authLevelVal := resp.Header.Get(authLevel)
-	require.NotEqual(s.T(), "", authLevelVal)
-	require.Equal(s.T(), fmt.Sprintf("%d", AuthOrg), authLevelVal)
+	roleVal := resp.Header.Get(roleHeader)
+	require.NotEqual(s.T(), "", roleVal)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleOwner), roleVal)
 }
 
 func (s *SessionSuite) TestFoundAndActiveUser() {
@@ -122,9 +132,27 @@ func (s *SessionSuite) TestFoundAndActiveUser() {
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
-	authLevelVal := resp.Header.Get(authLevel)
-	require.NotEqual(s.T(), "", authLevelVal)
-	require.Equal(s.T(), fmt.Sprintf("%d", AuthUser), authLevelVal)
+	roleVal := resp.Header.Get(roleHeader)
+	require.NotEqual(s.T(), "", roleVal)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleMember), roleVal)
+}
+
+func (s *SessionSuite) TestFoundAndActiveAdmin() {
+	o, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	u.Role = models.RoleAdmin
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	req, err := http.NewRequest(http.MethodGet, s.ts.URL+"/", nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleAdmin), resp.Header.Get(roleHeader))
 }
 
 func (s *SessionSuite) TestUserNotFound() {
@@ -133,7 +161,7 @@ func (s *SessionSuite) TestUserNotFound() {
 	req.Header.Add(IDHeader, uuid.NewString())
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
-	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
 }
 
 func (s *SessionSuite) TestUserInactive() {
@@ -146,7 +174,7 @@ func (s *SessionSuite) TestUserInactive() {
 	req.Header.Add(IDHeader, u.ID)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
-	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
 }
 
 func (s *SessionSuite) TestOrgInactive() {
@@ -159,7 +187,109 @@ func (s *SessionSuite) TestOrgInactive() {
 	req.Header.Add(IDHeader, u.ID)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
-	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
+
+// get requests the session-only handler as id
+func (s *SessionSuite) get(id string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, s.ts.URL+"/", nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, id)
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	return resp
+}
+
+func (s *SessionSuite) TestSessionCache() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	before := s.srv.SessionCacheStats()
+	require.Equal(s.T(), http.StatusOK, s.get(u.ID).StatusCode)
+	require.Equal(s.T(), http.StatusOK, s.get(u.ID).StatusCode)
+	after := s.srv.SessionCacheStats()
+	require.Equal(s.T(), before.Misses+1, after.Misses)
+	require.Equal(s.T(), before.Hits+1, after.Hits)
+
+	// changes made through the models are seen at once
+	err = u.UpdateRole(s.ctx, s.srv.ST.Master, models.RoleAdmin)
+	require.Nil(s.T(), err)
+	resp := s.get(u.ID)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleAdmin), resp.Header.Get(roleHeader))
+	err = o.UpdateOwner(s.ctx, s.srv.ST.Master, u.ID)
+	require.Nil(s.T(), err)
+	resp = s.get(u.ID)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleOwner), resp.Header.Get(roleHeader))
+	resp = s.get(owner.ID)
+	require.Equal(s.T(), fmt.Sprintf("%d", models.RoleMember), resp.Header.Get(roleHeader))
+	err = u.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusInactive)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, s.get(u.ID).StatusCode)
+}
+
+func (s *SessionSuite) TestSessionCacheSync() {
+	s.srv.ST.SessionCacheSync = time.Nanosecond
+	defer func() { s.srv.ST.SessionCacheSync = 0 }()
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, s.get(u.ID).StatusCode)
+
+	// another instance deactivates the user, so only the change entry is seen here
+	q := fmt.Sprintf("update %s set status = $1 where id = $2", schemas.UsersTableName)
+	_, err = s.srv.ST.Master.Exec(q, models.StatusInactive, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, s.get(u.ID).StatusCode)
+	err = change.Record(s.ctx, s.srv.ST.Master, models.KindUser, u.ID, time.Now().Unix())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, s.get(u.ID).StatusCode)
+
+	// changes made here are recorded for other instances
+	seq, err := change.Latest(s.ctx, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	err = u.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusActive)
+	require.Nil(s.T(), err)
+	entries, err := change.Since(s.ctx, s.srv.ST.Master, seq)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), entries)
+	require.Equal(s.T(), u.ID, entries[len(entries)-1].ID)
+}
+
+func (s *SessionSuite) TestSessionCacheOff() {
+	// as New leaves it with SessionCache off
+	s.srv.sessions = nil
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, s.get(u.ID).StatusCode)
+	require.Equal(s.T(), SessionCacheStats{}, s.srv.SessionCacheStats())
+
+	// so changes outside the models are seen at once
+	q := fmt.Sprintf("update %s set status = $1 where id = $2", schemas.UsersTableName)
+	_, err = s.srv.ST.Master.Exec(q, models.StatusInactive, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, s.get(u.ID).StatusCode)
+}
+
+func (s *SessionSuite) TestClose() {
+	gen := func() uint64 {
+		s.srv.sessions.mu.Lock()
+		defer s.srv.sessions.mu.Unlock()
+		return s.srv.sessions.gen
+	}
+	before := gen()
+	models.Changed(models.KindUser, uuid.NewString())
+	require.Equal(s.T(), before+1, gen())
+
+	// a closed instance no longer hears of changes, and closes again safely
+	s.srv.Close()
+	models.Changed(models.KindUser, uuid.NewString())
+	require.Equal(s.T(), before+1, gen())
+	s.srv.Close()
 }
 
 func TestSessionSuite(t *testing.T) {
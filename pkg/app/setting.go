@@ -0,0 +1,324 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/setting"
+)
+
+// CreateSettingMsg is what a client should marshal to send as a json body to CreateSetting
+type CreateSettingMsg struct {
+	Key      string          `json:"key"`
+	Type     setting.Type    `json:"type"`
+	Value    json.RawMessage `json:"value"`
+	Schema   json.RawMessage `json:"schema,omitempty"`
+	Editable bool            `json:"editable"`
+}
+
+// UpdateSettingMsg is the body format for updating a setting value
+type UpdateSettingMsg struct {
+	Value json.RawMessage `json:"value"`
+}
+
+// UnmarshalJSON is a custom unmarshal for UpdateSettingMsg
+func (m *UpdateSettingMsg) UnmarshalJSON(bs []byte) error {
+	var t map[string]json.RawMessage
+	err := json.Unmarshal(bs, &t)
+	if err != nil {
+		return err
+	}
+	v, ok := t["value"]
+	if !ok {
+		return errors.New("no value field found")
+	}
+	m.Value = v
+	return nil
+}
+
+// CreateSetting creates a new setting for an org
+// only root can create settings and decide which are editable by the org
+func (srv Instance) CreateSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	if !can(role, ActionManageSettings) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m CreateSettingMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		http.Error(w, "malformed setting create", http.StatusBadRequest)
+		return
+	}
+
+	s, err := setting.New(id, m.Key, m.Type, m.Value, m.Schema, m.Editable)
+	if err != nil {
+		if errors.Is(err, setting.ErrInvalidValue) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "malformed setting args", http.StatusBadRequest)
+		return
+	}
+
+	err = s.Insert(ctx, srv.ST.Master)
+	if err != nil {
+		if err == models.ErrConflict {
+			http.Error(w, "duplicate setting args", http.StatusConflict)
+			return
+		}
+		if err == models.ErrRelatedOrg {
+			http.Error(w, "org not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("insert setting",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("location", OrgRoute+"/"+id+SettingsPath+"/"+s.Key)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ReadSettings reads all settings for an org
+func (srv Instance) ReadSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	// the context settings are for the caller's org
+	settings := session.Settings
+	if session.Org.ID != id {
+		if !can(role, ActionManageOrgs) {
+			http.Error(w, "not a member of requested org", http.StatusForbidden)
+			return
+		}
+		var err error
+		settings, err = setting.ReadAll(ctx, srv.ST.RandomReplica(), id)
+		if err != nil {
+			sugar.Debugw("read settings",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	bs, err := json.Marshal(settings)
+	if err != nil {
+		sugar.Debugw("marshal settings",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// readSetting reads the setting named in the url for the handlers below
+// it writes the error response and returns nil on failure
+func (srv Instance) readSetting(w http.ResponseWriter, r *http.Request) *setting.Instance {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+	key := chi.URLParam(r, KeyParam)
+	if len(key) == 0 {
+		panic("key missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if session.Org.ID != id && !can(role, ActionManageOrgs) {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return nil
+	}
+
+	s, err := setting.Read(ctx, srv.ST.Master, id, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "setting not found", http.StatusNotFound)
+			return nil
+		}
+		sugar.Debugw("read setting",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil
+	}
+	return s
+}
+
+// ReadSetting reads one setting for an org
+func (srv Instance) ReadSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	s := srv.readSetting(w, r)
+	if s == nil {
+		return
+	}
+
+	bs, err := json.Marshal(s)
+	if err != nil {
+		sugar.Debugw("marshal setting",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// UpdateSetting changes a setting value
+// org owners and admins can only change editable settings, root can change any
+func (srv Instance) UpdateSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	if !can(role, ActionEditSettings) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	s := srv.readSetting(w, r)
+	if s == nil {
+		return
+	}
+	if !s.Editable && !can(role, ActionManageSettings) {
+		http.Error(w, "setting not editable", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m UpdateSettingMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		http.Error(w, "malformed update msg", http.StatusBadRequest)
+		return
+	}
+
+	err = s.UpdateValue(ctx, srv.ST.Master, m.Value)
+	if err != nil {
+		if errors.Is(err, setting.ErrInvalidValue) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("update setting",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteSetting removes a setting
+// only root can delete settings
+func (srv Instance) DeleteSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	if !can(role, ActionManageSettings) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	s := srv.readSetting(w, r)
+	if s == nil {
+		return
+	}
+
+	err := s.Delete(ctx, srv.ST.Master)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "setting not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("delete setting",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
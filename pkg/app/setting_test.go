@@ -0,0 +1,127 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/setting"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *OrgSuite) TestSettings() {
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	settingsURL := s.ts.URL + OrgRoute + "/" + o.ID + SettingsPath
+
+	// root creates an editable and a locked setting
+	resp, _, err := authedDo(s.c, http.MethodPost, settingsURL, s.srv.ST.RootUser, s.token, CreateSettingMsg{
+		Key:      "brand.title",
+		Type:     setting.TypeString,
+		Value:    json.RawMessage(`"Acme"`),
+		Schema:   json.RawMessage(`{"maxLength":8}`),
+		Editable: true,
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	require.Equal(s.T(), OrgRoute+"/"+o.ID+SettingsPath+"/brand.title", resp.Header.Get("location"))
+	resp, _, err = authedDo(s.c, http.MethodPost, settingsURL, s.srv.ST.RootUser, s.token, CreateSettingMsg{
+		Key:   "limit.users",
+		Type:  setting.TypeInt,
+		Value: json.RawMessage(`5`),
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+
+	// duplicate, invalid
+	resp, _, err = authedDo(s.c, http.MethodPost, settingsURL, s.srv.ST.RootUser, s.token, CreateSettingMsg{
+		Key:   "limit.users",
+		Type:  setting.TypeInt,
+		Value: json.RawMessage(`5`),
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, settingsURL, s.srv.ST.RootUser, s.token, CreateSettingMsg{
+		Key:   "limit.other",
+		Type:  setting.TypeInt,
+		Value: json.RawMessage(`"5"`),
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// owner cannot create, but can read all and edit the editable setting
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodPost, settingsURL, u.ID, tok, CreateSettingMsg{
+		Key:   "limit.other",
+		Type:  setting.TypeInt,
+		Value: json.RawMessage(`5`),
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, respBody, err := authedDo(s.c, http.MethodGet, settingsURL, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var m setting.Map
+	err = json.Unmarshal(respBody, &m)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), m, 2)
+	require.Equal(s.T(), "Acme", m.String("brand.title", ""))
+	resp, _, err = authedDo(s.c, http.MethodPut, settingsURL+"/brand.title", u.ID, tok, UpdateSettingMsg{Value: json.RawMessage(`"Acme Co"`)})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, settingsURL+"/brand.title", u.ID, tok, UpdateSettingMsg{Value: json.RawMessage(`"Acme Incorporated"`)})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, settingsURL+"/limit.users", u.ID, tok, UpdateSettingMsg{Value: json.RawMessage(`50`)})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, respBody, err = authedDo(s.c, http.MethodGet, settingsURL+"/brand.title", u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var v setting.Instance
+	err = json.Unmarshal(respBody, &v)
+	require.Nil(s.T(), err)
+	require.JSONEq(s.T(), `"Acme Co"`, string(v.Value))
+
+	// root can edit the locked setting, then delete it
+	resp, _, err = authedDo(s.c, http.MethodPut, settingsURL+"/limit.users", s.srv.ST.RootUser, s.token, UpdateSettingMsg{Value: json.RawMessage(`50`)})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, settingsURL+"/limit.users", u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, settingsURL+"/limit.users", s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodGet, settingsURL+"/limit.users", s.srv.ST.RootUser, s.token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// regular users can read but not edit
+	rUser, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	rUser.Meta.Status = models.StatusActive
+	err = rUser.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	rTok, err := tokenFor(s.c, s.ts.URL, rUser.ID, rUser.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, settingsURL+"/brand.title", rUser.ID, rTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, settingsURL+"/brand.title", rUser.ID, rTok, UpdateSettingMsg{Value: json.RawMessage(`"X"`)})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// other orgs cannot read
+	_, uOther, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	otherTok, err := tokenFor(s.c, s.ts.URL, uOther.ID, uOther.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, settingsURL, uOther.ID, otherTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/nonce"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// nonceLen is the number of random bytes in a nonce made by SignRequest
+const nonceLen = 16
+
+// SignRequest adds the signature headers for req, which has body, under secret
+func SignRequest(req *http.Request, secret string, body []byte) error {
+	n, err := security.RandomToken(nonceLen)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, n)
+	req.Header.Set(SignatureHeader, security.SignRequest(secret, req.Method, req.URL.Path, timestamp, n, body))
+	return nil
+}
+
+// apiSecrets returns the secrets that may sign a token request for u:
+// the api secret, and the previous one while a rotation grace period lasts
+func apiSecrets(u user.Instance) []string {
+	secrets := []string{u.APISecret}
+	if u.APISecretValid(u.PrevAPISecret, time.Now().Unix()) {
+		secrets = append(secrets, u.PrevAPISecret)
+	}
+	return secrets
+}
+
+// verifyTokenRequest checks that r was signed by id with one of secrets,
+// within the allowed clock skew, and records the nonce so r cannot be
+// replayed; the unsigned TokenRequestHeader is accepted instead only
+// when LegacyTokenRequests is set
+// on failure the errAuthFailed response is written and false is returned
+func (srv *Instance) verifyTokenRequest(w http.ResponseWriter, r *http.Request, id string, secrets []string) bool {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	signature := r.Header.Get(SignatureHeader)
+	if len(signature) == 0 {
+		tokenRequest := r.Header.Get(TokenRequestHeader)
+		if !srv.ST.LegacyTokenRequests || len(tokenRequest) == 0 {
+			http.Error(w, errAuthFailed, http.StatusUnauthorized)
+			return false
+		}
+		for _, secret := range secrets {
+			if tokenRequest == security.EncodedSHA256(id+secret) {
+				return true
+			}
+		}
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return false
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	requestNonce := r.Header.Get(NonceHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(requestNonce) == 0 {
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return false
+	}
+	now := time.Now().Unix()
+	skew := int64(srv.ST.RequestSigningSkew / time.Second)
+	if ts < now-skew || ts > now+skew {
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return false
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	verified := false
+	for _, secret := range secrets {
+		if security.VerifyRequest(signature, secret, r.Method, r.URL.Path, timestamp, requestNonce, body) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		return false
+	}
+
+	// the nonce only needs to be kept while the timestamp is accepted
+	err = nonce.Use(ctx, srv.ST.Master, id, requestNonce, ts+skew)
+	if err != nil {
+		switch err {
+		case nonce.ErrReplay, models.ErrDisallowedValue:
+			http.Error(w, errAuthFailed, http.StatusUnauthorized)
+		default:
+			sugar.Debugw("use nonce",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return false
+	}
+	_, err = nonce.Prune(ctx, srv.ST.Master, now)
+	if err != nil {
+		sugar.Debugw("prune nonces",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+	return true
+}
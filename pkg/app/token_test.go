@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
-	jwt_go "github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
 	"github.com/grokloc/grokloc-go/pkg/security"
 	"github.com/grokloc/grokloc-go/pkg/util"
 	"github.com/stretchr/testify/require"
@@ -19,7 +20,8 @@ func (s *SessionSuite) TestNewToken() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+"/token", nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, s.srv.ST.RootUser)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(s.srv.ST.RootUser+s.srv.ST.RootUserAPISecret))
+	err = SignRequest(req, s.srv.ST.RootUserAPISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
@@ -50,26 +52,84 @@ func (s *SessionSuite) TestNewTokenMissingHeader() {
 	req.Header.Add(IDHeader, s.srv.ST.RootUser)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
-	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
 }
 
 func (s *SessionSuite) TestNewTokenMalformedHeader() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+"/token", nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, s.srv.ST.RootUser)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(uuid.NewString()))
+	err = SignRequest(req, uuid.NewString(), nil)
+	require.Nil(s.T(), err)
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// a timestamp that is not a number
+	req.Header.Set(TimestampHeader, "now")
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *SessionSuite) TestNewTokenReplay() {
+	req, err := http.NewRequest(http.MethodPut, s.ts.URL+"/token", nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, s.srv.ST.RootUser)
+	err = SignRequest(req, s.srv.ST.RootUserAPISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// the same signed request again
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
 }
 
+func (s *SessionSuite) TestNewTokenSkew() {
+	id, secret := s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret
+	skew := int64(s.srv.ST.RequestSigningSkew / time.Second)
+	for _, offset := range []int64{-skew - 60, skew + 60} {
+		req, err := http.NewRequest(http.MethodPut, s.ts.URL+"/token", nil)
+		require.Nil(s.T(), err)
+		req.Header.Add(IDHeader, id)
+		timestamp := strconv.FormatInt(time.Now().Unix()+offset, 10)
+		n := uuid.NewString()
+		req.Header.Add(TimestampHeader, timestamp)
+		req.Header.Add(NonceHeader, n)
+		req.Header.Add(SignatureHeader, security.SignRequest(secret, http.MethodPut, "/token", timestamp, n, nil))
+		resp, err := s.c.Do(req)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func (s *SessionSuite) TestNewTokenLegacy() {
+	legacy := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPut, s.ts.URL+"/token", nil)
+		require.Nil(s.T(), err)
+		req.Header.Add(IDHeader, s.srv.ST.RootUser)
+		req.Header.Add(TokenRequestHeader, security.EncodedSHA256(s.srv.ST.RootUser+s.srv.ST.RootUserAPISecret))
+		resp, err := s.c.Do(req)
+		require.Nil(s.T(), err)
+		return resp
+	}
+
+	// refused unless enabled
+	require.Equal(s.T(), http.StatusUnauthorized, legacy().StatusCode)
+	s.srv.ST.LegacyTokenRequests = true
+	defer func() { s.srv.ST.LegacyTokenRequests = false }()
+	require.Equal(s.T(), http.StatusOK, legacy().StatusCode)
+}
+
 func (s *SessionSuite) TestOtherUsersToken() {
 	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
-	claims, err := jwt.New(*u)
+	claims, err := jwt.New(*u, s.srv.ST.AccessTokenExpiration, nil)
 	require.Nil(s.T(), err)
-	token := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(u.ID + string(s.srv.ST.SigningKey)))
+	signedToken, err := s.srv.ST.SigningKeys.Sign(claims)
 	require.Nil(s.T(), err)
 	req, err := http.NewRequest(http.MethodGet, s.ts.URL+"/verify", nil)
 	require.Nil(s.T(), err)
@@ -79,3 +139,201 @@ func (s *SessionSuite) TestOtherUsersToken() {
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
 }
+
+func (s *SessionSuite) TestTokenClaims() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	verify := func(claims *jwt.Claims) int {
+		signedToken, err := s.srv.ST.SigningKeys.Sign(claims)
+		require.Nil(s.T(), err)
+		resp, _, err := authedDo(s.c, http.MethodGet, s.ts.URL+"/verify", u.ID, &Token{Bearer: signedToken}, nil)
+		require.Nil(s.T(), err)
+		return resp.StatusCode
+	}
+	valid := func() *jwt.Claims {
+		claims, err := jwt.New(*u, s.srv.ST.AccessTokenExpiration, nil)
+		require.Nil(s.T(), err)
+		return claims
+	}
+	require.Equal(s.T(), http.StatusOK, verify(valid()))
+
+	claims := valid()
+	claims.Issuer = uuid.NewString()
+	require.Equal(s.T(), http.StatusUnauthorized, verify(claims))
+	claims = valid()
+	claims.Audience = uuid.NewString()
+	require.Equal(s.T(), http.StatusUnauthorized, verify(claims))
+	claims = valid()
+	claims.Id = ""
+	require.Equal(s.T(), http.StatusUnauthorized, verify(claims))
+	claims = valid()
+	claims.NotBefore = time.Now().Add(time.Hour).Unix()
+	require.Equal(s.T(), http.StatusUnauthorized, verify(claims))
+
+	// expiration is only checked past the leeway, and age regardless of it
+	claims = valid()
+	claims.ExpiresAt = time.Now().Add(-s.srv.ST.TokenLeeway / 2).Unix()
+	require.Equal(s.T(), http.StatusOK, verify(claims))
+	claims = valid()
+	claims.ExpiresAt = time.Now().Add(-2 * s.srv.ST.TokenLeeway).Unix()
+	require.Equal(s.T(), http.StatusUnauthorized, verify(claims))
+	claims = valid()
+	claims.IssuedAt = time.Now().Add(-2 * s.srv.ST.TokenMaxAge).Unix()
+	require.Equal(s.T(), http.StatusUnauthorized, verify(claims))
+
+	resp, _, err := authedDo(s.c, http.MethodGet, s.ts.URL+"/verify", u.ID, &Token{Bearer: uuid.NewString()}, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *SessionSuite) TestRefreshToken() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL+"/token", u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), tok.Refresh)
+	require.Greater(s.T(), tok.RefreshExpires, tok.Expires)
+	refreshURL := s.ts.URL + "/token" + RefreshPath
+
+	// rotate
+	resp, respBody, err := authedDo(s.c, http.MethodPut, refreshURL, u.ID, tok, RefreshTokenMsg{Refresh: tok.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var rotated Token
+	err = json.Unmarshal(respBody, &rotated)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), tok.Refresh, rotated.Refresh)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+"/verify", u.ID, &rotated, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// another user cannot use the refresh token
+	resp, _, err = authedDo(s.c, http.MethodPut, refreshURL, s.srv.ST.RootUser, tok, RefreshTokenMsg{Refresh: rotated.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// reuse of the first refresh token revokes the rotated one
+	resp, _, err = authedDo(s.c, http.MethodPut, refreshURL, u.ID, tok, RefreshTokenMsg{Refresh: tok.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, refreshURL, u.ID, tok, RefreshTokenMsg{Refresh: rotated.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// malformed
+	resp, _, err = authedDo(s.c, http.MethodPut, refreshURL, u.ID, tok, map[string]string{})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *UserSuite) TestLogout() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	other, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	readURL := s.ts.URL + UserRoute + "/" + u.ID
+
+	resp, _, err := authedDo(s.c, http.MethodDelete, s.ts.URL+TokenRoute, u.ID, tok, RefreshTokenMsg{Refresh: tok.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// the token and its refresh token are revoked
+	resp, _, err = authedDo(s.c, http.MethodGet, readURL, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+RefreshRoute, u.ID, tok, RefreshTokenMsg{Refresh: tok.Refresh})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// other sessions are unaffected
+	resp, _, err = authedDo(s.c, http.MethodGet, readURL, u.ID, other, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *UserSuite) TestRevokeAllTokens() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	other, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	readURL := s.ts.URL + UserRoute + "/" + u.ID
+
+	resp, _, err := authedDo(s.c, http.MethodDelete, s.ts.URL+TokenRoute+AllPath, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	for _, t := range []*Token{tok, other} {
+		resp, _, err = authedDo(s.c, http.MethodGet, readURL, u.ID, t, nil)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+		resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+RefreshRoute, u.ID, t, RefreshTokenMsg{Refresh: t.Refresh})
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// new tokens work
+	tok, err = tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, readURL, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *UserSuite) TestStatusChangeRevokesTokens() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+
+	// a deactivation and reactivation leaves earlier tokens revoked
+	for _, status := range []models.Status{models.StatusInactive, models.StatusActive} {
+		resp, _, err := authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+u.ID, s.srv.ST.RootUser, s.token, UpdateStatusMsg{Status: status})
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	}
+	resp, _, err := authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *UserSuite) TestJWKS() {
+	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+
+	// another service verifies with only the published keys
+	resp, err := s.c.Get(s.ts.URL + JWKSRoute)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var jwks jwt.JWKS
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	require.Nil(s.T(), err)
+	resp.Body.Close()
+	claims, err := jwt.Decode(tok.Bearer, jwks)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.ID, claims.Subject)
+
+	// after a rollover, tokens signed with the old key still work
+	next, err := jwt.GenerateKey()
+	require.Nil(s.T(), err)
+	s.srv.ST.SigningKeys.Rotate(next, s.srv.ST.AccessTokenExpiration)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	tokNext, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	_, err = jwt.Decode(tokNext.Bearer, jwks)
+	require.Error(s.T(), err)
+	resp, err = s.c.Get(s.ts.URL + JWKSRoute)
+	require.Nil(s.T(), err)
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	require.Nil(s.T(), err)
+	resp.Body.Close()
+	require.Len(s.T(), jwks.Keys, 2)
+	_, err = jwt.Decode(tokNext.Bearer, jwks)
+	require.Nil(s.T(), err)
+}
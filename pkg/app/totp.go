@@ -0,0 +1,478 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/lockout"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/totp"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+)
+
+// TOTPIssuer names the service in authenticator apps
+const TOTPIssuer = "GrokLOC"
+
+// LoginChallenge is returned by Login, with status 202, for users
+// enrolled in two-factor auth; the challenge is completed with LoginVerify
+type LoginChallenge struct {
+	ID        string `json:"id"`
+	Org       string `json:"org"`
+	Challenge string `json:"challenge"`
+	Expires   int64  `json:"expires"`
+}
+
+// LoginVerifyMsg is what a client should marshal to send as a json body to LoginVerify
+// Code is an authenticator code or a recovery code
+type LoginVerifyMsg struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// TOTPCodeMsg is the body format for confirming or disabling two-factor auth
+type TOTPCodeMsg struct {
+	Code string `json:"code"`
+}
+
+// TOTPEnrollment is returned by EnrollTOTP, the only time the seed
+// and recovery codes are shown
+type TOTPEnrollment struct {
+	totp.Enrollment
+	URI string `json:"uri"`
+}
+
+// UpdateRequire2FAMsg is the body format for UpdateOrgRequire2FA
+type UpdateRequire2FAMsg struct {
+	Required bool `json:"required"`
+}
+
+// errChallengeInvalid is the response for any unusable challenge
+const errChallengeInvalid = "login challenge invalid"
+
+// challenge starts the second step of a password login, writing the
+// LoginChallenge response
+func (srv Instance) challenge(w http.ResponseWriter, r *http.Request, o org.Instance, u user.Instance, scopes []string) {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	now := time.Now()
+	expires := now.Add(srv.ST.LoginChallengeExpiration).Unix()
+	c, err := totp.NewChallenge(ctx, srv.ST.Master, u.ID, jwt.JoinScopes(scopes), expires)
+	if err != nil {
+		sugar.Debugw("new login challenge",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// expired challenges are only clutter, so failing to prune is not fatal
+	_, err = totp.PruneChallenges(ctx, srv.ST.Master, now.Unix())
+	if err != nil {
+		sugar.Debugw("prune login challenges",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+
+	bs, err := json.Marshal(LoginChallenge{ID: u.ID, Org: o.ID, Challenge: c, Expires: expires})
+	if err != nil {
+		sugar.Debugw("marshal login challenge",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// LoginVerify completes a challenged login with a two-factor code and
+// returns a new JWT
+func (srv *Instance) LoginVerify(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m LoginVerifyMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil || len(m.Challenge) == 0 || len(m.Code) == 0 {
+		http.Error(w, "malformed login verify", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Unix()
+	c, err := totp.ReadChallenge(ctx, srv.ST.Master, m.Challenge)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, errChallengeInvalid, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read login challenge",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if c.Expires < now {
+		http.Error(w, "login challenge expired", http.StatusUnauthorized)
+		return
+	}
+
+	// failures also count against the user, across challenges
+	if srv.lockedOut(w, r, lockout.KindUser, c.User) {
+		return
+	}
+	err = totp.Verify(ctx, srv.ST.Master, srv.ST.Key, c.User, m.Code, now)
+	if err != nil {
+		if err == totp.ErrInvalidCode || err == sql.ErrNoRows {
+			failErr := c.Fail(ctx, srv.ST.Master)
+			if failErr != nil {
+				sugar.Debugw("fail login challenge",
+					"reqid", middleware.GetReqID(ctx),
+					"err", failErr)
+			}
+			srv.fail(ctx, lockout.KindUser, c.User)
+			http.Error(w, totp.ErrInvalidCode.Error(), http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("verify totp",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// a concurrent request with the same challenge may have won
+	err = c.Complete(ctx, srv.ST.Master)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, errChallengeInvalid, http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("complete login challenge",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// statuses may have changed since the password was checked
+	u, err := user.Read(ctx, srv.ST.Master, srv.ST.Key, c.User)
+	if err != nil {
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	o, err := org.Read(ctx, srv.ST.Master, u.Org)
+	if err != nil {
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if u.Meta.Status != models.StatusActive {
+		http.Error(w, "user not active", http.StatusForbidden)
+		return
+	}
+	if o.Meta.Status != models.StatusActive {
+		http.Error(w, "org not active", http.StatusForbidden)
+		return
+	}
+
+	scopes := intersectScopes(allowedScopes(srv.roleFor(*o, *u)), jwt.SplitScopes(c.Scope))
+	tok, err := srv.issueToken(ctx, *u, scopes)
+	if err != nil {
+		sugar.Debugw("issue token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.succeed(ctx, u.ID)
+
+	bs, err := json.Marshal(LoginResponse{ID: u.ID, Org: o.ID, Token: *tok})
+	if err != nil {
+		sugar.Debugw("marshal login response",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// ownTOTP checks that the caller is the user given by the IDParam;
+// otherwise the error response is written and ok is false
+func ownTOTP(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	ctx := r.Context()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	// the seed is a credential only its user should see
+	if session.User.ID != id {
+		http.Error(w, "cannot enroll another user", http.StatusForbidden)
+		return session, false
+	}
+	return session, true
+}
+
+// readTOTPCode reads a TOTPCodeMsg body; required is whether an empty
+// code is malformed
+func (srv Instance) readTOTPCode(w http.ResponseWriter, r *http.Request, required bool) (string, bool) {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return "", false
+	}
+	var m TOTPCodeMsg
+	if len(body) != 0 {
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			http.Error(w, "malformed totp code msg", http.StatusBadRequest)
+			return "", false
+		}
+	}
+	if required && len(m.Code) == 0 {
+		http.Error(w, "malformed totp code msg", http.StatusBadRequest)
+		return "", false
+	}
+	return m.Code, true
+}
+
+// EnrollTOTP starts two-factor enrollment for the calling user,
+// returning the seed and recovery codes
+// enrolling again before confirming replaces the seed
+func (srv Instance) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ownTOTP(w, r)
+	if !ok {
+		return
+	}
+
+	e, err := totp.Enroll(ctx, srv.ST.Master, srv.ST.Key, session.User.ID)
+	if err != nil {
+		if err == models.ErrConflict {
+			http.Error(w, "two-factor already enabled", http.StatusConflict)
+			return
+		}
+		sugar.Debugw("enroll totp",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(TOTPEnrollment{Enrollment: *e, URI: e.URI(TOTPIssuer, session.User.Email)})
+	if err != nil {
+		sugar.Debugw("marshal totp enrollment",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// ConfirmTOTP completes two-factor enrollment for the calling user
+// with a code from their authenticator; password logins need a second
+// factor from then on
+func (srv Instance) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	session, ok := ownTOTP(w, r)
+	if !ok {
+		return
+	}
+	code, ok := srv.readTOTPCode(w, r, true)
+	if !ok {
+		return
+	}
+
+	err := totp.Confirm(ctx, srv.ST.Master, srv.ST.Key, session.User.ID, code, time.Now().Unix())
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			http.Error(w, "two-factor not enrolled", http.StatusNotFound)
+		case models.ErrConflict:
+			http.Error(w, "two-factor already enabled", http.StatusConflict)
+		case totp.ErrInvalidCode:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			sugar.Debugw("confirm totp",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DisableTOTP removes two-factor auth from a user
+// users must present a current code to disable their own; managers
+// can reset it for users they manage, e.g. after a lost device
+func (srv Instance) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	self := session.User.ID == u.ID
+	code, ok := srv.readTOTPCode(w, r, self)
+	if !ok {
+		return
+	}
+
+	if self {
+		err := totp.Verify(ctx, srv.ST.Master, srv.ST.Key, u.ID, code, time.Now().Unix())
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				http.Error(w, "two-factor not enabled", http.StatusNotFound)
+			case totp.ErrInvalidCode:
+				http.Error(w, err.Error(), http.StatusForbidden)
+			default:
+				sugar.Debugw("verify totp",
+					"reqid", middleware.GetReqID(ctx),
+					"err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	err := totp.Disable(ctx, srv.ST.Master, u.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "two-factor not enabled", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("disable totp",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateOrgRequire2FA sets whether members of an org must use a second
+// factor for password logins
+func (srv Instance) UpdateOrgRequire2FA(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	if !can(role, ActionUpdateOrg2FA) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+	if role != models.RoleRoot && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m UpdateRequire2FAMsg
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		http.Error(w, "malformed require 2fa msg", http.StatusBadRequest)
+		return
+	}
+
+	o, err := org.Read(ctx, srv.ST.Master, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "org not found or inactive", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	err = o.UpdateRequire2FA(ctx, srv.ST.Master, m.Required)
+	if err != nil {
+		sugar.Debugw("update require 2fa",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
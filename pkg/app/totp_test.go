@@ -0,0 +1,156 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	"github.com/grokloc/grokloc-go/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// post sends body as json to url without auth
+func (s *UserSuite) post(url string, body interface{}) (*http.Response, []byte) {
+	bs, err := json.Marshal(body)
+	require.Nil(s.T(), err)
+	resp, err := s.c.Post(url, "application/json", bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	return resp, respBody
+}
+
+// totpCode is the authenticator code for seed offset steps from now
+func (s *UserSuite) totpCode(seed string, offset int64) string {
+	code, err := security.TOTPCode(seed, security.TOTPStep(time.Now())+offset)
+	require.Nil(s.T(), err)
+	return code
+}
+
+func (s *UserSuite) TestTOTP() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	ownerToken, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), email, o.ID, derived)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	userToken, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	totpURL := s.ts.URL + UserRoute + "/" + u.ID + TOTPPath
+	loginMsg := LoginMsg{Org: o.ID, Email: email, Password: password}
+
+	// only the user can enroll themself
+	resp, _, err := authedDo(s.c, http.MethodPost, totpURL, owner.ID, ownerToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, body, err := authedDo(s.c, http.MethodPost, totpURL, u.ID, userToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	var e TOTPEnrollment
+	err = json.Unmarshal(body, &e)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), e.Seed)
+	require.NotEmpty(s.T(), e.URI)
+	require.NotEmpty(s.T(), e.RecoveryCodes)
+
+	// unconfirmed enrollment does not affect login
+	resp, _ = s.login(loginMsg)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	resp, _, err = authedDo(s.c, http.MethodPut, totpURL, u.ID, userToken, TOTPCodeMsg{Code: "000000x"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, totpURL, u.ID, userToken, TOTPCodeMsg{Code: s.totpCode(e.Seed, -1)})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPost, totpURL, u.ID, userToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+
+	// password login now needs the second step
+	resp, body = s.post(s.ts.URL+LoginRoute, loginMsg)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+	var c LoginChallenge
+	err = json.Unmarshal(body, &c)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.ID, c.ID)
+	require.NotEmpty(s.T(), c.Challenge)
+
+	resp, _ = s.post(s.ts.URL+LoginVerifyRoute, LoginVerifyMsg{Challenge: c.Challenge, Code: "000000x"})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = s.post(s.ts.URL+LoginVerifyRoute, LoginVerifyMsg{Challenge: uuid.NewString(), Code: s.totpCode(e.Seed, 0)})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	resp, body = s.post(s.ts.URL+LoginVerifyRoute, LoginVerifyMsg{Challenge: c.Challenge, Code: s.totpCode(e.Seed, 0)})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var l LoginResponse
+	err = json.Unmarshal(body, &l)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, &l.Token, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// challenges are one-time
+	resp, _ = s.post(s.ts.URL+LoginVerifyRoute, LoginVerifyMsg{Challenge: c.Challenge, Code: s.totpCode(e.Seed, 1)})
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// recovery codes complete a login
+	resp, body = s.post(s.ts.URL+LoginRoute, loginMsg)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+	err = json.Unmarshal(body, &c)
+	require.Nil(s.T(), err)
+	resp, _ = s.post(s.ts.URL+LoginVerifyRoute, LoginVerifyMsg{Challenge: c.Challenge, Code: e.RecoveryCodes[0]})
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// disabling your own needs a code
+	resp, _, err = authedDo(s.c, http.MethodDelete, totpURL, u.ID, userToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, totpURL, u.ID, userToken, TOTPCodeMsg{Code: e.RecoveryCodes[0]})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// the owner requires 2fa for the org; users cannot
+	twoFactorURL := s.ts.URL + OrgRoute + "/" + o.ID + TwoFactorPath
+	resp, _, err = authedDo(s.c, http.MethodPut, twoFactorURL, u.ID, userToken, UpdateRequire2FAMsg{Required: true})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+OrgRoute+"/"+s.srv.ST.RootOrg+TwoFactorPath, owner.ID, ownerToken, UpdateRequire2FAMsg{Required: true})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, twoFactorURL, owner.ID, ownerToken, UpdateRequire2FAMsg{Required: true})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	// the owner resets the user's 2fa, e.g. for a lost device, without a code
+	resp, _, err = authedDo(s.c, http.MethodDelete, totpURL, owner.ID, ownerToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodDelete, totpURL, owner.ID, ownerToken, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// unenrolled members of the org cannot log in with a password alone
+	resp, _ = s.login(loginMsg)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// root can lift the requirement
+	resp, _, err = authedDo(s.c, http.MethodPut, twoFactorURL, s.srv.ST.RootUser, s.token, UpdateRequire2FAMsg{Required: false})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _ = s.login(loginMsg)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
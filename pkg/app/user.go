@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -43,8 +44,10 @@ func (m *UpdateUserDisplayNameMsg) UnmarshalJSON(bs []byte) error {
 }
 
 // UpdateUserPasswordMsg is the body format to update the user password
+// CurrentPassword is required when users change their own password
 type UpdateUserPasswordMsg struct {
-	Password string `json:"password"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password,omitempty"`
 }
 
 // UnmarshalJSON is a custom unmarshal for UpdateUserPasswordMsg
@@ -59,6 +62,7 @@ func (m *UpdateUserPasswordMsg) UnmarshalJSON(bs []byte) error {
 		return errors.New("no password field found")
 	}
 	m.Password = v
+	m.CurrentPassword = t["current_password"]
 	return nil
 }
 
@@ -68,12 +72,12 @@ func (srv Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 	defer srv.ST.L.Sync() // nolint
 	sugar := srv.ST.L.Sugar()
 
-	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
 	if !ok {
-		panic("auth missing")
+		panic("role missing")
 	}
 
-	if authLevel == AuthUser {
+	if !can(role, ActionCreateUser) {
 		http.Error(w, "auth inadequate", http.StatusForbidden)
 		return
 	}
@@ -94,6 +98,9 @@ func (srv Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !srv.checkPassword(w, r, m.Org, m.Password) {
+		return
+	}
 	derived, err := security.DerivePassword(m.Password, srv.ST.Argon2Cfg)
 	if err != nil {
 		sugar.Debugw("derive password",
@@ -115,7 +122,7 @@ func (srv Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if authLevel == AuthOrg {
+	if !can(role, ActionManageOrgs) {
 		// must be in same org as prospective user
 		session, ok := ctx.Value(sessionCtxKey).(Session)
 		if !ok {
@@ -126,7 +133,6 @@ func (srv Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	// now, either root or org owner
 
 	err = u.Insert(ctx, srv.ST.Master, srv.ST.Key)
 	if err != nil {
@@ -155,9 +161,9 @@ func (srv Instance) ReadUser(w http.ResponseWriter, r *http.Request) {
 		panic("id missing")
 	}
 
-	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
 	if !ok {
-		panic("auth missing")
+		panic("role missing")
 	}
 	session, ok := ctx.Value(sessionCtxKey).(Session)
 	if !ok {
@@ -165,13 +171,11 @@ func (srv Instance) ReadUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var u *user.Instance
-	if authLevel == AuthUser {
-		if session.User.ID == id {
-			u = &session.User
-		} else {
-			http.Error(w, "cannot read another user", http.StatusForbidden)
-			return
-		}
+	if session.User.ID == id {
+		u = &session.User
+	} else if !can(role, ActionReadUsers) {
+		http.Error(w, "cannot read another user", http.StatusForbidden)
+		return
 	}
 
 	var err error
@@ -190,11 +194,9 @@ func (srv Instance) ReadUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if authLevel == AuthOrg {
-		if session.Org.ID != u.Org {
-			http.Error(w, "not a member of requested org", http.StatusForbidden)
-			return
-		}
+	if !can(role, ActionManageOrgs) && session.Org.ID != u.Org {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return
 	}
 
 	bs, err := json.Marshal(u)
@@ -212,8 +214,9 @@ func (srv Instance) ReadUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// UpdateUser updates user display name, password, or status
-func (srv Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
+// ReadUserByEmail reads the user in an org with the email query parameter
+// only root, org owners and admins can look up users by email
+func (srv Instance) ReadUserByEmail(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	defer srv.ST.L.Sync() // nolint
 	sugar := srv.ST.L.Sugar()
@@ -223,39 +226,80 @@ func (srv Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		panic("id missing")
 	}
 
-	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
 	if !ok {
-		panic("auth missing")
+		panic("role missing")
 	}
 	session, ok := ctx.Value(sessionCtxKey).(Session)
 	if !ok {
 		panic("session missing")
 	}
 
-	if authLevel == AuthUser {
+	if !can(role, ActionReadUsers) {
 		http.Error(w, "auth inadequate", http.StatusForbidden)
 		return
 	}
+	if !can(role, ActionManageOrgs) && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return
+	}
 
-	u, err := user.Read(ctx, srv.ST.RandomReplica(), srv.ST.Key, id)
+	email := r.URL.Query().Get(EmailQuery)
+	if len(email) == 0 {
+		http.Error(w, "missing: "+EmailQuery, http.StatusBadRequest)
+		return
+	}
+
+	u, err := user.ReadByEmail(ctx, srv.ST.RandomReplica(), srv.ST.Key, id, email)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "user not found or inactive", http.StatusNotFound)
+			http.Error(w, "user not found", http.StatusNotFound)
 			return
 		}
-		sugar.Debugw("read user",
+		sugar.Debugw("read user by email",
 			"reqid", middleware.GetReqID(ctx),
 			"err", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	if authLevel == AuthOrg {
-		if session.Org.ID != u.Org {
-			http.Error(w, "not a member of requested org", http.StatusForbidden)
-			return
-		}
+	bs, err := json.Marshal(u)
+	if err != nil {
+		sugar.Debugw("marshal user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// UpdateUser updates user display name, password, status or role
+// users can update their own display name, and their own password if
+// they supply the current one; status and role are for those who
+// manage the user, see readManagedUser
+func (srv Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+	self := session.User.ID == u.ID
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -289,6 +333,35 @@ func (srv Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &passwordMsg)
 	// err will be non-nil if unmarshal fails - we have a custom unmarshal here
 	if err == nil {
+		if u.Service {
+			http.Error(w, errServiceCredentials, http.StatusBadRequest)
+			return
+		}
+		if len(session.Actor) != 0 {
+			http.Error(w, errImpersonated, http.StatusForbidden)
+			return
+		}
+		if self {
+			if len(passwordMsg.CurrentPassword) == 0 {
+				http.Error(w, "missing current password", http.StatusBadRequest)
+				return
+			}
+			verified, err := security.VerifyPassword(passwordMsg.CurrentPassword, u.Password)
+			if err != nil {
+				sugar.Debugw("verify password",
+					"reqid", middleware.GetReqID(ctx),
+					"err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if !verified {
+				http.Error(w, "current password incorrect", http.StatusForbidden)
+				return
+			}
+		}
+		if !srv.checkPassword(w, r, u.Org, passwordMsg.Password) {
+			return
+		}
 		derived, err := security.DerivePassword(passwordMsg.Password, srv.ST.Argon2Cfg)
 		if err != nil {
 			sugar.Debugw("update password",
@@ -314,6 +387,10 @@ func (srv Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &statusMsg)
 	// err will be non-nil if unmarshal fails - we have a custom unmarshal here
 	if err == nil {
+		if self {
+			http.Error(w, "cannot update own status", http.StatusForbidden)
+			return
+		}
 		err := u.UpdateStatus(ctx, srv.ST.Master, statusMsg.Status)
 		if err != nil {
 			if err == models.ErrDisallowedValue {
@@ -330,6 +407,261 @@ func (srv Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// try matching on role update
+	var roleMsg UpdateRoleMsg
+	err = json.Unmarshal(body, &roleMsg)
+	// err will be non-nil if unmarshal fails - we have a custom unmarshal here
+	if err == nil {
+		if self || !can(role, ActionUpdateRoles) {
+			http.Error(w, "auth inadequate", http.StatusForbidden)
+			return
+		}
+		// roles can only be granted below the caller's own
+		if roleMsg.Role >= role {
+			http.Error(w, "role value disallowed", http.StatusForbidden)
+			return
+		}
+		err := u.UpdateRole(ctx, srv.ST.Master, roleMsg.Role)
+		if err != nil {
+			if err == models.ErrDisallowedValue {
+				http.Error(w, "role value disallowed", http.StatusBadRequest)
+				return
+			}
+			sugar.Debugw("update role",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	// no update formats matched
 	http.Error(w, "malformed update msg", http.StatusBadRequest)
 }
+
+// RotateAPISecretMsg is the optional body format for RotateAPISecret
+// Grace is the number of seconds the old secret is still accepted
+type RotateAPISecretMsg struct {
+	Grace int64 `json:"grace"`
+}
+
+// APISecretResponse is the new secret returned by RotateAPISecret,
+// along with when the old one stops being accepted (unixtime)
+type APISecretResponse struct {
+	APISecret            string `json:"api_secret"`
+	PrevAPISecretExpires int64  `json:"prev_api_secret_expires,omitempty"`
+}
+
+// readManagedUser reads the user given by the IDParam, if the caller is
+// that user and may update themself, or manages them: root, or an owner
+// or admin of their org with a higher role; otherwise the error response
+// is written and ok is false
+func (srv Instance) readManagedUser(w http.ResponseWriter, r *http.Request) (*user.Instance, bool) {
+	ctx := r.Context()
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	self := session.User.ID == id
+	if self && !can(role, ActionUpdateSelf) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return nil, false
+	}
+	if !self && !can(role, ActionManageUsers) {
+		http.Error(w, "cannot update another user", http.StatusForbidden)
+		return nil, false
+	}
+
+	u, err := user.Read(ctx, srv.ST.RandomReplica(), srv.ST.Key, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "user not found or inactive", http.StatusNotFound)
+			return nil, false
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !self {
+		if !can(role, ActionManageOrgs) && session.Org.ID != u.Org {
+			http.Error(w, "not a member of requested org", http.StatusForbidden)
+			return nil, false
+		}
+		if !srv.manages(role, session, *u) {
+			http.Error(w, "cannot manage a user with an equal or higher role", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	return u, true
+}
+
+// RotateAPISecret replaces a user's api secret
+// users can rotate their own; managers can rotate for
+// users they manage, e.g. when a secret has leaked
+func (srv Instance) RotateAPISecret(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	u, ok := srv.readManagedUser(w, r)
+	if !ok {
+		return
+	}
+	if u.Service {
+		http.Error(w, errServiceCredentials, http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var m RotateAPISecretMsg
+	if len(body) != 0 {
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			http.Error(w, "malformed rotate msg", http.StatusBadRequest)
+			return
+		}
+	}
+	grace := time.Duration(m.Grace) * time.Second
+	if grace < 0 || grace > srv.ST.MaxAPISecretGrace {
+		http.Error(w, "grace out of range", http.StatusBadRequest)
+		return
+	}
+
+	err = u.RotateAPISecret(ctx, srv.ST.Master, srv.ST.Key, grace)
+	if err != nil {
+		sugar.Debugw("rotate api secret",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(APISecretResponse{
+		APISecret:            u.APISecret,
+		PrevAPISecretExpires: u.PrevAPISecretExpires,
+	})
+	if err != nil {
+		sugar.Debugw("marshal api secret",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// SearchUsers finds users in an org by email and/or display name prefix
+// only root, org owners and admins can search
+func (srv Instance) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer srv.ST.L.Sync() // nolint
+	sugar := srv.ST.L.Sugar()
+
+	id := chi.URLParam(r, IDParam)
+	if len(id) == 0 {
+		panic("id missing")
+	}
+
+	role, ok := ctx.Value(roleCtxKey).(models.Role)
+	if !ok {
+		panic("role missing")
+	}
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	if !can(role, ActionReadUsers) {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+	if !can(role, ActionManageOrgs) && session.Org.ID != id {
+		http.Error(w, "not a member of requested org", http.StatusForbidden)
+		return
+	}
+
+	// each supplied prefix narrows the result
+	query := r.URL.Query()
+	var found []*user.Instance
+	searched := false
+	for _, field := range []string{user.SearchEmail, user.SearchDisplayName} {
+		prefix := query.Get(field)
+		if len(prefix) == 0 {
+			continue
+		}
+		matched, err := user.Search(ctx, srv.ST.RandomReplica(), srv.ST.Key, id, field, prefix)
+		if err != nil {
+			if err == models.ErrDisallowedValue {
+				http.Error(w, "search prefix too short", http.StatusBadRequest)
+				return
+			}
+			sugar.Debugw("search users",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !searched {
+			found = matched
+			searched = true
+			continue
+		}
+		ids := make(map[string]bool, len(matched))
+		for _, u := range matched {
+			ids[u.ID] = true
+		}
+		narrowed := make([]*user.Instance, 0, len(found))
+		for _, u := range found {
+			if ids[u.ID] {
+				narrowed = append(narrowed, u)
+			}
+		}
+		found = narrowed
+	}
+	if !searched {
+		http.Error(w, "missing search prefix", http.StatusBadRequest)
+		return
+	}
+
+	bs, err := json.Marshal(found)
+	if err != nil {
+		sugar.Debugw("marshal users",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
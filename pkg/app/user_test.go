@@ -49,7 +49,10 @@ func (s *UserSuite) SetupTest() {
 		log.Fatal(err.Error())
 	}
 	req.Header.Add(IDHeader, s.srv.ST.RootUser)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(s.srv.ST.RootUser+s.srv.ST.RootUserAPISecret))
+	err = SignRequest(req, s.srv.ST.RootUserAPISecret, nil)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 	resp, err := s.c.Do(req)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -66,6 +69,12 @@ func (s *UserSuite) SetupTest() {
 	s.token = &tok
 }
 
+func (s *UserSuite) TearDownTest() {
+	s.ts.Close()
+	s.srv.Close()
+	require.Nil(s.T(), s.srv.ST.Close())
+}
+
 func (s *UserSuite) TestCreateUser() {
 	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
@@ -95,7 +104,8 @@ func (s *UserSuite) TestCreateUser() {
 	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -127,7 +137,8 @@ func (s *UserSuite) TestCreateUserForbidden() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -165,7 +176,8 @@ func (s *UserSuite) TestCreateUserForbidden() {
 	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, rUser.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(rUser.ID+rUser.APISecret))
+	err = SignRequest(req, rUser.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err = io.ReadAll(resp.Body)
@@ -204,7 +216,8 @@ func (s *UserSuite) TestReadUser() {
 	err = json.Unmarshal(respBody, &uRead)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), u.ID, uRead.ID)
-	require.Equal(s.T(), u.APISecret, uRead.APISecret)
+	require.Empty(s.T(), uRead.APISecret) // not returned in read
+	require.NotContains(s.T(), string(respBody), u.APISecret)
 	require.Equal(s.T(), u.APISecretDigest, uRead.APISecretDigest)
 	require.Equal(s.T(), u.DisplayName, uRead.DisplayName)
 	require.Equal(s.T(), u.DisplayNameDigest, uRead.DisplayNameDigest)
@@ -227,7 +240,8 @@ func (s *UserSuite) TestReadUser() {
 	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err = io.ReadAll(resp.Body)
@@ -247,7 +261,7 @@ func (s *UserSuite) TestReadUser() {
 	err = json.Unmarshal(respBody, &uRead)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), rUser.ID, uRead.ID)
-	require.Equal(s.T(), rUser.APISecret, uRead.APISecret)
+	require.NotContains(s.T(), string(respBody), rUser.APISecret) // not returned in read
 	require.Equal(s.T(), rUser.APISecretDigest, uRead.APISecretDigest)
 	require.Equal(s.T(), rUser.DisplayName, uRead.DisplayName)
 	require.Equal(s.T(), rUser.DisplayNameDigest, uRead.DisplayNameDigest)
@@ -262,7 +276,8 @@ func (s *UserSuite) TestReadUser() {
 	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, rUser.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(rUser.ID+rUser.APISecret))
+	err = SignRequest(req, rUser.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err = io.ReadAll(resp.Body)
@@ -281,7 +296,7 @@ func (s *UserSuite) TestReadUser() {
 	err = json.Unmarshal(respBody, &uRead)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), rUser.ID, uRead.ID)
-	require.Equal(s.T(), rUser.APISecret, uRead.APISecret)
+	require.NotContains(s.T(), string(respBody), rUser.APISecret) // not returned in read
 	require.Equal(s.T(), rUser.APISecretDigest, uRead.APISecretDigest)
 	require.Equal(s.T(), rUser.DisplayName, uRead.DisplayName)
 	require.Equal(s.T(), rUser.DisplayNameDigest, uRead.DisplayNameDigest)
@@ -312,7 +327,8 @@ func (s *UserSuite) TestReadUserForbidden() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -338,7 +354,8 @@ func (s *UserSuite) TestReadUserForbidden() {
 	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, rUser.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(rUser.ID+rUser.APISecret))
+	err = SignRequest(req, rUser.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err = io.ReadAll(resp.Body)
@@ -384,7 +401,8 @@ func (s *UserSuite) TestUpdateUser() {
 	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -471,6 +489,67 @@ func (s *UserSuite) TestUpdateUser() {
 	require.Equal(s.T(), models.StatusActive, uRead.Meta.Status)
 }
 
+func (s *UserSuite) TestUpdateUserSelf() {
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	rUser, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, derived)
+	require.Nil(s.T(), err)
+	rUser.Meta.Status = models.StatusActive
+	err = rUser.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	tok, err := tokenFor(s.c, s.ts.URL, rUser.ID, rUser.APISecret)
+	require.Nil(s.T(), err)
+	selfURL := s.ts.URL + UserRoute + "/" + rUser.ID
+
+	// own display name
+	displayName := uuid.NewString()
+	resp, _, err := authedDo(s.c, http.MethodPut, selfURL, rUser.ID, tok, UpdateUserDisplayNameMsg{DisplayName: displayName})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	uRead, err := user.Read(s.ctx, s.srv.ST.RandomReplica(), s.srv.ST.Key, rUser.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), displayName, uRead.DisplayName)
+
+	// someone else's display name
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+u.ID, rUser.ID, tok, UpdateUserDisplayNameMsg{DisplayName: displayName})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// own password, missing or wrong current password
+	newPassword := uuid.NewString()
+	resp, _, err = authedDo(s.c, http.MethodPut, selfURL, rUser.ID, tok, UpdateUserPasswordMsg{Password: newPassword})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, selfURL, rUser.ID, tok, UpdateUserPasswordMsg{Password: newPassword, CurrentPassword: uuid.NewString()})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// own password, correct current password
+	resp, _, err = authedDo(s.c, http.MethodPut, selfURL, rUser.ID, tok, UpdateUserPasswordMsg{Password: newPassword, CurrentPassword: password})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+	uRead, err = user.Read(s.ctx, s.srv.ST.RandomReplica(), s.srv.ST.Key, rUser.ID)
+	require.Nil(s.T(), err)
+	verified, err := security.VerifyPassword(newPassword, uRead.Password)
+	require.Nil(s.T(), err)
+	require.True(s.T(), verified)
+
+	// the password change revoked the token
+	resp, _, err = authedDo(s.c, http.MethodPut, selfURL, rUser.ID, tok, UpdateStatusMsg{Status: models.StatusInactive})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	tok, err = tokenFor(s.c, s.ts.URL, rUser.ID, rUser.APISecret)
+	require.Nil(s.T(), err)
+
+	// own status stays reserved for owners and root
+	resp, _, err = authedDo(s.c, http.MethodPut, selfURL, rUser.ID, tok, UpdateStatusMsg{Status: models.StatusInactive})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
+
 func (s *UserSuite) TestUpdateUserForbidden() {
 	_, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
 	require.Nil(s.T(), err)
@@ -479,7 +558,8 @@ func (s *UserSuite) TestUpdateUserForbidden() {
 	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
 	require.Nil(s.T(), err)
 	req.Header.Add(IDHeader, u.ID)
-	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+u.APISecret))
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
 	resp, err := s.c.Do(req)
 	require.Nil(s.T(), err)
 	respBody, err := io.ReadAll(resp.Body)
@@ -524,6 +604,253 @@ func (s *UserSuite) TestUpdateUserNotFound() {
 	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
 }
 
+func (s *UserSuite) TestRotateAPISecret() {
+	o, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	u, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	rotateURL := s.ts.URL + UserRoute + "/" + u.ID + APISecretPath
+
+	// self, with a grace period
+	tok, err := tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	resp, respBody, err := authedDo(s.c, http.MethodPut, rotateURL, u.ID, tok, RotateAPISecretMsg{Grace: 60})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var rotated APISecretResponse
+	err = json.Unmarshal(respBody, &rotated)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), u.APISecret, rotated.APISecret)
+	require.NotZero(s.T(), rotated.PrevAPISecretExpires)
+
+	// both secrets work, and the current token is still good
+	_, err = tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Nil(s.T(), err)
+	_, err = tokenFor(s.c, s.ts.URL, u.ID, rotated.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// the owner rotates without a grace period, for a leak
+	ownerTok, err := tokenFor(s.c, s.ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, respBody, err = authedDo(s.c, http.MethodPut, rotateURL, owner.ID, ownerTok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var leaked APISecretResponse
+	err = json.Unmarshal(respBody, &leaked)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), leaked.PrevAPISecretExpires)
+	_, err = tokenFor(s.c, s.ts.URL, u.ID, u.APISecret)
+	require.Error(s.T(), err)
+	_, err = tokenFor(s.c, s.ts.URL, u.ID, rotated.APISecret)
+	require.Error(s.T(), err)
+	_, err = tokenFor(s.c, s.ts.URL, u.ID, leaked.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodGet, s.ts.URL+UserRoute+"/"+u.ID, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+
+	// a regular user cannot rotate another user, and grace is bounded
+	tok, err = tokenFor(s.c, s.ts.URL, u.ID, leaked.APISecret)
+	require.Nil(s.T(), err)
+	resp, _, err = authedDo(s.c, http.MethodPut, s.ts.URL+UserRoute+"/"+owner.ID+APISecretPath, u.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+	resp, _, err = authedDo(s.c, http.MethodPut, rotateURL, u.ID, tok,
+		RotateAPISecretMsg{Grace: int64(s.srv.ST.MaxAPISecretGrace.Seconds()) + 1})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *UserSuite) TestReadUserByEmail() {
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	rUser, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	err = rUser.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	err = rUser.UpdateStatus(s.ctx, s.srv.ST.Master, models.StatusActive)
+	require.Nil(s.T(), err)
+	emailURL := s.ts.URL + OrgRoute + "/" + o.ID + UserPath + "?" + EmailQuery + "="
+
+	// as root
+	req, err := http.NewRequest(http.MethodGet, emailURL+rUser.Email, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, s.srv.ST.RootUser)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(s.token.Bearer))
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var uRead user.Instance
+	err = json.Unmarshal(respBody, &uRead)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), rUser.ID, uRead.ID)
+
+	// not found
+	req, err = http.NewRequest(http.MethodGet, emailURL+uuid.NewString(), nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, s.srv.ST.RootUser)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(s.token.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// as org owner
+	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	respBody, err = io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var tok Token
+	err = json.Unmarshal(respBody, &tok)
+	require.Nil(s.T(), err)
+	req, err = http.NewRequest(http.MethodGet, emailURL+rUser.Email, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// as regular user
+	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, rUser.ID)
+	err = SignRequest(req, rUser.APISecret, nil)
+	require.Nil(s.T(), err)
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	respBody, err = io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	err = json.Unmarshal(respBody, &tok)
+	require.Nil(s.T(), err)
+	req, err = http.NewRequest(http.MethodGet, emailURL+u.Email, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, rUser.ID)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
+
+func (s *UserSuite) TestSearchUsers() {
+	o, u, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	prefix := uuid.NewString()[:8]
+	rUser, err := user.New(prefix+" "+uuid.NewString(), prefix+"@example.com", o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	err = rUser.Insert(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	// as root, by both fields
+	searchURL := s.ts.URL + OrgRoute + "/" + o.ID + UserPath + SearchPath
+	req, err := http.NewRequest(http.MethodGet, searchURL+"?email="+prefix+"&display_name="+prefix[:4], nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, s.srv.ST.RootUser)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(s.token.Bearer))
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var found []user.Instance
+	err = json.Unmarshal(respBody, &found)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 1)
+	require.Equal(s.T(), rUser.ID, found[0].ID)
+
+	// as org owner
+	req, err = http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	err = SignRequest(req, u.APISecret, nil)
+	require.Nil(s.T(), err)
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	respBody, err = io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var tok Token
+	err = json.Unmarshal(respBody, &tok)
+	require.Nil(s.T(), err)
+	req, err = http.NewRequest(http.MethodGet, searchURL+"?email="+prefix, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// prefix too short, or missing
+	req, err = http.NewRequest(http.MethodGet, searchURL+"?email="+prefix[:1], nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	req, err = http.NewRequest(http.MethodGet, searchURL, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// owner of another org
+	oOther, _, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+	req, err = http.NewRequest(http.MethodGet, s.ts.URL+OrgRoute+"/"+oOther.ID+UserPath+SearchPath+"?email="+prefix, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, u.ID)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(tok.Bearer))
+	resp, err = s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
+
+func (s *UserSuite) TestMigrateOnStart() {
+	_, owner, err := util.NewOrgOwner(s.ctx, s.srv.ST.Master, s.srv.ST.Key)
+	require.Nil(s.T(), err)
+
+	// put the owner back into the version 0 format, as a deployment from
+	// before keyed digests has it
+	_, err = s.srv.ST.Master.Exec("update users set display_name_digest = $1, email_digest = $2, schema_version = 0 where id = $3",
+		security.EncodedSHA256(owner.DisplayName), security.EncodedSHA256(owner.Email), owner.ID)
+	require.Nil(s.T(), err)
+	_, err = s.srv.ST.Master.Exec("delete from user_search_index where user_id = $1", owner.ID)
+	require.Nil(s.T(), err)
+	_, err = user.Read(s.ctx, s.srv.ST.Master, s.srv.ST.Key, owner.ID)
+	require.Equal(s.T(), models.ErrModelMigrate, err)
+
+	// a server started on the db migrates the row, so the owner signs in
+	srv, err := newInstance(s.srv.ST)
+	require.Nil(s.T(), err)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	tok, err := tokenFor(s.c, ts.URL, owner.ID, owner.APISecret)
+	require.Nil(s.T(), err)
+	resp, body, err := authedDo(s.c, http.MethodGet, ts.URL+UserRoute+"/"+owner.ID, owner.ID, tok, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var uRead user.Instance
+	require.Nil(s.T(), json.Unmarshal(body, &uRead))
+	require.Equal(s.T(), owner.Email, uRead.Email)
+	require.Equal(s.T(), user.SchemaVersion, uRead.Meta.SchemaVersion)
+	require.Equal(s.T(), owner.EmailDigest, uRead.EmailDigest)
+}
+
 func TestUserSuite(t *testing.T) {
 	suite.Run(t, new(UserSuite))
 }
@@ -2,12 +2,13 @@
 package jwt
 
 import (
-	"errors"
+	"crypto/rsa"
 	"fmt"
 	"strings"
 	"time"
 
 	jwt_go "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/models/user"
 )
 
@@ -15,32 +16,89 @@ import (
 const (
 	Authorization = "Authorization"
 	TokenType     = "Bearer"
-	Expiration    = 86400
 )
 
 // Claims are the JWT claims for the app
+// Scope is a space separated list of granted scopes (as in RFC 8693);
+// Subject is the user id and Id (jti) is unique to each token;
+// Watermark is the user's token watermark when the token was issued;
+// Act is set when another user is acting as the subject
 type Claims struct {
-	Scope string `json:"scope"`
-	Org   string `json:"org"`
+	Scope     string `json:"scope"`
+	Org       string `json:"org"`
+	Watermark int64  `json:"wmk"`
+	Act       *Actor `json:"act,omitempty"`
 	jwt_go.StandardClaims
 }
 
-// New returns a new Claims instance
-func New(u user.Instance) (*Claims, error) {
+// Actor is the user acting on behalf of the subject (the RFC 8693 act
+// claim), with the actor's token watermark so revoking the actor's
+// tokens also ends the impersonation
+type Actor struct {
+	Subject   string `json:"sub"`
+	Org       string `json:"org"`
+	Watermark int64  `json:"wmk"`
+}
+
+// New returns a new Claims instance granting scopes that expires after expiration
+func New(u user.Instance, expiration time.Duration, scopes []string) (*Claims, error) {
 	now := time.Now().Unix()
 	claims := &Claims{
-		"app",
+		JoinScopes(scopes),
 		u.Org,
+		u.TokenWatermark,
+		nil,
 		jwt_go.StandardClaims{
 			Audience:  u.EmailDigest,
-			ExpiresAt: now + int64(Expiration),
-			Id:        u.ID,
-			Issuer:    "grokLOC.com",
+			ExpiresAt: now + int64(expiration/time.Second),
+			Id:        uuid.NewString(),
+			Issuer:    Issuer,
 			IssuedAt:  now,
+			Subject:   u.ID,
 		}}
 	return claims, nil
 }
 
+// Impersonate returns a new Claims instance for u as with New, with
+// actor recorded as the user acting on u's behalf
+func Impersonate(u, actor user.Instance, expiration time.Duration, scopes []string) (*Claims, error) {
+	claims, err := New(u, expiration, scopes)
+	if err != nil {
+		return nil, err
+	}
+	claims.Act = &Actor{
+		Subject:   actor.ID,
+		Org:       actor.Org,
+		Watermark: actor.TokenWatermark,
+	}
+	return claims, nil
+}
+
+// Scopes returns the granted scopes
+func (c *Claims) Scopes() []string {
+	return SplitScopes(c.Scope)
+}
+
+// HasScope reports whether scope was granted
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinScopes formats scopes for the scope claim
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// SplitScopes parses a scope claim, ignoring extra whitespace
+func SplitScopes(scope string) []string {
+	return strings.Fields(scope)
+}
+
 // ToHeaderVal prepends the JWTTokenType
 func ToHeaderVal(token string) string {
 	return fmt.Sprintf("%s %s", TokenType, token)
@@ -52,18 +110,15 @@ func FromHeaderVal(s string) string {
 	return strings.TrimPrefix(s, fmt.Sprintf("%s ", TokenType))
 }
 
-// Decode returns the claims from a signed string jwt
-func Decode(id, token string, signingKey []byte) (*Claims, error) {
-	f := func(token *jwt_go.Token) (interface{}, error) {
-		return []byte(id + string(signingKey)), nil
-	}
-	parsed, err := jwt_go.ParseWithClaims(token, &Claims{}, f)
-	if err != nil {
-		return nil, err
-	}
-	claims, ok := parsed.Claims.(*Claims)
-	if ok {
-		return claims, nil
-	}
-	return nil, errors.New("Token claims")
+// PublicKeys finds verification keys by kid; it is satisfied by
+// KeySet on the server and by a JWKS fetched by other services
+type PublicKeys interface {
+	PublicKey(kid string) (*rsa.PublicKey, bool)
+}
+
+// Decode returns the claims from a signed string jwt,
+// verified with the key named by its kid header and checked only for
+// its times; see Verify for the rest
+func Decode(token string, keys PublicKeys) (*Claims, error) {
+	return Verify(token, keys, Expected{}, time.Now())
 }
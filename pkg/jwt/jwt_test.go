@@ -1,70 +1,234 @@
 package jwt
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"testing"
+	"time"
 
 	jwt_go "github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
-	"github.com/grokloc/grokloc-go/pkg/env"
-	"github.com/grokloc/grokloc-go/pkg/models"
 	"github.com/grokloc/grokloc-go/pkg/models/user"
-	"github.com/grokloc/grokloc-go/pkg/security"
-	"github.com/grokloc/grokloc-go/pkg/state"
-	"github.com/grokloc/grokloc-go/pkg/util"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
+// JWTSuite cannot use a state unit instance as it will create
+// an import cycle, so the keys are made directly
 type JWTSuite struct {
 	suite.Suite
-	ST *state.Instance
+	Keys *KeySet
+	User *user.Instance
 }
 
 func (s *JWTSuite) SetupTest() {
-	var err error
-	s.ST, err = state.New(env.Unit)
+	k, err := GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Keys = NewKeySet(k)
+	s.User, err = user.New(uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString())
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (s *JWTSuite) TestJWT() {
-	// make a new org and user as owner
-	o, u, err := util.NewOrgOwner(context.Background(), s.ST.Master, s.ST.Key)
+	u := s.User
+	claims, err := New(*u, 15*time.Minute, []string{"org:read", "user:read"})
 	require.Nil(s.T(), err)
-
-	claims, err := New(*u)
+	require.Equal(s.T(), claims.IssuedAt+int64(15*60), claims.ExpiresAt)
+	signedToken, err := s.Keys.Sign(claims)
 	require.Nil(s.T(), err)
-	token := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(u.ID + string(s.ST.SigningKey)))
+	claimsDecoded, err := Decode(signedToken, s.Keys)
 	require.Nil(s.T(), err)
-	claimsDecoded, err := Decode(u.ID, signedToken, s.ST.SigningKey)
-	require.Nil(s.T(), err)
-	require.Equal(s.T(), u.ID, claimsDecoded.Id)
+	require.Equal(s.T(), u.ID, claimsDecoded.Subject)
+	require.Equal(s.T(), claims.Id, claimsDecoded.Id)
 	require.Equal(s.T(), u.Org, claimsDecoded.Org)
+	require.Equal(s.T(), "org:read user:read", claimsDecoded.Scope)
+	require.True(s.T(), claimsDecoded.HasScope("org:read"))
+	require.False(s.T(), claimsDecoded.HasScope("org:write"))
 
-	// wrong user
-	password, err := security.DerivePassword(uuid.NewString(), s.ST.Argon2Cfg)
+	// each token has its own id
+	claimsOther, err := New(*u, 15*time.Minute, []string{"org:read", "user:read"})
 	require.Nil(s.T(), err)
-	uOther, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, password)
+	require.NotEqual(s.T(), claims.Id, claimsOther.Id)
+
+	// bad JWT
+	_, err = Decode(uuid.NewString(), s.Keys)
+	require.Error(s.T(), err)
+
+	// other key set
+	k, err := GenerateKey()
 	require.Nil(s.T(), err)
-	u.Meta.Status = models.StatusActive
-	err = uOther.Insert(context.Background(), s.ST.Master, s.ST.Key)
+	_, err = Decode(signedToken, NewKeySet(k))
+	require.Error(s.T(), err)
+
+	// HS256 is refused, even when keyed with something public
+	hs := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
+	hs.Header["kid"] = s.Keys.JWKS().Keys[0].Kid
+	hsToken, err := hs.SignedString([]byte(s.Keys.JWKS().Keys[0].N))
 	require.Nil(s.T(), err)
-	_, err = Decode(uOther.ID, signedToken, s.ST.SigningKey)
+	_, err = Decode(hsToken, s.Keys)
 	require.Error(s.T(), err)
 
-	// bad JWT
-	_, err = Decode(u.ID, uuid.NewString(), s.ST.SigningKey)
+	// no kid
+	noKid := jwt_go.NewWithClaims(jwt_go.SigningMethodRS256, claims)
+	noKidToken, err := noKid.SignedString(s.Keys.current.Private)
+	require.Nil(s.T(), err)
+	_, err = Decode(noKidToken, s.Keys)
 	require.Error(s.T(), err)
+}
+
+func (s *JWTSuite) TestVerify() {
+	u := *s.User
+	u.EmailDigest = uuid.NewString()
+	now := time.Now()
+	expected := Expected{
+		Issuer:   Issuer,
+		Audience: u.EmailDigest,
+		Leeway:   time.Minute,
+		MaxAge:   time.Hour,
+		Required: RequiredClaims,
+	}
+	sign := func(claims *Claims) string {
+		signedToken, err := s.Keys.Sign(claims)
+		require.Nil(s.T(), err)
+		return signedToken
+	}
+	claims, err := New(u, 15*time.Minute, nil)
+	require.Nil(s.T(), err)
+	_, err = Verify(sign(claims), s.Keys, expected, now)
+	require.Nil(s.T(), err)
+
+	// malformed tokens are told from bad signatures
+	_, err = Verify(uuid.NewString(), s.Keys, expected, now)
+	require.True(s.T(), errors.Is(err, ErrMalformed))
+	k, err := GenerateKey()
+	require.Nil(s.T(), err)
+	_, err = Verify(sign(claims), NewKeySet(k), expected, now)
+	require.True(s.T(), errors.Is(err, ErrSignature))
+
+	other := expected
+	other.Issuer = uuid.NewString()
+	_, err = Verify(sign(claims), s.Keys, other, now)
+	require.Equal(s.T(), ErrIssuer, err)
+	other = expected
+	other.Audience = uuid.NewString()
+	_, err = Verify(sign(claims), s.Keys, other, now)
+	require.Equal(s.T(), ErrAudience, err)
+
+	noOrg := *claims
+	noOrg.Org = ""
+	_, err = Verify(sign(&noOrg), s.Keys, expected, now)
+	require.True(s.T(), errors.Is(err, ErrMissingClaim))
+	// nbf is not set by New, so only checked when required
+	other = expected
+	other.Required = append([]string{ClaimNotBefore}, RequiredClaims...)
+	_, err = Verify(sign(claims), s.Keys, other, now)
+	require.True(s.T(), errors.Is(err, ErrMissingClaim))
+
+	// times are checked with leeway
+	_, err = Verify(sign(claims), s.Keys, expected, now.Add(15*time.Minute+30*time.Second))
+	require.Nil(s.T(), err)
+	_, err = Verify(sign(claims), s.Keys, expected, now.Add(17*time.Minute))
+	require.Equal(s.T(), ErrExpired, err)
+	_, err = Verify(sign(claims), s.Keys, expected, now.Add(-30*time.Second))
+	require.Nil(s.T(), err)
+	_, err = Verify(sign(claims), s.Keys, expected, now.Add(-2*time.Minute))
+	require.Equal(s.T(), ErrNotYetValid, err)
+	notBefore := *claims
+	notBefore.NotBefore = now.Add(10 * time.Minute).Unix()
+	_, err = Verify(sign(&notBefore), s.Keys, expected, now)
+	require.Equal(s.T(), ErrNotYetValid, err)
+
+	// long lived tokens are refused past the max age
+	long, err := New(u, 24*time.Hour, nil)
+	require.Nil(s.T(), err)
+	_, err = Verify(sign(long), s.Keys, expected, now.Add(2*time.Hour))
+	require.Equal(s.T(), ErrTooOld, err)
+	_, err = Verify(sign(long), s.Keys, Expected{}, now.Add(2*time.Hour))
+	require.Nil(s.T(), err)
+}
+
+func (s *JWTSuite) TestImpersonate() {
+	actor, err := user.New(uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	actor.TokenWatermark = 3
+	claims, err := Impersonate(*s.User, *actor, 5*time.Minute, []string{"org:read"})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), claims.IssuedAt+int64(5*60), claims.ExpiresAt)
+	signedToken, err := s.Keys.Sign(claims)
+	require.Nil(s.T(), err)
+	claimsDecoded, err := Decode(signedToken, s.Keys)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.User.ID, claimsDecoded.Subject)
+	require.Equal(s.T(), s.User.Org, claimsDecoded.Org)
+	require.NotNil(s.T(), claimsDecoded.Act)
+	require.Equal(s.T(), actor.ID, claimsDecoded.Act.Subject)
+	require.Equal(s.T(), actor.Org, claimsDecoded.Act.Org)
+	require.Equal(s.T(), int64(3), claimsDecoded.Act.Watermark)
+}
+
+func (s *JWTSuite) TestRotate() {
+	claims, err := New(*s.User, 15*time.Minute, nil)
+	require.Nil(s.T(), err)
+	before, err := s.Keys.Sign(claims)
+	require.Nil(s.T(), err)
+	oldKid := s.Keys.current.ID
+
+	next, err := GenerateKey()
+	require.Nil(s.T(), err)
+	s.Keys.Rotate(next, time.Hour)
+	after, err := s.Keys.Sign(claims)
+	require.Nil(s.T(), err)
 
-	// bad signing key
-	otherSigningKey, err := security.MakeKey(uuid.NewString())
+	// both verify, and the JWKS has both keys, current first
+	_, err = Decode(before, s.Keys)
 	require.Nil(s.T(), err)
-	_, err = Decode(u.ID, signedToken, otherSigningKey)
+	_, err = Decode(after, s.Keys)
+	require.Nil(s.T(), err)
+	jwks := s.Keys.JWKS()
+	require.Len(s.T(), jwks.Keys, 2)
+	require.Equal(s.T(), next.ID, jwks.Keys[0].Kid)
+	require.Equal(s.T(), oldKid, jwks.Keys[1].Kid)
+
+	// a retired key stops verifying once its retention passes
+	last, err := GenerateKey()
+	require.Nil(s.T(), err)
+	s.Keys.Rotate(last, -time.Second)
+	_, err = Decode(after, s.Keys)
 	require.Error(s.T(), err)
+	_, err = Decode(before, s.Keys)
+	require.Nil(s.T(), err)
+}
+
+func (s *JWTSuite) TestJWKS() {
+	claims, err := New(*s.User, 15*time.Minute, nil)
+	require.Nil(s.T(), err)
+	signedToken, err := s.Keys.Sign(claims)
+	require.Nil(s.T(), err)
+
+	// a verifier with only the published document can decode
+	bs, err := json.Marshal(s.Keys.JWKS())
+	require.Nil(s.T(), err)
+	var jwks JWKS
+	err = json.Unmarshal(bs, &jwks)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "RS256", jwks.Keys[0].Alg)
+	require.Equal(s.T(), "AQAB", jwks.Keys[0].E)
+	claimsDecoded, err := Decode(signedToken, jwks)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.User.ID, claimsDecoded.Subject)
+	_, ok := jwks.PublicKey(uuid.NewString())
+	require.False(s.T(), ok)
+}
+
+func (s *JWTSuite) TestScopes() {
+	require.Equal(s.T(), []string{"a", "b"}, SplitScopes(" a  b "))
+	require.Empty(s.T(), SplitScopes(""))
+	require.Equal(s.T(), "a b", JoinScopes([]string{"a", "b"}))
 }
 
 func (s *JWTSuite) TestHeaderVal() {
@@ -0,0 +1,202 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	jwt_go "github.com/dgrijalva/jwt-go"
+)
+
+// KeyBits is the RSA modulus size for generated keys
+const KeyBits = 2048
+
+// Key is an RSA signing key identified by ID, used as the kid header
+type Key struct {
+	ID      string
+	Private *rsa.PrivateKey
+}
+
+// NewKey wraps an existing private key, deriving its ID
+func NewKey(private *rsa.PrivateKey) *Key {
+	return &Key{ID: thumbprint(&private.PublicKey), Private: private}
+}
+
+// GenerateKey creates a new random Key
+func GenerateKey() (*Key, error) {
+	private, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(private), nil
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of public
+func thumbprint(public *rsa.PublicKey) string {
+	// members in lexicographic order, no whitespace
+	bs, err := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   encodeInt(big.NewInt(int64(public.E))),
+		Kty: "RSA",
+		N:   encodeInt(public.N),
+	})
+	if err != nil {
+		// only strings are marshaled
+		panic(err.Error())
+	}
+	sum := sha256.Sum256(bs)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// encodeInt is the base64url encoding of the big-endian bytes of i
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// KeySet holds the key that signs new tokens, and retired keys that
+// still verify tokens signed before a rollover
+type KeySet struct {
+	mu      sync.RWMutex
+	current *Key
+	retired map[string]retiredKey
+}
+
+// retiredKey is accepted for verification until expires (unixtime)
+type retiredKey struct {
+	key     *Key
+	expires int64
+}
+
+// NewKeySet returns a KeySet signing with current
+func NewKeySet(current *Key) *KeySet {
+	return &KeySet{current: current, retired: make(map[string]retiredKey)}
+}
+
+// Rotate makes next the signing key; the previous key stays valid for
+// verification for retain, which should be at least the token lifetime
+func (ks *KeySet) Rotate(next *Key, retain time.Duration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	now := time.Now().Unix()
+	for kid, r := range ks.retired {
+		if r.expires < now {
+			delete(ks.retired, kid)
+		}
+	}
+	ks.retired[ks.current.ID] = retiredKey{key: ks.current, expires: time.Now().Add(retain).Unix()}
+	ks.current = next
+}
+
+// Sign returns claims as a signed RS256 token with the current kid
+func (ks *KeySet) Sign(claims *Claims) (string, error) {
+	ks.mu.RLock()
+	current := ks.current
+	ks.mu.RUnlock()
+	token := jwt_go.NewWithClaims(jwt_go.SigningMethodRS256, claims)
+	token.Header["kid"] = current.ID
+	return token.SignedString(current.Private)
+}
+
+// PublicKey returns the verification key for kid, if it is current
+// or retired and unexpired
+func (ks *KeySet) PublicKey(kid string) (*rsa.PublicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.current.ID == kid {
+		return &ks.current.Private.PublicKey, true
+	}
+	r, ok := ks.retired[kid]
+	if !ok || r.expires < time.Now().Unix() {
+		return nil, false
+	}
+	return &r.key.Private.PublicKey, true
+}
+
+// JWK is a public key in RFC 7517 form
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the RFC 7517 key set document
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that verify tokens, current first
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := time.Now().Unix()
+	keys := []JWK{toJWK(ks.current)}
+	var retired []JWK
+	for _, r := range ks.retired {
+		if r.expires >= now {
+			retired = append(retired, toJWK(r.key))
+		}
+	}
+	// stable output for caches
+	sort.Slice(retired, func(i, j int) bool { return retired[i].Kid < retired[j].Kid })
+	return JWKS{Keys: append(keys, retired...)}
+}
+
+// toJWK describes the public part of k
+func toJWK(k *Key) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: jwt_go.SigningMethodRS256.Alg(),
+		Kid: k.ID,
+		N:   encodeInt(k.Private.PublicKey.N),
+		E:   encodeInt(big.NewInt(int64(k.Private.PublicKey.E))),
+	}
+}
+
+// PublicKey converts a JWK back to an RSA public key, for verifiers
+// working from a fetched JWKS
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.New("unsupported key type")
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// PublicKey returns the key in the set with kid, so a fetched JWKS can
+// be passed to Decode
+func (j JWKS) PublicKey(kid string) (*rsa.PublicKey, bool) {
+	for _, k := range j.Keys {
+		if k.Kid == kid {
+			public, err := k.PublicKey()
+			if err != nil {
+				return nil, false
+			}
+			return public, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,147 @@
+package jwt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	jwt_go "github.com/dgrijalva/jwt-go"
+)
+
+// Issuer is the iss claim of every token the app signs
+const Issuer = "grokLOC.com"
+
+// Claim names that may be listed in Expected.Required
+const (
+	ClaimAudience  = "aud"
+	ClaimExpiresAt = "exp"
+	ClaimID        = "jti"
+	ClaimIssuedAt  = "iat"
+	ClaimIssuer    = "iss"
+	ClaimNotBefore = "nbf"
+	ClaimOrg       = "org"
+	ClaimSubject   = "sub"
+)
+
+// RequiredClaims are the claims New always sets
+var RequiredClaims = []string{
+	ClaimAudience,
+	ClaimExpiresAt,
+	ClaimID,
+	ClaimIssuedAt,
+	ClaimIssuer,
+	ClaimOrg,
+	ClaimSubject,
+}
+
+// Verify errors; the error returned is, or wraps, one of these, so test
+// with errors.Is
+var (
+	ErrMalformed    = errors.New("token malformed")
+	ErrSignature    = errors.New("token signature invalid")
+	ErrMissingClaim = errors.New("token claim missing")
+	ErrIssuer       = errors.New("token issuer invalid")
+	ErrAudience     = errors.New("token audience invalid")
+	ErrExpired      = errors.New("token expired")
+	ErrNotYetValid  = errors.New("token not yet valid")
+	ErrTooOld       = errors.New("token too old")
+)
+
+// Expected is what Verify requires of a token beyond its signature
+// Issuer and Audience are not checked when empty; Leeway is the clock
+// skew allowed on exp, nbf and iat; MaxAge, if not zero, refuses tokens
+// issued longer ago regardless of exp, and makes iat required;
+// Required lists claims that must be present, by their Claim names
+type Expected struct {
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+	MaxAge   time.Duration
+	Required []string
+}
+
+// present reports whether the named claim is set in c
+func (c *Claims) present(name string) bool {
+	switch name {
+	case ClaimAudience:
+		return len(c.Audience) != 0
+	case ClaimExpiresAt:
+		return c.ExpiresAt != 0
+	case ClaimID:
+		return len(c.Id) != 0
+	case ClaimIssuedAt:
+		return c.IssuedAt != 0
+	case ClaimIssuer:
+		return len(c.Issuer) != 0
+	case ClaimNotBefore:
+		return c.NotBefore != 0
+	case ClaimOrg:
+		return len(c.Org) != 0
+	case ClaimSubject:
+		return len(c.Subject) != 0
+	}
+	panic("unknown claim name: " + name)
+}
+
+// Verify returns the claims from a signed string jwt, verified with the
+// key named by its kid header, once they meet e at now
+// exp, nbf and iat are always checked when present
+func Verify(token string, keys PublicKeys, e Expected, now time.Time) (*Claims, error) {
+	parser := jwt_go.Parser{
+		// only accept the algorithm we sign with
+		ValidMethods:         []string{jwt_go.SigningMethodRS256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	f := func(token *jwt_go.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errors.New("kid missing")
+		}
+		public, ok := keys.PublicKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown kid: %s", kid)
+		}
+		return public, nil
+	}
+	claims := &Claims{}
+	_, err := parser.ParseWithClaims(token, claims, f)
+	if err != nil {
+		var v *jwt_go.ValidationError
+		if errors.As(err, &v) && v.Errors&jwt_go.ValidationErrorMalformed != 0 {
+			return nil, fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+		}
+		return nil, fmt.Errorf("%w: %s", ErrSignature, err.Error())
+	}
+
+	required := e.Required
+	if e.MaxAge != 0 {
+		required = append([]string{ClaimIssuedAt}, required...)
+	}
+	for _, name := range required {
+		if !claims.present(name) {
+			return nil, fmt.Errorf("%w: %s", ErrMissingClaim, name)
+		}
+	}
+	if len(e.Issuer) != 0 && claims.Issuer != e.Issuer {
+		return nil, ErrIssuer
+	}
+	if len(e.Audience) != 0 && claims.Audience != e.Audience {
+		return nil, ErrAudience
+	}
+
+	unix := now.Unix()
+	leeway := int64(e.Leeway / time.Second)
+	if claims.ExpiresAt != 0 && claims.ExpiresAt+leeway < unix {
+		return nil, ErrExpired
+	}
+	if claims.NotBefore != 0 && claims.NotBefore-leeway > unix {
+		return nil, ErrNotYetValid
+	}
+	if claims.IssuedAt != 0 && claims.IssuedAt-leeway > unix {
+		return nil, ErrNotYetValid
+	}
+	if e.MaxAge != 0 && claims.IssuedAt+int64(e.MaxAge/time.Second)+leeway < unix {
+		return nil, ErrTooOld
+	}
+	return claims, nil
+}
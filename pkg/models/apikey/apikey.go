@@ -0,0 +1,209 @@
+// Package apikey models named api keys
+//
+// A user can hold any number of keys alongside their api secret, each
+// with its own label, optional expiry and optional scope restriction,
+// so a single script or CI job can be cut off without affecting others.
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// Encrypted is the key secret, encrypted with the key ring
+var Encrypted = models.Encrypted{
+	Table:   schemas.APIKeysTableName,
+	ID:      "id",
+	Columns: []string{"secret"},
+}
+
+// Instance is a single api key
+// Secret is only set on a new key or one read with Read; List leaves it empty
+// Scope is a space separated restriction on token scopes, empty for none;
+// Expires and LastUsed are unixtimes, zero for never
+type Instance struct {
+	ID           string `json:"id"`
+	User         string `json:"user"`
+	Label        string `json:"label"`
+	Secret       string `json:"-"`
+	SecretDigest string `json:"-"`
+	Scope        string `json:"scope,omitempty"`
+	Expires      int64  `json:"expires,omitempty"`
+	LastUsed     int64  `json:"last_used"`
+	Ctime        int64  `json:"ctime"`
+}
+
+// New creates a new key for user that hasn't been created before
+func New(user, label, scope string, expires int64) (*Instance, error) {
+	for _, v := range []string{user, label} {
+		if !security.SafeStr(v) {
+			return nil, errors.New("malformed api key arg")
+		}
+	}
+	if expires < 0 {
+		return nil, errors.New("malformed api key expires")
+	}
+	secret := uuid.NewString()
+	return &Instance{
+		ID:           uuid.NewString(),
+		User:         user,
+		Label:        label,
+		Secret:       secret,
+		SecretDigest: security.EncodedSHA256(secret),
+		Scope:        scope,
+		Expires:      expires,
+	}, nil
+}
+
+// Insert a new row.
+// a label already used by the user is models.ErrConflict
+func (k *Instance) Insert(ctx context.Context, db *sql.DB, key *security.KeyRing) error {
+	// make sure the key's user is in the db
+	qUser := fmt.Sprintf("select count(*) from %s where id = $1", schemas.UsersTableName)
+	var count int
+	err := db.QueryRowContext(ctx, qUser, k.User).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return models.ErrRelatedUser
+	}
+
+	encryptedSecret, err := key.Encrypt(k.Secret)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("insert into %s (id,user_id,label,secret,secret_digest,scope,expires) values ($1,$2,$3,$4,$5,$6,$7)",
+		schemas.APIKeysTableName)
+	result, err := db.ExecContext(ctx, q, k.ID, k.User, k.Label, encryptedSecret, k.SecretDigest, k.Scope, k.Expires)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return models.ErrConflict
+		}
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+const selectCols = "id,user_id,label,secret_digest,scope,expires,last_used,ctime"
+
+// scanner is satisfied by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan initializes an Instance from the columns in selectCols
+func scan(row scanner) (*Instance, error) {
+	k := &Instance{}
+	err := row.Scan(&k.ID, &k.User, &k.Label, &k.SecretDigest, &k.Scope, &k.Expires, &k.LastUsed, &k.Ctime)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Read initializes an Instance, including the secret, for the key id
+// belonging to user
+func Read(ctx context.Context, db *sql.DB, key *security.KeyRing, user, id string) (*Instance, error) {
+	q := fmt.Sprintf("select %s,secret from %s where id = $1 and user_id = $2",
+		selectCols, schemas.APIKeysTableName)
+	k := &Instance{}
+	var encryptedSecret string
+	err := db.QueryRowContext(ctx, q, id, user).Scan(
+		&k.ID,
+		&k.User,
+		&k.Label,
+		&k.SecretDigest,
+		&k.Scope,
+		&k.Expires,
+		&k.LastUsed,
+		&k.Ctime,
+		&encryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	k.Secret, err = key.Decrypt(encryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// List returns the keys for user ordered by label, without secrets
+func List(ctx context.Context, db *sql.DB, user string) ([]*Instance, error) {
+	q := fmt.Sprintf("select %s from %s where user_id = $1 order by label",
+		selectCols, schemas.APIKeysTableName)
+	rows, err := db.QueryContext(ctx, q, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*Instance{}
+	for rows.Next() {
+		k, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke deletes the key id belonging to user
+func Revoke(ctx context.Context, db *sql.DB, user, id string) error {
+	q := fmt.Sprintf("delete from %s where id = $1 and user_id = $2",
+		schemas.APIKeysTableName)
+	result, err := db.ExecContext(ctx, q, id, user)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Active reports whether the key is unexpired at now (unixtime)
+func (k *Instance) Active(now int64) bool {
+	return k.Expires == 0 || now < k.Expires
+}
+
+// Touch records that the key was used at now (unixtime)
+func (k *Instance) Touch(ctx context.Context, db *sql.DB, now int64) error {
+	q := fmt.Sprintf("update %s set last_used = $1 where id = $2",
+		schemas.APIKeysTableName)
+	result, err := db.ExecContext(ctx, q, now, k.ID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	k.LastUsed = now
+	return nil
+}
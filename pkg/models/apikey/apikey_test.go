@@ -0,0 +1,143 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type APIKeySuite struct {
+	suite.Suite
+	DB   *sql.DB
+	Key  *security.KeyRing
+	User *user.Instance
+}
+
+func (s *APIKeySuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Key, err = security.MakeKeyRing("test", uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	o, err := org.New(uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	o.Meta.Status = models.StatusActive
+	err = o.Insert(context.Background(), s.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.User, err = user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = s.User.Insert(context.Background(), s.DB, s.Key)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *APIKeySuite) TestInsertRead() {
+	expires := time.Now().Add(time.Hour).Unix()
+	k, err := New(s.User.ID, "ci", "org:read", expires)
+	require.Nil(s.T(), err)
+	err = k.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+
+	kRead, err := Read(context.Background(), s.DB, s.Key, s.User.ID, k.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), k.Secret, kRead.Secret)
+	require.Equal(s.T(), security.EncodedSHA256(k.Secret), kRead.SecretDigest)
+	require.Equal(s.T(), "ci", kRead.Label)
+	require.Equal(s.T(), "org:read", kRead.Scope)
+	require.Equal(s.T(), expires, kRead.Expires)
+	require.Zero(s.T(), kRead.LastUsed)
+	require.NotZero(s.T(), kRead.Ctime)
+
+	// scoped to the user
+	_, err = Read(context.Background(), s.DB, s.Key, uuid.NewString(), k.ID)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// labels are unique per user
+	dup, err := New(s.User.ID, "ci", "", 0)
+	require.Nil(s.T(), err)
+	err = dup.Insert(context.Background(), s.DB, s.Key)
+	require.Equal(s.T(), models.ErrConflict, err)
+
+	// the user must exist
+	orphan, err := New(uuid.NewString(), "ci", "", 0)
+	require.Nil(s.T(), err)
+	err = orphan.Insert(context.Background(), s.DB, s.Key)
+	require.Equal(s.T(), models.ErrRelatedUser, err)
+
+	_, err = New(s.User.ID, "", "", 0)
+	require.Error(s.T(), err)
+}
+
+func (s *APIKeySuite) TestListRevoke() {
+	for _, label := range []string{"b", "a"} {
+		k, err := New(s.User.ID, label, "", 0)
+		require.Nil(s.T(), err)
+		err = k.Insert(context.Background(), s.DB, s.Key)
+		require.Nil(s.T(), err)
+	}
+	keys, err := List(context.Background(), s.DB, s.User.ID)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), keys, 2)
+	require.Equal(s.T(), "a", keys[0].Label)
+	require.Empty(s.T(), keys[0].Secret)
+
+	err = Revoke(context.Background(), s.DB, uuid.NewString(), keys[0].ID)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	err = Revoke(context.Background(), s.DB, s.User.ID, keys[0].ID)
+	require.Nil(s.T(), err)
+	keys, err = List(context.Background(), s.DB, s.User.ID)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), keys, 1)
+	require.Equal(s.T(), "b", keys[0].Label)
+}
+
+func (s *APIKeySuite) TestActiveTouch() {
+	now := time.Now().Unix()
+	k, err := New(s.User.ID, uuid.NewString(), "", now+60)
+	require.Nil(s.T(), err)
+	require.True(s.T(), k.Active(now))
+	require.False(s.T(), k.Active(now+60))
+	k.Expires = 0
+	require.True(s.T(), k.Active(now+60))
+
+	err = k.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	err = k.Touch(context.Background(), s.DB, now)
+	require.Nil(s.T(), err)
+	kRead, err := Read(context.Background(), s.DB, s.Key, s.User.ID, k.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), now, kRead.LastUsed)
+}
+
+func TestAPIKeySuite(t *testing.T) {
+	suite.Run(t, new(APIKeySuite))
+}
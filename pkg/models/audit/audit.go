@@ -0,0 +1,91 @@
+// Package audit records requests made by one user acting as another,
+// and requests made by service accounts
+//
+// Entries are written for changes made while impersonating, so an org
+// can see what was done in its name and by whom, and for changes made
+// by service accounts, which have no person behind them to ask.
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+)
+
+// Entry is a single audited request
+// Actor is the user who made the request, Subject the user they acted as,
+// and Org the subject's org; Status is the http response status
+// Service marks requests made by a service account, which acts as itself
+type Entry struct {
+	ID        string `json:"id"`
+	Actor     string `json:"actor"`
+	Subject   string `json:"subject"`
+	Org       string `json:"org"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id"`
+	Service   bool   `json:"service"`
+	Ctime     int64  `json:"ctime"`
+}
+
+// New creates a new Entry that hasn't been inserted before
+func New(actor, subject, org, method, path, requestID string, status int) *Entry {
+	return &Entry{
+		ID:        uuid.NewString(),
+		Actor:     actor,
+		Subject:   subject,
+		Org:       org,
+		Method:    method,
+		Path:      path,
+		Status:    status,
+		RequestID: requestID,
+	}
+}
+
+// Insert a new row
+func (e *Entry) Insert(ctx context.Context, db *sql.DB) error {
+	q := fmt.Sprintf("insert into %s (id,actor,subject,org,method,path,status,request_id,service) values ($1,$2,$3,$4,$5,$6,$7,$8,$9)",
+		schemas.AuditLogTableName)
+	result, err := db.ExecContext(ctx, q, e.ID, e.Actor, e.Subject, e.Org, e.Method, e.Path, e.Status, e.RequestID, e.Service)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return models.ErrConflict
+		}
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+// List returns the entries for org, newest first
+func List(ctx context.Context, db *sql.DB, org string) ([]*Entry, error) {
+	q := fmt.Sprintf("select id,actor,subject,org,method,path,status,request_id,service,ctime from %s where org = $1 order by ctime desc, rowid desc",
+		schemas.AuditLogTableName)
+	rows, err := db.QueryContext(ctx, q, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*Entry{}
+	for rows.Next() {
+		e := &Entry{}
+		err := rows.Scan(&e.ID, &e.Actor, &e.Subject, &e.Org, &e.Method, &e.Path, &e.Status, &e.RequestID, &e.Service, &e.Ctime)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditSuite struct {
+	suite.Suite
+	DB *sql.DB
+}
+
+func (s *AuditSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *AuditSuite) TestInsertList() {
+	actor, subject, org := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	first := New(actor, subject, org, http.MethodPut, "/first", uuid.NewString(), http.StatusNoContent)
+	err := first.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	second := New(actor, subject, org, http.MethodPost, "/second", uuid.NewString(), http.StatusCreated)
+	second.Service = true
+	err = second.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	other := New(actor, uuid.NewString(), uuid.NewString(), http.MethodPost, "/other", uuid.NewString(), http.StatusCreated)
+	err = other.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+
+	// same id twice
+	err = first.Insert(context.Background(), s.DB)
+	require.Error(s.T(), err)
+
+	entries, err := List(context.Background(), s.DB, org)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), entries, 2)
+	require.Equal(s.T(), second.ID, entries[0].ID)
+	require.True(s.T(), entries[0].Service)
+	require.False(s.T(), entries[1].Service)
+	require.Equal(s.T(), first.ID, entries[1].ID)
+	require.Equal(s.T(), actor, entries[1].Actor)
+	require.Equal(s.T(), subject, entries[1].Subject)
+	require.Equal(s.T(), http.MethodPut, entries[1].Method)
+	require.Equal(s.T(), "/first", entries[1].Path)
+	require.Equal(s.T(), http.StatusNoContent, entries[1].Status)
+	require.Equal(s.T(), first.RequestID, entries[1].RequestID)
+	require.NotZero(s.T(), entries[1].Ctime)
+
+	entries, err = List(context.Background(), s.DB, uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), entries)
+}
+
+func TestAuditSuite(t *testing.T) {
+	suite.Run(t, new(AuditSuite))
+}
@@ -0,0 +1,49 @@
+package models
+
+import "sync"
+
+// Kind names a model type in change notifications
+type Kind string
+
+// exported kinds
+// settings changes are reported as changes to their org
+const (
+	KindOrg  = Kind("org")
+	KindUser = Kind("user")
+)
+
+// Listener is called after an instance of kind with id has changed
+type Listener func(kind Kind, id string)
+
+// listeners are registered with Listen and called by Changed
+var listeners = struct {
+	sync.RWMutex
+	next int
+	fns  map[int]Listener
+}{fns: make(map[int]Listener)}
+
+// Listen registers fn to be called on every change, returning a function
+// that removes it
+// fn is called synchronously by the changing goroutine, so it must not block
+func Listen(fn Listener) func() {
+	listeners.Lock()
+	defer listeners.Unlock()
+	n := listeners.next
+	listeners.next++
+	listeners.fns[n] = fn
+	return func() {
+		listeners.Lock()
+		defer listeners.Unlock()
+		delete(listeners.fns, n)
+	}
+}
+
+// Changed notifies listeners that the instance of kind with id changed
+// models call this after a successful update
+func Changed(kind Kind, id string) {
+	listeners.RLock()
+	defer listeners.RUnlock()
+	for _, fn := range listeners.fns {
+		fn(kind, id)
+	}
+}
@@ -0,0 +1,83 @@
+// Package change records model changes for other app instances
+//
+// Each app instance may cache sessions in memory; an instance that changes
+// a user or org records it here, and the others read the entries past the
+// last sequence number they saw to drop their own copies.
+package change
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+)
+
+// Entry is a single recorded change
+// Seq increases with each entry; Ctime is a unixtime
+type Entry struct {
+	Seq   int64
+	Kind  models.Kind
+	ID    string
+	Ctime int64
+}
+
+// Record adds an entry for the instance of kind with id, changed at now (unixtime)
+func Record(ctx context.Context, db *sql.DB, kind models.Kind, id string, now int64) error {
+	q := fmt.Sprintf("insert into %s (kind,id,ctime) values ($1,$2,$3)",
+		schemas.ModelChangesTableName)
+	_, err := db.ExecContext(ctx, q, string(kind), id, now)
+	return err
+}
+
+// Since returns the entries after seq, oldest first
+func Since(ctx context.Context, db *sql.DB, seq int64) ([]Entry, error) {
+	q := fmt.Sprintf("select seq,kind,id,ctime from %s where seq > $1 order by seq",
+		schemas.ModelChangesTableName)
+	rows, err := db.QueryContext(ctx, q, seq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var kind string
+		err := rows.Scan(&e.Seq, &kind, &e.ID, &e.Ctime)
+		if err != nil {
+			return nil, err
+		}
+		e.Kind = models.Kind(kind)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Latest returns the highest sequence number recorded, or zero
+func Latest(ctx context.Context, db *sql.DB) (int64, error) {
+	q := fmt.Sprintf("select coalesce(max(seq),0) from %s",
+		schemas.ModelChangesTableName)
+	var seq int64
+	err := db.QueryRowContext(ctx, q).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// Prune removes entries recorded before (unixtime), returning the number removed
+func Prune(ctx context.Context, db *sql.DB, before int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where ctime < $1",
+		schemas.ModelChangesTableName)
+	result, err := db.ExecContext(ctx, q, before)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
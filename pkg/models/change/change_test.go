@@ -0,0 +1,86 @@
+package change
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ChangeSuite struct {
+	suite.Suite
+	DB *sql.DB
+}
+
+func (s *ChangeSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *ChangeSuite) TestRecordSince() {
+	now := time.Now().Unix()
+	seq, err := Latest(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	user, org := uuid.NewString(), uuid.NewString()
+	err = Record(context.Background(), s.DB, models.KindUser, user, now)
+	require.Nil(s.T(), err)
+	err = Record(context.Background(), s.DB, models.KindOrg, org, now)
+	require.Nil(s.T(), err)
+
+	entries, err := Since(context.Background(), s.DB, seq)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), entries, 2)
+	require.Equal(s.T(), models.KindUser, entries[0].Kind)
+	require.Equal(s.T(), user, entries[0].ID)
+	require.Equal(s.T(), models.KindOrg, entries[1].Kind)
+	require.Equal(s.T(), org, entries[1].ID)
+	require.Equal(s.T(), now, entries[1].Ctime)
+	require.Greater(s.T(), entries[1].Seq, entries[0].Seq)
+
+	latest, err := Latest(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), entries[1].Seq, latest)
+	entries, err = Since(context.Background(), s.DB, latest)
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), entries)
+}
+
+func (s *ChangeSuite) TestPrune() {
+	now := time.Now().Unix()
+	seq, err := Latest(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	err = Record(context.Background(), s.DB, models.KindUser, uuid.NewString(), now-60)
+	require.Nil(s.T(), err)
+	current := uuid.NewString()
+	err = Record(context.Background(), s.DB, models.KindUser, current, now)
+	require.Nil(s.T(), err)
+
+	deleted, err := Prune(context.Background(), s.DB, now-1)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	entries, err := Since(context.Background(), s.DB, seq)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), entries, 1)
+	require.Equal(s.T(), current, entries[0].ID)
+}
+
+func TestChangeSuite(t *testing.T) {
+	suite.Run(t, new(ChangeSuite))
+}
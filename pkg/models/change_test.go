@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ChangeSuite struct {
+	suite.Suite
+}
+
+func (s *ChangeSuite) TestListen() {
+	id := uuid.NewString()
+	var seen []Kind
+	cancel := Listen(func(kind Kind, changed string) {
+		if changed == id {
+			seen = append(seen, kind)
+		}
+	})
+	Changed(KindUser, id)
+	Changed(KindOrg, id)
+	Changed(KindOrg, uuid.NewString())
+	require.Equal(s.T(), []Kind{KindUser, KindOrg}, seen)
+
+	cancel()
+	Changed(KindUser, id)
+	require.Len(s.T(), seen, 2)
+}
+
+func TestChangeSuite(t *testing.T) {
+	suite.Run(t, new(ChangeSuite))
+}
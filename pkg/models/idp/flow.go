@@ -0,0 +1,138 @@
+package idp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// TokenLen is the number of random bytes in a state, nonce or verifier
+const TokenLen = 32
+
+// ErrExpired signals a flow past its expiration; it has been removed
+var ErrExpired error = errors.New("authorization flow expired")
+
+// FlowEncrypted is the pkce verifier, encrypted with the key ring
+var FlowEncrypted = models.Encrypted{
+	Table:   schemas.OIDCFlowsTableName,
+	ID:      "digest",
+	Columns: []string{"verifier"},
+}
+
+// Flow is an authorization sent to an org's identity provider and not
+// yet returned
+// State identifies the flow on return, and only its digest is stored;
+// Nonce must come back in the id token; Verifier is the PKCE code
+// verifier, stored encrypted; Scope is what the completed login grants
+// Link is the user the identity is to be linked to, empty for a sign in
+type Flow struct {
+	State       string `json:"-"`
+	Org         string `json:"org"`
+	Link        string `json:"link,omitempty"`
+	Nonce       string `json:"-"`
+	Verifier    string `json:"-"`
+	RedirectURI string `json:"redirect_uri"`
+	Scope       string `json:"scope"`
+	Expires     int64  `json:"expires"`
+}
+
+// StartFlow stores a new flow for org, returning it with its state,
+// nonce and verifier to send to the provider; link is the user to link
+// the identity to, or empty to sign in with it
+func StartFlow(ctx context.Context, db *sql.DB, key *security.KeyRing, org, link, redirectURI, scope string, expires int64) (*Flow, error) {
+	f := &Flow{Org: org, Link: link, RedirectURI: redirectURI, Scope: scope, Expires: expires}
+	for _, v := range []*string{&f.State, &f.Nonce, &f.Verifier} {
+		token, err := security.RandomToken(TokenLen)
+		if err != nil {
+			return nil, err
+		}
+		*v = token
+	}
+	encryptedVerifier, err := key.Encrypt(f.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	q := fmt.Sprintf("insert into %s (digest,org,link,nonce,verifier,redirect_uri,scope,expires) values ($1,$2,$3,$4,$5,$6,$7,$8)",
+		schemas.OIDCFlowsTableName)
+	result, err := db.ExecContext(ctx, q, security.EncodedSHA256(f.State), f.Org, f.Link, f.Nonce, encryptedVerifier, f.RedirectURI, f.Scope, f.Expires)
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return nil, models.ErrRowsAffected
+	}
+	return f, nil
+}
+
+// TakeFlow removes and returns the flow for state, so it completes once
+// an unknown or completed state is sql.ErrNoRows
+func TakeFlow(ctx context.Context, db *sql.DB, key *security.KeyRing, state string, now int64) (*Flow, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint
+
+	digest := security.EncodedSHA256(state)
+	q := fmt.Sprintf("select org,link,nonce,verifier,redirect_uri,scope,expires from %s where digest = $1",
+		schemas.OIDCFlowsTableName)
+	f := &Flow{State: state}
+	var encryptedVerifier string
+	err = tx.QueryRowContext(ctx, q, digest).Scan(&f.Org, &f.Link, &f.Nonce, &encryptedVerifier, &f.RedirectURI, &f.Scope, &f.Expires)
+	if err != nil {
+		return nil, err
+	}
+	q = fmt.Sprintf("delete from %s where digest = $1",
+		schemas.OIDCFlowsTableName)
+	result, err := tx.ExecContext(ctx, q, digest)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted != 1 {
+		return nil, sql.ErrNoRows
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if f.Expires < now {
+		return nil, ErrExpired
+	}
+	f.Verifier, err = key.Decrypt(encryptedVerifier)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// PruneFlows removes flows that expired before now (unixtime),
+// returning the number removed
+func PruneFlows(ctx context.Context, db *sql.DB, now int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where expires < $1",
+		schemas.OIDCFlowsTableName)
+	result, err := db.ExecContext(ctx, q, now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
@@ -0,0 +1,47 @@
+package idp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+)
+
+// Link binds the identity subject at issuer to user in org, so signing
+// in with it is signing in as user
+// an identity already bound in org is models.ErrConflict
+func Link(ctx context.Context, db *sql.DB, org, issuer, subject, user string) error {
+	q := fmt.Sprintf("insert into %s (org,issuer,subject,user_id) values ($1,$2,$3,$4)",
+		schemas.OIDCIdentitiesTableName)
+	result, err := db.ExecContext(ctx, q, org, issuer, subject, user)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return models.ErrConflict
+		}
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+// LinkedUser returns the id of the user in org the identity subject at
+// issuer is bound to; sql.ErrNoRows if it is bound to none
+func LinkedUser(ctx context.Context, db *sql.DB, org, issuer, subject string) (string, error) {
+	q := fmt.Sprintf("select user_id from %s where org = $1 and issuer = $2 and subject = $3",
+		schemas.OIDCIdentitiesTableName)
+	var user string
+	err := db.QueryRowContext(ctx, q, org, issuer, subject).Scan(&user)
+	if err != nil {
+		return "", err
+	}
+	return user, nil
+}
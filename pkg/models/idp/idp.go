@@ -0,0 +1,123 @@
+// Package idp models org identity provider federation
+//
+// An org may name one OpenID Connect provider its members sign in with,
+// as an alternative to passwords. Config holds the client registration
+// with the provider; Flow holds an authorization in progress.
+package idp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/oidc"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// ConfigEncrypted is the client secret, encrypted with the key ring
+var ConfigEncrypted = models.Encrypted{
+	Table:   schemas.OIDCConfigsTableName,
+	ID:      "org",
+	Columns: []string{"client_secret"},
+}
+
+// Config is an org's registration with its identity provider
+// ClientSecret is stored encrypted and never marshaled
+type Config struct {
+	Org          string `json:"org"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"-"`
+	Ctime        int64  `json:"ctime"`
+	Mtime        int64  `json:"mtime"`
+}
+
+// NewConfig creates a config for org
+// the issuer must pass oidc.ValidIssuer, as the app calls it
+func NewConfig(org, issuer, clientID, clientSecret string) (*Config, error) {
+	for _, v := range []string{org, issuer, clientID, clientSecret} {
+		if !security.SafeStr(v) {
+			return nil, errors.New("malformed idp config arg")
+		}
+	}
+	err := oidc.ValidIssuer(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{Org: org, Issuer: issuer, ClientID: clientID, ClientSecret: clientSecret}, nil
+}
+
+// Save inserts the config, or replaces the org's existing one
+func (c *Config) Save(ctx context.Context, db *sql.DB, key *security.KeyRing) error {
+	// make sure the org is in the db
+	qOrg := fmt.Sprintf("select count(*) from %s where id = $1", schemas.OrgsTableName)
+	var count int
+	err := db.QueryRowContext(ctx, qOrg, c.Org).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return models.ErrRelatedOrg
+	}
+
+	encryptedSecret, err := key.Encrypt(c.ClientSecret)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf(`insert into %s (org,issuer,client_id,client_secret) values ($1,$2,$3,$4)
+on conflict (org) do update set issuer = excluded.issuer, client_id = excluded.client_id, client_secret = excluded.client_secret`,
+		schemas.OIDCConfigsTableName)
+	result, err := db.ExecContext(ctx, q, c.Org, c.Issuer, c.ClientID, encryptedSecret)
+	if err != nil {
+		return err
+	}
+	saved, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if saved != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+// ReadConfig initializes a Config, including the client secret, for org
+func ReadConfig(ctx context.Context, db *sql.DB, key *security.KeyRing, org string) (*Config, error) {
+	q := fmt.Sprintf("select org,issuer,client_id,client_secret,ctime,mtime from %s where org = $1",
+		schemas.OIDCConfigsTableName)
+	c := &Config{}
+	var encryptedSecret string
+	err := db.QueryRowContext(ctx, q, org).Scan(&c.Org, &c.Issuer, &c.ClientID, &encryptedSecret, &c.Ctime, &c.Mtime)
+	if err != nil {
+		return nil, err
+	}
+	c.ClientSecret, err = key.Decrypt(encryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DeleteConfig removes the org's config, so members sign in with
+// passwords only
+func DeleteConfig(ctx context.Context, db *sql.DB, org string) error {
+	q := fmt.Sprintf("delete from %s where org = $1",
+		schemas.OIDCConfigsTableName)
+	result, err := db.ExecContext(ctx, q, org)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package idp
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/oidc"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type IDPSuite struct {
+	suite.Suite
+	DB  *sql.DB
+	Key *security.KeyRing
+	Org *org.Instance
+}
+
+func (s *IDPSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Key, err = security.MakeKeyRing("test", uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Org, err = org.New(uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Org.Meta.Status = models.StatusActive
+	err = s.Org.Insert(context.Background(), s.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *IDPSuite) TestConfig() {
+	ctx := context.Background()
+	_, err := ReadConfig(ctx, s.DB, s.Key, s.Org.ID)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	c, err := NewConfig(s.Org.ID, "https://"+uuid.NewString(), uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), c.Save(ctx, s.DB, s.Key))
+	cRead, err := ReadConfig(ctx, s.DB, s.Key, s.Org.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), c.Issuer, cRead.Issuer)
+	require.Equal(s.T(), c.ClientID, cRead.ClientID)
+	require.Equal(s.T(), c.ClientSecret, cRead.ClientSecret)
+
+	// saving again replaces
+	next, err := NewConfig(s.Org.ID, "https://"+uuid.NewString(), uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), next.Save(ctx, s.DB, s.Key))
+	cRead, err = ReadConfig(ctx, s.DB, s.Key, s.Org.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), next.Issuer, cRead.Issuer)
+	require.Equal(s.T(), next.ClientSecret, cRead.ClientSecret)
+
+	// the secret is encrypted at rest
+	var stored string
+	err = s.DB.QueryRow("select client_secret from oidc_configs where org = $1", s.Org.ID).Scan(&stored)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), next.ClientSecret, stored)
+
+	require.Nil(s.T(), DeleteConfig(ctx, s.DB, s.Org.ID))
+	require.Equal(s.T(), sql.ErrNoRows, DeleteConfig(ctx, s.DB, s.Org.ID))
+
+	other, err := NewConfig(uuid.NewString(), "https://"+uuid.NewString(), uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.ErrRelatedOrg, other.Save(ctx, s.DB, s.Key))
+}
+
+func (s *IDPSuite) TestConfigIssuer() {
+	// the app calls the issuer, so it may not be on the app's network
+	for _, issuer := range []string{
+		"http://" + uuid.NewString(),
+		"https://localhost",
+		"https://127.0.0.1",
+		"https://[::1]",
+		"https://10.0.0.1",
+		"https://192.168.0.1",
+		"https://[fd00::1]",
+		"https://169.254.169.254",
+		"https://[fe80::1]",
+		"https://0.0.0.0",
+	} {
+		_, err := NewConfig(s.Org.ID, issuer, uuid.NewString(), uuid.NewString())
+		require.Equal(s.T(), oidc.ErrIssuer, err, issuer)
+	}
+}
+
+func (s *IDPSuite) TestFlow() {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	f, err := StartFlow(ctx, s.DB, s.Key, s.Org.ID, uuid.NewString(), "https://"+uuid.NewString(), "org:read", now+60)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), f.State)
+	require.NotEqual(s.T(), f.State, f.Nonce)
+	require.NotEqual(s.T(), f.Nonce, f.Verifier)
+
+	taken, err := TakeFlow(ctx, s.DB, s.Key, f.State, now)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), *f, *taken)
+
+	// only once
+	_, err = TakeFlow(ctx, s.DB, s.Key, f.State, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	expired, err := StartFlow(ctx, s.DB, s.Key, s.Org.ID, "", "https://"+uuid.NewString(), "", now-1)
+	require.Nil(s.T(), err)
+	_, err = TakeFlow(ctx, s.DB, s.Key, expired.State, now)
+	require.Equal(s.T(), ErrExpired, err)
+	_, err = TakeFlow(ctx, s.DB, s.Key, expired.State, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	pruned, err := StartFlow(ctx, s.DB, s.Key, s.Org.ID, "", "https://"+uuid.NewString(), "", now-1)
+	require.Nil(s.T(), err)
+	deleted, err := PruneFlows(ctx, s.DB, now)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	_, err = TakeFlow(ctx, s.DB, s.Key, pruned.State, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *IDPSuite) TestLink() {
+	ctx := context.Background()
+	issuer, subject := "https://"+uuid.NewString(), uuid.NewString()
+	_, err := LinkedUser(ctx, s.DB, s.Org.ID, issuer, subject)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	u := uuid.NewString()
+	require.Nil(s.T(), Link(ctx, s.DB, s.Org.ID, issuer, subject, u))
+	linked, err := LinkedUser(ctx, s.DB, s.Org.ID, issuer, subject)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u, linked)
+
+	// an identity is linked once per org
+	require.Equal(s.T(), models.ErrConflict, Link(ctx, s.DB, s.Org.ID, issuer, subject, uuid.NewString()))
+	require.Nil(s.T(), Link(ctx, s.DB, uuid.NewString(), issuer, subject, uuid.NewString()))
+
+	// the subject is only unique at its issuer
+	_, err = LinkedUser(ctx, s.DB, s.Org.ID, "https://"+uuid.NewString(), subject)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func TestIDPSuite(t *testing.T) {
+	suite.Run(t, new(IDPSuite))
+}
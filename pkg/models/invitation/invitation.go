@@ -0,0 +1,245 @@
+// Package invitation models pending invitations to join an org
+//
+// An invitation holds the invitee's email and a digest of a single-use
+// token sent to it. The invitee accepts by choosing their own password,
+// so the inviter never knows it; accepting removes the invitation.
+package invitation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// TokenLen is the number of random bytes in a token
+const TokenLen = 32
+
+// ErrExpired signals an invitation past its expiration
+var ErrExpired error = errors.New("invitation expired")
+
+// Encrypted is the invitee email, encrypted with the key ring
+var Encrypted = models.Encrypted{
+	Table:   schemas.InvitationsTableName,
+	ID:      "id",
+	Columns: []string{"email"},
+}
+
+// Instance is a single pending invitation
+// Token is only set on a new or resent invitation
+// Expires, Ctime and Mtime are unixtimes
+type Instance struct {
+	ID          string `json:"id"`
+	Org         string `json:"org"`
+	Email       string `json:"email"`
+	EmailDigest string `json:"-"`
+	Token       string `json:"-"`
+	TokenDigest string `json:"-"`
+	Inviter     string `json:"inviter"`
+	Expires     int64  `json:"expires"`
+	Ctime       int64  `json:"ctime"`
+	Mtime       int64  `json:"mtime"`
+}
+
+// New creates a new invitation to org for email, expiring at expires
+func New(org, email, inviter string, expires int64) (*Instance, error) {
+	for _, v := range []string{org, email, inviter} {
+		if !security.SafeStr(v) {
+			return nil, errors.New("malformed invitation arg")
+		}
+	}
+	token, err := security.RandomToken(TokenLen)
+	if err != nil {
+		return nil, err
+	}
+	return &Instance{
+		ID:          uuid.NewString(),
+		Org:         org,
+		Email:       email,
+		Token:       token,
+		TokenDigest: security.EncodedSHA256(token),
+		Inviter:     inviter,
+		Expires:     expires,
+	}, nil
+}
+
+// Insert a new row
+// an email already invited to the org, or already used by any user, is
+// models.ErrConflict
+func (i *Instance) Insert(ctx context.Context, db *sql.DB, key *security.KeyRing) error {
+	// make sure the org is in the db and active
+	qOrg := fmt.Sprintf("select count(*) from %s where id = $1 and status = $2", schemas.OrgsTableName)
+	var count int
+	err := db.QueryRowContext(ctx, qOrg, i.Org, models.StatusActive).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return models.ErrRelatedOrg
+	}
+
+	// user emails are unique, so the invitation could never be accepted
+	i.EmailDigest = security.BlindIndex(i.Email, key.IndexKey())
+	qUser := fmt.Sprintf("select count(*) from %s where email_digest = $1", schemas.UsersTableName)
+	err = db.QueryRowContext(ctx, qUser, i.EmailDigest).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return models.ErrConflict
+	}
+
+	encryptedEmail, err := key.Encrypt(i.Email)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("insert into %s (id,org,email,email_digest,token_digest,inviter,expires) values ($1,$2,$3,$4,$5,$6,$7)",
+		schemas.InvitationsTableName)
+	result, err := db.ExecContext(ctx, q, i.ID, i.Org, encryptedEmail, i.EmailDigest, i.TokenDigest, i.Inviter, i.Expires)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return models.ErrConflict
+		}
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+const selectCols = "id,org,email,email_digest,token_digest,inviter,expires,ctime,mtime"
+
+// scanner is satisfied by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan initializes an Instance from the columns in selectCols
+func scan(row scanner, key *security.KeyRing) (*Instance, error) {
+	i := &Instance{}
+	var encryptedEmail string
+	err := row.Scan(&i.ID, &i.Org, &encryptedEmail, &i.EmailDigest, &i.TokenDigest, &i.Inviter, &i.Expires, &i.Ctime, &i.Mtime)
+	if err != nil {
+		return nil, err
+	}
+	i.Email, err = key.Decrypt(encryptedEmail)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Read initializes an Instance for the invitation id to org
+func Read(ctx context.Context, db *sql.DB, key *security.KeyRing, org, id string) (*Instance, error) {
+	q := fmt.Sprintf("select %s from %s where id = $1 and org = $2",
+		selectCols, schemas.InvitationsTableName)
+	return scan(db.QueryRowContext(ctx, q, id, org), key)
+}
+
+// ReadByToken initializes an Instance for the invitation token was sent
+// for, if it has not expired at now (unixtime)
+// an unknown or accepted token is sql.ErrNoRows
+func ReadByToken(ctx context.Context, db *sql.DB, key *security.KeyRing, token string, now int64) (*Instance, error) {
+	q := fmt.Sprintf("select %s from %s where token_digest = $1",
+		selectCols, schemas.InvitationsTableName)
+	i, err := scan(db.QueryRowContext(ctx, q, security.EncodedSHA256(token)), key)
+	if err != nil {
+		return nil, err
+	}
+	if i.Expires < now {
+		return nil, ErrExpired
+	}
+	return i, nil
+}
+
+// List returns the invitations to org, oldest first, including expired
+// ones that can still be resent
+func List(ctx context.Context, db *sql.DB, key *security.KeyRing, org string) ([]*Instance, error) {
+	q := fmt.Sprintf("select %s from %s where org = $1 order by ctime, id",
+		selectCols, schemas.InvitationsTableName)
+	rows, err := db.QueryContext(ctx, q, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []*Instance{}
+	for rows.Next() {
+		i, err := scan(rows, key)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, i)
+	}
+	return invitations, rows.Err()
+}
+
+// Resend replaces the token, so only the one sent last can be accepted,
+// and extends the expiration to expires
+func (i *Instance) Resend(ctx context.Context, db *sql.DB, expires int64) error {
+	token, err := security.RandomToken(TokenLen)
+	if err != nil {
+		return err
+	}
+	tokenDigest := security.EncodedSHA256(token)
+	q := fmt.Sprintf("update %s set token_digest = $1, expires = $2 where id = $3",
+		schemas.InvitationsTableName)
+	result, err := db.ExecContext(ctx, q, tokenDigest, expires, i.ID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	i.Token = token
+	i.TokenDigest = tokenDigest
+	i.Expires = expires
+	return nil
+}
+
+// Accept removes the invitation, conditional on its token not having
+// been replaced, so it is only accepted once
+func (i *Instance) Accept(ctx context.Context, db *sql.DB) error {
+	q := fmt.Sprintf("delete from %s where id = $1 and token_digest = $2",
+		schemas.InvitationsTableName)
+	return exec(ctx, db, q, i.ID, i.TokenDigest)
+}
+
+// Revoke deletes the invitation id to org
+func Revoke(ctx context.Context, db *sql.DB, org, id string) error {
+	q := fmt.Sprintf("delete from %s where id = $1 and org = $2",
+		schemas.InvitationsTableName)
+	return exec(ctx, db, q, id, org)
+}
+
+// exec runs a delete, returning sql.ErrNoRows if nothing was deleted
+func exec(ctx context.Context, db *sql.DB, q string, args ...interface{}) error {
+	result, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
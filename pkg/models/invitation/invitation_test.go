@@ -0,0 +1,151 @@
+package invitation
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type InvitationSuite struct {
+	suite.Suite
+	DB  *sql.DB
+	Key *security.KeyRing
+	Org *org.Instance
+}
+
+func (s *InvitationSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Key, err = security.MakeKeyRing("test", uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Org, err = org.New(uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Org.Meta.Status = models.StatusActive
+	err = s.Org.Insert(context.Background(), s.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *InvitationSuite) TestInsertRead() {
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour).Unix()
+	i, err := New(s.Org.ID, uuid.NewString(), uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), i.Token)
+	err = i.Insert(ctx, s.DB, s.Key)
+	require.Nil(s.T(), err)
+
+	iRead, err := Read(ctx, s.DB, s.Key, s.Org.ID, i.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), i.Email, iRead.Email)
+	require.Equal(s.T(), i.Inviter, iRead.Inviter)
+	require.Equal(s.T(), expires, iRead.Expires)
+	require.Empty(s.T(), iRead.Token)
+	_, err = Read(ctx, s.DB, s.Key, uuid.NewString(), i.ID)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	iToken, err := ReadByToken(ctx, s.DB, s.Key, i.Token, time.Now().Unix())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), i.ID, iToken.ID)
+	_, err = ReadByToken(ctx, s.DB, s.Key, i.Token, expires+1)
+	require.Equal(s.T(), ErrExpired, err)
+	_, err = ReadByToken(ctx, s.DB, s.Key, uuid.NewString(), time.Now().Unix())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	invitations, err := List(ctx, s.DB, s.Key, s.Org.ID)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), invitations, 1)
+	require.Equal(s.T(), i.Email, invitations[0].Email)
+}
+
+func (s *InvitationSuite) TestConflict() {
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour).Unix()
+	email := uuid.NewString()
+	i, err := New(s.Org.ID, email, uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), i.Insert(ctx, s.DB, s.Key))
+
+	// once per org
+	dup, err := New(s.Org.ID, email, uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.ErrConflict, dup.Insert(ctx, s.DB, s.Key))
+
+	// never for an email a user has
+	u, err := user.New(uuid.NewString(), uuid.NewString(), s.Org.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), u.Insert(ctx, s.DB, s.Key))
+	taken, err := New(s.Org.ID, u.Email, uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.ErrConflict, taken.Insert(ctx, s.DB, s.Key))
+
+	// only to active orgs
+	other, err := New(uuid.NewString(), uuid.NewString(), uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.ErrRelatedOrg, other.Insert(ctx, s.DB, s.Key))
+}
+
+func (s *InvitationSuite) TestResendAccept() {
+	ctx := context.Background()
+	i, err := New(s.Org.ID, uuid.NewString(), uuid.NewString(), time.Now().Unix()-1)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), i.Insert(ctx, s.DB, s.Key))
+	first := i.Token
+
+	// resending replaces the token and renews the expiration
+	expires := time.Now().Add(time.Hour).Unix()
+	require.Nil(s.T(), i.Resend(ctx, s.DB, expires))
+	require.NotEqual(s.T(), first, i.Token)
+	_, err = ReadByToken(ctx, s.DB, s.Key, first, time.Now().Unix())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	iToken, err := ReadByToken(ctx, s.DB, s.Key, i.Token, time.Now().Unix())
+	require.Nil(s.T(), err)
+
+	// accepted once
+	require.Nil(s.T(), iToken.Accept(ctx, s.DB))
+	require.Equal(s.T(), sql.ErrNoRows, iToken.Accept(ctx, s.DB))
+	_, err = ReadByToken(ctx, s.DB, s.Key, i.Token, time.Now().Unix())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *InvitationSuite) TestRevoke() {
+	ctx := context.Background()
+	i, err := New(s.Org.ID, uuid.NewString(), uuid.NewString(), time.Now().Add(time.Hour).Unix())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), i.Insert(ctx, s.DB, s.Key))
+	require.Equal(s.T(), sql.ErrNoRows, Revoke(ctx, s.DB, uuid.NewString(), i.ID))
+	require.Nil(s.T(), Revoke(ctx, s.DB, s.Org.ID, i.ID))
+	require.Equal(s.T(), sql.ErrNoRows, Revoke(ctx, s.DB, s.Org.ID, i.ID))
+	_, err = ReadByToken(ctx, s.DB, s.Key, i.Token, time.Now().Unix())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func TestInvitationSuite(t *testing.T) {
+	suite.Run(t, new(InvitationSuite))
+}
@@ -0,0 +1,153 @@
+// Package lockout counts failed authentication attempts, and locks out
+// users and client addresses that keep failing
+//
+// Once the failures in a window reach the policy threshold, each further
+// failure locks the key out for twice as long as the one before, up to
+// the policy maximum. Keys are stored as digests, as they come straight
+// from requests.
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// Kind is what a key identifies
+type Kind string
+
+// exported kinds
+const (
+	KindUser = Kind("user")
+	KindIP   = Kind("ip")
+)
+
+// Policy sets when failures lead to a lockout
+// failures older than Window are forgotten; the first lockout, at
+// Threshold failures, lasts Backoff, doubling with each further failure
+// up to MaxLockout
+type Policy struct {
+	Threshold  int
+	Backoff    time.Duration
+	MaxLockout time.Duration
+	Window     time.Duration
+}
+
+// lockout returns the lockout for a key with failures, in seconds
+func (p Policy) lockout(failures int) int64 {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+	d := p.Backoff
+	for i := p.Threshold; i < failures && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return int64(d / time.Second)
+}
+
+// LockedUntil returns the unixtime the key of kind is locked out until,
+// or zero if it is not locked out at now (unixtime)
+func LockedUntil(ctx context.Context, db *sql.DB, kind Kind, key string, now int64) (int64, error) {
+	q := fmt.Sprintf("select locked_until from %s where kind = $1 and digest = $2",
+		schemas.AuthFailuresTableName)
+	var until int64
+	err := db.QueryRowContext(ctx, q, string(kind), security.EncodedSHA256(key)).Scan(&until)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if until <= now {
+		return 0, nil
+	}
+	return until, nil
+}
+
+// Fail records a failed attempt for the key of kind at now (unixtime),
+// returning the unixtime it is now locked out until, or zero
+func Fail(ctx context.Context, db *sql.DB, kind Kind, key string, now int64, p Policy) (int64, error) {
+	digest := security.EncodedSHA256(key)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf("select failures,last_failure from %s where kind = $1 and digest = $2",
+		schemas.AuthFailuresTableName)
+	var failures int
+	var last int64
+	err = tx.QueryRowContext(ctx, q, string(kind), digest).Scan(&failures, &last)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if last < now-int64(p.Window/time.Second) {
+		failures = 0
+	}
+	failures++
+	var until int64
+	if d := p.lockout(failures); d > 0 {
+		until = now + d
+	}
+
+	q = fmt.Sprintf("insert or replace into %s (kind,digest,failures,last_failure,locked_until) values ($1,$2,$3,$4,$5)",
+		schemas.AuthFailuresTableName)
+	_, err = tx.ExecContext(ctx, q, string(kind), digest, failures, now, until)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return until, nil
+}
+
+// Clear forgets the failures and any lockout for the key of kind
+// a key without failures is sql.ErrNoRows
+func Clear(ctx context.Context, db *sql.DB, kind Kind, key string) error {
+	q := fmt.Sprintf("delete from %s where kind = $1 and digest = $2",
+		schemas.AuthFailuresTableName)
+	result, err := db.ExecContext(ctx, q, string(kind), security.EncodedSHA256(key))
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	if deleted != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+// Prune removes keys with no failures since before (unixtime) that are
+// not locked out at before, returning the number removed
+func Prune(ctx context.Context, db *sql.DB, before int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where last_failure < $1 and locked_until < $1",
+		schemas.AuthFailuresTableName)
+	result, err := db.ExecContext(ctx, q, before)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
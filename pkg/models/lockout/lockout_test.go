@@ -0,0 +1,131 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockoutSuite struct {
+	suite.Suite
+	DB     *sql.DB
+	Policy Policy
+}
+
+func (s *LockoutSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Policy = Policy{
+		Threshold:  3,
+		Backoff:    time.Minute,
+		MaxLockout: 3 * time.Minute,
+		Window:     time.Hour,
+	}
+}
+
+func (s *LockoutSuite) TestFail() {
+	key := uuid.NewString()
+	now := time.Now().Unix()
+
+	// under the threshold
+	for i := 0; i < 2; i++ {
+		until, err := Fail(context.Background(), s.DB, KindUser, key, now, s.Policy)
+		require.Nil(s.T(), err)
+		require.Zero(s.T(), until)
+	}
+	until, err := LockedUntil(context.Background(), s.DB, KindUser, key, now)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), until)
+
+	// backoff doubles up to the maximum
+	for _, d := range []int64{60, 120, 180, 180} {
+		until, err = Fail(context.Background(), s.DB, KindUser, key, now, s.Policy)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), now+d, until)
+	}
+	until, err = LockedUntil(context.Background(), s.DB, KindUser, key, now)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), now+180, until)
+	until, err = LockedUntil(context.Background(), s.DB, KindUser, key, now+180)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), until)
+
+	// kinds are counted apart
+	until, err = LockedUntil(context.Background(), s.DB, KindIP, key, now)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), until)
+}
+
+func (s *LockoutSuite) TestWindow() {
+	key := uuid.NewString()
+	now := time.Now().Unix()
+	for i := 0; i < 2; i++ {
+		_, err := Fail(context.Background(), s.DB, KindIP, key, now, s.Policy)
+		require.Nil(s.T(), err)
+	}
+	// earlier failures have been forgotten
+	until, err := Fail(context.Background(), s.DB, KindIP, key, now+3601, s.Policy)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), until)
+}
+
+func (s *LockoutSuite) TestClear() {
+	key := uuid.NewString()
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		_, err := Fail(context.Background(), s.DB, KindUser, key, now, s.Policy)
+		require.Nil(s.T(), err)
+	}
+	err := Clear(context.Background(), s.DB, KindUser, key)
+	require.Nil(s.T(), err)
+	until, err := LockedUntil(context.Background(), s.DB, KindUser, key, now)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), until)
+
+	// counting starts over
+	until, err = Fail(context.Background(), s.DB, KindUser, key, now, s.Policy)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), until)
+
+	err = Clear(context.Background(), s.DB, KindUser, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *LockoutSuite) TestPrune() {
+	now := time.Now().Unix()
+	stale := uuid.NewString()
+	_, err := Fail(context.Background(), s.DB, KindIP, stale, now-60, s.Policy)
+	require.Nil(s.T(), err)
+	recent := uuid.NewString()
+	_, err = Fail(context.Background(), s.DB, KindIP, recent, now, s.Policy)
+	require.Nil(s.T(), err)
+
+	deleted, err := Prune(context.Background(), s.DB, now-30)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	err = Clear(context.Background(), s.DB, KindIP, stale)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	err = Clear(context.Background(), s.DB, KindIP, recent)
+	require.Nil(s.T(), err)
+}
+
+func TestLockoutSuite(t *testing.T) {
+	suite.Run(t, new(LockoutSuite))
+}
@@ -0,0 +1,58 @@
+// Package nonce records the nonces of signed requests so they cannot
+// be replayed
+//
+// A nonce only needs to be kept while its request's timestamp is still
+// accepted, so Prune can remove it after that.
+package nonce
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// MaxLen bounds the length of a nonce
+const MaxLen = 64
+
+// ErrReplay signals a nonce that was already used
+var ErrReplay error = errors.New("nonce already used")
+
+// Use records that user has used nonce, keeping it until expires (unixtime)
+// a nonce the user has already used is ErrReplay
+func Use(ctx context.Context, db *sql.DB, user, nonce string, expires int64) error {
+	if !security.SafeStr(nonce) || len(nonce) > MaxLen {
+		return models.ErrDisallowedValue
+	}
+	q := fmt.Sprintf("insert into %s (user_id,nonce,expires) values ($1,$2,$3)",
+		schemas.RequestNoncesTableName)
+	_, err := db.ExecContext(ctx, q, user, nonce, expires)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return ErrReplay
+		}
+		return err
+	}
+	return nil
+}
+
+// Prune removes nonces that expired before now (unixtime),
+// returning the number removed
+func Prune(ctx context.Context, db *sql.DB, now int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where expires < $1",
+		schemas.RequestNoncesTableName)
+	result, err := db.ExecContext(ctx, q, now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
@@ -0,0 +1,78 @@
+package nonce
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type NonceSuite struct {
+	suite.Suite
+	DB *sql.DB
+}
+
+func (s *NonceSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *NonceSuite) TestUse() {
+	user := uuid.NewString()
+	n := uuid.NewString()
+	expires := time.Now().Add(time.Minute).Unix()
+	err := Use(context.Background(), s.DB, user, n, expires)
+	require.Nil(s.T(), err)
+	err = Use(context.Background(), s.DB, user, n, expires)
+	require.Equal(s.T(), ErrReplay, err)
+
+	// nonces are per user
+	err = Use(context.Background(), s.DB, uuid.NewString(), n, expires)
+	require.Nil(s.T(), err)
+
+	err = Use(context.Background(), s.DB, user, "", expires)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+	err = Use(context.Background(), s.DB, user, strings.Repeat("a", MaxLen+1), expires)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+}
+
+func (s *NonceSuite) TestPrune() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	expired := uuid.NewString()
+	err := Use(context.Background(), s.DB, user, expired, now-1)
+	require.Nil(s.T(), err)
+	current := uuid.NewString()
+	err = Use(context.Background(), s.DB, user, current, now+60)
+	require.Nil(s.T(), err)
+
+	deleted, err := Prune(context.Background(), s.DB, now)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	err = Use(context.Background(), s.DB, user, expired, now+60)
+	require.Nil(s.T(), err)
+	err = Use(context.Background(), s.DB, user, current, now+60)
+	require.Equal(s.T(), ErrReplay, err)
+}
+
+func TestNonceSuite(t *testing.T) {
+	suite.Run(t, new(NonceSuite))
+}
@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/models"
@@ -19,11 +20,19 @@ const (
 	OwnerNone     = "OWNER.NONE"
 )
 
+// ErrNoNomination signals there is no unexpired ownership offer for a user
+var ErrNoNomination error = errors.New("no pending owner nomination")
+
 // Instance is an organization model
+// PendingOwner has been offered ownership until PendingOwnerExpires (unixtime)
+// Require2FA means members must complete a second factor on password login
 type Instance struct {
 	models.Base
-	Name  string `json:"name"`
-	Owner string `json:"owner"`
+	Name                string `json:"name"`
+	Owner               string `json:"owner"`
+	PendingOwner        string `json:"pending_owner,omitempty"`
+	PendingOwnerExpires int64  `json:"pending_owner_expires,omitempty"`
+	Require2FA          bool   `json:"require_2fa"`
 }
 
 // New creates a new org that hasn't been created before
@@ -42,8 +51,9 @@ func New(name string) (*Instance, error) {
 // 1. exists
 // 2. is in the org
 // 3. is active
+// 4. is not a service account
 func (o *Instance) validOwner(ctx context.Context, db *sql.DB, owner string) (bool, error) {
-	q := fmt.Sprintf("select count(*) from %s where id = $1 and org = $2 and status = $3", schemas.UsersTableName)
+	q := fmt.Sprintf("select count(*) from %s where id = $1 and org = $2 and status = $3 and service = 0", schemas.UsersTableName)
 	var count int
 	err := db.QueryRowContext(ctx, q, owner, o.ID, models.StatusActive).Scan(&count)
 	if err != nil {
@@ -85,7 +95,7 @@ func (o *Instance) Insert(ctx context.Context, db *sql.DB) error {
 
 // Read initializes an Instance based on a database row
 func Read(ctx context.Context, db *sql.DB, id string) (*Instance, error) {
-	q := fmt.Sprintf("select name,owner,ctime,mtime,status,schema_version from %s where id = $1",
+	q := fmt.Sprintf("select name,owner,pending_owner,pending_owner_expires,require_2fa,ctime,mtime,status,schema_version from %s where id = $1",
 		schemas.OrgsTableName)
 	var statusRaw int
 	o := &Instance{}
@@ -93,6 +103,9 @@ func Read(ctx context.Context, db *sql.DB, id string) (*Instance, error) {
 	err := db.QueryRowContext(ctx, q, id).Scan(
 		&o.Name,
 		&o.Owner,
+		&o.PendingOwner,
+		&o.PendingOwnerExpires,
+		&o.Require2FA,
 		&o.Meta.Ctime,
 		&o.Meta.Mtime,
 		&statusRaw,
@@ -111,8 +124,19 @@ func Read(ctx context.Context, db *sql.DB, id string) (*Instance, error) {
 	return o, nil
 }
 
-// UpdateOwner sets the org owner
-// TODO check owner exists, is in same org, is active
+// ReadByName initializes an Instance for the org with name
+func ReadByName(ctx context.Context, db *sql.DB, name string) (*Instance, error) {
+	q := fmt.Sprintf("select id from %s where name = $1",
+		schemas.OrgsTableName)
+	var id string
+	err := db.QueryRowContext(ctx, q, name).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return Read(ctx, db, id)
+}
+
+// UpdateOwner sets the org owner immediately, voiding any pending nomination
 func (o *Instance) UpdateOwner(ctx context.Context, db *sql.DB, owner string) error {
 	isValid, err := o.validOwner(ctx, db, owner)
 	if err != nil {
@@ -121,7 +145,113 @@ func (o *Instance) UpdateOwner(ctx context.Context, db *sql.DB, owner string) er
 	if !isValid {
 		return models.ErrRelatedUser
 	}
-	return models.Update(ctx, db, schemas.OrgsTableName, o.ID, "owner", owner)
+	q := fmt.Sprintf("update %s set owner = $1, pending_owner = '', pending_owner_expires = 0 where id = $2",
+		schemas.OrgsTableName)
+	err = o.exec(ctx, db, q, owner, o.ID)
+	if err != nil {
+		return err
+	}
+	o.Owner = owner
+	o.PendingOwner = ""
+	o.PendingOwnerExpires = 0
+	return nil
+}
+
+// NominateOwner offers ownership of the org to nominee until expires (unixtime)
+// the nominee must accept with AcceptOwner; a new nomination replaces any other
+func (o *Instance) NominateOwner(ctx context.Context, db *sql.DB, nominee string, expires int64) error {
+	if nominee == o.Owner {
+		return models.ErrDisallowedValue
+	}
+	isValid, err := o.validOwner(ctx, db, nominee)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return models.ErrRelatedUser
+	}
+	q := fmt.Sprintf("update %s set pending_owner = $1, pending_owner_expires = $2 where id = $3",
+		schemas.OrgsTableName)
+	err = o.exec(ctx, db, q, nominee, expires, o.ID)
+	if err != nil {
+		return err
+	}
+	o.PendingOwner = nominee
+	o.PendingOwnerExpires = expires
+	return nil
+}
+
+// CancelNomination withdraws any pending ownership offer
+func (o *Instance) CancelNomination(ctx context.Context, db *sql.DB) error {
+	q := fmt.Sprintf("update %s set pending_owner = '', pending_owner_expires = 0 where id = $1",
+		schemas.OrgsTableName)
+	err := o.exec(ctx, db, q, o.ID)
+	if err != nil {
+		return err
+	}
+	o.PendingOwner = ""
+	o.PendingOwnerExpires = 0
+	return nil
+}
+
+// AcceptOwner makes nominee the owner if they hold an unexpired nomination
+func (o *Instance) AcceptOwner(ctx context.Context, db *sql.DB, nominee string) error {
+	// the nominee may have left the org or been deactivated since
+	isValid, err := o.validOwner(ctx, db, nominee)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return models.ErrRelatedUser
+	}
+	// conditional on the nomination, so a concurrent change wins or loses as a whole
+	q := fmt.Sprintf("update %s set owner = $1, pending_owner = '', pending_owner_expires = 0 where id = $2 and pending_owner = $1 and pending_owner_expires >= $3",
+		schemas.OrgsTableName)
+	err = o.exec(ctx, db, q, nominee, o.ID, time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return ErrNoNomination
+	}
+	if err != nil {
+		return err
+	}
+	o.Owner = nominee
+	o.PendingOwner = ""
+	o.PendingOwnerExpires = 0
+	return nil
+}
+
+// UpdateRequire2FA sets whether members must use a second factor
+func (o *Instance) UpdateRequire2FA(ctx context.Context, db *sql.DB, required bool) error {
+	q := fmt.Sprintf("update %s set require_2fa = $1 where id = $2",
+		schemas.OrgsTableName)
+	err := o.exec(ctx, db, q, required, o.ID)
+	if err != nil {
+		return err
+	}
+	o.Require2FA = required
+	return nil
+}
+
+// exec runs an update that must change exactly one row, and notifies
+// listeners of the change
+func (o *Instance) exec(ctx context.Context, db *sql.DB, q string, args ...interface{}) error {
+	result, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	if updated != 1 {
+		return models.ErrRowsAffected
+	}
+	models.Changed(models.KindOrg, o.ID)
+	return nil
 }
 
 // UpdateStatus sets the org status
@@ -129,5 +259,10 @@ func (o *Instance) UpdateStatus(ctx context.Context, db *sql.DB, status models.S
 	if status == models.StatusNone {
 		return models.ErrDisallowedValue
 	}
-	return models.Update(ctx, db, schemas.OrgsTableName, o.ID, "status", status)
+	err := models.Update(ctx, db, schemas.OrgsTableName, o.ID, "status", status)
+	if err != nil {
+		return err
+	}
+	models.Changed(models.KindOrg, o.ID)
+	return nil
 }
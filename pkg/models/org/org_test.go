@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/models"
@@ -23,7 +24,7 @@ import (
 type OrgSuite struct {
 	suite.Suite
 	DB  *sql.DB
-	Key []byte
+	Key *security.KeyRing
 }
 
 func (s *OrgSuite) SetupTest() {
@@ -38,7 +39,7 @@ func (s *OrgSuite) SetupTest() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.Key, err = security.MakeKey(uuid.NewString())
+	s.Key, err = security.MakeKeyRing("test", uuid.NewString())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -76,6 +77,20 @@ func (s *OrgSuite) TestReadOrg() {
 	require.NotEqual(s.T(), o.Meta.Mtime, oRead.Meta.Mtime)
 }
 
+func (s *OrgSuite) TestReadOrgByName() {
+	_, err := ReadByName(context.Background(), s.DB, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	o, err := New(uuid.NewString())
+	require.Nil(s.T(), err)
+	err = o.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+
+	oRead, err := ReadByName(context.Background(), s.DB, o.Name)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), o.ID, oRead.ID)
+}
+
 func (s *OrgSuite) TestUpdateOrgOwner() {
 	o, err := New(uuid.NewString())
 	require.Nil(s.T(), err)
@@ -116,6 +131,81 @@ func (s *OrgSuite) TestUpdateOrgOwner() {
 	err = o.UpdateOwner(context.Background(), s.DB, uOther.ID)
 	require.Error(s.T(), err)
 	require.Equal(s.T(), models.ErrRelatedUser, err)
+
+	// service accounts cannot own an org
+	service, err := user.NewService(uuid.NewString(), o.ID, "", nil)
+	require.Nil(s.T(), err)
+	err = service.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	err = o.UpdateOwner(context.Background(), s.DB, service.ID)
+	require.Error(s.T(), err)
+	require.Equal(s.T(), models.ErrRelatedUser, err)
+}
+
+func (s *OrgSuite) TestNominateOrgOwner() {
+	o, err := New(uuid.NewString())
+	require.Nil(s.T(), err)
+	o.Meta.Status = models.StatusActive
+	err = o.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	owner, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	owner.Meta.Status = models.StatusActive
+	err = owner.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	err = o.UpdateOwner(context.Background(), s.DB, owner.ID)
+	require.Nil(s.T(), err)
+	nominee, err := user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	nominee.Meta.Status = models.StatusActive
+	err = nominee.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	expires := time.Now().Add(time.Hour).Unix()
+
+	// the owner and unknown users cannot be nominated
+	err = o.NominateOwner(context.Background(), s.DB, owner.ID, expires)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+	err = o.NominateOwner(context.Background(), s.DB, uuid.NewString(), expires)
+	require.Equal(s.T(), models.ErrRelatedUser, err)
+
+	// no nomination yet
+	err = o.AcceptOwner(context.Background(), s.DB, nominee.ID)
+	require.Equal(s.T(), ErrNoNomination, err)
+
+	// nominate, cancel
+	err = o.NominateOwner(context.Background(), s.DB, nominee.ID, expires)
+	require.Nil(s.T(), err)
+	oRead, err := Read(context.Background(), s.DB, o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), nominee.ID, oRead.PendingOwner)
+	require.Equal(s.T(), expires, oRead.PendingOwnerExpires)
+	err = o.CancelNomination(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	err = o.AcceptOwner(context.Background(), s.DB, nominee.ID)
+	require.Equal(s.T(), ErrNoNomination, err)
+
+	// expired
+	err = o.NominateOwner(context.Background(), s.DB, nominee.ID, time.Now().Add(-time.Minute).Unix())
+	require.Nil(s.T(), err)
+	err = o.AcceptOwner(context.Background(), s.DB, nominee.ID)
+	require.Equal(s.T(), ErrNoNomination, err)
+
+	// only the nominee can accept
+	err = o.NominateOwner(context.Background(), s.DB, nominee.ID, expires)
+	require.Nil(s.T(), err)
+	err = o.AcceptOwner(context.Background(), s.DB, owner.ID)
+	require.Equal(s.T(), ErrNoNomination, err)
+	err = o.AcceptOwner(context.Background(), s.DB, nominee.ID)
+	require.Nil(s.T(), err)
+	oRead, err = Read(context.Background(), s.DB, o.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), nominee.ID, oRead.Owner)
+	require.Equal(s.T(), "", oRead.PendingOwner)
+	require.Equal(s.T(), int64(0), oRead.PendingOwnerExpires)
+
+	// the nomination is consumed
+	err = o.AcceptOwner(context.Background(), s.DB, nominee.ID)
+	require.Equal(s.T(), ErrNoNomination, err)
 }
 
 func (s *OrgSuite) TestUpdateOrgStatus() {
@@ -150,6 +240,21 @@ func (s *OrgSuite) TestUpdateOrgStatus() {
 	require.Error(s.T(), err)
 }
 
+func (s *OrgSuite) TestUpdateOrgRequire2FA() {
+	o, err := New(uuid.NewString())
+	require.Nil(s.T(), err)
+	err = o.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	require.False(s.T(), o.Require2FA)
+
+	err = o.UpdateRequire2FA(context.Background(), s.DB, true)
+	require.Nil(s.T(), err)
+	require.True(s.T(), o.Require2FA)
+	oRead, err := Read(context.Background(), s.DB, o.ID)
+	require.Nil(s.T(), err)
+	require.True(s.T(), oRead.Require2FA)
+}
+
 func TestOrgSuite(t *testing.T) {
 	suite.Run(t, new(OrgSuite))
 }
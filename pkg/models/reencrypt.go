@@ -0,0 +1,174 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// Encrypted names the columns of Table that are encrypted with the key
+// ring, and the unique column ID its rows are paged by
+// models that encrypt declare theirs, so Reencrypt can find every one
+type Encrypted struct {
+	Table   string
+	ID      string
+	Columns []string
+}
+
+// ReencryptProgress counts the rows Reencrypt has checked of Total, and
+// of those, the ones rewritten with Key; rows changed by a concurrent
+// write are Skipped, and rows that cannot be decrypted are Failed
+// rows skipped or failed still need the keys they were written with
+type ReencryptProgress struct {
+	Key         string `json:"key"`
+	Total       int    `json:"total"`
+	Checked     int    `json:"checked"`
+	Reencrypted int    `json:"reencrypted"`
+	Skipped     int    `json:"skipped"`
+	Failed      int    `json:"failed"`
+}
+
+// reencryptRow is the id and encrypted columns of a row
+type reencryptRow struct {
+	id   string
+	cols []string
+}
+
+// Reencrypt rewrites the columns of tables still encrypted with an
+// earlier key using the current one, batch rows at a time, calling
+// progress after each batch
+// a row is only updated if unchanged since it was read, so the app can
+// serve writes meanwhile
+func Reencrypt(ctx context.Context, db *sql.DB, key *security.KeyRing, tables []Encrypted, batch int, progress func(ReencryptProgress)) (ReencryptProgress, error) {
+	p := ReencryptProgress{Key: key.Current()}
+	for _, t := range tables {
+		var n int
+		q := fmt.Sprintf("select count(*) from %s", t.Table)
+		err := db.QueryRowContext(ctx, q).Scan(&n)
+		if err != nil {
+			return p, err
+		}
+		p.Total += n
+	}
+	for _, t := range tables {
+		err := t.reencrypt(ctx, db, key, batch, &p, progress)
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// reencrypt runs Reencrypt over the rows of t, counting them in p
+func (t Encrypted) reencrypt(ctx context.Context, db *sql.DB, key *security.KeyRing, batch int, p *ReencryptProgress, progress func(ReencryptProgress)) error {
+	// rows are paged by id, so rows inserted meanwhile may or may not be
+	// seen; either way they are encrypted with the current key
+	q := fmt.Sprintf("select %s,%s from %s where %s > $1 order by %s limit $2",
+		t.ID, strings.Join(t.Columns, ","), t.Table, t.ID, t.ID)
+	last := ""
+	for {
+		rows, err := db.QueryContext(ctx, q, last, batch)
+		if err != nil {
+			return err
+		}
+		var page []reencryptRow
+		for rows.Next() {
+			r := reencryptRow{cols: make([]string, len(t.Columns))}
+			dest := []interface{}{&r.id}
+			for i := range r.cols {
+				dest = append(dest, &r.cols[i])
+			}
+			err = rows.Scan(dest...)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		for _, r := range page {
+			p.Checked++
+			updated, err := t.update(ctx, db, key, r)
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				p.Failed++
+				continue
+			}
+			if updated {
+				p.Reencrypted++
+			} else if r.stale(key) {
+				p.Skipped++
+			}
+		}
+		last = page[len(page)-1].id
+		if progress != nil {
+			progress(*p)
+		}
+	}
+}
+
+// stale reports whether any column of r is encrypted with an earlier key
+// empty columns hold nothing to encrypt
+func (r reencryptRow) stale(key *security.KeyRing) bool {
+	for _, e := range r.cols {
+		if len(e) != 0 && key.Stale(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// update rewrites the stale columns of r with the current key,
+// reporting whether the row was updated
+func (t Encrypted) update(ctx context.Context, db *sql.DB, key *security.KeyRing, r reencryptRow) (bool, error) {
+	if !r.stale(key) {
+		return false, nil
+	}
+	n := len(t.Columns)
+	sets := make([]string, n)
+	wheres := make([]string, n)
+	args := make([]interface{}, 2*n+1)
+	for i, e := range r.cols {
+		sets[i] = fmt.Sprintf("%s = $%d", t.Columns[i], i+1)
+		wheres[i] = fmt.Sprintf("%s = $%d", t.Columns[i], n+i+2)
+		args[n+i+1] = e
+		if len(e) == 0 || !key.Stale(e) {
+			args[i] = e
+			continue
+		}
+		v, err := key.Decrypt(e)
+		if err != nil {
+			return false, err
+		}
+		args[i], err = key.Encrypt(v)
+		if err != nil {
+			return false, err
+		}
+	}
+	args[n] = r.id
+
+	q := fmt.Sprintf("update %s set %s where %s = $%d and %s",
+		t.Table, strings.Join(sets, ", "), t.ID, n+1, strings.Join(wheres, " and "))
+	result, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return updated == 1, nil
+}
@@ -0,0 +1,209 @@
+// Package refresh models opaque refresh tokens
+//
+// Only a digest of each token is stored. Every use rotates the token:
+// the presented token is marked used and a new one is issued in the
+// same family. Presenting a used token means it was copied, so the
+// whole family is revoked. Tokens carry the user's token watermark when
+// issued, so revoking the user's access tokens revokes these as well,
+// and the scope granted to the access token they are paired with.
+package refresh
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// TokenLen is the number of random bytes in a token
+const TokenLen = 32
+
+// ErrExpired signals a refresh token past its expiration
+var ErrExpired error = errors.New("refresh token expired")
+
+// ErrRevoked signals a refresh token in a revoked family
+var ErrRevoked error = errors.New("refresh token revoked")
+
+// ErrReused signals a refresh token that was already used;
+// its family has been revoked
+var ErrReused error = errors.New("refresh token reused")
+
+// Instance is a stored refresh token
+type Instance struct {
+	Digest    string `json:"-"`
+	Family    string `json:"family"`
+	User      string `json:"user"`
+	Watermark int64  `json:"-"`
+	Scope     string `json:"scope"`
+	Expires   int64  `json:"expires"`
+	Used      bool   `json:"used"`
+	Revoked   bool   `json:"revoked"`
+	Ctime     int64  `json:"ctime"`
+}
+
+// Issue stores a new token for user in a new family,
+// returning the token to hand to the client
+func Issue(ctx context.Context, db *sql.DB, user, scope string, watermark, expires int64) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback() // nolint
+
+	token, err := insert(ctx, tx, uuid.NewString(), user, scope, watermark, expires)
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// insert stores a new token in family
+func insert(ctx context.Context, tx *sql.Tx, family, user, scope string, watermark, expires int64) (string, error) {
+	token, err := security.RandomToken(TokenLen)
+	if err != nil {
+		return "", err
+	}
+	q := fmt.Sprintf("insert into %s (digest,family,user_id,watermark,scope,expires) values ($1,$2,$3,$4,$5,$6)",
+		schemas.RefreshTokensTableName)
+	result, err := tx.ExecContext(ctx, q, security.EncodedSHA256(token), family, user, watermark, scope, expires)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return "", models.ErrConflict
+		}
+		return "", err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return "", models.ErrRowsAffected
+	}
+	return token, nil
+}
+
+// Read initializes an Instance for token
+func Read(ctx context.Context, db *sql.DB, token string) (*Instance, error) {
+	q := fmt.Sprintf("select digest,family,user_id,watermark,scope,expires,used,revoked,ctime from %s where digest = $1",
+		schemas.RefreshTokensTableName)
+	r := &Instance{}
+	err := db.QueryRowContext(ctx, q, security.EncodedSHA256(token)).Scan(
+		&r.Digest,
+		&r.Family,
+		&r.User,
+		&r.Watermark,
+		&r.Scope,
+		&r.Expires,
+		&r.Used,
+		&r.Revoked,
+		&r.Ctime)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate exchanges token, which must belong to user, for a new token
+// in the same family, returning it with its scope and expiration
+// the family keeps the expiration it was issued with, so rotating never
+// extends it
+// an unknown token (or one for another user) is sql.ErrNoRows, one
+// issued under a different watermark than the user's current one is
+// revoked, and one whose family expired before now is ErrExpired
+func Rotate(ctx context.Context, db *sql.DB, user, token string, watermark, now int64) (string, string, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf("select family,watermark,scope,expires,used,revoked from %s where digest = $1 and user_id = $2",
+		schemas.RefreshTokensTableName)
+	var family, scope string
+	var tokenWatermark, tokenExpires int64
+	var used, revoked bool
+	err = tx.QueryRowContext(ctx, q, security.EncodedSHA256(token), user).Scan(
+		&family,
+		&tokenWatermark,
+		&scope,
+		&tokenExpires,
+		&used,
+		&revoked)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if revoked || tokenWatermark != watermark {
+		return "", "", 0, ErrRevoked
+	}
+	if used {
+		// the token was copied; nothing in the family can be trusted
+		err = revokeFamily(ctx, tx, family)
+		if err != nil {
+			return "", "", 0, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return "", "", 0, err
+		}
+		return "", "", 0, ErrReused
+	}
+	if tokenExpires < now {
+		return "", "", 0, ErrExpired
+	}
+
+	// conditional on used, so only one of two concurrent rotations succeeds
+	qUse := fmt.Sprintf("update %s set used = 1 where digest = $1 and used = 0",
+		schemas.RefreshTokensTableName)
+	result, err := tx.ExecContext(ctx, qUse, security.EncodedSHA256(token))
+	if err != nil {
+		return "", "", 0, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated != 1 {
+		return "", "", 0, ErrReused
+	}
+
+	next, err := insert(ctx, tx, family, user, scope, watermark, tokenExpires)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return next, scope, tokenExpires, tx.Commit()
+}
+
+// revokeFamily marks every token in family revoked
+func revokeFamily(ctx context.Context, tx *sql.Tx, family string) error {
+	q := fmt.Sprintf("update %s set revoked = 1 where family = $1",
+		schemas.RefreshTokensTableName)
+	_, err := tx.ExecContext(ctx, q, family)
+	return err
+}
+
+// RevokeFamily marks every token in the family of token, which must
+// belong to user, revoked
+func RevokeFamily(ctx context.Context, db *sql.DB, user, token string) error {
+	q := fmt.Sprintf("update %s set revoked = 1 where family = (select family from %s where digest = $1 and user_id = $2)",
+		schemas.RefreshTokensTableName, schemas.RefreshTokensTableName)
+	result, err := db.ExecContext(ctx, q, security.EncodedSHA256(token), user)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package refresh
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RefreshSuite struct {
+	suite.Suite
+	DB *sql.DB
+}
+
+func (s *RefreshSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *RefreshSuite) TestIssueRead() {
+	user := uuid.NewString()
+	expires := time.Now().Add(time.Hour).Unix()
+	token, err := Issue(context.Background(), s.DB, user, "org:read user:read", 0, expires)
+	require.Nil(s.T(), err)
+	r, err := Read(context.Background(), s.DB, token)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), user, r.User)
+	require.Equal(s.T(), expires, r.Expires)
+	require.Equal(s.T(), "org:read user:read", r.Scope)
+	require.NotEqual(s.T(), token, r.Digest)
+	require.False(s.T(), r.Used)
+	require.False(s.T(), r.Revoked)
+	require.NotZero(s.T(), r.Ctime)
+
+	_, err = Read(context.Background(), s.DB, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *RefreshSuite) TestRotate() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	expires := time.Now().Add(time.Hour).Unix()
+	t0, err := Issue(context.Background(), s.DB, user, "", 0, expires)
+	require.Nil(s.T(), err)
+
+	// unknown token, other user
+	_, _, _, err = Rotate(context.Background(), s.DB, user, uuid.NewString(), 0, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	_, _, _, err = Rotate(context.Background(), s.DB, uuid.NewString(), t0, 0, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	t1, _, t1Expires, err := Rotate(context.Background(), s.DB, user, t0, 0, now)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), t0, t1)
+	r0, err := Read(context.Background(), s.DB, t0)
+	require.Nil(s.T(), err)
+	require.True(s.T(), r0.Used)
+	r1, err := Read(context.Background(), s.DB, t1)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), r0.Family, r1.Family)
+	// the family keeps its expiration
+	require.Equal(s.T(), expires, t1Expires)
+	require.Equal(s.T(), expires, r1.Expires)
+
+	// reusing t0 revokes t1 as well
+	_, _, _, err = Rotate(context.Background(), s.DB, user, t0, 0, now)
+	require.Equal(s.T(), ErrReused, err)
+	_, _, _, err = Rotate(context.Background(), s.DB, user, t1, 0, now)
+	require.Equal(s.T(), ErrRevoked, err)
+
+	// other families are unaffected
+	t2, err := Issue(context.Background(), s.DB, user, "", 0, expires)
+	require.Nil(s.T(), err)
+	_, _, _, err = Rotate(context.Background(), s.DB, user, t2, 0, now)
+	require.Nil(s.T(), err)
+}
+
+func (s *RefreshSuite) TestRotateWatermark() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	expires := time.Now().Add(time.Hour).Unix()
+	token, err := Issue(context.Background(), s.DB, user, "", 1, expires)
+	require.Nil(s.T(), err)
+	r, err := Read(context.Background(), s.DB, token)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(1), r.Watermark)
+	_, _, _, err = Rotate(context.Background(), s.DB, user, token, 2, now)
+	require.Equal(s.T(), ErrRevoked, err)
+	_, _, _, err = Rotate(context.Background(), s.DB, user, token, 1, now)
+	require.Nil(s.T(), err)
+}
+
+func (s *RefreshSuite) TestRotateExpired() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	token, err := Issue(context.Background(), s.DB, user, "", 0, time.Now().Add(-time.Minute).Unix())
+	require.Nil(s.T(), err)
+	_, _, _, err = Rotate(context.Background(), s.DB, user, token, 0, now)
+	require.Equal(s.T(), ErrExpired, err)
+}
+
+func (s *RefreshSuite) TestRotateFamilyExpires() {
+	// a family used right up to its expiration still expires
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	token, err := Issue(context.Background(), s.DB, user, "", 0, now+60)
+	require.Nil(s.T(), err)
+	for i := 0; i < 3; i++ {
+		token, _, _, err = Rotate(context.Background(), s.DB, user, token, 0, now+int64(i)*20)
+		require.Nil(s.T(), err)
+	}
+	_, _, _, err = Rotate(context.Background(), s.DB, user, token, 0, now+61)
+	require.Equal(s.T(), ErrExpired, err)
+}
+
+func (s *RefreshSuite) TestRevoke() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	expires := time.Now().Add(time.Hour).Unix()
+	t0, err := Issue(context.Background(), s.DB, user, "", 0, expires)
+	require.Nil(s.T(), err)
+	t1, err := Issue(context.Background(), s.DB, user, "", 0, expires)
+	require.Nil(s.T(), err)
+
+	// only the owning user can revoke
+	err = RevokeFamily(context.Background(), s.DB, uuid.NewString(), t0)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	err = RevokeFamily(context.Background(), s.DB, user, t0)
+	require.Nil(s.T(), err)
+	_, _, _, err = Rotate(context.Background(), s.DB, user, t0, 0, now)
+	require.Equal(s.T(), ErrRevoked, err)
+	err = RevokeFamily(context.Background(), s.DB, user, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// other families are unaffected
+	_, _, _, err = Rotate(context.Background(), s.DB, user, t1, 0, now)
+	require.Nil(s.T(), err)
+}
+
+func TestRefreshSuite(t *testing.T) {
+	suite.Run(t, new(RefreshSuite))
+}
@@ -0,0 +1,141 @@
+// Package reset models single-use password reset tokens
+//
+// Only a digest of each token is stored. A user has at most one
+// outstanding token: issuing another replaces it, and redeeming it
+// removes it.
+package reset
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// TokenLen is the number of random bytes in a token
+const TokenLen = 32
+
+// ErrExpired signals a reset token past its expiration; it has been removed
+var ErrExpired error = errors.New("reset token expired")
+
+// Issue stores a new token for user that expires at expires (unixtime),
+// replacing any outstanding token, and returns the token to send
+func Issue(ctx context.Context, db *sql.DB, user string, expires int64) (string, error) {
+	token, err := security.RandomToken(TokenLen)
+	if err != nil {
+		return "", err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf("delete from %s where user_id = $1",
+		schemas.PasswordResetsTableName)
+	_, err = tx.ExecContext(ctx, q, user)
+	if err != nil {
+		return "", err
+	}
+	q = fmt.Sprintf("insert into %s (digest,user_id,expires) values ($1,$2,$3)",
+		schemas.PasswordResetsTableName)
+	result, err := tx.ExecContext(ctx, q, security.EncodedSHA256(token), user, expires)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return "", models.ErrConflict
+		}
+		return "", err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return "", models.ErrRowsAffected
+	}
+	return token, tx.Commit()
+}
+
+// Lookup returns the user token was issued to, without redeeming it,
+// so a request can be validated first
+// an unknown or already redeemed token is sql.ErrNoRows
+func Lookup(ctx context.Context, db *sql.DB, token string, now int64) (string, error) {
+	q := fmt.Sprintf("select user_id,expires from %s where digest = $1",
+		schemas.PasswordResetsTableName)
+	var user string
+	var expires int64
+	err := db.QueryRowContext(ctx, q, security.EncodedSHA256(token)).Scan(&user, &expires)
+	if err != nil {
+		return "", err
+	}
+	if expires < now {
+		return "", ErrExpired
+	}
+	return user, nil
+}
+
+// Redeem removes token and returns the user it was issued to
+// an unknown or already redeemed token is sql.ErrNoRows
+func Redeem(ctx context.Context, db *sql.DB, token string, now int64) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback() // nolint
+
+	digest := security.EncodedSHA256(token)
+	q := fmt.Sprintf("select user_id,expires from %s where digest = $1",
+		schemas.PasswordResetsTableName)
+	var user string
+	var expires int64
+	err = tx.QueryRowContext(ctx, q, digest).Scan(&user, &expires)
+	if err != nil {
+		return "", err
+	}
+
+	// conditional on the digest, so only one of two concurrent redemptions succeeds
+	q = fmt.Sprintf("delete from %s where digest = $1",
+		schemas.PasswordResetsTableName)
+	result, err := tx.ExecContext(ctx, q, digest)
+	if err != nil {
+		return "", err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted != 1 {
+		return "", sql.ErrNoRows
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	if expires < now {
+		return "", ErrExpired
+	}
+	return user, nil
+}
+
+// Prune removes tokens that expired before now (unixtime),
+// returning the number removed
+func Prune(ctx context.Context, db *sql.DB, now int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where expires < $1",
+		schemas.PasswordResetsTableName)
+	result, err := db.ExecContext(ctx, q, now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
@@ -0,0 +1,99 @@
+package reset
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ResetSuite struct {
+	suite.Suite
+	DB *sql.DB
+}
+
+func (s *ResetSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *ResetSuite) TestRedeem() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	token, err := Issue(context.Background(), s.DB, user, now+60)
+	require.Nil(s.T(), err)
+	looked, err := Lookup(context.Background(), s.DB, token, now)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), user, looked)
+	redeemed, err := Redeem(context.Background(), s.DB, token, now)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), user, redeemed)
+
+	// only once
+	_, err = Redeem(context.Background(), s.DB, token, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	_, err = Redeem(context.Background(), s.DB, uuid.NewString(), now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *ResetSuite) TestReplace() {
+	user := uuid.NewString()
+	now := time.Now().Unix()
+	t0, err := Issue(context.Background(), s.DB, user, now+60)
+	require.Nil(s.T(), err)
+	t1, err := Issue(context.Background(), s.DB, user, now+60)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), t0, t1)
+	_, err = Redeem(context.Background(), s.DB, t0, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	redeemed, err := Redeem(context.Background(), s.DB, t1, now)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), user, redeemed)
+}
+
+func (s *ResetSuite) TestExpired() {
+	now := time.Now().Unix()
+	token, err := Issue(context.Background(), s.DB, uuid.NewString(), now-1)
+	require.Nil(s.T(), err)
+	_, err = Lookup(context.Background(), s.DB, token, now)
+	require.Equal(s.T(), ErrExpired, err)
+	_, err = Redeem(context.Background(), s.DB, token, now)
+	require.Equal(s.T(), ErrExpired, err)
+	_, err = Redeem(context.Background(), s.DB, token, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *ResetSuite) TestPrune() {
+	now := time.Now().Unix()
+	expired, err := Issue(context.Background(), s.DB, uuid.NewString(), now-1)
+	require.Nil(s.T(), err)
+	current, err := Issue(context.Background(), s.DB, uuid.NewString(), now+60)
+	require.Nil(s.T(), err)
+	deleted, err := Prune(context.Background(), s.DB, now)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	_, err = Redeem(context.Background(), s.DB, expired, now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	_, err = Redeem(context.Background(), s.DB, current, now)
+	require.Nil(s.T(), err)
+}
+
+func TestResetSuite(t *testing.T) {
+	suite.Run(t, new(ResetSuite))
+}
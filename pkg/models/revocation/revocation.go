@@ -0,0 +1,56 @@
+// Package revocation stores individually revoked access tokens by jti
+//
+// Entries are only needed until the token would have expired anyway,
+// so Prune can remove them after that.
+package revocation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+)
+
+// Revoke records that the token jti, issued to user and expiring at
+// expires (unixtime), is no longer accepted
+// revoking a token twice is not an error
+func Revoke(ctx context.Context, db *sql.DB, jti, user string, expires int64) error {
+	q := fmt.Sprintf("insert into %s (jti,user_id,expires) values ($1,$2,$3)",
+		schemas.RevokedTokensTableName)
+	_, err := db.ExecContext(ctx, q, jti, user, expires)
+	if err != nil && models.UniqueConstraint(err) {
+		return nil
+	}
+	return err
+}
+
+// IsRevoked reports whether the token jti has been revoked
+func IsRevoked(ctx context.Context, db *sql.DB, jti string) (bool, error) {
+	q := fmt.Sprintf("select count(*) from %s where jti = $1",
+		schemas.RevokedTokensTableName)
+	var count int
+	err := db.QueryRowContext(ctx, q, jti).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// Prune removes entries for tokens that expired before now (unixtime),
+// returning the number removed
+func Prune(ctx context.Context, db *sql.DB, now int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where expires < $1",
+		schemas.RevokedTokensTableName)
+	result, err := db.ExecContext(ctx, q, now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
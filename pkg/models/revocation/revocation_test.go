@@ -0,0 +1,76 @@
+package revocation
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RevocationSuite struct {
+	suite.Suite
+	DB *sql.DB
+}
+
+func (s *RevocationSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *RevocationSuite) TestRevoke() {
+	jti := uuid.NewString()
+	revoked, err := IsRevoked(context.Background(), s.DB, jti)
+	require.Nil(s.T(), err)
+	require.False(s.T(), revoked)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	err = Revoke(context.Background(), s.DB, jti, uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+	revoked, err = IsRevoked(context.Background(), s.DB, jti)
+	require.Nil(s.T(), err)
+	require.True(s.T(), revoked)
+
+	// twice is fine
+	err = Revoke(context.Background(), s.DB, jti, uuid.NewString(), expires)
+	require.Nil(s.T(), err)
+}
+
+func (s *RevocationSuite) TestPrune() {
+	now := time.Now().Unix()
+	expired := uuid.NewString()
+	err := Revoke(context.Background(), s.DB, expired, uuid.NewString(), now-1)
+	require.Nil(s.T(), err)
+	current := uuid.NewString()
+	err = Revoke(context.Background(), s.DB, current, uuid.NewString(), now+60)
+	require.Nil(s.T(), err)
+
+	deleted, err := Prune(context.Background(), s.DB, now)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	revoked, err := IsRevoked(context.Background(), s.DB, expired)
+	require.Nil(s.T(), err)
+	require.False(s.T(), revoked)
+	revoked, err = IsRevoked(context.Background(), s.DB, current)
+	require.Nil(s.T(), err)
+	require.True(s.T(), revoked)
+}
+
+func TestRevocationSuite(t *testing.T) {
+	suite.Run(t, new(RevocationSuite))
+}
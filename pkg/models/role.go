@@ -0,0 +1,42 @@
+package models
+
+import "errors"
+
+// Role is a user's membership role in their org, an int when stored
+// roles are ordered by privilege, so a role outranks those below it
+type Role int
+
+// exported role values
+// RoleOwner and RoleRoot are never stored: the owner is the one named by
+// the org, and every member of the root org is root
+const (
+	RoleNone     = Role(-1)
+	RoleReadOnly = Role(0)
+	RoleMember   = Role(1)
+	RoleAdmin    = Role(2)
+	RoleOwner    = Role(3)
+	RoleRoot     = Role(4)
+)
+
+// NewRole creates a Role from an int
+func NewRole(role int) (Role, error) {
+	switch role {
+	case 0:
+		return RoleReadOnly, nil
+	case 1:
+		return RoleMember, nil
+	case 2:
+		return RoleAdmin, nil
+	case 3:
+		return RoleOwner, nil
+	case 4:
+		return RoleRoot, nil
+	default:
+		return RoleNone, errors.New("unknown role")
+	}
+}
+
+// Stored reports whether r can be stored for a user
+func (r Role) Stored() bool {
+	return r == RoleReadOnly || r == RoleMember || r == RoleAdmin
+}
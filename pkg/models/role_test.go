@@ -0,0 +1,32 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RoleSuite struct {
+	suite.Suite
+}
+
+func (s *RoleSuite) TestRole() {
+	_, err := NewRole(-1)
+	require.Error(s.T(), err)
+	_, err = NewRole(100)
+	require.Error(s.T(), err)
+	for _, r := range []Role{RoleReadOnly, RoleMember, RoleAdmin, RoleOwner, RoleRoot} {
+		role, err := NewRole(int(r))
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), r, role)
+	}
+	require.True(s.T(), RoleAdmin.Stored())
+	require.False(s.T(), RoleOwner.Stored())
+	require.False(s.T(), RoleNone.Stored())
+	require.True(s.T(), RoleOwner > RoleAdmin)
+}
+
+func TestRoleSuite(t *testing.T) {
+	suite.Run(t, new(RoleSuite))
+}
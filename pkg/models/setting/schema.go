@@ -0,0 +1,159 @@
+package setting
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"unicode/utf8"
+)
+
+// validateSchema checks v against a JSON schema, supporting the subset:
+// type, enum, minimum, maximum, minLength, maxLength, pattern,
+// items, minItems, maxItems, properties, required, additionalProperties (bool)
+func validateSchema(schema map[string]interface{}, v interface{}, path string) error {
+	if t, ok := schema["type"].(string); ok {
+		if !hasType(t, v) {
+			return fmt.Errorf("%s: expected %s", path, t)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not in enum", path)
+		}
+	}
+
+	switch val := v.(type) {
+	case json.Number:
+		f, err := val.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: malformed number", path)
+		}
+		if min, ok := number(schema["minimum"]); ok && f < min {
+			return fmt.Errorf("%s: less than minimum", path)
+		}
+		if max, ok := number(schema["maximum"]); ok && f > max {
+			return fmt.Errorf("%s: greater than maximum", path)
+		}
+	case string:
+		l := float64(utf8.RuneCountInString(val))
+		if min, ok := number(schema["minLength"]); ok && l < min {
+			return fmt.Errorf("%s: shorter than minLength", path)
+		}
+		if max, ok := number(schema["maxLength"]); ok && l > max {
+			return fmt.Errorf("%s: longer than maxLength", path)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("%s: malformed pattern", path)
+			}
+			if !re.MatchString(val) {
+				return fmt.Errorf("%s: does not match pattern", path)
+			}
+		}
+	case []interface{}:
+		l := float64(len(val))
+		if min, ok := number(schema["minItems"]); ok && l < min {
+			return fmt.Errorf("%s: fewer than minItems", path)
+		}
+		if max, ok := number(schema["maxItems"]); ok && l > max {
+			return fmt.Errorf("%s: more than maxItems", path)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, ok := val[name]; !ok {
+					return fmt.Errorf("%s: missing required %s", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, hasAdditional := schema["additionalProperties"].(bool)
+		for name, prop := range val {
+			propSchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if hasAdditional && !additional {
+					return fmt.Errorf("%s: unexpected property %s", path, name)
+				}
+				continue
+			}
+			err := validateSchema(propSchema, prop, path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasType reports whether v is of the JSON schema type t
+func hasType(t string, v interface{}) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	default:
+		return false
+	}
+}
+
+// number converts a schema keyword value to a float64
+func number(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// equal compares decoded JSON values, treating numbers by value
+func equal(a, b interface{}) bool {
+	na, aok := a.(json.Number)
+	nb, bok := b.(json.Number)
+	if aok && bok {
+		fa, errA := na.Float64()
+		fb, errB := nb.Float64()
+		return errA == nil && errB == nil && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,333 @@
+// Package setting models org-scoped key/value settings
+package setting
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+)
+
+// Type is the declared type of a setting value
+type Type string
+
+// exported setting types
+const (
+	TypeBool   = Type("bool")
+	TypeInt    = Type("int")
+	TypeString = Type("string")
+	TypeJSON   = Type("json")
+)
+
+// NewType creates a Type from a string
+func NewType(t string) (Type, error) {
+	switch Type(t) {
+	case TypeBool, TypeInt, TypeString, TypeJSON:
+		return Type(t), nil
+	default:
+		return "", errors.New("unknown setting type")
+	}
+}
+
+// ErrInvalidValue signals a value that does not match its type or schema
+var ErrInvalidValue error = errors.New("setting value invalid")
+
+// keyPattern constrains setting keys
+var keyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// Instance is a single org setting
+// Schema is an optional JSON schema the value must satisfy;
+// only Editable settings can be changed by the org owner
+type Instance struct {
+	Org      string          `json:"org"`
+	Key      string          `json:"key"`
+	Type     Type            `json:"type"`
+	Value    json.RawMessage `json:"value"`
+	Schema   json.RawMessage `json:"schema,omitempty"`
+	Editable bool            `json:"editable"`
+	Ctime    int64           `json:"ctime"`
+	Mtime    int64           `json:"mtime"`
+}
+
+// New creates a new setting that hasn't been created before
+func New(org, key string, typ Type, value, schema json.RawMessage, editable bool) (*Instance, error) {
+	if !keyPattern.MatchString(key) {
+		return nil, errors.New("malformed setting key")
+	}
+	if _, err := NewType(string(typ)); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(schema)) == 0 {
+		schema = nil
+	}
+	err := Validate(typ, schema, value)
+	if err != nil {
+		return nil, err
+	}
+	return &Instance{
+		Org:      org,
+		Key:      key,
+		Type:     typ,
+		Value:    value,
+		Schema:   schema,
+		Editable: editable,
+	}, nil
+}
+
+// Insert a new row.
+func (s *Instance) Insert(ctx context.Context, db *sql.DB) error {
+	// make sure the setting's org is in the db
+	qOrg := fmt.Sprintf("select count(*) from %s where id = $1", schemas.OrgsTableName)
+	var count int
+	err := db.QueryRowContext(ctx, qOrg, s.Org).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return models.ErrRelatedOrg
+	}
+
+	q := fmt.Sprintf("insert into %s (org,name,type,value,json_schema,editable) values ($1,$2,$3,$4,$5,$6)",
+		schemas.OrgSettingsTableName)
+	result, err := db.ExecContext(ctx, q, s.Org, s.Key, s.Type, string(s.Value), string(s.Schema), s.Editable)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return models.ErrConflict
+		}
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return models.ErrRowsAffected
+	}
+	// settings are reported as a change to their org
+	models.Changed(models.KindOrg, s.Org)
+	return nil
+}
+
+// scanner is satisfied by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan initializes an Instance from the columns in selectCols
+func scan(row scanner) (*Instance, error) {
+	s := &Instance{}
+	var typ, value, schema string
+	err := row.Scan(&s.Org, &s.Key, &typ, &value, &schema, &s.Editable, &s.Ctime, &s.Mtime)
+	if err != nil {
+		return nil, err
+	}
+	s.Type, err = NewType(typ)
+	if err != nil {
+		return nil, err
+	}
+	s.Value = json.RawMessage(value)
+	if len(schema) != 0 {
+		s.Schema = json.RawMessage(schema)
+	}
+	return s, nil
+}
+
+const selectCols = "org,name,type,value,json_schema,editable,ctime,mtime"
+
+// Read initializes an Instance based on a database row
+func Read(ctx context.Context, db *sql.DB, org, key string) (*Instance, error) {
+	q := fmt.Sprintf("select %s from %s where org = $1 and name = $2",
+		selectCols, schemas.OrgSettingsTableName)
+	return scan(db.QueryRowContext(ctx, q, org, key))
+}
+
+// ReadAll reads every setting for an org in one query
+func ReadAll(ctx context.Context, db *sql.DB, org string) (Map, error) {
+	q := fmt.Sprintf("select %s from %s where org = $1",
+		selectCols, schemas.OrgSettingsTableName)
+	rows, err := db.QueryContext(ctx, q, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(Map)
+	for rows.Next() {
+		s, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		m[s.Key] = *s
+	}
+	return m, rows.Err()
+}
+
+// UpdateValue sets the setting value after checking it against
+// the setting type and schema
+func (s *Instance) UpdateValue(ctx context.Context, db *sql.DB, value json.RawMessage) error {
+	err := Validate(s.Type, s.Schema, value)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("update %s set value = $1 where org = $2 and name = $3",
+		schemas.OrgSettingsTableName)
+	result, err := db.ExecContext(ctx, q, string(value), s.Org, s.Key)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	if updated != 1 {
+		return models.ErrRowsAffected
+	}
+	models.Changed(models.KindOrg, s.Org)
+	return nil
+}
+
+// Delete removes the setting
+func (s *Instance) Delete(ctx context.Context, db *sql.DB) error {
+	q := fmt.Sprintf("delete from %s where org = $1 and name = $2",
+		schemas.OrgSettingsTableName)
+	result, err := db.ExecContext(ctx, q, s.Org, s.Key)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	if deleted != 1 {
+		return models.ErrRowsAffected
+	}
+	models.Changed(models.KindOrg, s.Org)
+	return nil
+}
+
+// Validate checks that value is JSON of the declared type, and
+// satisfies schema if schema is non-empty
+func Validate(typ Type, schema, value json.RawMessage) error {
+	v, err := decode(value)
+	if err != nil {
+		return fmt.Errorf("%w: value is not json", ErrInvalidValue)
+	}
+	switch typ {
+	case TypeBool:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%w: not a bool", ErrInvalidValue)
+		}
+	case TypeInt:
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%w: not an int", ErrInvalidValue)
+		}
+		if _, err := n.Int64(); err != nil {
+			return fmt.Errorf("%w: not an int", ErrInvalidValue)
+		}
+	case TypeString:
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%w: not a string", ErrInvalidValue)
+		}
+	case TypeJSON:
+	default:
+		return fmt.Errorf("%w: unknown type", ErrInvalidValue)
+	}
+	if len(schema) == 0 {
+		return nil
+	}
+	sv, err := decode(schema)
+	if err != nil {
+		return fmt.Errorf("%w: schema is not json", ErrInvalidValue)
+	}
+	sm, ok := sv.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: schema is not an object", ErrInvalidValue)
+	}
+	err = validateSchema(sm, v, "$")
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidValue, err.Error())
+	}
+	return nil
+}
+
+// decode unmarshals a single JSON value, keeping numbers exact
+func decode(bs json.RawMessage) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(bs))
+	d.UseNumber()
+	var v interface{}
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("trailing data")
+	}
+	return v, nil
+}
+
+// Map is the set of settings for an org, keyed by setting key
+type Map map[string]Instance
+
+// Bool returns the value of a bool setting, or def if it is not set
+func (m Map) Bool(key string, def bool) bool {
+	s, ok := m[key]
+	if !ok || s.Type != TypeBool {
+		return def
+	}
+	var v bool
+	if json.Unmarshal(s.Value, &v) != nil {
+		return def
+	}
+	return v
+}
+
+// Int returns the value of an int setting, or def if it is not set
+func (m Map) Int(key string, def int64) int64 {
+	s, ok := m[key]
+	if !ok || s.Type != TypeInt {
+		return def
+	}
+	var v int64
+	if json.Unmarshal(s.Value, &v) != nil {
+		return def
+	}
+	return v
+}
+
+// String returns the value of a string setting, or def if it is not set
+func (m Map) String(key string, def string) string {
+	s, ok := m[key]
+	if !ok || s.Type != TypeString {
+		return def
+	}
+	var v string
+	if json.Unmarshal(s.Value, &v) != nil {
+		return def
+	}
+	return v
+}
+
+// JSON unmarshals the value of a setting into v, returning false if
+// the setting is not set
+func (m Map) JSON(key string, v interface{}) (bool, error) {
+	s, ok := m[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(s.Value, v)
+}
@@ -0,0 +1,172 @@
+package setting
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SettingSuite struct {
+	suite.Suite
+	DB  *sql.DB
+	Org *org.Instance
+}
+
+func (s *SettingSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Org, err = org.New(uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Org.Meta.Status = models.StatusActive
+	err = s.Org.Insert(context.Background(), s.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *SettingSuite) TestNewSetting() {
+	_, err := New(s.Org.ID, "Bad Key", TypeBool, json.RawMessage(`true`), nil, false)
+	require.Error(s.T(), err)
+	_, err = New(s.Org.ID, "feature.x", Type("float"), json.RawMessage(`1.5`), nil, false)
+	require.Error(s.T(), err)
+	_, err = New(s.Org.ID, "feature.x", TypeBool, json.RawMessage(`1`), nil, false)
+	require.True(s.T(), errors.Is(err, ErrInvalidValue))
+	_, err = New(s.Org.ID, "limit.x", TypeInt, json.RawMessage(`1.5`), nil, false)
+	require.True(s.T(), errors.Is(err, ErrInvalidValue))
+	_, err = New(s.Org.ID, "brand.x", TypeString, json.RawMessage(`"a" "b"`), nil, false)
+	require.True(s.T(), errors.Is(err, ErrInvalidValue))
+	v, err := New(s.Org.ID, "brand.x", TypeString, json.RawMessage(`"a"`), json.RawMessage(` `), true)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), v.Schema)
+}
+
+func (s *SettingSuite) TestValidateSchema() {
+	schema := json.RawMessage(`{
+		"type": "object",
+		"required": ["color"],
+		"additionalProperties": false,
+		"properties": {
+			"color": {"type": "string", "pattern": "^#[0-9a-f]{6}$"},
+			"size": {"type": "integer", "minimum": 1, "maximum": 10},
+			"tags": {"type": "array", "maxItems": 2, "items": {"enum": ["a", "b"]}}
+		}
+	}`)
+	require.Nil(s.T(), Validate(TypeJSON, schema, json.RawMessage(`{"color":"#00ff00","size":3,"tags":["a"]}`)))
+	for _, bad := range []string{
+		`{"size":3}`,
+		`{"color":"green"}`,
+		`{"color":"#00ff00","size":11}`,
+		`{"color":"#00ff00","size":1.5}`,
+		`{"color":"#00ff00","tags":["c"]}`,
+		`{"color":"#00ff00","tags":["a","b","a"]}`,
+		`{"color":"#00ff00","other":1}`,
+		`[]`,
+	} {
+		err := Validate(TypeJSON, schema, json.RawMessage(bad))
+		require.True(s.T(), errors.Is(err, ErrInvalidValue), bad)
+	}
+	require.Nil(s.T(), Validate(TypeString, json.RawMessage(`{"minLength":2,"maxLength":3}`), json.RawMessage(`"ab"`)))
+	require.Error(s.T(), Validate(TypeString, json.RawMessage(`{"minLength":2,"maxLength":3}`), json.RawMessage(`"abcd"`)))
+	require.Error(s.T(), Validate(TypeString, json.RawMessage(`[]`), json.RawMessage(`"ab"`)))
+}
+
+func (s *SettingSuite) TestInsertReadSetting() {
+	v, err := New(s.Org.ID, "limit.users", TypeInt, json.RawMessage(`10`), json.RawMessage(`{"minimum":1}`), true)
+	require.Nil(s.T(), err)
+	err = v.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+
+	// duplicate
+	err = v.Insert(context.Background(), s.DB)
+	require.Equal(s.T(), models.ErrConflict, err)
+
+	// org not there
+	vOther, err := New(uuid.NewString(), "limit.users", TypeInt, json.RawMessage(`10`), nil, true)
+	require.Nil(s.T(), err)
+	err = vOther.Insert(context.Background(), s.DB)
+	require.Equal(s.T(), models.ErrRelatedOrg, err)
+
+	vRead, err := Read(context.Background(), s.DB, s.Org.ID, v.Key)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), v.Type, vRead.Type)
+	require.JSONEq(s.T(), string(v.Value), string(vRead.Value))
+	require.JSONEq(s.T(), string(v.Schema), string(vRead.Schema))
+	require.True(s.T(), vRead.Editable)
+	require.NotZero(s.T(), vRead.Ctime)
+
+	// not found
+	_, err = Read(context.Background(), s.DB, s.Org.ID, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *SettingSuite) TestUpdateDeleteSetting() {
+	v, err := New(s.Org.ID, "limit.users", TypeInt, json.RawMessage(`10`), json.RawMessage(`{"minimum":1}`), true)
+	require.Nil(s.T(), err)
+	err = v.Insert(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+
+	err = v.UpdateValue(context.Background(), s.DB, json.RawMessage(`0`))
+	require.True(s.T(), errors.Is(err, ErrInvalidValue))
+	err = v.UpdateValue(context.Background(), s.DB, json.RawMessage(`20`))
+	require.Nil(s.T(), err)
+
+	m, err := ReadAll(context.Background(), s.DB, s.Org.ID)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), m, 1)
+	require.Equal(s.T(), int64(20), m.Int(v.Key, 0))
+
+	err = v.Delete(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	err = v.Delete(context.Background(), s.DB)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	err = v.UpdateValue(context.Background(), s.DB, json.RawMessage(`20`))
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *SettingSuite) TestMap() {
+	m := Map{
+		"b": Instance{Key: "b", Type: TypeBool, Value: json.RawMessage(`true`)},
+		"i": Instance{Key: "i", Type: TypeInt, Value: json.RawMessage(`7`)},
+		"s": Instance{Key: "s", Type: TypeString, Value: json.RawMessage(`"x"`)},
+		"j": Instance{Key: "j", Type: TypeJSON, Value: json.RawMessage(`{"a":1}`)},
+	}
+	require.True(s.T(), m.Bool("b", false))
+	require.True(s.T(), m.Bool("missing", true))
+	require.False(s.T(), m.Bool("i", false)) // wrong type
+	require.Equal(s.T(), int64(7), m.Int("i", 0))
+	require.Equal(s.T(), "x", m.String("s", ""))
+	var j map[string]int
+	found, err := m.JSON("j", &j)
+	require.True(s.T(), found)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, j["a"])
+	found, err = m.JSON("missing", &j)
+	require.False(s.T(), found)
+	require.Nil(s.T(), err)
+}
+
+func TestSettingSuite(t *testing.T) {
+	suite.Run(t, new(SettingSuite))
+}
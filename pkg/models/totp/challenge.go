@@ -0,0 +1,124 @@
+package totp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+// ChallengeLen is the number of random bytes in a challenge
+const ChallengeLen = 32
+
+// MaxChallengeAttempts is the number of wrong codes after which a
+// challenge is discarded
+const MaxChallengeAttempts = 5
+
+// Challenge is a password login waiting on a second factor
+// only a digest of the challenge is stored; Scope is what the
+// completed login grants
+type Challenge struct {
+	Digest   string `json:"-"`
+	User     string `json:"user"`
+	Scope    string `json:"scope"`
+	Attempts int    `json:"attempts"`
+	Expires  int64  `json:"expires"`
+}
+
+// NewChallenge stores a new challenge for user,
+// returning the challenge to hand to the client
+func NewChallenge(ctx context.Context, db *sql.DB, user, scope string, expires int64) (string, error) {
+	token, err := security.RandomToken(ChallengeLen)
+	if err != nil {
+		return "", err
+	}
+	q := fmt.Sprintf("insert into %s (digest,user_id,scope,expires) values ($1,$2,$3,$4)",
+		schemas.LoginChallengesTableName)
+	_, err = db.ExecContext(ctx, q, security.EncodedSHA256(token), user, scope, expires)
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return "", models.ErrConflict
+		}
+		return "", err
+	}
+	return token, nil
+}
+
+// ReadChallenge initializes a Challenge from the token handed to the client
+func ReadChallenge(ctx context.Context, db *sql.DB, token string) (*Challenge, error) {
+	q := fmt.Sprintf("select digest,user_id,scope,attempts,expires from %s where digest = $1",
+		schemas.LoginChallengesTableName)
+	c := &Challenge{}
+	err := db.QueryRowContext(ctx, q, security.EncodedSHA256(token)).Scan(
+		&c.Digest,
+		&c.User,
+		&c.Scope,
+		&c.Attempts,
+		&c.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Fail records a wrong code, discarding the challenge once
+// MaxChallengeAttempts is reached
+func (c *Challenge) Fail(ctx context.Context, db *sql.DB) error {
+	c.Attempts++
+	if c.Attempts >= MaxChallengeAttempts {
+		_, err := c.delete(ctx, db)
+		return err
+	}
+	q := fmt.Sprintf("update %s set attempts = $1 where digest = $2",
+		schemas.LoginChallengesTableName)
+	_, err := db.ExecContext(ctx, q, c.Attempts, c.Digest)
+	return err
+}
+
+// Complete consumes the challenge
+// a challenge already consumed is sql.ErrNoRows
+func (c *Challenge) Complete(ctx context.Context, db *sql.DB) error {
+	deleted, err := c.delete(ctx, db)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// delete removes the challenge, returning the number of rows removed
+func (c *Challenge) delete(ctx context.Context, db *sql.DB) (int64, error) {
+	q := fmt.Sprintf("delete from %s where digest = $1", schemas.LoginChallengesTableName)
+	result, err := db.ExecContext(ctx, q, c.Digest)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
+
+// PruneChallenges removes challenges that expired before now (unixtime),
+// returning the number removed
+func PruneChallenges(ctx context.Context, db *sql.DB, now int64) (int64, error) {
+	q := fmt.Sprintf("delete from %s where expires < $1",
+		schemas.LoginChallengesTableName)
+	result, err := db.ExecContext(ctx, q, now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	return deleted, nil
+}
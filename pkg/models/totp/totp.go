@@ -0,0 +1,274 @@
+// Package totp models TOTP (RFC 6238) two-factor enrollment
+//
+// A user enrolls by receiving a seed, which is stored encrypted, and a
+// set of one-time recovery codes, of which only digests are stored. The
+// enrollment takes effect once confirmed with a code from the user's
+// authenticator. Each accepted time step is recorded so a code cannot
+// be used twice.
+package totp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+)
+
+const (
+	// RecoveryCodes is the number of recovery codes issued on enrollment
+	RecoveryCodes = 10
+
+	// RecoveryCodeLen is the number of random bytes in a recovery code
+	RecoveryCodeLen = 5
+
+	// Window is the number of time steps either side of now accepted,
+	// to allow for clock drift
+	Window = 1
+)
+
+// ErrInvalidCode signals a code that does not match, or was already used
+var ErrInvalidCode error = errors.New("invalid two-factor code")
+
+// Encrypted is the enrollment seed, encrypted with the key ring
+var Encrypted = models.Encrypted{
+	Table:   schemas.TOTPTableName,
+	ID:      "user_id",
+	Columns: []string{"seed"},
+}
+
+// Enrollment is handed to the user once, when they enroll
+type Enrollment struct {
+	Seed          string   `json:"seed"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// URI returns the otpauth uri for the enrollment, for display as a QR code
+func (e *Enrollment) URI(issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", e.Seed)
+	v.Set("issuer", issuer)
+	v.Set("digits", strconv.Itoa(security.TOTPDigits))
+	v.Set("period", strconv.Itoa(security.TOTPPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Enroll creates a new unconfirmed enrollment for user, replacing any
+// earlier unconfirmed one
+// a user with a confirmed enrollment is models.ErrConflict
+func Enroll(ctx context.Context, db *sql.DB, key *security.KeyRing, user string) (*Enrollment, error) {
+	seed, err := security.NewTOTPSeed()
+	if err != nil {
+		return nil, err
+	}
+	encryptedSeed, err := key.Encrypt(seed)
+	if err != nil {
+		return nil, err
+	}
+	e := &Enrollment{Seed: seed}
+	for i := 0; i < RecoveryCodes; i++ {
+		code, err := security.RandomToken(RecoveryCodeLen)
+		if err != nil {
+			return nil, err
+		}
+		e.RecoveryCodes = append(e.RecoveryCodes, code)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint
+
+	// make sure the user is in the db
+	qUser := fmt.Sprintf("select count(*) from %s where id = $1", schemas.UsersTableName)
+	var count int
+	err = tx.QueryRowContext(ctx, qUser, user).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count != 1 {
+		return nil, models.ErrRelatedUser
+	}
+
+	qConfirmed := fmt.Sprintf("select count(*) from %s where user_id = $1 and confirmed = 1",
+		schemas.TOTPTableName)
+	err = tx.QueryRowContext(ctx, qConfirmed, user).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count != 0 {
+		return nil, models.ErrConflict
+	}
+
+	err = removeAll(ctx, tx, user)
+	if err != nil {
+		return nil, err
+	}
+	q := fmt.Sprintf("insert into %s (user_id,seed) values ($1,$2)", schemas.TOTPTableName)
+	_, err = tx.ExecContext(ctx, q, user, encryptedSeed)
+	if err != nil {
+		return nil, err
+	}
+	qCode := fmt.Sprintf("insert into %s (user_id,digest) values ($1,$2)", schemas.TOTPRecoveryTableName)
+	for _, code := range e.RecoveryCodes {
+		_, err = tx.ExecContext(ctx, qCode, user, security.EncodedSHA256(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, tx.Commit()
+}
+
+// removeAll removes the enrollment and recovery codes for user
+func removeAll(ctx context.Context, tx *sql.Tx, user string) error {
+	for _, table := range []string{schemas.TOTPTableName, schemas.TOTPRecoveryTableName} {
+		q := fmt.Sprintf("delete from %s where user_id = $1", table)
+		_, err := tx.ExecContext(ctx, q, user)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSeed returns the decrypted seed for user and whether the
+// enrollment is confirmed
+func readSeed(ctx context.Context, db *sql.DB, key *security.KeyRing, user string) (string, bool, error) {
+	q := fmt.Sprintf("select seed,confirmed from %s where user_id = $1", schemas.TOTPTableName)
+	var encryptedSeed string
+	var confirmed bool
+	err := db.QueryRowContext(ctx, q, user).Scan(&encryptedSeed, &confirmed)
+	if err != nil {
+		return "", false, err
+	}
+	seed, err := key.Decrypt(encryptedSeed)
+	if err != nil {
+		return "", false, err
+	}
+	return seed, confirmed, nil
+}
+
+// useStep records step as the latest accepted for user, failing with
+// ErrInvalidCode if it is not later than the last one
+func useStep(ctx context.Context, db *sql.DB, user string, step int64, confirm bool) error {
+	q := fmt.Sprintf("update %s set last_step = $1, confirmed = confirmed or $2 where user_id = $3 and last_step < $1",
+		schemas.TOTPTableName)
+	result, err := db.ExecContext(ctx, q, step, confirm, user)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Confirm completes the enrollment for user with a code at now (unixtime)
+// a user with no enrollment is sql.ErrNoRows, one already confirmed
+// is models.ErrConflict
+func Confirm(ctx context.Context, db *sql.DB, key *security.KeyRing, user, code string, now int64) error {
+	seed, confirmed, err := readSeed(ctx, db, key, user)
+	if err != nil {
+		return err
+	}
+	if confirmed {
+		return models.ErrConflict
+	}
+	step, ok, err := security.VerifyTOTP(seed, code, time.Unix(now, 0), Window)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	return useStep(ctx, db, user, step, true)
+}
+
+// Enabled reports whether user has a confirmed enrollment
+func Enabled(ctx context.Context, db *sql.DB, user string) (bool, error) {
+	q := fmt.Sprintf("select count(*) from %s where user_id = $1 and confirmed = 1",
+		schemas.TOTPTableName)
+	var count int
+	err := db.QueryRowContext(ctx, q, user).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// Verify checks code for user at now (unixtime); code is either a
+// current authenticator code or an unused recovery code, which is
+// then spent
+// a user with no confirmed enrollment is sql.ErrNoRows
+func Verify(ctx context.Context, db *sql.DB, key *security.KeyRing, user, code string, now int64) error {
+	seed, confirmed, err := readSeed(ctx, db, key, user)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return sql.ErrNoRows
+	}
+	code = strings.TrimSpace(code)
+	step, ok, err := security.VerifyTOTP(seed, code, time.Unix(now, 0), Window)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return useStep(ctx, db, user, step, false)
+	}
+
+	q := fmt.Sprintf("update %s set used = 1 where user_id = $1 and digest = $2 and used = 0",
+		schemas.TOTPRecoveryTableName)
+	result, err := db.ExecContext(ctx, q, user, security.EncodedSHA256(strings.ToLower(code)))
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable removes the enrollment for user
+// a user with no enrollment is sql.ErrNoRows
+func Disable(ctx context.Context, db *sql.DB, user string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf("select count(*) from %s where user_id = $1", schemas.TOTPTableName)
+	var count int
+	err = tx.QueryRowContext(ctx, q, user).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	err = removeAll(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
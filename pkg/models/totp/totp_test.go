@@ -0,0 +1,187 @@
+package totp
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/models"
+	"github.com/grokloc/grokloc-go/pkg/models/org"
+	"github.com/grokloc/grokloc-go/pkg/models/user"
+	"github.com/grokloc/grokloc-go/pkg/schemas"
+	"github.com/grokloc/grokloc-go/pkg/security"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TOTPSuite struct {
+	suite.Suite
+	DB   *sql.DB
+	Key  *security.KeyRing
+	User *user.Instance
+}
+
+func (s *TOTPSuite) SetupTest() {
+	var err error
+	s.DB, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// avoid concurrency bug with the sqlite library
+	s.DB.SetMaxOpenConns(1)
+	_, err = s.DB.Exec(schemas.AppCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Key, err = security.MakeKeyRing("test", uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	o, err := org.New(uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	o.Meta.Status = models.StatusActive
+	err = o.Insert(context.Background(), s.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.User, err = user.New(uuid.NewString(), uuid.NewString(), o.ID, uuid.NewString())
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = s.User.Insert(context.Background(), s.DB, s.Key)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// code returns the authenticator code for seed at now plus offset steps
+func (s *TOTPSuite) code(seed string, now int64, offset int64) string {
+	code, err := security.TOTPCode(seed, now/security.TOTPPeriod+offset)
+	require.Nil(s.T(), err)
+	return code
+}
+
+func (s *TOTPSuite) TestEnroll() {
+	ctx := context.Background()
+	now := time.Now().Unix()
+
+	_, err := Enroll(ctx, s.DB, s.Key, uuid.NewString())
+	require.Equal(s.T(), models.ErrRelatedUser, err)
+
+	// enrolling twice before confirming replaces the seed
+	e0, err := Enroll(ctx, s.DB, s.Key, s.User.ID)
+	require.Nil(s.T(), err)
+	e, err := Enroll(ctx, s.DB, s.Key, s.User.ID)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), e0.Seed, e.Seed)
+	require.Len(s.T(), e.RecoveryCodes, RecoveryCodes)
+	require.True(s.T(), strings.HasPrefix(e.URI("GrokLOC", "a@b.c"), "otpauth://totp/GrokLOC:a@b.c?"))
+
+	// not in effect until confirmed
+	enabled, err := Enabled(ctx, s.DB, s.User.ID)
+	require.Nil(s.T(), err)
+	require.False(s.T(), enabled)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, 0), now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	err = Confirm(ctx, s.DB, s.Key, s.User.ID, s.code(e0.Seed, now, 5), now)
+	require.Equal(s.T(), ErrInvalidCode, err)
+	err = Confirm(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, -1), now)
+	require.Nil(s.T(), err)
+	enabled, err = Enabled(ctx, s.DB, s.User.ID)
+	require.Nil(s.T(), err)
+	require.True(s.T(), enabled)
+
+	err = Confirm(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, 0), now)
+	require.Equal(s.T(), models.ErrConflict, err)
+	_, err = Enroll(ctx, s.DB, s.Key, s.User.ID)
+	require.Equal(s.T(), models.ErrConflict, err)
+	err = Confirm(ctx, s.DB, s.Key, uuid.NewString(), "000000", now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *TOTPSuite) TestVerify() {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	e, err := Enroll(ctx, s.DB, s.Key, s.User.ID)
+	require.Nil(s.T(), err)
+	err = Confirm(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, -1), now)
+	require.Nil(s.T(), err)
+
+	// each step is accepted once, and not after a later one
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, -1), now)
+	require.Equal(s.T(), ErrInvalidCode, err)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, 1), now)
+	require.Nil(s.T(), err)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, 0), now)
+	require.Equal(s.T(), ErrInvalidCode, err)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, s.code(e.Seed, now, 3), now)
+	require.Equal(s.T(), ErrInvalidCode, err)
+
+	// recovery codes work once each
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, e.RecoveryCodes[0], now)
+	require.Nil(s.T(), err)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, e.RecoveryCodes[0], now)
+	require.Equal(s.T(), ErrInvalidCode, err)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, strings.ToUpper(e.RecoveryCodes[1]), now)
+	require.Nil(s.T(), err)
+
+	err = Disable(ctx, s.DB, s.User.ID)
+	require.Nil(s.T(), err)
+	err = Disable(ctx, s.DB, s.User.ID)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	err = Verify(ctx, s.DB, s.Key, s.User.ID, e.RecoveryCodes[2], now)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *TOTPSuite) TestChallenge() {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	token, err := NewChallenge(ctx, s.DB, s.User.ID, "org:read", now+60)
+	require.Nil(s.T(), err)
+	c, err := ReadChallenge(ctx, s.DB, token)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.User.ID, c.User)
+	require.Equal(s.T(), "org:read", c.Scope)
+	require.NotEqual(s.T(), token, c.Digest)
+	_, err = ReadChallenge(ctx, s.DB, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// complete is one-time
+	err = c.Complete(ctx, s.DB)
+	require.Nil(s.T(), err)
+	err = c.Complete(ctx, s.DB)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// too many failures discard the challenge
+	token, err = NewChallenge(ctx, s.DB, s.User.ID, "", now+60)
+	require.Nil(s.T(), err)
+	for i := 0; i < MaxChallengeAttempts; i++ {
+		c, err = ReadChallenge(ctx, s.DB, token)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), i, c.Attempts)
+		err = c.Fail(ctx, s.DB)
+		require.Nil(s.T(), err)
+	}
+	_, err = ReadChallenge(ctx, s.DB, token)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	expired, err := NewChallenge(ctx, s.DB, s.User.ID, "", now-1)
+	require.Nil(s.T(), err)
+	deleted, err := PruneChallenges(ctx, s.DB, now)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), deleted, int64(1))
+	_, err = ReadChallenge(ctx, s.DB, expired)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func TestTOTPSuite(t *testing.T) {
+	suite.Run(t, new(TOTPSuite))
+}
@@ -6,6 +6,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/models"
@@ -15,13 +19,29 @@ import (
 
 // exported user symbols
 const (
-	SchemaVersion = 0
+	SchemaVersion = 1
 )
 
+// searchable fields and prefix token bounds
+const (
+	SearchEmail       = "email"
+	SearchDisplayName = "display_name"
+	MinSearchPrefix   = 3
+	MaxSearchPrefix   = 16
+	SearchLimit       = 100
+)
+
+// Encrypted is the user columns encrypted with the key ring
+var Encrypted = models.Encrypted{
+	Table:   schemas.UsersTableName,
+	ID:      "id",
+	Columns: []string{"api_secret", "prev_api_secret", "display_name", "email"},
+}
+
 // Instance is a user model
 type Instance struct {
 	models.Base
-	APISecret         string `json:"api_secret"`
+	APISecret         string `json:"-"` // only returned by RotateAPISecret
 	APISecretDigest   string `json:"api_secret_digest"`
 	DisplayName       string `json:"display_name"`
 	DisplayNameDigest string `json:"display_name_digest"`
@@ -29,10 +49,24 @@ type Instance struct {
 	EmailDigest       string `json:"email_digest"`
 	Org               string `json:"org"`
 	Password          string `json:"-"` // don't serialize password
+	// the stored role; the effective role may be higher, see models.Role
+	Role           models.Role `json:"role"`
+	TokenWatermark int64       `json:"-"` // tokens carrying an older value are revoked
+	// the api secret replaced by RotateAPISecret, accepted until
+	// PrevAPISecretExpires (unixtime); empty if there is none
+	PrevAPISecret        string `json:"-"`
+	PrevAPISecretExpires int64  `json:"-"`
+	// a service account is a non-human user with no email or password,
+	// which only gets tokens through its api keys, limited to
+	// ServiceScope if set, from AllowedIPs if set
+	Service      bool   `json:"service"`
+	ServiceScope string `json:"service_scope,omitempty"`
+	AllowedIPs   string `json:"allowed_ips,omitempty"` // space separated ips and cidrs
 }
 
 // New creates a new user that hasn't been created before
 // password assumed derived
+// DisplayNameDigest and EmailDigest are keyed, so they are set in Insert
 func New(displayName, email, org, password string) (*Instance, error) {
 	for _, v := range []string{displayName, email, org, password} {
 		if !security.SafeStr(v) {
@@ -43,19 +77,121 @@ func New(displayName, email, org, password string) (*Instance, error) {
 	u.ID = uuid.NewString()
 	u.Meta.SchemaVersion = SchemaVersion
 	u.Meta.Status = models.StatusUnconfirmed
+	u.Role = models.RoleMember
 
 	u.APISecret = uuid.NewString()
 	u.APISecretDigest = security.EncodedSHA256(u.APISecret)
 	u.DisplayName = displayName
-	u.DisplayNameDigest = security.EncodedSHA256(u.DisplayName)
 	u.Email = email
-	u.EmailDigest = security.EncodedSHA256(u.Email)
 
 	return u, nil
 }
 
+// NewService creates a new service account that hasn't been created before
+// scope is space separated and not checked here; allowedIPs are ips or cidrs
+// the account is active at once, as there is no one to confirm it
+func NewService(displayName, org, scope string, allowedIPs []string) (*Instance, error) {
+	for _, v := range []string{displayName, org} {
+		if !security.SafeStr(v) {
+			return nil, errors.New("malformed user arg")
+		}
+	}
+	for _, ip := range allowedIPs {
+		if !validIP(ip) {
+			return nil, errors.New("malformed allowed ip")
+		}
+	}
+	u := &Instance{Org: org}
+	u.ID = uuid.NewString()
+	u.Meta.SchemaVersion = SchemaVersion
+	u.Meta.Status = models.StatusActive
+	u.Role = models.RoleMember
+	u.Service = true
+	u.ServiceScope = scope
+	u.AllowedIPs = strings.Join(allowedIPs, " ")
+
+	// the api secret is never accepted, but the column is required
+	u.APISecret = uuid.NewString()
+	u.APISecretDigest = security.EncodedSHA256(u.APISecret)
+	u.DisplayName = displayName
+
+	return u, nil
+}
+
+// validIP reports whether s is an ip or a cidr
+func validIP(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// AllowsIP reports whether requests from ip are accepted for u
+// only service accounts are restricted, and only if AllowedIPs is set
+func (u *Instance) AllowsIP(ip string) bool {
+	if !u.Service || len(u.AllowedIPs) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, allowed := range strings.Fields(u.AllowedIPs) {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(parsed) {
+				return true
+			}
+			continue
+		}
+		if net.ParseIP(allowed).Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDigests computes the display name and email blind indexes
+// service accounts have no email, so theirs is derived from the id to
+// stay unique in the org
+func (u *Instance) setDigests(key *security.KeyRing) {
+	indexKey := key.IndexKey()
+	u.DisplayNameDigest = security.BlindIndex(u.DisplayName, indexKey)
+	if u.Service {
+		u.EmailDigest = security.BlindIndex("service:"+u.ID, indexKey)
+		return
+	}
+	u.EmailDigest = security.BlindIndex(u.Email, indexKey)
+}
+
+// searchToken is the blind index of a normalized prefix of a field in an org
+func searchToken(indexKey []byte, org, field, prefix string) string {
+	return security.BlindIndex(org+":"+field+":"+prefix, indexKey)
+}
+
+// insertSearchTokens adds the prefix tokens for one field of a user
+func insertSearchTokens(ctx context.Context, tx *sql.Tx, indexKey []byte, id, org, field, val string) error {
+	q := fmt.Sprintf("insert into %s (user_id,org,field,token) values ($1,$2,$3,$4)",
+		schemas.UserSearchIndexTableName)
+	for _, prefix := range security.Prefixes(security.Normalize(val), MinSearchPrefix, MaxSearchPrefix) {
+		_, err := tx.ExecContext(ctx, q, id, org, field, searchToken(indexKey, org, field, prefix))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSearchTokens removes the prefix tokens for one field of a user
+func deleteSearchTokens(ctx context.Context, tx *sql.Tx, id, field string) error {
+	q := fmt.Sprintf("delete from %s where user_id = $1 and field = $2",
+		schemas.UserSearchIndexTableName)
+	_, err := tx.ExecContext(ctx, q, id, field)
+	return err
+}
+
 // Insert a new row.
-func (u *Instance) Insert(ctx context.Context, db *sql.DB, key []byte) error {
+func (u *Instance) Insert(ctx context.Context, db *sql.DB, key *security.KeyRing) error {
 	// make sure the user's org is in the db and active
 	qOrg := fmt.Sprintf("select count(*) from %s where id = $1 and status = $2", schemas.OrgsTableName)
 	var count int
@@ -67,21 +203,29 @@ func (u *Instance) Insert(ctx context.Context, db *sql.DB, key []byte) error {
 		return models.ErrRelatedOrg
 	}
 
-	encryptedAPISecret, err := security.Encrypt(u.APISecret, key)
+	u.setDigests(key)
+	encryptedAPISecret, err := key.Encrypt(u.APISecret)
+	if err != nil {
+		return err
+	}
+	encryptedDisplayName, err := key.Encrypt(u.DisplayName)
 	if err != nil {
 		return err
 	}
-	encryptedDisplayName, err := security.Encrypt(u.DisplayName, key)
+	encryptedEmail, err := key.Encrypt(u.Email)
 	if err != nil {
 		return err
 	}
-	encryptedEmail, err := security.Encrypt(u.Email, key)
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	q := fmt.Sprintf("insert into %s (id,api_secret,api_secret_digest,display_name,display_name_digest,email,email_digest,org,password,status,schema_version) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)",
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf("insert into %s (id,api_secret,api_secret_digest,display_name,display_name_digest,email,email_digest,org,password,role,service,service_scope,allowed_ips,status,schema_version) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)",
 		schemas.UsersTableName)
-	result, err := db.ExecContext(ctx,
+	result, err := tx.ExecContext(ctx,
 		q,
 		u.ID,
 		encryptedAPISecret,
@@ -92,6 +236,10 @@ func (u *Instance) Insert(ctx context.Context, db *sql.DB, key []byte) error {
 		u.EmailDigest,
 		u.Org,
 		u.Password,
+		u.Role,
+		u.Service,
+		u.ServiceScope,
+		u.AllowedIPs,
 		u.Meta.Status,
 		SchemaVersion)
 	if err != nil {
@@ -108,26 +256,43 @@ func (u *Instance) Insert(ctx context.Context, db *sql.DB, key []byte) error {
 	if inserted != 1 {
 		return models.ErrRowsAffected
 	}
-	return nil
+
+	indexKey := key.IndexKey()
+	err = insertSearchTokens(ctx, tx, indexKey, u.ID, u.Org, SearchEmail, u.Email)
+	if err != nil {
+		return err
+	}
+	err = insertSearchTokens(ctx, tx, indexKey, u.ID, u.Org, SearchDisplayName, u.DisplayName)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Read initializes an Instance based on a database row
-func Read(ctx context.Context, db *sql.DB, key []byte, id string) (*Instance, error) {
-	q := fmt.Sprintf("select api_secret,api_secret_digest,display_name,display_name_digest,email,email_digest,org,password,ctime,mtime,status,schema_version from %s where id = $1",
+func Read(ctx context.Context, db *sql.DB, key *security.KeyRing, id string) (*Instance, error) {
+	q := fmt.Sprintf("select api_secret,api_secret_digest,prev_api_secret,prev_api_secret_expires,display_name,display_name_digest,email,email_digest,org,password,role,service,service_scope,allowed_ips,token_watermark,ctime,mtime,status,schema_version from %s where id = $1",
 		schemas.UsersTableName)
-	var statusRaw int
+	var statusRaw, roleRaw int
 	u := &Instance{}
 	u.ID = id
-	var encryptedAPISecret, encryptedDisplayName, encryptedEmail string
+	var encryptedAPISecret, encryptedPrevAPISecret, encryptedDisplayName, encryptedEmail string
 	err := db.QueryRowContext(ctx, q, id).Scan(
 		&encryptedAPISecret,
 		&u.APISecretDigest,
+		&encryptedPrevAPISecret,
+		&u.PrevAPISecretExpires,
 		&encryptedDisplayName,
 		&u.DisplayNameDigest,
 		&encryptedEmail,
 		&u.EmailDigest,
 		&u.Org,
 		&u.Password,
+		&roleRaw,
+		&u.Service,
+		&u.ServiceScope,
+		&u.AllowedIPs,
+		&u.TokenWatermark,
 		&u.Meta.Ctime,
 		&u.Meta.Mtime,
 		&statusRaw,
@@ -135,15 +300,21 @@ func Read(ctx context.Context, db *sql.DB, key []byte, id string) (*Instance, er
 	if err != nil {
 		return nil, err
 	}
-	u.APISecret, err = security.Decrypt(encryptedAPISecret, key)
+	u.APISecret, err = key.Decrypt(encryptedAPISecret)
 	if err != nil {
 		return nil, err
 	}
-	u.DisplayName, err = security.Decrypt(encryptedDisplayName, key)
+	if len(encryptedPrevAPISecret) != 0 {
+		u.PrevAPISecret, err = key.Decrypt(encryptedPrevAPISecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	u.DisplayName, err = key.Decrypt(encryptedDisplayName)
 	if err != nil {
 		return nil, err
 	}
-	u.Email, err = security.Decrypt(encryptedEmail, key)
+	u.Email, err = key.Decrypt(encryptedEmail)
 	if err != nil {
 		return nil, err
 	}
@@ -151,6 +322,10 @@ func Read(ctx context.Context, db *sql.DB, key []byte, id string) (*Instance, er
 	if err != nil {
 		return nil, err
 	}
+	u.Role, err = models.NewRole(roleRaw)
+	if err != nil {
+		return nil, err
+	}
 	if u.Meta.SchemaVersion != SchemaVersion {
 		// handle migrating different versions, or err
 		return nil, models.ErrModelMigrate
@@ -158,20 +333,73 @@ func Read(ctx context.Context, db *sql.DB, key []byte, id string) (*Instance, er
 	return u, nil
 }
 
+// ListServices returns the service accounts in org, oldest first
+func ListServices(ctx context.Context, db *sql.DB, key *security.KeyRing, org string) ([]*Instance, error) {
+	q := fmt.Sprintf("select id from %s where org = $1 and service = 1 order by ctime, rowid",
+		schemas.UsersTableName)
+	rows, err := db.QueryContext(ctx, q, org)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	users := make([]*Instance, 0, len(ids))
+	for _, id := range ids {
+		u, err := Read(ctx, db, key, id)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// ReadByEmail initializes an Instance based on the row with email in org
+func ReadByEmail(ctx context.Context, db *sql.DB, key *security.KeyRing, org, email string) (*Instance, error) {
+	q := fmt.Sprintf("select id from %s where email_digest = $1 and org = $2",
+		schemas.UsersTableName)
+	var id string
+	err := db.QueryRowContext(ctx, q, security.BlindIndex(email, key.IndexKey()), org).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return Read(ctx, db, key, id)
+}
+
 // UpdateDisplayName sets the user display name
-func (u *Instance) UpdateDisplayName(ctx context.Context, db *sql.DB, key []byte, displayName string) error {
+func (u *Instance) UpdateDisplayName(ctx context.Context, db *sql.DB, key *security.KeyRing, displayName string) error {
 	if !security.SafeStr(displayName) {
 		return errors.New("display name malformed")
 	}
 
-	// both the display name and the digest must be reset
-	encryptedDisplayName, err := security.Encrypt(displayName, key)
+	// the display name, the digest and the search tokens must be reset
+	encryptedDisplayName, err := key.Encrypt(displayName)
 	if err != nil {
 		return err
 	}
+	indexKey := key.IndexKey()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
 
 	q := "update users set display_name = $1, display_name_digest = $2 where id = $3"
-	result, err := db.ExecContext(ctx, q, encryptedDisplayName, security.EncodedSHA256(displayName), u.ID)
+	result, err := tx.ExecContext(ctx, q, encryptedDisplayName, security.BlindIndex(displayName, indexKey), u.ID)
 	if err != nil {
 		return err
 	}
@@ -186,22 +414,304 @@ func (u *Instance) UpdateDisplayName(ctx context.Context, db *sql.DB, key []byte
 	if updated != 1 {
 		return models.ErrRowsAffected
 	}
+
+	err = deleteSearchTokens(ctx, tx, u.ID, SearchDisplayName)
+	if err != nil {
+		return err
+	}
+	err = insertSearchTokens(ctx, tx, indexKey, u.ID, u.Org, SearchDisplayName, displayName)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	models.Changed(models.KindUser, u.ID)
 	return nil
 }
 
 // UpdatePassword sets the user password
 // password assumed derived
+// tokens issued under the old password are revoked
 func (u *Instance) UpdatePassword(ctx context.Context, db *sql.DB, password string) error {
 	if !security.SafeStr(password) {
 		return errors.New("password malformed")
 	}
-	return models.Update(ctx, db, schemas.UsersTableName, u.ID, "password", password)
+	return u.updateRevoking(ctx, db, "password", password)
+}
+
+// RevokeTokens moves the token watermark forward, so every token
+// issued to the user so far is no longer accepted
+func (u *Instance) RevokeTokens(ctx context.Context, db *sql.DB) error {
+	watermark := time.Now().UnixNano()
+	err := models.Update(ctx, db, schemas.UsersTableName, u.ID, "token_watermark", watermark)
+	if err != nil {
+		return err
+	}
+	u.TokenWatermark = watermark
+	models.Changed(models.KindUser, u.ID)
+	return nil
+}
+
+// RotateAPISecret replaces the api secret with a new random one
+// with a positive grace, the old secret is still accepted for token
+// requests until grace elapses; without one the old secret is presumed
+// leaked, so tokens issued so far are revoked as well
+func (u *Instance) RotateAPISecret(ctx context.Context, db *sql.DB, key *security.KeyRing, grace time.Duration) error {
+	apiSecret := uuid.NewString()
+	encryptedAPISecret, err := key.Encrypt(apiSecret)
+	if err != nil {
+		return err
+	}
+	apiSecretDigest := security.EncodedSHA256(apiSecret)
+
+	var q string
+	var args []interface{}
+	var prevExpires int64
+	watermark := u.TokenWatermark
+	if grace > 0 {
+		// the current column value is the old secret, already encrypted
+		prevExpires = time.Now().Add(grace).Unix()
+		q = fmt.Sprintf("update %s set prev_api_secret = api_secret, prev_api_secret_expires = $1, api_secret = $2, api_secret_digest = $3 where id = $4",
+			schemas.UsersTableName)
+		args = []interface{}{prevExpires, encryptedAPISecret, apiSecretDigest, u.ID}
+	} else {
+		watermark = time.Now().UnixNano()
+		q = fmt.Sprintf("update %s set prev_api_secret = '', prev_api_secret_expires = 0, api_secret = $1, api_secret_digest = $2, token_watermark = $3 where id = $4",
+			schemas.UsersTableName)
+		args = []interface{}{encryptedAPISecret, apiSecretDigest, watermark, u.ID}
+	}
+	result, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	if updated != 1 {
+		return models.ErrRowsAffected
+	}
+
+	if grace > 0 {
+		u.PrevAPISecret = u.APISecret
+	} else {
+		u.PrevAPISecret = ""
+	}
+	u.PrevAPISecretExpires = prevExpires
+	u.APISecret = apiSecret
+	u.APISecretDigest = apiSecretDigest
+	u.TokenWatermark = watermark
+	models.Changed(models.KindUser, u.ID)
+	return nil
+}
+
+// APISecretValid reports whether secret is the api secret, or the
+// previous one within its grace period at now (unixtime)
+func (u *Instance) APISecretValid(secret string, now int64) bool {
+	if secret == u.APISecret {
+		return true
+	}
+	return len(u.PrevAPISecret) != 0 && secret == u.PrevAPISecret && now <= u.PrevAPISecretExpires
 }
 
 // UpdateStatus sets the user status
+// tokens issued under the old status are revoked
 func (u *Instance) UpdateStatus(ctx context.Context, db *sql.DB, status models.Status) error {
 	if status == models.StatusNone {
 		return errors.New("cannot use None as a stored status")
 	}
-	return models.Update(ctx, db, schemas.UsersTableName, u.ID, "status", status)
+	return u.updateRevoking(ctx, db, "status", status)
+}
+
+// UpdateRole sets the stored user role
+// tokens issued under the old role are revoked, as their scopes follow it
+func (u *Instance) UpdateRole(ctx context.Context, db *sql.DB, role models.Role) error {
+	if !role.Stored() {
+		return models.ErrDisallowedValue
+	}
+	err := u.updateRevoking(ctx, db, "role", role)
+	if err != nil {
+		return err
+	}
+	u.Role = role
+	return nil
+}
+
+// updateRevoking sets colName to val and moves the token watermark
+// forward in the same statement
+func (u *Instance) updateRevoking(ctx context.Context, db *sql.DB, colName string, val interface{}) error {
+	watermark := time.Now().UnixNano()
+	q := fmt.Sprintf("update %s set %s = $1, token_watermark = $2 where id = $3",
+		schemas.UsersTableName, colName)
+	result, err := db.ExecContext(ctx, q, val, watermark, u.ID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	if updated != 1 {
+		return models.ErrRowsAffected
+	}
+	u.TokenWatermark = watermark
+	models.Changed(models.KindUser, u.ID)
+	return nil
+}
+
+// Search returns the users in org with a field starting with prefix
+// field is SearchEmail or SearchDisplayName; prefix is normalized and
+// must be at least MinSearchPrefix runes, and only matching rows are decrypted
+func Search(ctx context.Context, db *sql.DB, key *security.KeyRing, org, field, prefix string) ([]*Instance, error) {
+	if field != SearchEmail && field != SearchDisplayName {
+		return nil, models.ErrDisallowedValue
+	}
+	prefix = security.Normalize(prefix)
+	if utf8.RuneCountInString(prefix) < MinSearchPrefix {
+		return nil, models.ErrDisallowedValue
+	}
+
+	// prefixes longer than MaxSearchPrefix are matched on the longest
+	// indexed prefix, then filtered after decryption, so index rows are
+	// paged until SearchLimit users match or none are left
+	token := searchToken(key.IndexKey(), org, field, security.Truncate(prefix, MaxSearchPrefix))
+	q := fmt.Sprintf("select user_id from %s where org = $1 and token = $2 and user_id > $3 order by user_id limit %d",
+		schemas.UserSearchIndexTableName, SearchLimit)
+	users := make([]*Instance, 0)
+	last := ""
+	for {
+		ids, err := searchPage(ctx, db, q, org, token, last)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			u, err := Read(ctx, db, key, id)
+			if err != nil {
+				return nil, err
+			}
+			val := u.Email
+			if field == SearchDisplayName {
+				val = u.DisplayName
+			}
+			if strings.HasPrefix(security.Normalize(val), prefix) {
+				users = append(users, u)
+				if len(users) == SearchLimit {
+					return users, nil
+				}
+			}
+		}
+		if len(ids) < SearchLimit {
+			return users, nil
+		}
+		last = ids[len(ids)-1]
+	}
+}
+
+// searchPage runs the Search query q for the user ids after last
+func searchPage(ctx context.Context, db *sql.DB, q, org, token, last string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, q, org, token, last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Migrate upgrades rows stored under an earlier SchemaVersion and
+// returns the number of rows migrated
+// version 0 rows have unkeyed sha256 digests and no search tokens
+func Migrate(ctx context.Context, db *sql.DB, key *security.KeyRing) (int, error) {
+	q := fmt.Sprintf("select id,display_name,email,org,service from %s where schema_version < $1",
+		schemas.UsersTableName)
+	rows, err := db.QueryContext(ctx, q, SchemaVersion)
+	if err != nil {
+		return 0, err
+	}
+	var stale []Instance
+	for rows.Next() {
+		var u Instance
+		err = rows.Scan(&u.ID, &u.DisplayName, &u.Email, &u.Org, &u.Service)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	indexKey := key.IndexKey()
+	for i, u := range stale {
+		u.DisplayName, err = key.Decrypt(u.DisplayName)
+		if err != nil {
+			return i, err
+		}
+		u.Email, err = key.Decrypt(u.Email)
+		if err != nil {
+			return i, err
+		}
+		u.setDigests(key)
+		err = u.migrate(ctx, db, indexKey)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(stale), nil
+}
+
+// migrate writes the current digests, search tokens and SchemaVersion for u
+func (u *Instance) migrate(ctx context.Context, db *sql.DB, indexKey []byte) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf("update %s set display_name_digest = $1, email_digest = $2, schema_version = $3 where id = $4",
+		schemas.UsersTableName)
+	_, err = tx.ExecContext(ctx, q, u.DisplayNameDigest, u.EmailDigest, SchemaVersion, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{SearchEmail, SearchDisplayName} {
+		err = deleteSearchTokens(ctx, tx, u.ID, field)
+		if err != nil {
+			return err
+		}
+	}
+	err = insertSearchTokens(ctx, tx, indexKey, u.ID, u.Org, SearchEmail, u.Email)
+	if err != nil {
+		return err
+	}
+	err = insertSearchTokens(ctx, tx, indexKey, u.ID, u.Org, SearchDisplayName, u.DisplayName)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	models.Changed(models.KindUser, u.ID)
+	return nil
 }
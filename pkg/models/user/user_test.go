@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-go/pkg/models"
@@ -23,7 +25,7 @@ import (
 type UserSuite struct {
 	suite.Suite
 	DB  *sql.DB
-	Key []byte
+	Key *security.KeyRing
 	Org *org.Instance
 }
 
@@ -39,7 +41,7 @@ func (s *UserSuite) SetupTest() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.Key, err = security.MakeKey(uuid.NewString())
+	s.Key, err = security.MakeKeyRing("test", uuid.NewString())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -116,6 +118,72 @@ func (s *UserSuite) TestReadUser() {
 	require.NotEqual(s.T(), u.Meta.Mtime, uRead.Meta.Mtime)
 }
 
+func (s *UserSuite) TestReadUserByEmail() {
+	password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
+	require.Nil(s.T(), err)
+	u, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, password)
+	require.Nil(s.T(), err)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+
+	uRead, err := ReadByEmail(context.Background(), s.DB, s.Key, s.Org.ID, u.Email)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.ID, uRead.ID)
+	require.Equal(s.T(), u.Email, uRead.Email)
+
+	// not found
+	_, err = ReadByEmail(context.Background(), s.DB, s.Key, s.Org.ID, uuid.NewString())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// wrong org
+	_, err = ReadByEmail(context.Background(), s.DB, s.Key, uuid.NewString(), u.Email)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *UserSuite) TestServiceUser() {
+	// malformed ips
+	_, err := NewService(uuid.NewString(), s.Org.ID, "", []string{"10.0.0.0/33"})
+	require.Error(s.T(), err)
+
+	u, err := NewService(uuid.NewString(), s.Org.ID, "org.read", []string{"10.0.0.0/8", "192.168.1.1"})
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), u.Email)
+	require.Empty(s.T(), u.Password)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	// no email to conflict on
+	other, err := NewService(uuid.NewString(), s.Org.ID, "", nil)
+	require.Nil(s.T(), err)
+	err = other.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+
+	uRead, err := Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.True(s.T(), uRead.Service)
+	require.Equal(s.T(), "org.read", uRead.ServiceScope)
+	require.Equal(s.T(), models.StatusActive, uRead.Meta.Status)
+	require.True(s.T(), uRead.AllowsIP("10.1.2.3"))
+	require.True(s.T(), uRead.AllowsIP("192.168.1.1"))
+	require.False(s.T(), uRead.AllowsIP("192.168.1.2"))
+	require.False(s.T(), uRead.AllowsIP("not an ip"))
+	require.True(s.T(), other.AllowsIP("192.168.1.2"))
+
+	// users are not listed
+	password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
+	require.Nil(s.T(), err)
+	person, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, password)
+	require.Nil(s.T(), err)
+	err = person.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	require.False(s.T(), person.Service)
+	require.True(s.T(), person.AllowsIP("192.168.1.2"))
+	services, err := ListServices(context.Background(), s.DB, s.Key, s.Org.ID)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), services, 2)
+	require.Equal(s.T(), u.ID, services[0].ID)
+	require.Equal(s.T(), other.ID, services[1].ID)
+}
+
 func (s *UserSuite) TestUpdateUserDisplayName() {
 	password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
 	require.Nil(s.T(), err)
@@ -146,7 +214,14 @@ func (s *UserSuite) TestUpdateUserDisplayName() {
 	uRead, err = Read(context.Background(), s.DB, s.Key, u.ID)
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), displayName, uRead.DisplayName)
-	require.Equal(s.T(), security.EncodedSHA256(displayName), uRead.DisplayNameDigest)
+	require.Equal(s.T(), security.BlindIndex(displayName, s.Key.IndexKey()), uRead.DisplayNameDigest)
+	require.NotEqual(s.T(), security.EncodedSHA256(displayName), uRead.DisplayNameDigest)
+
+	// search tokens follow the new display name
+	found, err := Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchDisplayName, displayName[:MinSearchPrefix])
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 1)
+	require.Equal(s.T(), u.ID, found[0].ID)
 }
 
 func (s *UserSuite) TestUpdateUserPassword() {
@@ -215,6 +290,315 @@ func (s *UserSuite) TestUpdateUserStatus() {
 	require.Error(s.T(), err)
 }
 
+func (s *UserSuite) TestUpdateUserRole() {
+	u, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.RoleMember, u.Role)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	watermark := u.TokenWatermark
+
+	err = u.UpdateRole(context.Background(), s.DB, models.RoleAdmin)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), watermark, u.TokenWatermark)
+	uRead, err := Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.RoleAdmin, uRead.Role)
+
+	// owner and root are not stored
+	err = u.UpdateRole(context.Background(), s.DB, models.RoleOwner)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+	err = u.UpdateRole(context.Background(), s.DB, models.RoleNone)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+}
+
+func (s *UserSuite) TestUpdateUserNotifies() {
+	u, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	changes := 0
+	cancel := models.Listen(func(kind models.Kind, id string) {
+		if kind == models.KindUser && id == u.ID {
+			changes++
+		}
+	})
+	defer cancel()
+
+	err = u.UpdateDisplayName(context.Background(), s.DB, s.Key, uuid.NewString())
+	require.Nil(s.T(), err)
+	err = u.UpdateStatus(context.Background(), s.DB, models.StatusActive)
+	require.Nil(s.T(), err)
+	err = u.RevokeTokens(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	err = u.RotateAPISecret(context.Background(), s.DB, s.Key, 0)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 4, changes)
+
+	// failed updates are not changes
+	err = u.UpdateRole(context.Background(), s.DB, models.RoleOwner)
+	require.Error(s.T(), err)
+	require.Equal(s.T(), 4, changes)
+}
+
+func (s *UserSuite) TestRevokeUserTokens() {
+	u, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	uRead, err := Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(0), uRead.TokenWatermark)
+
+	err = u.RevokeTokens(context.Background(), s.DB)
+	require.Nil(s.T(), err)
+	uRead, err = Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.NotZero(s.T(), uRead.TokenWatermark)
+	require.Equal(s.T(), u.TokenWatermark, uRead.TokenWatermark)
+
+	// password and status changes move the watermark too
+	last := u.TokenWatermark
+	err = u.UpdatePassword(context.Background(), s.DB, uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Greater(s.T(), u.TokenWatermark, last)
+	last = u.TokenWatermark
+	err = u.UpdateStatus(context.Background(), s.DB, models.StatusInactive)
+	require.Nil(s.T(), err)
+	require.Greater(s.T(), u.TokenWatermark, last)
+	uRead, err = Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.TokenWatermark, uRead.TokenWatermark)
+}
+
+func (s *UserSuite) TestRotateAPISecret() {
+	u, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, uuid.NewString())
+	require.Nil(s.T(), err)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	now := time.Now().Unix()
+
+	// with a grace period the old secret is still valid
+	first := u.APISecret
+	err = u.RotateAPISecret(context.Background(), s.DB, s.Key, time.Hour)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), first, u.APISecret)
+	require.Zero(s.T(), u.TokenWatermark)
+	uRead, err := Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.APISecret, uRead.APISecret)
+	require.Equal(s.T(), security.EncodedSHA256(u.APISecret), uRead.APISecretDigest)
+	require.Equal(s.T(), first, uRead.PrevAPISecret)
+	require.True(s.T(), uRead.APISecretValid(uRead.APISecret, now))
+	require.True(s.T(), uRead.APISecretValid(first, now))
+	require.False(s.T(), uRead.APISecretValid(first, uRead.PrevAPISecretExpires+1))
+	require.False(s.T(), uRead.APISecretValid(uuid.NewString(), now))
+
+	// without one, only the new secret is valid and tokens are revoked
+	second := u.APISecret
+	err = u.RotateAPISecret(context.Background(), s.DB, s.Key, 0)
+	require.Nil(s.T(), err)
+	require.NotZero(s.T(), u.TokenWatermark)
+	uRead, err = Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), uRead.PrevAPISecret)
+	require.Equal(s.T(), u.TokenWatermark, uRead.TokenWatermark)
+	require.False(s.T(), uRead.APISecretValid(second, now))
+	require.False(s.T(), uRead.APISecretValid(first, now))
+	require.False(s.T(), uRead.APISecretValid("", now))
+}
+
+func (s *UserSuite) TestSearchUser() {
+	password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
+	require.Nil(s.T(), err)
+	prefix := uuid.NewString()[:8]
+	u, err := New("Display "+uuid.NewString(), "  "+strings.ToUpper(prefix)+"@example.com", s.Org.ID, password)
+	require.Nil(s.T(), err)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+
+	// normalized prefix
+	found, err := Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix[:MinSearchPrefix+1])
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 1)
+	require.Equal(s.T(), u.ID, found[0].ID)
+
+	// longer than the indexed prefixes
+	found, err = Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix+"@example.co")
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 1)
+	found, err = Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix+"@example.org")
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 0)
+
+	// other org
+	found, err = Search(context.Background(), s.DB, s.Key, uuid.NewString(), SearchEmail, prefix)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 0)
+
+	// too short, unknown field
+	_, err = Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix[:MinSearchPrefix-1])
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+	_, err = Search(context.Background(), s.DB, s.Key, s.Org.ID, "password", prefix)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+}
+
+func (s *UserSuite) TestSearchUserPages() {
+	password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
+	require.Nil(s.T(), err)
+	// more than a page of users share the indexed prefix, and only
+	// the last few match the longer one
+	prefix := uuid.NewString()[:MaxSearchPrefix]
+	insert := func(email string) *Instance {
+		u, err := New(uuid.NewString(), email, s.Org.ID, password)
+		require.Nil(s.T(), err)
+		require.Nil(s.T(), u.Insert(context.Background(), s.DB, s.Key))
+		return u
+	}
+	for i := 0; i < SearchLimit+10; i++ {
+		insert(prefix + "a" + uuid.NewString())
+	}
+	want := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		want[insert(prefix+"b"+uuid.NewString()).ID] = true
+	}
+
+	found, err := Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix+"b")
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, len(want))
+	for _, u := range found {
+		require.True(s.T(), want[u.ID])
+	}
+
+	// at most SearchLimit are returned
+	found, err = Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix+"a")
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, SearchLimit)
+	found, err = Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, prefix)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, SearchLimit)
+}
+
+func (s *UserSuite) TestMigrateUser() {
+	password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
+	require.Nil(s.T(), err)
+	u, err := New(uuid.NewString(), uuid.NewString(), s.Org.ID, password)
+	require.Nil(s.T(), err)
+	err = u.Insert(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+
+	// put the row back into the version 0 format
+	_, err = s.DB.Exec("update users set display_name_digest = $1, email_digest = $2, schema_version = 0 where id = $3",
+		security.EncodedSHA256(u.DisplayName), security.EncodedSHA256(u.Email), u.ID)
+	require.Nil(s.T(), err)
+	_, err = s.DB.Exec("delete from user_search_index where user_id = $1", u.ID)
+	require.Nil(s.T(), err)
+	_, err = Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Equal(s.T(), models.ErrModelMigrate, err)
+
+	migrated, err := Migrate(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), migrated, 1)
+
+	uRead, err := Read(context.Background(), s.DB, s.Key, u.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.EmailDigest, uRead.EmailDigest)
+	require.Equal(s.T(), u.DisplayNameDigest, uRead.DisplayNameDigest)
+	found, err := Search(context.Background(), s.DB, s.Key, s.Org.ID, SearchEmail, u.Email)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), found, 1)
+
+	// nothing left to do
+	migrated, err = Migrate(context.Background(), s.DB, s.Key)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, migrated)
+}
+
+func (s *UserSuite) TestReencryptUser() {
+	// a db of its own, as rows in the shared one are under other keys
+	db, err := sql.Open("sqlite3", "file:"+uuid.NewString()+"?mode=memory&cache=shared")
+	require.Nil(s.T(), err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(schemas.AppCreate)
+	require.Nil(s.T(), err)
+	first, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	key, err := security.NewKeyRing(first, "first", first)
+	require.Nil(s.T(), err)
+	o, err := org.New(uuid.NewString())
+	require.Nil(s.T(), err)
+	o.Meta.Status = models.StatusActive
+	require.Nil(s.T(), o.Insert(context.Background(), db))
+
+	var users []*Instance
+	for i := 0; i < 3; i++ {
+		password, err := security.DerivePassword(uuid.NewString(), argon2.DefaultConfig())
+		require.Nil(s.T(), err)
+		u, err := New(uuid.NewString(), uuid.NewString(), o.ID, password)
+		require.Nil(s.T(), err)
+		require.Nil(s.T(), u.Insert(context.Background(), db, key))
+		users = append(users, u)
+	}
+	require.Nil(s.T(), users[0].RotateAPISecret(context.Background(), db, key, time.Hour))
+
+	// a value from before key ids
+	legacy, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), key.Add(security.LegacyKeyID, legacy))
+	encryptedEmail, err := security.Encrypt(users[1].Email, legacy)
+	require.Nil(s.T(), err)
+	_, err = db.Exec("update users set email = $1 where id = $2", encryptedEmail, users[1].ID)
+	require.Nil(s.T(), err)
+
+	next, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), key.Rotate("next", next))
+	var calls []models.ReencryptProgress
+	p, err := models.Reencrypt(context.Background(), db, key, []models.Encrypted{Encrypted}, 2, func(p models.ReencryptProgress) {
+		calls = append(calls, p)
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.ReencryptProgress{Key: "next", Total: 3, Checked: 3, Reencrypted: 3}, p)
+	require.Len(s.T(), calls, 2)
+	require.Equal(s.T(), 2, calls[0].Checked)
+
+	// only the new key is needed now
+	nextOnly, err := security.NewKeyRing(first, "next", next)
+	require.Nil(s.T(), err)
+	for _, u := range users {
+		var apiSecret, prevAPISecret, displayName, email string
+		err = db.QueryRow("select api_secret,prev_api_secret,display_name,email from users where id = $1", u.ID).
+			Scan(&apiSecret, &prevAPISecret, &displayName, &email)
+		require.Nil(s.T(), err)
+		for _, e := range []string{apiSecret, displayName, email} {
+			require.Equal(s.T(), "next", security.KeyID(e))
+		}
+		uRead, err := Read(context.Background(), db, nextOnly, u.ID)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), u.APISecret, uRead.APISecret)
+		require.Equal(s.T(), u.PrevAPISecret, uRead.PrevAPISecret)
+		require.Equal(s.T(), u.DisplayName, uRead.DisplayName)
+		require.Equal(s.T(), u.Email, uRead.Email)
+	}
+	found, err := ReadByEmail(context.Background(), db, nextOnly, o.ID, users[1].Email)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), users[1].ID, found.ID)
+
+	// nothing left to do
+	p, err = models.Reencrypt(context.Background(), db, nextOnly, []models.Encrypted{Encrypted}, 2, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, p.Reencrypted)
+	require.Equal(s.T(), 3, p.Checked)
+
+	// rows under a key not in the ring are counted, not fatal
+	_, err = db.Exec("update users set email = $1 where id = $2", "gone:"+encryptedEmail, users[2].ID)
+	require.Nil(s.T(), err)
+	p, err = models.Reencrypt(context.Background(), db, nextOnly, []models.Encrypted{Encrypted}, 2, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, p.Failed)
+}
+
 func TestUserSuite(t *testing.T) {
 	suite.Run(t, new(UserSuite))
 }
@@ -0,0 +1,80 @@
+// Package notify delivers messages to users out of band
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Message is addressed to a user's email
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages; deployments provide one for their mail service
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// Outbox is a Notifier that appends each message as a json line to a
+// file, for local testing
+type Outbox struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewOutbox creates an Outbox writing to path; the file is created on
+// the first message
+func NewOutbox(path string) *Outbox {
+	return &Outbox{path: path}
+}
+
+// Notify appends m to the outbox file
+func (o *Outbox) Notify(ctx context.Context, m Message) error {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(bs, '\n'))
+	if err != nil {
+		f.Close() // nolint
+		return err
+	}
+	return f.Close()
+}
+
+// Messages reads every message in the outbox, oldest first
+func (o *Outbox) Messages() ([]Message, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, err := os.Open(o.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var ms []Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m Message
+		err = json.Unmarshal(scanner.Bytes(), &m)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, scanner.Err()
+}
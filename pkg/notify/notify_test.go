@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type NotifySuite struct {
+	suite.Suite
+	path string
+}
+
+func (s *NotifySuite) SetupTest() {
+	s.path = filepath.Join(os.TempDir(), uuid.NewString()+".outbox")
+}
+
+func (s *NotifySuite) TearDownTest() {
+	os.Remove(s.path) // nolint
+}
+
+func (s *NotifySuite) TestOutbox() {
+	o := NewOutbox(s.path)
+	ms, err := o.Messages()
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), ms)
+
+	first := Message{To: uuid.NewString(), Subject: uuid.NewString(), Body: "line\nline"}
+	second := Message{To: uuid.NewString(), Subject: uuid.NewString(), Body: uuid.NewString()}
+	require.Nil(s.T(), o.Notify(context.Background(), first))
+	require.Nil(s.T(), o.Notify(context.Background(), second))
+	ms, err = o.Messages()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []Message{first, second}, ms)
+
+	// messages persist in the file
+	ms, err = NewOutbox(s.path).Messages()
+	require.Nil(s.T(), err)
+	require.Len(s.T(), ms, 2)
+}
+
+func TestNotifySuite(t *testing.T) {
+	suite.Run(t, new(NotifySuite))
+}
@@ -0,0 +1,104 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrIssuer is an issuer that is not an https url on a public host
+// issuers are set by org owners, so the app must not be made to call
+// its own network with one
+var ErrIssuer = errors.New("issuer must be an https url on a public host")
+
+// nonPublic are the networks a provider may not be on: loopback,
+// private, shared, link-local, multicast and unspecified addresses
+var nonPublic = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// PublicIP reports whether ip may be a provider's address
+func PublicIP(ip net.IP) bool {
+	for _, n := range nonPublic {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidIssuer checks issuer is an https url whose host is not named as
+// local or a non-public address
+// a name may still resolve to one, which the client from NewClient refuses
+func ValidIssuer(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Scheme != "https" || len(u.Hostname()) == 0 ||
+		u.User != nil || len(u.RawQuery) != 0 || len(u.Fragment) != 0 {
+		return ErrIssuer
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrIssuer
+	}
+	if ip := net.ParseIP(host); ip != nil && !PublicIP(ip) {
+		return ErrIssuer
+	}
+	return nil
+}
+
+// NewClient creates a client for calling providers, which only connects
+// to public addresses, whatever a name resolves to or redirects to
+// proxies are not used, as they would connect on the client's behalf
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !PublicIP(ip) {
+				return fmt.Errorf("%w: %s is not public", ErrIssuer, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,236 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt_go "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+)
+
+// Identity is who a MockIdP signs in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// grant is an issued authorization code
+type grant struct {
+	identity    Identity
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+// MockIdP is an in-process identity provider for tests
+// it has a single client, and authorizes whoever is set with SignIn
+// without prompting, redirecting at once with a code
+type MockIdP struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+	key          *jwt.Key
+	mu           sync.Mutex
+	identity     Identity
+	codes        map[string]grant
+}
+
+// NewMockIdP starts a MockIdP with a new client registration and
+// signing key; Close it when done
+func NewMockIdP() (*MockIdP, error) {
+	key, err := jwt.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	m := &MockIdP{
+		ClientID:     uuid.NewString(),
+		ClientSecret: uuid.NewString(),
+		key:          key,
+		codes:        make(map[string]grant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(DiscoveryPath, m.discovery)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/jwks", m.jwks)
+	m.Server = httptest.NewTLSServer(mux)
+	return m, nil
+}
+
+// mockHost is the name the provider is reached by, which its test
+// certificate is for; Client connects it to the server
+const mockHost = "example.com"
+
+// Issuer is the issuer identifier of the provider
+func (m *MockIdP) Issuer() string {
+	return "https://" + mockHost + ":" + m.port()
+}
+
+// port is the port the server listens on
+func (m *MockIdP) port() string {
+	_, port, err := net.SplitHostPort(m.Server.Listener.Addr().String())
+	if err != nil {
+		panic(err.Error())
+	}
+	return port
+}
+
+// Client creates a client that trusts the provider and connects its
+// name to it; NewClient would refuse to, as it is on loopback
+func (m *MockIdP) Client() *http.Client {
+	c := m.Server.Client()
+	transport := c.Transport.(*http.Transport).Clone()
+	addr := m.Server.Listener.Addr().String()
+	var dialer net.Dialer
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Timeout: 5 * time.Second, Transport: transport}
+}
+
+// Close stops the provider
+func (m *MockIdP) Close() {
+	m.Server.Close()
+}
+
+// SignIn sets who the next authorizations are for
+func (m *MockIdP) SignIn(i Identity) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identity = i
+}
+
+// SignIDToken signs claims as the provider does, so tests can present
+// id tokens the provider would not issue
+func (m *MockIdP) SignIDToken(claims jwt_go.MapClaims) (string, error) {
+	token := jwt_go.NewWithClaims(jwt_go.SigningMethodRS256, claims)
+	token.Header["kid"] = m.key.ID
+	return token.SignedString(m.key.Private)
+}
+
+func (m *MockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Provider{
+		Issuer:                m.Issuer(),
+		AuthorizationEndpoint: m.Issuer() + "/authorize",
+		TokenEndpoint:         m.Issuer() + "/token",
+		JWKSURI:               m.Issuer() + "/jwks",
+	})
+}
+
+func (m *MockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, jwt.NewKeySet(m.key).JWKS())
+}
+
+func (m *MockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != m.ClientID ||
+		q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0 ||
+		!strings.Contains(" "+q.Get("scope")+" ", " openid ") {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := uuid.NewString()
+	m.mu.Lock()
+	m.codes[code] = grant{
+		identity:    m.identity,
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+	}
+	m.mu.Unlock()
+
+	v := redirect.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *MockIdP) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(e string, status int) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(tokenResponse{Error: e}) // nolint
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		tokenError("invalid_client", http.StatusUnauthorized)
+		return
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != m.ClientID || secret != m.ClientSecret {
+		tokenError("invalid_client", http.StatusUnauthorized)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	// codes are single use, even when refused
+	code := r.PostForm.Get("code")
+	m.mu.Lock()
+	g, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+	if !ok || g.redirectURI != r.PostForm.Get("redirect_uri") ||
+		Challenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		tokenError("invalid_grant", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Unix()
+	idToken, err := m.SignIDToken(jwt_go.MapClaims{
+		"iss":            m.Issuer(),
+		"sub":            g.identity.Subject,
+		"aud":            m.ClientID,
+		"exp":            now + 300,
+		"iat":            now,
+		"nonce":          g.nonce,
+		"email":          g.identity.Email,
+		"email_verified": g.identity.EmailVerified,
+		"name":           g.identity.Name,
+	})
+	if err != nil {
+		tokenError("server_error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": uuid.NewString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// writeJSON writes v as a json response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,245 @@
+// Package oidc is an OpenID Connect relying party
+//
+// Only the authorization code flow with PKCE is supported, and id tokens
+// must be RS256; see https://openid.net/specs/openid-connect-core-1_0.html
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt_go "github.com/dgrijalva/jwt-go"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+)
+
+// Scope is requested in every authorization, so id tokens carry the email
+const Scope = "openid email profile"
+
+// DiscoveryPath is appended to an issuer to find its Provider document
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+// Leeway is the clock skew allowed with a provider when checking id token times
+const Leeway = time.Minute
+
+// maxResponse bounds what is read from a provider
+const maxResponse = 1 << 20
+
+// Provider is the part of a provider's discovery document a relying
+// party needs
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// getJSON reads the json document at u into v
+func getJSON(ctx context.Context, c *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s response code: %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(v)
+}
+
+// Discover reads the discovery document of issuer
+// the document must name the same issuer, as id tokens are checked against it
+func Discover(ctx context.Context, c *http.Client, issuer string) (*Provider, error) {
+	var p Provider
+	err := getJSON(ctx, c, strings.TrimSuffix(issuer, "/")+DiscoveryPath, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("discovered issuer %s does not match", p.Issuer)
+	}
+	if len(p.AuthorizationEndpoint) == 0 || len(p.TokenEndpoint) == 0 || len(p.JWKSURI) == 0 {
+		return nil, errors.New("discovery document incomplete")
+	}
+	return &p, nil
+}
+
+// Challenge is the S256 PKCE code challenge for verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL is where to send the user to sign in
+// the provider returns to redirectURI with the state and a code for Exchange
+func (p Provider) AuthURL(clientID, redirectURI, state, nonce, verifier string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", clientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", Scope)
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", Challenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// tokenResponse is the part of a token endpoint response that is used
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+	Error   string `json:"error"`
+}
+
+// Exchange redeems an authorization code for an id token, which must
+// still be checked with Verify
+// the client authenticates with client_secret_basic
+func (p Provider) Exchange(ctx context.Context, c *http.Client, clientID, clientSecret, redirectURI, code, verifier string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var t tokenResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(&t)
+	if resp.StatusCode != http.StatusOK {
+		if err == nil && len(t.Error) != 0 {
+			return "", fmt.Errorf("token endpoint error: %s", t.Error)
+		}
+		return "", fmt.Errorf("token endpoint response code: %d", resp.StatusCode)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(t.IDToken) == 0 {
+		return "", errors.New("token endpoint returned no id token")
+	}
+	return t.IDToken, nil
+}
+
+// Keys reads the provider's signing keys
+func (p Provider) Keys(ctx context.Context, c *http.Client) (jwt.JWKS, error) {
+	var jwks jwt.JWKS
+	err := getJSON(ctx, c, p.JWKSURI, &jwks)
+	return jwks, err
+}
+
+// Audience is the aud claim, which providers send as a string or a list
+type Audience []string
+
+// UnmarshalJSON accepts either form of Audience
+func (a *Audience) UnmarshalJSON(bs []byte) error {
+	var s string
+	if json.Unmarshal(bs, &s) == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var ss []string
+	err := json.Unmarshal(bs, &ss)
+	if err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+// IDClaims are the id token claims that are used
+type IDClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   bool     `json:"email_verified"`
+	Name            string   `json:"name"`
+}
+
+// Valid satisfies jwt_go.Claims; the claims are checked by Verify instead,
+// against the expected issuer, audience and nonce
+func (c *IDClaims) Valid() error {
+	return nil
+}
+
+// Verify checks the signature of idToken with keys, and that it was
+// issued by issuer to clientID for the authorization with nonce, and
+// is current at now
+func Verify(idToken string, keys jwt.PublicKeys, issuer, clientID, nonce string, now time.Time) (*IDClaims, error) {
+	parser := jwt_go.Parser{
+		ValidMethods:         []string{jwt_go.SigningMethodRS256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	f := func(token *jwt_go.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errors.New("kid missing")
+		}
+		public, ok := keys.PublicKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown kid: %s", kid)
+		}
+		return public, nil
+	}
+	claims := &IDClaims{}
+	_, err := parser.ParseWithClaims(idToken, claims, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != issuer {
+		return nil, errors.New("id token issuer mismatch")
+	}
+	audienced := false
+	for _, aud := range claims.Audience {
+		audienced = audienced || aud == clientID
+	}
+	if !audienced {
+		return nil, errors.New("id token audience mismatch")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != clientID {
+		return nil, errors.New("id token authorized party mismatch")
+	}
+	leeway := int64(Leeway / time.Second)
+	if claims.ExpiresAt+leeway < now.Unix() {
+		return nil, errors.New("id token expired")
+	}
+	if claims.IssuedAt-leeway > now.Unix() {
+		return nil, errors.New("id token issued in the future")
+	}
+	if len(nonce) == 0 || claims.Nonce != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("id token subject missing")
+	}
+	return claims, nil
+}
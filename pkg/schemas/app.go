@@ -4,8 +4,25 @@ package schemas
 
 // exported table names
 const (
-	OrgsTableName  = "orgs"
-	UsersTableName = "users"
+	APIKeysTableName         = "api_keys"
+	AuditLogTableName        = "audit_log"
+	AuthFailuresTableName    = "auth_failures"
+	InvitationsTableName     = "invitations"
+	LoginChallengesTableName = "login_challenges"
+	OIDCConfigsTableName     = "oidc_configs"
+	OIDCFlowsTableName       = "oidc_flows"
+	OIDCIdentitiesTableName  = "oidc_identities"
+	ModelChangesTableName    = "model_changes"
+	OrgsTableName            = "orgs"
+	OrgSettingsTableName     = "org_settings"
+	PasswordResetsTableName  = "password_resets"
+	RefreshTokensTableName   = "refresh_tokens"
+	RequestNoncesTableName   = "request_nonces"
+	RevokedTokensTableName   = "revoked_tokens"
+	TOTPTableName            = "user_totp"
+	TOTPRecoveryTableName    = "totp_recovery_codes"
+	UsersTableName           = "users"
+	UserSearchIndexTableName = "user_search_index"
 )
 
 // AppCreate creates the entire app schema
@@ -13,6 +30,8 @@ const AppCreate = `
 create table if not exists users (
        api_secret text unique not null,
        api_secret_digest text unique not null,
+       prev_api_secret text not null default '',
+       prev_api_secret_expires integer not null default 0,
        id text unique not null,
        display_name text not null,
        display_name_digest text not null,
@@ -20,6 +39,11 @@ create table if not exists users (
        email_digest text unique not null,
        org text not null,
        password text not null,
+       role integer not null default 1,
+       service integer not null default 0,
+       service_scope text not null default '',
+       allowed_ips text not null default '',
+       token_watermark integer not null default 0,
        schema_version integer not null default 0,
        status integer not null,
        ctime integer,
@@ -42,10 +66,22 @@ begin
         where id = new.id;
 end;
 -- STMT
+create table if not exists user_search_index (
+       user_id text not null,
+       org text not null,
+       field text not null,
+       token text not null,
+       primary key (user_id, token));
+-- STMT
+create index if not exists user_search_index_org_token on user_search_index (org, token);
+-- STMT
 create table if not exists orgs (
        id text unique not null,
        name text unique not null,
        owner text not null,
+       pending_owner text not null default '',
+       pending_owner_expires integer not null default 0,
+       require_2fa integer not null default 0,
        schema_version integer not null default 0,
        status integer not null,
        ctime integer,
@@ -66,6 +102,251 @@ begin
         where id = new.id;
 end;
 -- STMT
+create table if not exists org_settings (
+       org text not null,
+       name text not null,
+       type text not null,
+       value text not null,
+       json_schema text not null default '',
+       editable integer not null default 0,
+       ctime integer,
+       mtime integer,
+       primary key (org, name));
+-- STMT
+create trigger if not exists org_settings_ctime_trigger after insert on org_settings
+begin
+        update org_settings set 
+        ctime = strftime('%s','now'), 
+        mtime = strftime('%s','now') 
+        where org = new.org and name = new.name;
+end;
+-- STMT
+create trigger if not exists org_settings_mtime_trigger after update on org_settings
+begin
+        update org_settings set mtime = strftime('%s','now') 
+        where org = new.org and name = new.name;
+end;
+-- STMT
+create table if not exists refresh_tokens (
+       digest text unique not null,
+       family text not null,
+       user_id text not null,
+       watermark integer not null,
+       scope text not null default '',
+       expires integer not null,
+       used integer not null default 0,
+       revoked integer not null default 0,
+       ctime integer,
+       primary key (digest));
+-- STMT
+create index if not exists refresh_tokens_family on refresh_tokens (family);
+-- STMT
+create index if not exists refresh_tokens_user_id on refresh_tokens (user_id);
+-- STMT
+create trigger if not exists refresh_tokens_ctime_trigger after insert on refresh_tokens
+begin
+        update refresh_tokens set
+        ctime = strftime('%s','now')
+        where digest = new.digest;
+end;
+-- STMT
+create table if not exists invitations (
+       id text unique not null,
+       org text not null,
+       email text not null,
+       email_digest text not null,
+       token_digest text unique not null,
+       inviter text not null,
+       expires integer not null,
+       ctime integer,
+       mtime integer,
+       primary key (id));
+-- STMT
+create unique index if not exists invitations_org_email on invitations (org, email_digest);
+-- STMT
+create trigger if not exists invitations_ctime_trigger after insert on invitations
+begin
+        update invitations set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create trigger if not exists invitations_mtime_trigger after update on invitations
+begin
+        update invitations set mtime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create table if not exists oidc_configs (
+       org text unique not null,
+       issuer text not null,
+       client_id text not null,
+       client_secret text not null,
+       ctime integer,
+       mtime integer,
+       primary key (org));
+-- STMT
+create trigger if not exists oidc_configs_ctime_trigger after insert on oidc_configs
+begin
+        update oidc_configs set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where org = new.org;
+end;
+-- STMT
+create trigger if not exists oidc_configs_mtime_trigger after update on oidc_configs
+begin
+        update oidc_configs set mtime = strftime('%s','now')
+        where org = new.org;
+end;
+-- STMT
+create table if not exists oidc_flows (
+       digest text unique not null,
+       org text not null,
+       nonce text not null,
+       verifier text not null,
+       redirect_uri text not null,
+       scope text not null default '',
+       link text not null default '',
+       expires integer not null,
+       primary key (digest));
+-- STMT
+create table if not exists oidc_identities (
+       org text not null,
+       issuer text not null,
+       subject text not null,
+       user_id text not null,
+       ctime integer,
+       primary key (org, issuer, subject));
+-- STMT
+create trigger if not exists oidc_identities_ctime_trigger after insert on oidc_identities
+begin
+        update oidc_identities set
+        ctime = strftime('%s','now')
+        where org = new.org and issuer = new.issuer and subject = new.subject;
+end;
+-- STMT
+create table if not exists password_resets (
+       digest text unique not null,
+       user_id text unique not null,
+       expires integer not null,
+       ctime integer,
+       primary key (digest));
+-- STMT
+create trigger if not exists password_resets_ctime_trigger after insert on password_resets
+begin
+        update password_resets set
+        ctime = strftime('%s','now')
+        where digest = new.digest;
+end;
+-- STMT
+create table if not exists api_keys (
+       id text unique not null,
+       user_id text not null,
+       label text not null,
+       secret text not null,
+       secret_digest text unique not null,
+       scope text not null default '',
+       expires integer not null default 0,
+       last_used integer not null default 0,
+       ctime integer,
+       primary key (id));
+-- STMT
+create unique index if not exists api_keys_user_label on api_keys (user_id, label);
+-- STMT
+create trigger if not exists api_keys_ctime_trigger after insert on api_keys
+begin
+        update api_keys set
+        ctime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create table if not exists revoked_tokens (
+       jti text unique not null,
+       user_id text not null,
+       expires integer not null,
+       primary key (jti));
+-- STMT
+create index if not exists revoked_tokens_expires on revoked_tokens (expires);
+-- STMT
+create table if not exists request_nonces (
+       user_id text not null,
+       nonce text not null,
+       expires integer not null,
+       primary key (user_id, nonce));
+-- STMT
+create index if not exists request_nonces_expires on request_nonces (expires);
+-- STMT
+create table if not exists user_totp (
+       user_id text unique not null,
+       seed text not null,
+       confirmed integer not null default 0,
+       last_step integer not null default 0,
+       ctime integer,
+       primary key (user_id));
+-- STMT
+create trigger if not exists user_totp_ctime_trigger after insert on user_totp
+begin
+        update user_totp set
+        ctime = strftime('%s','now')
+        where user_id = new.user_id;
+end;
+-- STMT
+create table if not exists totp_recovery_codes (
+       user_id text not null,
+       digest text not null,
+       used integer not null default 0,
+       primary key (user_id, digest));
+-- STMT
+create table if not exists login_challenges (
+       digest text unique not null,
+       user_id text not null,
+       scope text not null default '',
+       attempts integer not null default 0,
+       expires integer not null,
+       primary key (digest));
+-- STMT
+create index if not exists login_challenges_expires on login_challenges (expires);
+-- STMT
+create table if not exists audit_log (
+       id text unique not null,
+       actor text not null,
+       subject text not null,
+       org text not null,
+       method text not null,
+       path text not null,
+       status integer not null,
+       request_id text not null default '',
+       service integer not null default 0,
+       ctime integer,
+       primary key (id));
+-- STMT
+create index if not exists audit_log_org on audit_log (org);
+-- STMT
+create trigger if not exists audit_log_ctime_trigger after insert on audit_log
+begin
+        update audit_log set
+        ctime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create table if not exists model_changes (
+       seq integer primary key autoincrement,
+       kind text not null,
+       id text not null,
+       ctime integer not null);
+-- STMT
+create index if not exists model_changes_ctime on model_changes (ctime);
+-- STMT
+create table if not exists auth_failures (
+       kind text not null,
+       digest text not null,
+       failures integer not null,
+       last_failure integer not null,
+       locked_until integer not null,
+       primary key (kind, digest));
+-- STMT
 create table if not exists repositories (
        id text unique not null,
        name text unique not null,
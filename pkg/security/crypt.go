@@ -18,6 +18,16 @@ func EncodedSHA256(s string) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// RandomToken returns n random bytes, hex encoded, for use as an opaque secret
+func RandomToken(n int) (string, error) {
+	bs := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, bs)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
 // MakeKey returns a 32-len byte
 func MakeKey(s string) ([]byte, error) {
 	v := EncodedSHA256(s)
@@ -45,6 +45,15 @@ func (s *CryptSuite) TestDerivePassword() {
 	require.False(s.T(), bad)
 }
 
+func (s *CryptSuite) TestRandomToken() {
+	t0, err := RandomToken(32)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), t0, 64)
+	t1, err := RandomToken(32)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), t0, t1)
+}
+
 func TestCryptSuite(t *testing.T) {
 	suite.Run(t, new(CryptSuite))
 }
@@ -0,0 +1,65 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// indexKeyLabel separates the blind index key from the encryption key
+const indexKeyLabel = "grokloc blind index"
+
+// IndexKey derives the blind index key from an encryption key
+// so the same key material is never used for both AES-GCM and HMAC
+func IndexKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(indexKeyLabel)) // nolint
+	return mac.Sum(nil)
+}
+
+// BlindIndex returns the encoded (base16) HMAC-SHA256 of s under key;
+// unlike EncodedSHA256, the result cannot be dictionary-attacked
+// without the key
+func BlindIndex(s string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s)) // nolint
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Normalize prepares s for prefix matching
+func Normalize(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Prefixes returns the prefixes of s that are between min and max runes long
+func Prefixes(s string, min, max int) []string {
+	var prefixes []string
+	n := 0
+	for i := range s {
+		if n >= min && n <= max {
+			prefixes = append(prefixes, s[:i])
+		}
+		n++
+	}
+	if n >= min && n <= max {
+		prefixes = append(prefixes, s)
+	}
+	return prefixes
+}
+
+// Truncate returns at most max runes of s
+func Truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	n := 0
+	for i := range s {
+		if n == max {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
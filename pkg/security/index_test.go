@@ -0,0 +1,39 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type IndexSuite struct {
+	suite.Suite
+}
+
+func (s *IndexSuite) TestBlindIndex() {
+	key, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	str := uuid.NewString()
+	require.Equal(s.T(), BlindIndex(str, IndexKey(key)), BlindIndex(str, IndexKey(key)))
+	require.NotEqual(s.T(), EncodedSHA256(str), BlindIndex(str, IndexKey(key)))
+	require.NotEqual(s.T(), BlindIndex(str, key), BlindIndex(str, IndexKey(key)))
+	otherKey, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), BlindIndex(str, IndexKey(key)), BlindIndex(str, IndexKey(otherKey)))
+}
+
+func (s *IndexSuite) TestPrefixes() {
+	require.Equal(s.T(), "abc", Normalize("  AbC "))
+	require.Equal(s.T(), []string{"ab", "abc"}, Prefixes("abcd", 2, 3))
+	require.Equal(s.T(), []string{"ab", "abc", "abcd"}, Prefixes("abcd", 2, 10))
+	require.Empty(s.T(), Prefixes("a", 2, 3))
+	require.Equal(s.T(), []string{"éé", "ééé"}, Prefixes("éééé", 2, 3))
+	require.Equal(s.T(), "éé", Truncate("éééé", 2))
+	require.Equal(s.T(), "ab", Truncate("ab", 5))
+}
+
+func TestIndexSuite(t *testing.T) {
+	suite.Run(t, new(IndexSuite))
+}
@@ -0,0 +1,133 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// keyIDSep separates the key id from the ciphertext; Encrypt output is
+// hex, so it never contains one
+const keyIDSep = ":"
+
+// LegacyKeyID names the key that decrypts ciphertexts written before key
+// ids, which have no prefix
+const LegacyKeyID = "legacy"
+
+// ErrUnknownKey is returned when a ciphertext names a key not in the ring
+var ErrUnknownKey = errors.New("encryption key unknown")
+
+// KeyRing holds the key that encrypts new values, and the keys that
+// still decrypt values written before a rotation, each by its id
+// ciphertexts are prefixed with the id of the key that encrypted them
+type KeyRing struct {
+	mu       sync.RWMutex
+	current  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+// NewKeyRing returns a KeyRing encrypting with key, named id
+// blind indexes are keyed from index, which does not rotate with the
+// encryption keys, as digests are looked up by value
+func NewKeyRing(index []byte, id string, key []byte) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[string][]byte), indexKey: IndexKey(index)}
+	err := kr.Add(id, key)
+	if err != nil {
+		return nil, err
+	}
+	kr.current = id
+	return kr, nil
+}
+
+// MakeKeyRing returns a KeyRing with a single key made from s, which also
+// keys the blind indexes
+func MakeKeyRing(id, s string) (*KeyRing, error) {
+	key, err := MakeKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyRing(key, id, key)
+}
+
+// Add puts key in the ring under id for decryption only
+func (kr *KeyRing) Add(id string, key []byte) error {
+	if !SafeStr(id) || strings.Contains(id, keyIDSep) {
+		return errors.New("malformed key id")
+	}
+	if len(key) != KeyLen {
+		return errors.New("malformed key")
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if k, ok := kr.keys[id]; ok && string(k) != string(key) {
+		return fmt.Errorf("key id in use: %s", id)
+	}
+	kr.keys[id] = key
+	return nil
+}
+
+// Rotate makes key, named id, the key new values are encrypted with
+// earlier keys still decrypt until the values are re-encrypted
+func (kr *KeyRing) Rotate(id string, key []byte) error {
+	err := kr.Add(id, key)
+	if err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.current = id
+	return nil
+}
+
+// Current returns the id of the key new values are encrypted with
+func (kr *KeyRing) Current() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current
+}
+
+// IndexKey returns the key for blind indexes
+func (kr *KeyRing) IndexKey() []byte {
+	return kr.indexKey
+}
+
+// Encrypt returns s encrypted with the current key, prefixed by its id
+func (kr *KeyRing) Encrypt(s string) (string, error) {
+	kr.mu.RLock()
+	id := kr.current
+	key := kr.keys[id]
+	kr.mu.RUnlock()
+	e, err := Encrypt(s, key)
+	if err != nil {
+		return "", err
+	}
+	return id + keyIDSep + e, nil
+}
+
+// Decrypt reverses Encrypt with the key named by the prefix of e
+func (kr *KeyRing) Decrypt(e string) (string, error) {
+	id := KeyID(e)
+	kr.mu.RLock()
+	key, ok := kr.keys[id]
+	kr.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return Decrypt(strings.TrimPrefix(e, id+keyIDSep), key)
+}
+
+// Stale reports whether e was encrypted with other than the current key
+func (kr *KeyRing) Stale(e string) bool {
+	return KeyID(e) != kr.Current()
+}
+
+// KeyID returns the id of the key that encrypted e
+func KeyID(e string) string {
+	i := strings.Index(e, keyIDSep)
+	if i == -1 {
+		return LegacyKeyID
+	}
+	return e[:i]
+}
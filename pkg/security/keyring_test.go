@@ -0,0 +1,91 @@
+package security
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyRingSuite struct {
+	suite.Suite
+}
+
+func (s *KeyRingSuite) TestEncrypt() {
+	first, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	kr, err := NewKeyRing(first, "first", first)
+	require.Nil(s.T(), err)
+	str := uuid.NewString()
+	e, err := kr.Encrypt(str)
+	require.Nil(s.T(), err)
+	require.True(s.T(), strings.HasPrefix(e, "first:"))
+	require.Equal(s.T(), "first", KeyID(e))
+	require.False(s.T(), kr.Stale(e))
+	d, err := kr.Decrypt(e)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), str, d)
+
+	// new values use the new key, old ones still decrypt
+	next, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), kr.Rotate("next", next))
+	require.Equal(s.T(), "next", kr.Current())
+	require.True(s.T(), kr.Stale(e))
+	d, err = kr.Decrypt(e)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), str, d)
+	e, err = kr.Encrypt(str)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "next", KeyID(e))
+
+	// blind indexes do not rotate
+	require.Equal(s.T(), IndexKey(first), kr.IndexKey())
+
+	// a ring without the key cannot decrypt
+	other, err := MakeKeyRing("other", uuid.NewString())
+	require.Nil(s.T(), err)
+	_, err = other.Decrypt(e)
+	require.True(s.T(), errors.Is(err, ErrUnknownKey))
+}
+
+func (s *KeyRingSuite) TestLegacy() {
+	legacy, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	str := uuid.NewString()
+	e, err := Encrypt(str, legacy)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), LegacyKeyID, KeyID(e))
+
+	kr, err := MakeKeyRing("current", uuid.NewString())
+	require.Nil(s.T(), err)
+	_, err = kr.Decrypt(e)
+	require.True(s.T(), errors.Is(err, ErrUnknownKey))
+	require.Nil(s.T(), kr.Add(LegacyKeyID, legacy))
+	require.True(s.T(), kr.Stale(e))
+	d, err := kr.Decrypt(e)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), str, d)
+}
+
+func (s *KeyRingSuite) TestAdd() {
+	kr, err := MakeKeyRing("first", uuid.NewString())
+	require.Nil(s.T(), err)
+	key, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.Error(s.T(), kr.Add("", key))
+	require.Error(s.T(), kr.Add("a:b", key))
+	require.Error(s.T(), kr.Add("short", key[:16]))
+	// ids are not reused for other keys
+	require.Error(s.T(), kr.Add("first", key))
+	require.Nil(s.T(), kr.Add("second", key))
+	require.Nil(s.T(), kr.Add("second", key))
+	require.Equal(s.T(), "first", kr.Current())
+}
+
+func TestKeyRingSuite(t *testing.T) {
+	suite.Run(t, new(KeyRingSuite))
+}
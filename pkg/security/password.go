@@ -0,0 +1,186 @@
+package security
+
+import (
+	"bufio"
+	"crypto/sha1" // nolint
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// password policy rules, as reported in a PasswordViolation
+const (
+	RuleMinLength  = "min_length"
+	RuleMaxLength  = "max_length"
+	RuleMinClasses = "min_classes"
+	RuleBreached   = "breached"
+)
+
+// PasswordPolicy constrains new passwords
+// MinLength is in characters; MaxLength is in bytes, as it bounds the
+// cost of deriving the password; MinClasses is how many of lower case,
+// upper case, digits and other characters must appear
+// Breached, if non-nil, refuses passwords known from breaches
+type PasswordPolicy struct {
+	MinLength  int
+	MaxLength  int
+	MinClasses int
+	Breached   *BreachedList
+}
+
+// PasswordViolation is a rule a password does not satisfy, with the
+// limit the rule sets, if any
+type PasswordViolation struct {
+	Rule  string `json:"rule"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// PasswordError lists every rule a password violates
+type PasswordError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+// Error describes the violated rules
+func (e *PasswordError) Error() string {
+	rules := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		rules[i] = v.Rule
+	}
+	return "password violates policy: " + strings.Join(rules, ", ")
+}
+
+// Check returns the violations if password violates the policy, or nil
+func (p PasswordPolicy) Check(password string) *PasswordError {
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{Rule: RuleMinLength, Limit: p.MinLength})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{Rule: RuleMaxLength, Limit: p.MaxLength})
+	}
+	if classes(password) < p.MinClasses {
+		violations = append(violations, PasswordViolation{Rule: RuleMinClasses, Limit: p.MinClasses})
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, PasswordViolation{Rule: RuleBreached})
+	}
+	if len(violations) != 0 {
+		return &PasswordError{Violations: violations}
+	}
+	return nil
+}
+
+// Tighten returns p with any of minLength, maxLength and minClasses that
+// are stricter than its own; looser or zero limits are ignored
+func (p PasswordPolicy) Tighten(minLength, maxLength, minClasses int) PasswordPolicy {
+	if minLength > p.MinLength {
+		p.MinLength = minLength
+	}
+	if maxLength > 0 && (p.MaxLength == 0 || maxLength < p.MaxLength) {
+		p.MaxLength = maxLength
+	}
+	if minClasses > p.MinClasses {
+		p.MinClasses = minClasses
+	}
+	return p
+}
+
+// classes counts the character classes in s
+func classes(s string) int {
+	var lower, upper, digit, other int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// rangeLen is the length of the hash prefix a breached list is
+// partitioned by, as in the published range queries
+const rangeLen = 5
+
+// BreachedList holds the sha1 hashes of breached passwords, as they are
+// published; hashes are kept by prefix range, so a lookup only compares
+// the suffixes within one range
+type BreachedList struct {
+	ranges map[string]map[string]struct{}
+}
+
+// ReadBreachedList reads one upper or lower case hex sha1 hash per line,
+// optionally followed by a colon and a count, as published; blank lines
+// are skipped
+func ReadBreachedList(r io.Reader) (*BreachedList, error) {
+	l := &BreachedList{ranges: make(map[string]map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			line = line[:i]
+		}
+		hash := strings.ToUpper(line)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("malformed hash on line %d", n)
+		}
+		l.add(hash)
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// LoadBreachedList reads the breached list in the file at path
+func LoadBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path) // nolint
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadBreachedList(f)
+}
+
+// add inserts an upper case hex hash
+func (l *BreachedList) add(hash string) {
+	prefix, suffix := hash[:rangeLen], hash[rangeLen:]
+	suffixes, ok := l.ranges[prefix]
+	if !ok {
+		suffixes = make(map[string]struct{})
+		l.ranges[prefix] = suffixes
+	}
+	suffixes[suffix] = struct{}{}
+}
+
+// Contains reports whether password is in the list
+func (l *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password)) // nolint
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, ok := l.ranges[hash[:rangeLen]][hash[rangeLen:]]
+	return ok
+}
+
+// Len is the number of hashes in the list
+func (l *BreachedList) Len() int {
+	n := 0
+	for _, suffixes := range l.ranges {
+		n += len(suffixes)
+	}
+	return n
+}
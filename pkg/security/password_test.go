@@ -0,0 +1,81 @@
+package security
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// breached is "password" and "Password123!", in the published format
+const breached = `5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824
+
+49efef5f70d47adc2db2eb397fbef5f7bc560e29:1
+`
+
+type PasswordSuite struct {
+	suite.Suite
+	Breached *BreachedList
+}
+
+func (s *PasswordSuite) SetupTest() {
+	var err error
+	s.Breached, err = ReadBreachedList(strings.NewReader(breached))
+	require.Nil(s.T(), err)
+}
+
+func (s *PasswordSuite) TestCheck() {
+	p := PasswordPolicy{MinLength: 8, MaxLength: 16, MinClasses: 3, Breached: s.Breached}
+	require.Nil(s.T(), p.Check("correct-Horse1"))
+	require.Nil(s.T(), p.Check("ÉCOLE-école"))
+
+	err := p.Check("a")
+	require.NotNil(s.T(), err)
+	require.Equal(s.T(), []PasswordViolation{
+		{Rule: RuleMinLength, Limit: 8},
+		{Rule: RuleMinClasses, Limit: 3},
+	}, err.Violations)
+
+	err = p.Check(strings.Repeat("aA1", 6))
+	require.Equal(s.T(), &PasswordError{Violations: []PasswordViolation{{Rule: RuleMaxLength, Limit: 16}}}, err)
+	err = p.Check("Password123!")
+	require.Equal(s.T(), &PasswordError{Violations: []PasswordViolation{{Rule: RuleBreached}}}, err)
+	require.Contains(s.T(), err.Error(), RuleBreached)
+
+	// no limits at all
+	require.Nil(s.T(), PasswordPolicy{}.Check("password"))
+}
+
+func (s *PasswordSuite) TestTighten() {
+	p := PasswordPolicy{MinLength: 8, MaxLength: 64, MinClasses: 2}
+	require.Equal(s.T(), PasswordPolicy{MinLength: 12, MaxLength: 32, MinClasses: 3}, p.Tighten(12, 32, 3))
+	require.Equal(s.T(), p, p.Tighten(4, 128, 1))
+	require.Equal(s.T(), p, p.Tighten(0, 0, 0))
+}
+
+func (s *PasswordSuite) TestBreachedList() {
+	require.Equal(s.T(), 2, s.Breached.Len())
+	require.True(s.T(), s.Breached.Contains("password"))
+	require.False(s.T(), s.Breached.Contains("Password"))
+
+	_, err := ReadBreachedList(strings.NewReader("5BAA61E4"))
+	require.Error(s.T(), err)
+	_, err = ReadBreachedList(strings.NewReader(strings.Repeat("Z", 40)))
+	require.Error(s.T(), err)
+
+	path := filepath.Join(s.T().TempDir(), "breached.txt")
+	err = os.WriteFile(path, []byte(breached), 0600)
+	require.Nil(s.T(), err)
+	l, err := LoadBreachedList(path)
+	require.Nil(s.T(), err)
+	require.True(s.T(), l.Contains("Password123!"))
+	_, err = LoadBreachedList(path + ".missing")
+	require.Error(s.T(), err)
+}
+
+func TestPasswordSuite(t *testing.T) {
+	suite.Run(t, new(PasswordSuite))
+}
@@ -0,0 +1,32 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// SignRequest returns the encoded (base16) HMAC-SHA256 under secret of
+// the canonical form of a request: the method, path, timestamp, nonce
+// and encoded sha256 of the body, newline separated
+func SignRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		method,
+		path,
+		timestamp,
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical)) // nolint
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequest reports whether signature is the SignRequest result
+// for the same arguments, comparing in constant time
+func VerifyRequest(signature, secret, method, path, timestamp, nonce string, body []byte) bool {
+	expected := SignRequest(secret, method, path, timestamp, nonce, body)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
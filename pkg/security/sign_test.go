@@ -0,0 +1,33 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SignSuite struct {
+	suite.Suite
+}
+
+func (s *SignSuite) TestSignRequest() {
+	secret := uuid.NewString()
+	body := []byte(`{"a":1}`)
+	sig := SignRequest(secret, "PUT", "/token", "1", "n", body)
+	require.True(s.T(), VerifyRequest(sig, secret, "PUT", "/token", "1", "n", body))
+
+	// every part is covered
+	require.False(s.T(), VerifyRequest(sig, uuid.NewString(), "PUT", "/token", "1", "n", body))
+	require.False(s.T(), VerifyRequest(sig, secret, "GET", "/token", "1", "n", body))
+	require.False(s.T(), VerifyRequest(sig, secret, "PUT", "/other", "1", "n", body))
+	require.False(s.T(), VerifyRequest(sig, secret, "PUT", "/token", "2", "n", body))
+	require.False(s.T(), VerifyRequest(sig, secret, "PUT", "/token", "1", "m", body))
+	require.False(s.T(), VerifyRequest(sig, secret, "PUT", "/token", "1", "n", nil))
+	require.False(s.T(), VerifyRequest("", secret, "PUT", "/token", "1", "n", body))
+}
+
+func TestSignSuite(t *testing.T) {
+	suite.Run(t, new(SignSuite))
+}
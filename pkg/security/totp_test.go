@@ -0,0 +1,56 @@
+package security
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TOTPSuite struct {
+	suite.Suite
+}
+
+func (s *TOTPSuite) TestRFC6238() {
+	// SHA1 test vectors from RFC 6238 appendix B
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for t, code := range vectors {
+		require.Equal(s.T(), code, hotp(key, uint64(t/TOTPPeriod), 8))
+	}
+	seed := totpEncoding.EncodeToString(key)
+	code, err := TOTPCode(seed, 59/TOTPPeriod)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "287082", code)
+}
+
+func (s *TOTPSuite) TestVerifyTOTP() {
+	seed, err := NewTOTPSeed()
+	require.Nil(s.T(), err)
+	now := time.Now()
+	code, err := TOTPCode(seed, TOTPStep(now)-1)
+	require.Nil(s.T(), err)
+
+	step, ok, err := VerifyTOTP(seed, code, now, 1)
+	require.Nil(s.T(), err)
+	require.True(s.T(), ok)
+	require.Equal(s.T(), TOTPStep(now)-1, step)
+	_, ok, err = VerifyTOTP(seed, code, now.Add(2*TOTPPeriod*time.Second), 1)
+	require.Nil(s.T(), err)
+	require.False(s.T(), ok)
+
+	_, _, err = VerifyTOTP("not base32!", code, now, 1)
+	require.Error(s.T(), err)
+}
+
+func TestTOTPSuite(t *testing.T) {
+	suite.Run(t, new(TOTPSuite))
+}
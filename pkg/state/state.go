@@ -6,8 +6,16 @@ import (
 	"errors"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/grokloc/grokloc-go/pkg/env"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models/lockout"
+	"github.com/grokloc/grokloc-go/pkg/notify"
+	"github.com/grokloc/grokloc-go/pkg/security"
 	"github.com/matthewhartstonge/argon2"
 	"go.uber.org/zap"
 )
@@ -17,11 +25,36 @@ type Instance struct {
 	Level                                env.Level
 	Master                               *sql.DB
 	Replicas                             []*sql.DB
-	Key                                  []byte
-	SigningKey                           []byte
+	Key                                  *security.KeyRing // rotate the ring, then re-encrypt with the app
+	SigningKeys                          *jwt.KeySet
 	Argon2Cfg                            argon2.Config
+	AccessTokenExpiration                time.Duration
+	TokenLeeway                          time.Duration // clock skew allowed on token times
+	TokenMaxAge                          time.Duration // oldest token accepted, whatever its expiration
+	RefreshTokenExpiration               time.Duration
+	OwnerTransferExpiration              time.Duration
+	MaxAPISecretGrace                    time.Duration
+	RequestSigningSkew                   time.Duration
+	LoginChallengeExpiration             time.Duration
+	ImpersonationExpiration              time.Duration
+	PasswordResetExpiration              time.Duration
+	InvitationExpiration                 time.Duration
+	OIDCFlowExpiration                   time.Duration
+	ReencryptBatch                       int                     // rows re-encrypted at a time after a key rotation
+	SessionCache                         bool                    // cache sessions in memory
+	SessionCacheTTL                      time.Duration           // how long a cached session is used
+	SessionCacheSize                     int                     // most sessions cached
+	SessionCacheSync                     time.Duration           // poll interval for other instances' changes; zero for none
+	LegacyTokenRequests                  bool                    // accept the unsigned TokenRequestHeader
+	UserLockout                          lockout.Policy          // failed logins and token requests per user
+	IPLockout                            lockout.Policy          // failed logins and token requests per client ip
+	PasswordPolicy                       security.PasswordPolicy // orgs may tighten it with settings
+	Notifier                             notify.Notifier         // delivers password resets and invitations
+	IdPClient                            *http.Client            // calls org identity providers, only on public addresses
+	TrustedProxies                       []*net.IPNet            // peers whose forwarding headers give the client ip
 	RootOrg, RootUser, RootUserAPISecret string
 	L                                    *zap.Logger
+	tempDir                              string // files the instance owns, removed by Close
 }
 
 // New creates a new instance for the given level
@@ -51,6 +84,10 @@ func (s *Instance) Close() error {
 		if err != nil {
 			return err
 		}
+		err = os.RemoveAll(s.tempDir)
+		if err != nil {
+			return err
+		}
 	} else {
 		log.Fatal("env unsupported")
 	}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"os"
 	"testing"
 
 	"github.com/grokloc/grokloc-go/pkg/env"
@@ -13,8 +14,15 @@ type StateSuite struct {
 }
 
 func (s *StateSuite) TestUnit() {
-	_, err := New(env.Unit)
+	st, err := New(env.Unit)
 	require.Nil(s.T(), err)
+	_, err = os.Stat(st.tempDir)
+	require.Nil(s.T(), err)
+
+	// closing removes the files the instance made
+	require.Nil(s.T(), st.Close())
+	_, err = os.Stat(st.tempDir)
+	require.True(s.T(), os.IsNotExist(err))
 }
 
 func TestStateSuite(t *testing.T) {
@@ -4,6 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/matthewhartstonge/argon2"
@@ -11,11 +16,23 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/grokloc/grokloc-go/pkg/env"
+	"github.com/grokloc/grokloc-go/pkg/jwt"
+	"github.com/grokloc/grokloc-go/pkg/models/lockout"
+	"github.com/grokloc/grokloc-go/pkg/notify"
+	"github.com/grokloc/grokloc-go/pkg/oidc"
 	"github.com/grokloc/grokloc-go/pkg/schemas"
 	"github.com/grokloc/grokloc-go/pkg/security"
 	"github.com/grokloc/grokloc-go/pkg/util"
 )
 
+// unitBreached is a few common passwords, as a breached password list
+const unitBreached = `5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:1
+7C4A8D09CA3762AF61E59520943DC26494F8941B:1
+B1B3773A05C0ED0176787A4F1574FF0075F7521E:1
+49EFEF5F70D47ADC2DB2EB397FBEF5F7BC560E29:1
+116A4DA0477B36B603C9382E8A14ED1679DD211D:1
+`
+
 // unitInstance builds an instance for the Unit environment
 func unitInstance() *Instance {
 	db, err := sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
@@ -28,11 +45,11 @@ func unitInstance() *Instance {
 	if err != nil {
 		log.Fatal(err)
 	}
-	key, err := security.MakeKey(uuid.NewString())
+	key, err := security.MakeKeyRing("unit", uuid.NewString())
 	if err != nil {
 		log.Fatal(err)
 	}
-	signingKey, err := security.MakeKey(uuid.NewString())
+	signingKey, err := jwt.GenerateKey()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -40,20 +57,78 @@ func unitInstance() *Instance {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// removed by Close
+	tempDir, err := os.MkdirTemp("", "grokloc-unit-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	breached, err := security.ReadBreachedList(strings.NewReader(unitBreached))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// tests connect over loopback, and set the client ip as a proxy would
+	var proxies []*net.IPNet
+	for _, cidr := range []string{"127.0.0.0/8", "::1/128"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxies = append(proxies, n)
+	}
 	rootOrg, rootUser, err := util.NewOrgOwner(context.Background(), db, key)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return &Instance{
-		Level:             env.Unit,
-		Master:            db,
-		Replicas:          []*sql.DB{db},
-		Key:               key,
-		SigningKey:        signingKey,
-		Argon2Cfg:         argon2.DefaultConfig(),
+		Level:                    env.Unit,
+		Master:                   db,
+		Replicas:                 []*sql.DB{db},
+		Key:                      key,
+		SigningKeys:              jwt.NewKeySet(signingKey),
+		Argon2Cfg:                argon2.DefaultConfig(),
+		AccessTokenExpiration:    15 * time.Minute,
+		TokenLeeway:              30 * time.Second,
+		TokenMaxAge:              time.Hour,
+		RefreshTokenExpiration:   30 * 24 * time.Hour,
+		OwnerTransferExpiration:  72 * time.Hour,
+		MaxAPISecretGrace:        7 * 24 * time.Hour,
+		RequestSigningSkew:       5 * time.Minute,
+		LoginChallengeExpiration: 5 * time.Minute,
+		ImpersonationExpiration:  10 * time.Minute,
+		PasswordResetExpiration:  30 * time.Minute,
+		InvitationExpiration:     7 * 24 * time.Hour,
+		OIDCFlowExpiration:       10 * time.Minute,
+		ReencryptBatch:           100,
+		SessionCache:             true,
+		SessionCacheTTL:          30 * time.Second,
+		SessionCacheSize:         1024,
+		UserLockout: lockout.Policy{
+			Threshold:  5,
+			Backoff:    time.Minute,
+			MaxLockout: time.Hour,
+			Window:     15 * time.Minute,
+		},
+		// tests all connect from the same ip
+		IPLockout: lockout.Policy{
+			Threshold:  1000,
+			Backoff:    time.Minute,
+			MaxLockout: time.Hour,
+			Window:     15 * time.Minute,
+		},
+		PasswordPolicy: security.PasswordPolicy{
+			MinLength:  12,
+			MaxLength:  256,
+			MinClasses: 3,
+			Breached:   breached,
+		},
+		// tests read delivered messages back from the outbox
+		Notifier:          notify.NewOutbox(filepath.Join(tempDir, "outbox")),
+		IdPClient:         oidc.NewClient(5 * time.Second),
+		TrustedProxies:    proxies,
 		RootOrg:           rootOrg.ID,
 		RootUser:          rootUser.ID,
 		RootUserAPISecret: rootUser.APISecret,
 		L:                 logger,
+		tempDir:           tempDir,
 	}
 }
@@ -14,7 +14,7 @@ import (
 )
 
 // NewOrgOwner returns a new, inserted org and a new, inserted user as owner
-func NewOrgOwner(ctx context.Context, db *sql.DB, key []byte) (*org.Instance, *user.Instance, error) {
+func NewOrgOwner(ctx context.Context, db *sql.DB, key *security.KeyRing) (*org.Instance, *user.Instance, error) {
 	o, err := org.New(uuid.NewString())
 	if err != nil {
 		return nil, nil, err